@@ -13,6 +13,7 @@ import (
 	"syscall"
 	"time"
 
+	"dropserve/internal/clamd"
 	"dropserve/internal/cli"
 	"dropserve/internal/config"
 	"dropserve/internal/control"
@@ -43,6 +44,12 @@ func main() {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+	case "review":
+		runCommand(cli.RunReview(os.Args[2:], os.Stdout, os.Stderr))
+	case "approve":
+		runCommand(cli.RunApprove(os.Args[2:], os.Stdout, os.Stderr))
+	case "reject":
+		runCommand(cli.RunReject(os.Args[2:], os.Stdout, os.Stderr))
 	case "serve":
 		if err := runServe(os.Args[2:]); err != nil {
 			fmt.Fprintln(os.Stderr, err)
@@ -59,6 +66,13 @@ func main() {
 	}
 }
 
+func runCommand(err error) {
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
 func runServe(args []string) error {
 	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
 	fs.SetOutput(os.Stderr)
@@ -68,16 +82,25 @@ func runServe(args []string) error {
 		return err
 	}
 
+	// Uploads must not slip past a scanner that was meant to run.
+	if address := config.ClamdAddress(); address != "" {
+		if _, err := clamd.New(address, 0); err != nil {
+			return fmt.Errorf("DROPSERVE_CLAMD_ADDRESS: %w", err)
+		}
+	}
+
 	addr := addrFromEnv(port)
 	store := control.NewStore()
 	publicLogger := log.New(os.Stdout, "public ", log.LstdFlags)
 
 	controlLogger := log.New(os.Stdout, "control ", log.LstdFlags)
-	publicHandler := publicapi.NewServer(store, publicLogger).Handler()
+	publicServer := publicapi.NewServer(store, publicLogger)
 	controlHandler := control.NewServer(store, controlLogger).Handler()
 	mux := http.NewServeMux()
 	mux.Handle("/api/control/", controlHandler)
-	mux.Handle("/", publicHandler)
+	mux.Handle("/api/control/review", publicServer.ReviewHandler())
+	mux.Handle("/api/control/review/", publicServer.ReviewHandler())
+	mux.Handle("/", publicServer.Handler())
 
 	server := &http.Server{
 		Addr:              addr,
@@ -100,6 +123,7 @@ func runServe(args []string) error {
 		PartMaxAge:       config.PartMaxAge(),
 		PortalIdleMaxAge: config.PortalIdleMaxAge(),
 		Roots:            config.SweepRoots(),
+		StagingRoots:     config.StagingRoots(),
 	}, store, sweepLogger)
 	if err := sweeper.RunOnce(ctx); err != nil {
 		sweepLogger.Printf("startup sweep failed: %v", err)
@@ -151,7 +175,10 @@ func usage() {
 	fmt.Fprintln(os.Stderr, "DropServe CLI")
 	fmt.Fprintln(os.Stderr, "\nUsage:")
 	fmt.Fprintln(os.Stderr, "  dropserve (defaults to: open)")
-	fmt.Fprintln(os.Stderr, "  dropserve open [--minutes N] [--reusable] [--policy overwrite|autorename] [--host HOST] [--port N]")
+	fmt.Fprintln(os.Stderr, "  dropserve open [--minutes N] [--reusable] [--policy overwrite|autorename|skip|fail|skip-if-identical] [--rename-template T] [--case-mode auto|sensitive|insensitive] [--folder-policy merge|autorename] [--atomic-batches] [--file-mode MODE] [--dir-mode MODE] [--group GROUP] [--allow-ext EXTS] [--deny-ext EXTS] [--allow-type TYPES] [--deny-type TYPES] [--webhook-url URL] [--webhook-secret SECRET] [--review] [--approve-claims] [--pin PIN | --passphrase PHRASE] [--qr | --no-qr] [--host HOST] [--port N]")
+	fmt.Fprintln(os.Stderr, "  dropserve review [--portal ID] [--json] [--port N]")
+	fmt.Fprintln(os.Stderr, "  dropserve approve [--policy overwrite|autorename|skip|fail|skip-if-identical] [--port N] ID...")
+	fmt.Fprintln(os.Stderr, "  dropserve reject [--port N] ID...")
 	fmt.Fprintln(os.Stderr, "  dropserve serve [--port N]")
 	fmt.Fprintln(os.Stderr, "  dropserve version")
 }
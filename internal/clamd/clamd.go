@@ -0,0 +1,150 @@
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// chunkSize is how much data goes into one INSTREAM chunk. clamd's default
+// StreamMaxLength is far larger; this only bounds the buffer.
+const chunkSize = 64 * 1024
+
+var ErrInvalidAddress = errors.New("clamd address must be unix:/path, tcp:host:port, a socket path or host:port")
+
+// Result is the daemon's verdict on a stream. Signature names what was
+// found and is empty for a clean stream.
+type Result struct {
+	Signature string
+}
+
+func (r Result) Infected() bool {
+	return r.Signature != ""
+}
+
+// Client scans data with a clamd-compatible daemon using the INSTREAM
+// command, so the daemon never needs access to the upload's path.
+type Client struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// New parses address and returns a client for it. A timeout of zero or less
+// leaves scans bounded only by the caller's context.
+func New(address string, timeout time.Duration) (*Client, error) {
+	network, addr, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{network: network, address: addr, timeout: timeout}, nil
+}
+
+func parseAddress(address string) (string, string, error) {
+	address = strings.TrimSpace(address)
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		address = strings.TrimPrefix(address, "unix:")
+		if address == "" {
+			return "", "", ErrInvalidAddress
+		}
+		return "unix", address, nil
+	case strings.HasPrefix(address, "tcp:"):
+		address = strings.TrimPrefix(address, "tcp:")
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", ErrInvalidAddress
+		}
+		return "tcp", address, nil
+	case strings.HasPrefix(address, "/"):
+		return "unix", address, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", ErrInvalidAddress
+	}
+	return "tcp", address, nil
+}
+
+// Scan streams r to the daemon and returns its verdict. An error means no
+// verdict was reached: the daemon was unreachable, timed out, or answered
+// with an error such as the stream exceeding its size limit.
+func (c *Client) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	writeErr := writeStream(conn, r)
+	// clamd stops reading and answers as soon as a stream grows past its
+	// limit, so a failed write may still be followed by a useful reply.
+	reply, readErr := bufio.NewReader(conn).ReadString(0)
+	if readErr != nil && reply == "" {
+		if writeErr != nil {
+			return Result{}, writeErr
+		}
+		return Result{}, fmt.Errorf("read clamd reply: %w", readErr)
+	}
+	return parseReply(reply)
+}
+
+func writeStream(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := w.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseReply reads "stream: OK", "stream: <signature> FOUND" or
+// "<message> ERROR".
+func parseReply(reply string) (Result, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	_, verdict, ok := strings.Cut(reply, ": ")
+	if !ok {
+		verdict = reply
+	}
+	switch {
+	case verdict == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	default:
+		return Result{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
@@ -0,0 +1,67 @@
+package clamd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"dropserve/internal/clamd/clamdtest"
+)
+
+func TestScanReportsVerdicts(t *testing.T) {
+	server := clamdtest.NewServer(t, map[string]string{"EICAR": "Eicar-Test-Signature"})
+	client, err := New(server.Addr, time.Second)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	// Larger than one chunk, so the stream is split.
+	clean := strings.Repeat("a", 200*1024)
+	result, err := client.Scan(context.Background(), strings.NewReader(clean))
+	if err != nil || result.Infected() {
+		t.Fatalf("expected a clean verdict, got %+v: %v", result, err)
+	}
+
+	result, err = client.Scan(context.Background(), strings.NewReader(clean+"EICAR"))
+	if err != nil || result.Signature != "Eicar-Test-Signature" {
+		t.Fatalf("expected the signature, got %+v: %v", result, err)
+	}
+
+	server.SetFailing(true)
+	if _, err := client.Scan(context.Background(), strings.NewReader("x")); err == nil {
+		t.Fatal("expected an ERROR reply to fail the scan")
+	}
+}
+
+func TestScanFailsWithoutDaemon(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	client, err := New(addr, time.Second)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	if _, err := client.Scan(context.Background(), strings.NewReader("x")); err == nil {
+		t.Fatal("expected an unreachable daemon to fail the scan")
+	}
+}
+
+func TestNewParsesAddresses(t *testing.T) {
+	for _, valid := range []string{"unix:/run/clamd.ctl", "/run/clamav/clamd.sock", "tcp:127.0.0.1:3310", "clamav:3310"} {
+		if _, err := New(valid, 0); err != nil {
+			t.Fatalf("unexpected error for %q: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"unix:", "tcp:clamav", "clamav", "relative/clamd.sock"} {
+		if _, err := New(invalid, 0); !errors.Is(err, ErrInvalidAddress) {
+			t.Fatalf("expected ErrInvalidAddress for %q, got %v", invalid, err)
+		}
+	}
+}
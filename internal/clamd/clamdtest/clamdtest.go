@@ -0,0 +1,111 @@
+// Package clamdtest provides a fake clamd that speaks just enough of the
+// INSTREAM protocol for tests.
+package clamdtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Server reports a stream as infected when it contains one of its markers,
+// and as clean otherwise.
+type Server struct {
+	// Addr is the address to configure the scanner with.
+	Addr string
+
+	listener net.Listener
+	markers  map[string]string
+	mu       sync.Mutex
+	scans    int
+	failing  atomic.Bool
+}
+
+// NewServer starts a fake clamd on a loopback port. markers maps a byte
+// string to the signature name reported when a stream contains it. The
+// server is stopped when the test ends.
+func NewServer(t testing.TB, markers map[string]string) *Server {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &Server{Addr: "tcp:" + listener.Addr().String(), listener: listener, markers: markers}
+	go server.serve()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return server
+}
+
+// Scans is how many streams the server has received in full.
+func (s *Server) Scans() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scans
+}
+
+// SetFailing makes the server answer every scan with an error, as clamd
+// does when it cannot scan a stream.
+func (s *Server) SetFailing(failing bool) {
+	s.failing.Store(failing)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	command, err := reader.ReadString(0)
+	if err != nil {
+		return
+	}
+	if command != "zINSTREAM\x00" {
+		_, _ = io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+
+	var data bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&data, reader, int64(size)); err != nil {
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.scans++
+	s.mu.Unlock()
+	_, _ = io.WriteString(conn, s.verdict(data.Bytes())+"\x00")
+}
+
+func (s *Server) verdict(data []byte) string {
+	if s.failing.Load() {
+		return "INSTREAM size limit exceeded. ERROR"
+	}
+	for marker, signature := range s.markers {
+		if bytes.Contains(data, []byte(marker)) {
+			return "stream: " + signature + " FOUND"
+		}
+	}
+	return "stream: OK"
+}
@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"dropserve/internal/control"
+)
+
+const claimPollInterval = time.Second
+
+// watchClaims asks the operator about every claim on a portal opened with
+// --approve-claims. It returns once a one-time portal is claimed, the
+// portal closes, or in reaches EOF.
+func watchClaims(baseURL, portalID string, reusable bool, in io.Reader, stdout, stderr io.Writer) error {
+	claimsURL := strings.TrimRight(baseURL, "/") + "/api/control/portals/" + url.PathEscape(portalID) + "/claims"
+	answers := readLines(in)
+	asked := map[string]bool{}
+
+	fmt.Fprintln(stdout, "Waiting for claims; each browser must be approved here.")
+	for {
+		var response control.PendingClaimsResponse
+		if err := controlRequest(http.MethodGet, claimsURL, nil, &response); err != nil {
+			var controlErr *controlError
+			if errors.As(err, &controlErr) && (controlErr.StatusCode == http.StatusGone || controlErr.StatusCode == http.StatusNotFound) {
+				fmt.Fprintln(stdout, "Portal closed.")
+				return nil
+			}
+			return err
+		}
+
+		for _, claim := range response.Claims {
+			if asked[claim.ClaimID] {
+				continue
+			}
+			asked[claim.ClaimID] = true
+
+			fmt.Fprintf(stdout, "\nClaim from %s (%s)\n", claim.RemoteAddr, claim.UserAgent)
+			fmt.Fprintf(stdout, "Pairing code: %s\n", claim.Code)
+			fmt.Fprint(stdout, "Approve only if the browser shows the same code. Approve? [y/N] ")
+			answer, ok := <-answers
+			if !ok {
+				fmt.Fprintln(stdout)
+			}
+			approve := ok && isYes(answer)
+
+			action := "deny"
+			if approve {
+				action = "approve"
+			}
+			var decision control.ClaimDecisionResponse
+			if err := controlRequest(http.MethodPost, claimsURL+"/"+url.PathEscape(claim.ClaimID)+"/"+action, nil, &decision); err != nil {
+				fmt.Fprintf(stderr, "%s: %v\n", claim.ClaimID, err)
+			} else if approve {
+				fmt.Fprintf(stdout, "Approved; client %s may upload.\n", decision.ClientID)
+				if !reusable {
+					return nil
+				}
+			} else {
+				fmt.Fprintln(stdout, "Denied.")
+			}
+
+			if !ok {
+				fmt.Fprintln(stdout, "No more input; no longer waiting for claims.")
+				return nil
+			}
+		}
+		time.Sleep(claimPollInterval)
+	}
+}
+
+// readLines delivers in line by line, closing the channel at EOF.
+func readLines(in io.Reader) <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+}
+
+func isYes(answer string) bool {
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
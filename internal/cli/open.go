@@ -3,6 +3,7 @@ package cli
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -16,6 +17,7 @@ import (
 	"time"
 
 	"dropserve/internal/control"
+	"dropserve/internal/webhooks"
 )
 
 const (
@@ -31,12 +33,35 @@ func RunOpen(args []string, stdout, stderr io.Writer) error {
 	var reusable bool
 	var minutes int
 	var portOverride int
+	var atomicBatches bool
 	fs.IntVar(&minutes, "minutes", defaultOpenMinutes, "Minutes to keep portal open")
 	fs.IntVar(&minutes, "m", defaultOpenMinutes, "Alias for --minutes")
 	fs.BoolVar(&reusable, "reusable", false, "Allow multiple claims")
 	fs.BoolVar(&reusable, "reuseable", false, "Alias for --reusable")
 	fs.BoolVar(&reusable, "r", false, "Alias for --reusable")
-	policy := fs.String("policy", "overwrite", "Default conflict policy: overwrite or autorename")
+	fs.BoolVar(&atomicBatches, "atomic-batches", false, "Stage each drop and move it into place only once it is complete")
+	policy := fs.String("policy", "overwrite", "Default conflict policy: overwrite, autorename, skip, fail, or skip-if-identical")
+	renameTemplate := fs.String("rename-template", "timestamp", "Autorename style: timestamp, numbered, or a template using {name} {ext} {timestamp} {n}")
+	caseMode := fs.String("case-mode", "auto", "Filename case handling: auto, sensitive, or insensitive")
+	folderPolicy := fs.String("folder-policy", "merge", "When a dropped folder already exists: merge or autorename")
+	fileMode := fs.String("file-mode", "", "Octal permission bits for uploaded files, e.g. 0664 (default: server setting)")
+	dirMode := fs.String("dir-mode", "", "Octal permission bits for created directories, e.g. 0775 (default: server setting)")
+	group := fs.String("group", "", "Group (name or gid) for uploaded files and created directories (default: server setting)")
+	allowExt := fs.String("allow-ext", "", "Comma-separated extensions to accept, e.g. pdf,jpg (default: any)")
+	denyExt := fs.String("deny-ext", "", "Comma-separated extensions to refuse, e.g. exe,bat")
+	allowType := fs.String("allow-type", "", "Comma-separated content types to accept, sniffed from the data, e.g. application/pdf,image/* (default: any)")
+	denyType := fs.String("deny-type", "", "Comma-separated content types to refuse, sniffed from the data")
+	webhookURL := fs.String("webhook-url", "", "URL to POST signed upload and portal events to")
+	webhookSecret := fs.String("webhook-secret", "", "Secret used to sign webhook deliveries (HMAC-SHA256)")
+	var reviewMode bool
+	fs.BoolVar(&reviewMode, "review", false, "Hold uploads for approval with dropserve review/approve/reject instead of placing them")
+	var approveClaims bool
+	fs.BoolVar(&approveClaims, "approve-claims", false, "Ask here before each browser may claim the portal, showing its address and pairing code")
+	pin := fs.String("pin", "", "Numeric PIN a browser must enter before it may claim the portal (at least 4 digits)")
+	passphrase := fs.String("passphrase", "", "Passphrase a browser must enter before it may claim the portal")
+	var showQR, hideQR bool
+	fs.BoolVar(&showQR, "qr", false, "Print the link as a QR code even when stdout is not a terminal")
+	fs.BoolVar(&hideQR, "no-qr", false, "Do not print the link as a QR code")
 	hostOverride := fs.String("host", "", "Override LAN host/IP for printed link")
 	fs.IntVar(&portOverride, "port", 0, "Override server port for control call + printed link")
 
@@ -44,9 +69,45 @@ func RunOpen(args []string, stdout, stderr io.Writer) error {
 		return err
 	}
 
-	policyValue := strings.ToLower(strings.TrimSpace(*policy))
-	if policyValue != "overwrite" && policyValue != "autorename" {
-		return fmt.Errorf("policy must be overwrite or autorename")
+	policyValue, err := control.NormalizePolicy(*policy)
+	if err != nil {
+		return err
+	}
+	renameTemplateValue, err := control.NormalizeRenameTemplate(*renameTemplate)
+	if err != nil {
+		return err
+	}
+	caseModeValue, err := control.NormalizeCaseMode(*caseMode)
+	if err != nil {
+		return err
+	}
+
+	folderPolicyValue, err := control.NormalizeFolderPolicy(*folderPolicy)
+	if err != nil {
+		return err
+	}
+	if _, err := control.ParseMode(*fileMode, "--file-mode"); err != nil {
+		return err
+	}
+	if _, err := control.ParseMode(*dirMode, "--dir-mode"); err != nil {
+		return err
+	}
+	fileTypes, err := control.ParseFileTypes(commaList(*allowExt), commaList(*denyExt), commaList(*allowType), commaList(*denyType))
+	if err != nil {
+		return err
+	}
+	if err := webhooks.ValidateURL(*webhookURL); err != nil {
+		return err
+	}
+	if reviewMode && atomicBatches {
+		return control.ErrReviewAtomicBatches
+	}
+	secret, err := portalSecret(*pin, *passphrase)
+	if err != nil {
+		return err
+	}
+	if showQR && hideQR {
+		return errors.New("--qr and --no-qr cannot be combined")
 	}
 
 	destAbs, err := canonicalizeCwd()
@@ -61,7 +122,23 @@ func RunOpen(args []string, stdout, stderr io.Writer) error {
 		OpenMinutes:          minutes,
 		Reusable:             reusable,
 		DefaultPolicy:        policyValue,
-		AutorenameOnConflict: policyValue == "autorename",
+		RenameTemplate:       renameTemplateValue,
+		CaseMode:             caseModeValue,
+		FolderPolicy:         folderPolicyValue,
+		AtomicBatches:        atomicBatches,
+		FileMode:             strings.TrimSpace(*fileMode),
+		DirMode:              strings.TrimSpace(*dirMode),
+		Group:                strings.TrimSpace(*group),
+		AllowExtensions:      fileTypes.AllowExtensions,
+		DenyExtensions:       fileTypes.DenyExtensions,
+		AllowTypes:           fileTypes.AllowTypes,
+		DenyTypes:            fileTypes.DenyTypes,
+		WebhookURL:           strings.TrimSpace(*webhookURL),
+		WebhookSecret:        *webhookSecret,
+		Review:               reviewMode,
+		ApproveClaims:        approveClaims,
+		Passphrase:           secret,
+		AutorenameOnConflict: policyValue == control.PolicyAutorename,
 	}
 
 	response, err := createPortal(baseURL, request)
@@ -82,9 +159,40 @@ func RunOpen(args []string, stdout, stderr io.Writer) error {
 		localLink := formatPortalURL("localhost", port, response.PortalID)
 		fmt.Fprintln(stdout, localLink)
 	}
+	if showQR || (!hideQR && isTerminal(stdout)) {
+		printQR(link, stdout, stderr)
+	}
+	if response.Code != "" {
+		fmt.Fprintf(stdout, "Code: %s (enter it at %s)\n", response.Code, formatLandingURL(host, port))
+	}
+	if approveClaims {
+		return watchClaims(baseURL, response.PortalID, reusable, os.Stdin, stdout, stderr)
+	}
 	return nil
 }
 
+// portalSecret picks the --pin or --passphrase value, whichever is set.
+func portalSecret(pin, passphrase string) (string, error) {
+	if pin != "" && passphrase != "" {
+		return "", errors.New("--pin and --passphrase cannot be combined")
+	}
+	if pin != "" {
+		for _, r := range pin {
+			if r < '0' || r > '9' {
+				return "", errors.New("--pin must be digits only")
+			}
+		}
+		passphrase = pin
+	}
+	if passphrase == "" {
+		return "", nil
+	}
+	if err := control.ValidatePassphrase(passphrase); err != nil {
+		return "", err
+	}
+	return passphrase, nil
+}
+
 func canonicalizeCwd() (string, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -160,22 +268,45 @@ func portSuffix(port string) string {
 }
 
 func createPortal(baseURL string, payload control.CreatePortalRequest) (control.CreatePortalResponse, error) {
-	endpoint := strings.TrimRight(baseURL, "/") + "/api/control/portals"
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return control.CreatePortalResponse{}, fmt.Errorf("encode request: %w", err)
+	var response control.CreatePortalResponse
+	err := controlRequest(http.MethodPost, strings.TrimRight(baseURL, "/")+"/api/control/portals", payload, &response)
+	return response, err
+}
+
+// controlError is a control API call answered with a status other than 200.
+type controlError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *controlError) Error() string {
+	return "control api error: " + e.Message
+}
+
+// controlRequest calls the control API, sending payload as JSON when it is
+// not nil and decoding the response into out.
+func controlRequest(method, endpoint string, payload, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+		body = bytes.NewReader(encoded)
 	}
 
-	request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	request, err := http.NewRequest(method, endpoint, body)
 	if err != nil {
-		return control.CreatePortalResponse{}, fmt.Errorf("build request: %w", err)
+		return fmt.Errorf("build request: %w", err)
+	}
+	if payload != nil {
+		request.Header.Set("Content-Type", "application/json")
 	}
-	request.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(request)
 	if err != nil {
-		return control.CreatePortalResponse{}, fmt.Errorf("control api request failed: %w", err)
+		return fmt.Errorf("control api request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -185,15 +316,13 @@ func createPortal(baseURL string, payload control.CreatePortalRequest) (control.
 		if message == "" {
 			message = resp.Status
 		}
-		return control.CreatePortalResponse{}, fmt.Errorf("control api error: %s", message)
+		return &controlError{StatusCode: resp.StatusCode, Message: message}
 	}
 
-	var response control.CreatePortalResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return control.CreatePortalResponse{}, fmt.Errorf("decode response: %w", err)
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
 	}
-
-	return response, nil
+	return nil
 }
 
 func resolveHost(override string) (string, error) {
@@ -259,3 +388,18 @@ func formatPortalURL(host string, port int, portalID string) string {
 
 	return fmt.Sprintf("http://%s:%d/p/%s", host, port, portalID)
 }
+
+func formatLandingURL(host string, port int) string {
+	if port == 80 {
+		return fmt.Sprintf("http://%s/", host)
+	}
+
+	return fmt.Sprintf("http://%s:%d/", host, port)
+}
+
+func commaList(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
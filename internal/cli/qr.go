@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"dropserve/internal/qr"
+)
+
+// printQR draws link as a QR code, or explains on stderr why it cannot.
+func printQR(link string, stdout, stderr io.Writer) {
+	code, err := qr.Encode([]byte(link))
+	if err != nil {
+		fmt.Fprintf(stderr, "warning: no QR code for %s: %v\n", link, err)
+		return
+	}
+	fmt.Fprintln(stdout)
+	if err := code.WriteTerminal(stdout); err != nil {
+		fmt.Fprintf(stderr, "warning: print QR code: %v\n", err)
+		return
+	}
+	fmt.Fprintln(stdout)
+}
+
+// isTerminal reports whether w is a terminal rather than a pipe or file.
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
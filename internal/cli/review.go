@@ -0,0 +1,125 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"dropserve/internal/control"
+)
+
+// RunReview lists the uploads held by review portals.
+func RunReview(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("review", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	portalID := fs.String("portal", "", "Only list uploads to this portal")
+	asJSON := fs.Bool("json", false, "Print the items as JSON")
+	var portOverride int
+	fs.IntVar(&portOverride, "port", 0, "Override server port for control call")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimRight(resolveBaseURL(portOverride), "/") + "/api/control/review"
+	if *portalID != "" {
+		endpoint += "?portal_id=" + url.QueryEscape(*portalID)
+	}
+	var response control.ReviewListResponse
+	if err := controlRequest(http.MethodGet, endpoint, nil, &response); err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(response.Items)
+	}
+	if len(response.Items) == 0 {
+		fmt.Fprintln(stdout, "No uploads waiting for review.")
+		return nil
+	}
+
+	table := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tRECEIVED\tPORTAL\tFROM\tSIZE\tSHA256\tPATH")
+	for _, item := range response.Items {
+		from := item.RemoteAddr
+		if from == "" {
+			from = item.ClientID
+		}
+		size, sha := fmt.Sprint(item.Size), item.SHA256
+		relpath := item.Relpath
+		if item.Dir {
+			size, sha, relpath = "-", "-", relpath+"/"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			item.ID, item.ReceivedAt.Local().Format(time.DateTime), item.PortalID, from, size, sha, relpath)
+	}
+	return table.Flush()
+}
+
+// RunApprove moves held uploads into their destinations.
+func RunApprove(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("approve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	policy := fs.String("policy", "", "Conflict policy to place with instead of the upload's: overwrite, autorename, skip, fail, or skip-if-identical")
+	var portOverride int
+	fs.IntVar(&portOverride, "port", 0, "Override server port for control call")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	request := control.ReviewDecisionRequest{}
+	if strings.TrimSpace(*policy) != "" {
+		normalized, err := control.NormalizePolicy(*policy)
+		if err != nil {
+			return err
+		}
+		request.Policy = normalized
+	}
+	return decideReview(fs.Args(), "approve", request, portOverride, stdout, stderr)
+}
+
+// RunReject deletes held uploads.
+func RunReject(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("reject", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var portOverride int
+	fs.IntVar(&portOverride, "port", 0, "Override server port for control call")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return decideReview(fs.Args(), "reject", control.ReviewDecisionRequest{}, portOverride, stdout, stderr)
+}
+
+// decideReview sends the decision for each ID and reports every outcome,
+// failing at the end if any of them failed.
+func decideReview(ids []string, action string, request control.ReviewDecisionRequest, portOverride int, stdout, stderr io.Writer) error {
+	if len(ids) == 0 {
+		return fmt.Errorf("%s: at least one review ID required", action)
+	}
+	baseURL := strings.TrimRight(resolveBaseURL(portOverride), "/")
+	failed := 0
+	for _, id := range ids {
+		endpoint := baseURL + "/api/control/review/" + url.PathEscape(id) + "/" + action
+		var response control.ReviewDecisionResponse
+		if err := controlRequest(http.MethodPost, endpoint, request, &response); err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", id, err)
+			failed++
+			continue
+		}
+		if response.FinalRelpath != "" && response.FinalRelpath != response.Relpath {
+			fmt.Fprintf(stdout, "%s %s %s -> %s\n", response.ID, response.Status, response.Relpath, response.FinalRelpath)
+			continue
+		}
+		fmt.Fprintf(stdout, "%s %s %s\n", response.ID, response.Status, response.Relpath)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%s failed for %d of %d items", action, failed, len(ids))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package commit
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+var ErrExists = errors.New("destination exists")
+
+// RenameNoReplace moves src to dst only if dst does not exist, atomically with
+// respect to other writers. It hard-links src into place (link fails with
+// EEXIST instead of replacing) and then unlinks src. On filesystems without
+// hard links it reserves dst with O_EXCL and renames over the reservation.
+func RenameNoReplace(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		if err := os.Remove(src); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return ErrExists
+	}
+	if !linkUnsupported(err) {
+		return err
+	}
+
+	reservation, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return ErrExists
+		}
+		return err
+	}
+	_ = reservation.Close()
+
+	if err := os.Rename(src, dst); err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// RenameDirNoReplace moves the directory src to name inside dir only if
+// that entry does not exist, failing with ErrExists otherwise. Where
+// renameat2 with RENAME_NOREPLACE is missing, name is reserved with mkdir
+// and src renamed over the reservation, which rename(2) only does while it
+// is still empty.
+func RenameDirNoReplace(src string, dir *os.File, name string) error {
+	return renameDirNoReplaceAt(src, dir, name)
+}
+
+func renameDirOverReservation(src string, dir *os.File, name string) error {
+	dst := dirEntryPath(dir, name)
+	if err := os.Mkdir(dst, 0o700); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return ErrExists
+		}
+		return err
+	}
+	// os.Rename refuses any existing directory, so call rename(2) itself.
+	if err := syscall.Rename(src, dst); err != nil {
+		_ = os.Remove(dst)
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+	}
+	return nil
+}
+
+func linkUnsupported(err error) bool {
+	return errors.Is(err, syscall.EPERM) ||
+		errors.Is(err, syscall.ENOTSUP) ||
+		errors.Is(err, syscall.EOPNOTSUPP) ||
+		errors.Is(err, syscall.ENOSYS) ||
+		errors.Is(err, syscall.EMLINK)
+}
+
+// SyncDir flushes a directory so that entries created or renamed in it
+// survive a power loss.
+func SyncDir(dir string) error {
+	handle, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = handle.Close()
+	}()
+	return handle.Sync()
+}
@@ -0,0 +1,209 @@
+package commit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenameNoReplaceMovesFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.part")
+	dst := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(src, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+
+	if err := RenameNoReplace(src, dst); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("expected src to be removed, got %v", err)
+	}
+	content, err := os.ReadFile(dst)
+	if err != nil || string(content) != "data" {
+		t.Fatalf("unexpected dst content %q: %v", content, err)
+	}
+}
+
+func TestRenameNoReplaceKeepsExistingFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.part")
+	dst := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(src, []byte("new"), 0o644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+	if err := os.WriteFile(dst, []byte("old"), 0o644); err != nil {
+		t.Fatalf("write dst: %v", err)
+	}
+
+	if err := RenameNoReplace(src, dst); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	content, _ := os.ReadFile(dst)
+	if string(content) != "old" {
+		t.Fatalf("existing file was replaced: %q", content)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Fatalf("expected src to remain: %v", err)
+	}
+}
+
+func TestRenameDirNoReplaceRefusesEvenEmptyFolders(t *testing.T) {
+	staging := t.TempDir()
+	dest := t.TempDir()
+	for _, name := range []string{"Album", "Empty"} {
+		if err := os.MkdirAll(filepath.Join(staging, name), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(staging, "Album", "1.txt"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dest, "Empty"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	dir, err := os.Open(dest)
+	if err != nil {
+		t.Fatalf("open dest: %v", err)
+	}
+	defer dir.Close()
+
+	for _, rename := range []func(string, *os.File, string) error{RenameDirNoReplace, renameDirOverReservation} {
+		if err := rename(filepath.Join(staging, "Empty"), dir, "Empty"); !errors.Is(err, ErrExists) {
+			t.Fatalf("expected an existing empty folder to be kept, got %v", err)
+		}
+	}
+	if err := RenameDirNoReplace(filepath.Join(staging, "Album"), dir, "Album"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(dest, "Album", "1.txt")); err != nil || string(content) != "x" {
+		t.Fatalf("unexpected moved content %q: %v", content, err)
+	}
+	if err := renameDirOverReservation(filepath.Join(staging, "Empty"), dir, "Other"); err != nil {
+		t.Fatalf("rename over reservation: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(staging, "Empty")); !os.IsNotExist(err) {
+		t.Fatalf("expected the staged folder to be moved, got %v", err)
+	}
+}
+
+func TestPendingAnonymousLeavesNoArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	partPath := filepath.Join(dir, "u1.part")
+	pending, err := Create(partPath, 0o644)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer pending.Close()
+	if !pending.Anonymous() {
+		t.Skip("anonymous temp files not supported here")
+	}
+
+	if _, err := pending.Write([]byte("data")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("expected no directory entries while writing, got %d", len(entries))
+	}
+
+	dirFile := openDir(t, dir)
+	dst := filepath.Join(dir, "a.txt")
+	if err := pending.LinkNoReplace(dirFile, "a.txt"); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	if err := pending.LinkNoReplace(dirFile, "a.txt"); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists on second link, got %v", err)
+	}
+	content, err := os.ReadFile(dst)
+	if err != nil || string(content) != "data" {
+		t.Fatalf("unexpected dst content %q: %v", content, err)
+	}
+}
+
+func TestPendingReplaceOverwrites(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(dst, []byte("old"), 0o644); err != nil {
+		t.Fatalf("write dst: %v", err)
+	}
+	pending, err := Create(filepath.Join(dir, "u1.part"), 0o644)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer pending.Close()
+	if _, err := pending.Write([]byte("new")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := pending.Replace(openDir(t, dir), "a.txt"); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	content, _ := os.ReadFile(dst)
+	if string(content) != "new" {
+		t.Fatalf("expected replaced content, got %q", content)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("expected only the destination file, got %d entries", len(entries))
+	}
+}
+
+func TestPendingCopyIntoPlacesWithoutReplacing(t *testing.T) {
+	stagingDir := t.TempDir()
+	destDir := t.TempDir()
+	partPath := filepath.Join(stagingDir, "u1.part")
+	pending, err := Open(writeFile(t, partPath, "data"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer pending.Close()
+
+	dir := openDir(t, destDir)
+	if err := os.WriteFile(filepath.Join(destDir, "taken.txt"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("write existing: %v", err)
+	}
+	if err := pending.copyInto(dir, "taken.txt", false); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	if err := pending.copyInto(dir, "a.txt", false); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if !pending.Copied() {
+		t.Fatalf("expected the placement to be reported as a copy")
+	}
+
+	content, err := os.ReadFile(filepath.Join(destDir, "a.txt"))
+	if err != nil || string(content) != "data" {
+		t.Fatalf("unexpected dst content %q: %v", content, err)
+	}
+	if _, err := os.Stat(partPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the source to be consumed, got %v", err)
+	}
+	entries, _ := os.ReadDir(destDir)
+	if len(entries) != 2 {
+		t.Fatalf("expected no leftover temp files, got %d entries", len(entries))
+	}
+}
+
+func writeFile(t *testing.T, path, content string) string {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+	return path
+}
+
+func openDir(t *testing.T, dir string) *os.File {
+	t.Helper()
+	file, err := os.Open(dir)
+	if err != nil {
+		t.Fatalf("open dir: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = file.Close()
+	})
+	return file
+}
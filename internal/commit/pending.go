@@ -0,0 +1,174 @@
+package commit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Pending is upload data that has not been placed yet. Where the platform
+// allows it the data lives in an anonymous O_TMPFILE inode that the kernel
+// frees if the process dies; otherwise it is a named .part file that the
+// sweeper cleans up after a crash.
+type Pending struct {
+	file     *os.File
+	partPath string
+	named    bool
+	copied   bool
+}
+
+// Create opens a pending file for writing. partPath names the .part file used
+// when anonymous files are unsupported. Its directory should be on the same
+// filesystem as the final destination; otherwise placing the data falls back
+// to a copy.
+func Create(partPath string, perm os.FileMode) (*Pending, error) {
+	if file, err := openAnonymous(filepath.Dir(partPath), perm); err == nil {
+		return &Pending{file: file, partPath: partPath}, nil
+	}
+
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &Pending{file: file, partPath: partPath, named: true}, nil
+}
+
+// Open wraps data that is already written to a named file, such as a file
+// staged for a batch, so it can be placed like a fresh upload.
+func Open(path string) (*Pending, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Pending{file: file, partPath: path, named: true}, nil
+}
+
+func (p *Pending) Write(b []byte) (int, error) {
+	return p.file.Write(b)
+}
+
+// Contents reads back the data written so far, for checks that must see
+// all of it before it is placed.
+func (p *Pending) Contents() (*io.SectionReader, error) {
+	info, err := p.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(p.file, 0, info.Size()), nil
+}
+
+// Anonymous reports whether the data has no name on disk.
+func (p *Pending) Anonymous() bool {
+	return !p.named
+}
+
+// Copied reports whether placing the data had to copy it because the
+// pending file and the destination are on different filesystems.
+func (p *Pending) Copied() bool {
+	return p.copied
+}
+
+// LinkNoReplace gives the data the name name inside dir, failing with
+// ErrExists if that entry already exists. Resolving relative to an open
+// directory keeps a concurrently swapped path component from redirecting it.
+func (p *Pending) LinkNoReplace(dir *os.File, name string) error {
+	var err error
+	if p.named {
+		err = renameNoReplaceAt(p.partPath, dir, name)
+	} else {
+		err = linkAnonymousAt(p.file, dir, name)
+		if errors.Is(err, fs.ErrExist) {
+			err = ErrExists
+		}
+	}
+	if errors.Is(err, syscall.EXDEV) {
+		return p.copyInto(dir, name, false)
+	}
+	return err
+}
+
+// Replace places the data at name inside dir, atomically replacing any
+// existing entry. Anonymous data is first linked at the .part path, since
+// rename needs a name.
+func (p *Pending) Replace(dir *os.File, name string) error {
+	if !p.named {
+		if err := linkAnonymous(p.file, p.partPath); err != nil {
+			if !errors.Is(err, fs.ErrExist) {
+				return err
+			}
+			if err := os.Remove(p.partPath); err != nil {
+				return err
+			}
+			if err := linkAnonymous(p.file, p.partPath); err != nil {
+				return err
+			}
+		}
+		p.named = true
+	}
+	err := renameAt(p.partPath, dir, name)
+	if errors.Is(err, syscall.EXDEV) {
+		return p.copyInto(dir, name, true)
+	}
+	return err
+}
+
+// copyInto places the data across filesystems: it is copied to a hidden
+// temp file inside dir, synced, and then renamed into place, so readers
+// still see either nothing or the complete file. The source is consumed
+// as a rename would.
+func (p *Pending) copyInto(dir *os.File, name string, replace bool) error {
+	info, err := p.file.Stat()
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmpPath := dirEntryPath(dir, ".dropserve-"+hex.EncodeToString(suffix)+".part")
+
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, io.NewSectionReader(p.file, 0, info.Size()))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		if replace {
+			err = renameAt(tmpPath, dir, name)
+		} else {
+			err = renameNoReplaceAt(tmpPath, dir, name)
+		}
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	p.copied = true
+	if p.named {
+		if err := os.Remove(p.partPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync flushes the file data to stable storage.
+func (p *Pending) Sync() error {
+	return p.file.Sync()
+}
+
+func (p *Pending) Close() error {
+	return p.file.Close()
+}
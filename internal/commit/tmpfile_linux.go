@@ -0,0 +1,158 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || mips || mips64 || mips64le || mipsle || ppc64 || ppc64le || riscv64 || s390x)
+
+package commit
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// __O_TMPFILE is 0x400000 in the generic Linux ABI; sparc, alpha and parisc
+// use other values, which is why this file is limited to the architectures
+// listed in its build constraint.
+const (
+	oTmpfile        = 0x400000 | syscall.O_DIRECTORY
+	atSymlinkFollow = 0x400
+	renameNoreplace = 0x1
+)
+
+// sysRenameat2 is the renameat2 syscall number of each architecture this
+// file builds for; the syscall package names it on only some of them.
+var sysRenameat2 = map[string]uintptr{
+	"386": 353, "amd64": 316, "arm": 382, "arm64": 276, "loong64": 276,
+	"mips": 4351, "mipsle": 4351, "mips64": 5311, "mips64le": 5311,
+	"ppc64": 357, "ppc64le": 357, "riscv64": 276, "s390x": 347,
+}
+
+var atFDCWD = -100
+
+func openAnonymous(dir string, perm os.FileMode) (*os.File, error) {
+	fd, err := syscall.Open(dir, oTmpfile|syscall.O_RDWR|syscall.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	file := os.NewFile(uintptr(fd), dir)
+
+	// linkat needs /proc to name the descriptor; without it the data could
+	// never be placed, so refuse the anonymous file up front.
+	if _, err := os.Stat(procFDPath(file)); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func linkAnonymous(file *os.File, dst string) error {
+	return linkat(atFDCWD, procFDPath(file), atFDCWD, dst, atSymlinkFollow)
+}
+
+func linkAnonymousAt(file *os.File, dir *os.File, name string) error {
+	return linkat(atFDCWD, procFDPath(file), int(dir.Fd()), name, atSymlinkFollow)
+}
+
+// renameNoReplaceAt is RenameNoReplace with the destination resolved
+// relative to an already opened directory.
+func renameNoReplaceAt(src string, dir *os.File, name string) error {
+	dirfd := int(dir.Fd())
+	err := linkat(atFDCWD, src, dirfd, name, 0)
+	if err == nil {
+		if err := os.Remove(src); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return ErrExists
+	}
+	if !linkUnsupported(err) {
+		return err
+	}
+
+	fd, err := syscall.Openat(dirfd, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0o600)
+	if err != nil {
+		if errors.Is(err, syscall.EEXIST) {
+			return ErrExists
+		}
+		return err
+	}
+	_ = syscall.Close(fd)
+
+	if err := syscall.Renameat(atFDCWD, src, dirfd, name); err != nil {
+		_ = syscall.Unlinkat(dirfd, name)
+		return err
+	}
+	return nil
+}
+
+func renameAt(src string, dir *os.File, name string) error {
+	if err := syscall.Renameat(atFDCWD, src, int(dir.Fd()), name); err != nil {
+		return &os.LinkError{Op: "renameat", Old: src, New: name, Err: err}
+	}
+	return nil
+}
+
+func renameDirNoReplaceAt(src string, dir *os.File, name string) error {
+	err := renameat2(atFDCWD, src, int(dir.Fd()), name, renameNoreplace)
+	if errors.Is(err, syscall.EEXIST) {
+		return ErrExists
+	}
+	if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EINVAL) {
+		return renameDirOverReservation(src, dir, name)
+	}
+	return err
+}
+
+func renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags int) error {
+	oldp, err := syscall.BytePtrFromString(oldpath)
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(newpath)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall6(sysRenameat2[runtime.GOARCH],
+		uintptr(olddirfd), uintptr(unsafe.Pointer(oldp)),
+		uintptr(newdirfd), uintptr(unsafe.Pointer(newp)),
+		uintptr(flags), 0)
+	if errno != 0 {
+		return &os.LinkError{Op: "renameat2", Old: oldpath, New: newpath, Err: errno}
+	}
+	return nil
+}
+
+func linkat(olddirfd int, oldpath string, newdirfd int, newpath string, flags int) error {
+	oldp, err := syscall.BytePtrFromString(oldpath)
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(newpath)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT,
+		uintptr(olddirfd), uintptr(unsafe.Pointer(oldp)),
+		uintptr(newdirfd), uintptr(unsafe.Pointer(newp)),
+		uintptr(flags), 0)
+	if errno != 0 {
+		return &os.LinkError{Op: "linkat", Old: oldpath, New: newpath, Err: errno}
+	}
+	return nil
+}
+
+// dirEntryPath names an entry of an open directory through its descriptor,
+// so the path cannot be redirected by a swapped component.
+func dirEntryPath(dir *os.File, name string) string {
+	return procFDPath(dir) + "/" + name
+}
+
+func procFDPath(file *os.File) string {
+	return "/proc/self/fd/" + strconv.Itoa(int(file.Fd()))
+}
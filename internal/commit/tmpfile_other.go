@@ -0,0 +1,39 @@
+//go:build !linux || !(386 || amd64 || arm || arm64 || loong64 || mips || mips64 || mips64le || mipsle || ppc64 || ppc64le || riscv64 || s390x)
+
+package commit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var errAnonymousUnsupported = errors.New("anonymous temp files not supported")
+
+func openAnonymous(dir string, perm os.FileMode) (*os.File, error) {
+	return nil, errAnonymousUnsupported
+}
+
+func linkAnonymous(file *os.File, dst string) error {
+	return errAnonymousUnsupported
+}
+
+func linkAnonymousAt(file *os.File, dir *os.File, name string) error {
+	return errAnonymousUnsupported
+}
+
+func renameNoReplaceAt(src string, dir *os.File, name string) error {
+	return RenameNoReplace(src, filepath.Join(dir.Name(), name))
+}
+
+func renameDirNoReplaceAt(src string, dir *os.File, name string) error {
+	return renameDirOverReservation(src, dir, name)
+}
+
+func renameAt(src string, dir *os.File, name string) error {
+	return os.Rename(src, filepath.Join(dir.Name(), name))
+}
+
+func dirEntryPath(dir *os.File, name string) string {
+	return filepath.Join(dir.Name(), name)
+}
@@ -6,6 +6,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"dropserve/internal/pathsafe"
 )
 
 const (
@@ -13,6 +15,18 @@ const (
 	defaultSweepIntervalSeconds = 120
 	defaultPartMaxAgeSeconds    = 600
 	defaultPortalIdleMaxSeconds = 1800
+	defaultHookTimeoutSeconds   = 60
+	defaultHookConcurrency      = 2
+	defaultHookQueueSize        = 1000
+	defaultWebhookMaxAttempts   = 12
+	defaultScanTimeoutSeconds   = 120
+)
+
+// Fsync modes for committed uploads.
+const (
+	FsyncOff  = "off"
+	FsyncFile = "file"
+	FsyncFull = "full"
 )
 
 func TempDirName() string {
@@ -44,7 +58,21 @@ func SweepRoots() []string {
 		}
 		return []string{cwd}
 	}
+	return pathList(raw)
+}
+
+// StagingRoots lists directories that may hold temp and staging trees
+// instead of the destination itself. For each destination the server uses a
+// root on the same filesystem, so placing a file stays an atomic rename.
+func StagingRoots() []string {
+	raw := strings.TrimSpace(os.Getenv("DROPSERVE_STAGING_ROOTS"))
+	if raw == "" {
+		return nil
+	}
+	return pathList(raw)
+}
 
+func pathList(raw string) []string {
 	parts := strings.FieldsFunc(raw, func(r rune) bool {
 		return r == os.PathListSeparator
 	})
@@ -66,6 +94,180 @@ func SweepRoots() []string {
 	return roots
 }
 
+// FsyncMode controls durability of commits: "off" never syncs, "file" syncs
+// file data before it is placed, "full" also syncs the destination directory.
+func FsyncMode() string {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("DROPSERVE_FSYNC")))
+	switch value {
+	case FsyncOff, FsyncFile, FsyncFull:
+		return value
+	default:
+		return FsyncFull
+	}
+}
+
+func VerifyCommits() bool {
+	return boolFromEnv("DROPSERVE_VERIFY_COMMITS", false)
+}
+
+// PreserveMetadata controls whether the modification time and mode bits a
+// client sends at init are applied to committed files.
+func PreserveMetadata() bool {
+	return boolFromEnv("DROPSERVE_PRESERVE_METADATA", true)
+}
+
+// FileMode and DirMode are the permission bits given to committed files and
+// the directories created for them, read as octal ("0664"). Zero, the
+// default, keeps 0644 and 0755 under the process umask.
+func FileMode() os.FileMode {
+	return modeFromEnv("DROPSERVE_FILE_MODE")
+}
+
+func DirMode() os.FileMode {
+	return modeFromEnv("DROPSERVE_DIR_MODE")
+}
+
+// Group names the group (or numeric gid) committed files and created
+// directories are given. Empty keeps the server user's group.
+func Group() string {
+	return strings.TrimSpace(os.Getenv("DROPSERVE_GROUP"))
+}
+
+// InheritSetgid makes new files and directories take the group of a
+// setgid parent directory, and new directories keep the setgid bit, as they
+// would if a local user had created them there.
+func InheritSetgid() bool {
+	return boolFromEnv("DROPSERVE_INHERIT_SETGID", true)
+}
+
+// HookOnCommit is a shell command run after each file is committed, and
+// HookOnClose one run after a portal closes or expires. Empty disables them.
+func HookOnCommit() string {
+	return strings.TrimSpace(os.Getenv("DROPSERVE_HOOK_ON_COMMIT"))
+}
+
+func HookOnClose() string {
+	return strings.TrimSpace(os.Getenv("DROPSERVE_HOOK_ON_CLOSE"))
+}
+
+// HookTimeout bounds a single hook run; the command is killed after it.
+func HookTimeout() time.Duration {
+	return durationSecondsFromEnv("DROPSERVE_HOOK_TIMEOUT_SECONDS", defaultHookTimeoutSeconds)
+}
+
+// HookConcurrency is how many hook commands may run at once; further
+// events wait for a free slot.
+func HookConcurrency() int {
+	return intFromEnv("DROPSERVE_HOOK_CONCURRENCY", defaultHookConcurrency)
+}
+
+// HookQueueSize is how many hook events may wait for a slot; further ones
+// are dropped and logged.
+func HookQueueSize() int {
+	return intFromEnv("DROPSERVE_HOOK_QUEUE_SIZE", defaultHookQueueSize)
+}
+
+// WebhookURL and WebhookSecret configure a receiver that gets the events
+// of every portal, in addition to any receiver a portal names itself.
+func WebhookURL() string {
+	return strings.TrimSpace(os.Getenv("DROPSERVE_WEBHOOK_URL"))
+}
+
+func WebhookSecret() string {
+	return os.Getenv("DROPSERVE_WEBHOOK_SECRET")
+}
+
+// WebhookOutbox is the directory holding webhook deliveries until their
+// receiver accepts them, so they survive a restart. It has no default: the
+// deliveries carry their secrets and a cache directory may be purged or
+// shared, so webhooks are refused while it is empty.
+func WebhookOutbox() string {
+	return strings.TrimSpace(os.Getenv("DROPSERVE_WEBHOOK_OUTBOX"))
+}
+
+// WebhookMaxAttempts is how often a delivery is tried before it is set
+// aside as failed.
+func WebhookMaxAttempts() int {
+	return intFromEnv("DROPSERVE_WEBHOOK_MAX_ATTEMPTS", defaultWebhookMaxAttempts)
+}
+
+// ReviewDir holds uploads to review portals until an operator approves or
+// rejects them. It has no default: a cache directory may be purged and is
+// rarely on the destinations' filesystem, so review portals are refused
+// while it is empty.
+func ReviewDir() string {
+	return strings.TrimSpace(os.Getenv("DROPSERVE_REVIEW_DIR"))
+}
+
+// ClamdAddress is the clamd-compatible daemon uploads are scanned with
+// before they are committed: "unix:/path", "tcp:host:port", a bare socket
+// path or a bare host:port. Empty disables scanning.
+func ClamdAddress() string {
+	return strings.TrimSpace(os.Getenv("DROPSERVE_CLAMD_ADDRESS"))
+}
+
+// ScanTimeout bounds a single scan, including connecting to the daemon.
+func ScanTimeout() time.Duration {
+	return durationSecondsFromEnv("DROPSERVE_SCAN_TIMEOUT_SECONDS", defaultScanTimeoutSeconds)
+}
+
+// QuarantineDir is where infected uploads are moved instead of being
+// deleted. Empty deletes them.
+func QuarantineDir() string {
+	return strings.TrimSpace(os.Getenv("DROPSERVE_QUARANTINE_DIR"))
+}
+
+// FilenamePolicy reads the DROPSERVE_FILENAME_* settings. Mode "replace"
+// rewrites unsafe names; anything else rejects them.
+func FilenamePolicy() pathsafe.FilenamePolicy {
+	policy := pathsafe.DefaultFilenamePolicy()
+	policy.NFC = boolFromEnv("DROPSERVE_FILENAME_NFC", policy.NFC)
+	policy.Portable = boolFromEnv("DROPSERVE_FILENAME_PORTABLE", policy.Portable)
+	policy.Replace = strings.EqualFold(strings.TrimSpace(os.Getenv("DROPSERVE_FILENAME_MODE")), "replace")
+	if value := os.Getenv("DROPSERVE_FILENAME_REPLACEMENT"); value != "" {
+		policy.Replacement = value
+	}
+	policy.MaxSegmentBytes = intFromEnv("DROPSERVE_FILENAME_MAX_SEGMENT_BYTES", policy.MaxSegmentBytes)
+	policy.MaxPathBytes = intFromEnv("DROPSERVE_FILENAME_MAX_PATH_BYTES", policy.MaxPathBytes)
+	return policy
+}
+
+func modeFromEnv(name string) os.FileMode {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return 0
+	}
+	value, err := strconv.ParseUint(raw, 8, 32)
+	if err != nil || value > 0o777 {
+		return 0
+	}
+	return os.FileMode(value)
+}
+
+func intFromEnv(name string, defaultValue int) int {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func boolFromEnv(name string, defaultValue bool) bool {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
 func durationSecondsFromEnv(name string, defaultSeconds int) time.Duration {
 	raw := strings.TrimSpace(os.Getenv(name))
 	if raw == "" {
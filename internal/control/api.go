@@ -1,14 +1,73 @@
 package control
 
 type CreatePortalRequest struct {
-	DestAbs              string `json:"dest_abs"`
-	OpenMinutes          int    `json:"open_minutes"`
-	Reusable             bool   `json:"reusable"`
-	DefaultPolicy        string `json:"default_policy"`
-	AutorenameOnConflict bool   `json:"autorename_on_conflict"`
+	DestAbs              string   `json:"dest_abs"`
+	OpenMinutes          int      `json:"open_minutes"`
+	Reusable             bool     `json:"reusable"`
+	DefaultPolicy        string   `json:"default_policy"`
+	RenameTemplate       string   `json:"rename_template,omitempty"`
+	CaseMode             string   `json:"case_mode,omitempty"`
+	FolderPolicy         string   `json:"folder_policy,omitempty"`
+	AtomicBatches        bool     `json:"atomic_batches,omitempty"`
+	FileMode             string   `json:"file_mode,omitempty"`
+	DirMode              string   `json:"dir_mode,omitempty"`
+	Group                string   `json:"group,omitempty"`
+	AllowExtensions      []string `json:"allow_extensions,omitempty"`
+	DenyExtensions       []string `json:"deny_extensions,omitempty"`
+	AllowTypes           []string `json:"allow_types,omitempty"`
+	DenyTypes            []string `json:"deny_types,omitempty"`
+	WebhookURL           string   `json:"webhook_url,omitempty"`
+	WebhookSecret        string   `json:"webhook_secret,omitempty"`
+	Review               bool     `json:"review,omitempty"`
+	ApproveClaims        bool     `json:"approve_claims,omitempty"`
+	Passphrase           string   `json:"passphrase,omitempty"`
+	AutorenameOnConflict bool     `json:"autorename_on_conflict"`
 }
 
 type CreatePortalResponse struct {
-	PortalID  string `json:"portal_id"`
-	ExpiresAt string `json:"expires_at"`
+	PortalID   string `json:"portal_id"`
+	Code       string `json:"code"`
+	ExpiresAt  string `json:"expires_at"`
+	OwnerToken string `json:"owner_token"`
+}
+
+type PortalClientResponse struct {
+	ClientID       string `json:"client_id"`
+	ClaimedAt      string `json:"claimed_at"`
+	FilesCommitted int    `json:"files_committed"`
+	BytesCommitted int64  `json:"bytes_committed"`
+}
+
+type PortalStatusResponse struct {
+	PortalID      string                 `json:"portal_id"`
+	Code          string                 `json:"code"`
+	State         string                 `json:"state"`
+	Reusable      bool                   `json:"reusable"`
+	ExpiresAt     string                 `json:"expires_at"`
+	ActiveUploads int                    `json:"active_uploads"`
+	Clients       []PortalClientResponse `json:"clients"`
+}
+
+type ClosePortalResponse struct {
+	Status string `json:"status"`
+}
+
+// PendingClaimResponse is a claim waiting for the operator: the pairing code
+// the claiming browser shows and where the request came from.
+type PendingClaimResponse struct {
+	ClaimID     string `json:"claim_id"`
+	Code        string `json:"code"`
+	RemoteAddr  string `json:"remote_addr"`
+	UserAgent   string `json:"user_agent"`
+	RequestedAt string `json:"requested_at"`
+}
+
+type PendingClaimsResponse struct {
+	Claims []PendingClaimResponse `json:"claims"`
+}
+
+type ClaimDecisionResponse struct {
+	ClaimID  string `json:"claim_id"`
+	Status   string `json:"status"`
+	ClientID string `json:"client_id,omitempty"`
 }
@@ -0,0 +1,135 @@
+package control
+
+import (
+	"net"
+	"time"
+)
+
+// addressKey is the key limits on remote addresses are counted under. An
+// IPv6 host usually holds a whole /64, so those count as one address; any
+// other address is used as is.
+func addressKey(remoteAddr string) string {
+	ip := net.ParseIP(remoteAddr)
+	if ip == nil || ip.To4() != nil {
+		return remoteAddr
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// attemptCounter counts events per key within a fixed window that starts
+// with the first event, such as failed guesses from one address. Callers
+// hold the store's lock.
+type attemptCounter struct {
+	window time.Duration
+	counts map[string]attemptCount
+}
+
+type attemptCount struct {
+	n     int
+	since time.Time
+}
+
+func newAttemptCounter(window time.Duration) *attemptCounter {
+	return &attemptCounter{window: window, counts: make(map[string]attemptCount)}
+}
+
+func (c *attemptCounter) count(key string, now time.Time) int {
+	current, ok := c.counts[key]
+	if !ok {
+		return 0
+	}
+	if now.Sub(current.since) > c.window {
+		delete(c.counts, key)
+		return 0
+	}
+	return current.n
+}
+
+// prune forgets every key whose window is over, including keys that are
+// never seen again.
+func (c *attemptCounter) prune(now time.Time) {
+	for key, current := range c.counts {
+		if now.Sub(current.since) > c.window {
+			delete(c.counts, key)
+		}
+	}
+}
+
+// add changes the key's count by delta; a negative delta never starts a new
+// window.
+func (c *attemptCounter) add(key string, now time.Time, delta int) {
+	current, ok := c.counts[key]
+	if !ok || now.Sub(current.since) > c.window {
+		if delta < 0 {
+			return
+		}
+		current = attemptCount{since: now}
+	}
+	current.n += delta
+	c.counts[key] = current
+}
+
+// failureDelay makes a key wait after its first few failures, twice as long
+// after each further one up to a cap, such as wrong guesses from one
+// address. A key is forgotten once it has not failed for a while. Callers
+// hold the store's lock.
+type failureDelay struct {
+	free     int
+	base     time.Duration
+	max      time.Duration
+	forget   time.Duration
+	failures map[string]failureRecord
+}
+
+type failureRecord struct {
+	n    int
+	last time.Time
+}
+
+func newFailureDelay(free int, base, max, forget time.Duration) *failureDelay {
+	return &failureDelay{free: free, base: base, max: max, forget: forget, failures: make(map[string]failureRecord)}
+}
+
+// wait returns how long key has to wait before its next attempt.
+func (d *failureDelay) wait(key string, now time.Time) time.Duration {
+	record, ok := d.failures[key]
+	if !ok {
+		return 0
+	}
+	if now.Sub(record.last) > d.forget {
+		delete(d.failures, key)
+		return 0
+	}
+	if record.n < d.free {
+		return 0
+	}
+	delay := d.base
+	for i := d.free; i < record.n && delay < d.max; i++ {
+		delay *= 2
+	}
+	return max(record.last.Add(min(delay, d.max)).Sub(now), 0)
+}
+
+func (d *failureDelay) fail(key string, now time.Time) {
+	record := d.failures[key]
+	if now.Sub(record.last) > d.forget {
+		record = failureRecord{}
+	}
+	record.n++
+	record.last = now
+	d.failures[key] = record
+}
+
+// prune forgets every key that has not failed for a while, including keys
+// that are never seen again.
+func (d *failureDelay) prune(now time.Time) {
+	for key, record := range d.failures {
+		if now.Sub(record.last) > d.forget {
+			delete(d.failures, key)
+		}
+	}
+}
+
+func (d *failureDelay) reset(key string) {
+	delete(d.failures, key)
+}
@@ -0,0 +1,414 @@
+package control
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBatchIDInvalid  = errors.New("batch_id must be 1-64 characters of A-Z, a-z, 0-9, '-' or '_'")
+	ErrBatchNotFound   = errors.New("batch not found")
+	ErrBatchExists     = errors.New("batch already exists")
+	ErrBatchNotAtomic  = errors.New("batch is not atomic")
+	ErrBatchClosed     = errors.New("batch already committed or cancelled")
+	ErrBatchBusy       = errors.New("batch has uploads in progress")
+	ErrBatchIncomplete = errors.New("batch is missing files")
+	ErrFolderReserved  = errors.New("folder reserved by another batch")
+	ErrBatchFolders    = errors.New("an atomic batch holds exactly one top-level folder")
+)
+
+type BatchState string
+
+const (
+	BatchOpen       BatchState = "open"
+	BatchCommitting BatchState = "committing"
+	BatchCommitted  BatchState = "committed"
+	BatchCancelled  BatchState = "cancelled"
+)
+
+// finishedBatchMemory is how long a committed or cancelled batch is kept,
+// so a client retrying its commit still hears that the batch is closed.
+const finishedBatchMemory = 10 * time.Minute
+
+// Batch groups the uploads of one drop. Every batch remembers the folders
+// reserved for it under folder autorename; an atomic batch also stages its
+// files until the client commits it, and records the one top-level folder
+// they all live in.
+type Batch struct {
+	ID         string
+	PortalID   string
+	Atomic     bool
+	State      BatchState
+	Folders    map[string]string
+	Folder     string
+	CreatedAt  time.Time
+	FinishedAt time.Time
+}
+
+// batchKey scopes a client-chosen batch ID to its portal, like uploadKey.
+type batchKey struct {
+	portalID string
+	batchID  string
+}
+
+// ValidateBatchID applies the upload ID rules to batch IDs.
+func ValidateBatchID(id string) error {
+	if ValidateUploadID(id) != nil {
+		return ErrBatchIDInvalid
+	}
+	return nil
+}
+
+// NewBatchID mints an ID for clients that leave batch_id empty.
+func NewBatchID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate batch id: %w", err)
+	}
+
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+	return "b_" + strings.ToLower(encoded), nil
+}
+
+// CreateBatch registers a batch before its first upload. Batches that are
+// only used for folder reservations are created implicitly instead.
+func (s *Store) CreateBatch(portalID, batchID string, atomic bool) (Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	portal, ok := s.portals[portalID]
+	if !ok {
+		return Batch{}, ErrPortalNotFound
+	}
+	updated, changed := s.refreshPortalLocked(portal, time.Now())
+	if changed {
+		s.setPortalLocked(updated)
+	}
+	if updated.State == PortalClosed || updated.State == PortalExpired || updated.State == PortalClosing {
+		return Batch{}, ErrPortalClosed
+	}
+
+	if err := ValidateBatchID(batchID); err != nil {
+		return Batch{}, err
+	}
+	key := batchKey{portalID: portalID, batchID: batchID}
+	if _, ok := s.batches[key]; ok {
+		return Batch{}, ErrBatchExists
+	}
+
+	batch := Batch{
+		ID:        batchID,
+		PortalID:  portalID,
+		Atomic:    atomic,
+		State:     BatchOpen,
+		Folders:   make(map[string]string),
+		CreatedAt: time.Now(),
+	}
+	s.batches[key] = batch
+	return copyBatch(batch), nil
+}
+
+func (s *Store) GetBatch(portalID, batchID string) (Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch, ok := s.batches[batchKey{portalID: portalID, batchID: batchID}]
+	if !ok {
+		return Batch{}, ErrBatchNotFound
+	}
+	return copyBatch(batch), nil
+}
+
+// BatchFolder returns the folder reserved for the top-level folder within
+// a batch, if one has been reserved.
+func (s *Store) BatchFolder(portalID, batchID, folder string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target, ok := s.batches[batchKey{portalID: portalID, batchID: batchID}].Folders[folder]
+	return target, ok
+}
+
+// ReserveBatchFolder records target as the folder every upload of the batch
+// under folder lands in. If another upload of the same batch reserved one
+// first, that reservation wins and is returned; the caller should release
+// its own. A target another live batch of the portal holds, in any case
+// spelling, fails with ErrFolderReserved: an atomic batch's folder exists
+// only here until it commits.
+func (s *Store) ReserveBatchFolder(portalID, batchID, folder, target string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.portals[portalID]; !ok {
+		return "", ErrPortalNotFound
+	}
+
+	key := batchKey{portalID: portalID, batchID: batchID}
+	batch, ok := s.batches[key]
+	if !ok {
+		batch = Batch{ID: batchID, PortalID: portalID, State: BatchOpen, Folders: make(map[string]string), CreatedAt: time.Now()}
+		s.batches[key] = batch
+	}
+	if existing, ok := batch.Folders[folder]; ok {
+		return existing, nil
+	}
+	for otherKey, other := range s.batches {
+		if otherKey.portalID != portalID || otherKey == key || !other.FinishedAt.IsZero() {
+			continue
+		}
+		for _, reserved := range other.Folders {
+			if strings.EqualFold(reserved, target) {
+				return "", ErrFolderReserved
+			}
+		}
+	}
+	batch.Folders[folder] = target
+	return target, nil
+}
+
+// BatchFolders returns every folder reserved on disk for the portal's
+// non-atomic batches, except those a committed directory entry asked for:
+// an empty folder declared by the client stays. Atomic batches reserve in
+// the store only, and their folders arrive with content.
+func (s *Store) BatchFolders(portalID string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	declared := make(map[string]struct{})
+	for key, upload := range s.uploads {
+		if key.portalID == portalID && upload.Dir && upload.Status == UploadCommitted {
+			declared[upload.FinalRelpath] = struct{}{}
+		}
+	}
+
+	targets := make([]string, 0)
+	for key, batch := range s.batches {
+		if key.portalID != portalID || batch.Atomic {
+			continue
+		}
+		for _, target := range batch.Folders {
+			if _, ok := declared[target]; ok {
+				continue
+			}
+			targets = append(targets, target)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// BeginBatchCommit moves an open atomic batch to committing and returns its
+// staged uploads ordered by relpath. It refuses while any upload of the
+// batch is still streaming, and when expectFiles is positive and differs
+// from the number of staged files.
+func (s *Store) BeginBatchCommit(portalID, batchID string, expectFiles int) ([]Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := batchKey{portalID: portalID, batchID: batchID}
+	batch, err := s.openAtomicBatchLocked(key)
+	if err != nil {
+		return nil, err
+	}
+
+	staged := make([]Upload, 0)
+	for id, upload := range s.uploads {
+		if id.portalID != portalID || upload.BatchID != batchID {
+			continue
+		}
+		if upload.Active {
+			return nil, ErrBatchBusy
+		}
+		if upload.Status == UploadStaged {
+			staged = append(staged, upload)
+		}
+	}
+	if expectFiles > 0 && len(staged) != expectFiles {
+		return nil, ErrBatchIncomplete
+	}
+	sort.Slice(staged, func(i, j int) bool {
+		return staged[i].Relpath < staged[j].Relpath
+	})
+
+	batch.State = BatchCommitting
+	s.batches[key] = batch
+	return staged, nil
+}
+
+// FinishBatch records the final state of a batch whose commit has ended.
+// A batch that ends cancelled could not be moved in, and its staged uploads
+// fail.
+func (s *Store) FinishBatch(portalID, batchID string, state BatchState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := batchKey{portalID: portalID, batchID: batchID}
+	batch, ok := s.batches[key]
+	if !ok {
+		return
+	}
+	if state == BatchCancelled {
+		s.failStagedUploadsLocked(portalID, batchID)
+	}
+	batch.State = state
+	batch.FinishedAt = time.Now()
+	s.batches[key] = batch
+}
+
+// CancelBatch abandons an open atomic batch and fails its staged uploads.
+func (s *Store) CancelBatch(portalID, batchID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := batchKey{portalID: portalID, batchID: batchID}
+	batch, err := s.openAtomicBatchLocked(key)
+	if err != nil {
+		return err
+	}
+	for id, upload := range s.uploads {
+		if id.portalID == portalID && upload.BatchID == batchID && upload.Active {
+			return ErrBatchBusy
+		}
+	}
+
+	s.failStagedUploadsLocked(portalID, batchID)
+	batch.State = BatchCancelled
+	batch.FinishedAt = time.Now()
+	s.batches[key] = batch
+	return nil
+}
+
+// SweepBatches forgets batches that were committed or cancelled more than
+// finishedBatchMemory before now. Their uploads keep their own records.
+func (s *Store) SweepBatches(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, batch := range s.batches {
+		if !batch.FinishedAt.IsZero() && now.Sub(batch.FinishedAt) > finishedBatchMemory {
+			delete(s.batches, key)
+		}
+	}
+}
+
+// ForgetBatches drops every batch of a portal that has ended, once the
+// folders reserved for them have been dealt with.
+func (s *Store) ForgetBatches(portalID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.batches {
+		if key.portalID == portalID {
+			delete(s.batches, key)
+		}
+	}
+}
+
+func (s *Store) failStagedUploadsLocked(portalID, batchID string) {
+	for id, upload := range s.uploads {
+		if id.portalID != portalID || upload.BatchID != batchID || upload.Status != UploadStaged {
+			continue
+		}
+		upload.Status = UploadFailed
+		upload.UpdatedAt = time.Now()
+		s.uploads[id] = upload
+		s.uploadFailedLocked(upload)
+	}
+}
+
+// PortalsWithOpenBatches returns the IDs of portals holding staged files
+// that have not been committed or cancelled yet.
+func (s *Store) PortalsWithOpenBatches() map[string]struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	portals := make(map[string]struct{})
+	for key, batch := range s.batches {
+		if batch.Atomic && batch.State == BatchOpen {
+			portals[key.portalID] = struct{}{}
+		}
+	}
+	return portals
+}
+
+func (s *Store) openAtomicBatchLocked(key batchKey) (Batch, error) {
+	batch, ok := s.batches[key]
+	if !ok {
+		return Batch{}, ErrBatchNotFound
+	}
+	if !batch.Atomic {
+		return Batch{}, ErrBatchNotAtomic
+	}
+	if batch.State != BatchOpen {
+		return Batch{}, ErrBatchClosed
+	}
+	return batch, nil
+}
+
+// claimAtomicFolderLocked makes the first entry of an atomic batch pick the
+// batch's top-level folder and refuses every later entry outside it. A
+// commit moves that folder in with one rename; files at the top level or
+// in a second folder would have to be placed one by one.
+func (s *Store) claimAtomicFolderLocked(input CreateUploadInput) error {
+	if input.BatchID == "" {
+		return nil
+	}
+	key := batchKey{portalID: input.PortalID, batchID: input.BatchID}
+	batch, ok := s.batches[key]
+	if !ok || !batch.Atomic {
+		return nil
+	}
+	folder, _, nested := strings.Cut(input.Relpath, "/")
+	if !nested && !input.Dir {
+		return ErrBatchFolders
+	}
+	if batch.Folder == "" {
+		batch.Folder = folder
+		s.batches[key] = batch
+		return nil
+	}
+	if batch.Folder != folder {
+		return ErrBatchFolders
+	}
+	return nil
+}
+
+// batchAcceptsUploadsLocked reports whether uploads may still be added to
+// or streamed into batchID. Only atomic batches ever close.
+func (s *Store) batchAcceptsUploadsLocked(portalID, batchID string) bool {
+	if batchID == "" {
+		return true
+	}
+	batch, ok := s.batches[batchKey{portalID: portalID, batchID: batchID}]
+	return !ok || !batch.Atomic || batch.State == BatchOpen
+}
+
+func copyBatch(batch Batch) Batch {
+	folders := make(map[string]string, len(batch.Folders))
+	for folder, target := range batch.Folders {
+		folders[folder] = target
+	}
+	batch.Folders = folders
+	return batch
+}
+
+// RemoveUnusedBatchFolders deletes folders reserved for the portal's batches
+// that never received a file, then forgets the batches: every path that
+// closes a portal ends here. os.Remove refuses non-empty directories, so
+// nothing that was uploaded is touched.
+func RemoveUnusedBatchFolders(store *Store, portal Portal) {
+	if store == nil || strings.TrimSpace(portal.DestAbs) == "" {
+		return
+	}
+	for _, target := range store.BatchFolders(portal.ID) {
+		_ = os.Remove(filepath.Join(portal.DestAbs, target))
+	}
+	store.ForgetBatches(portal.ID)
+}
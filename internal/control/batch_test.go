@@ -0,0 +1,131 @@
+package control
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAtomicBatchLifecycle(t *testing.T) {
+	store := NewStore()
+	portal, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+
+	if _, err := store.CreateBatch(portal.ID, "drop", true); err != nil {
+		t.Fatalf("create batch: %v", err)
+	}
+	if _, err := store.CreateBatch(portal.ID, "drop", true); !errors.Is(err, ErrBatchExists) {
+		t.Fatalf("expected duplicate batch to be rejected, got %v", err)
+	}
+	if _, err := store.CreateBatch(portal.ID, "../drop", true); !errors.Is(err, ErrBatchIDInvalid) {
+		t.Fatalf("expected invalid batch id to be rejected, got %v", err)
+	}
+
+	for _, id := range []string{"one", "two"} {
+		if _, err := store.CreateUpload(CreateUploadInput{PortalID: portal.ID, BatchID: "drop", UploadID: id, Relpath: "a/" + id}); err != nil {
+			t.Fatalf("create upload: %v", err)
+		}
+	}
+	if _, err := store.StartUpload(portal.ID, "one"); err != nil {
+		t.Fatalf("start upload: %v", err)
+	}
+	if _, err := store.BeginBatchCommit(portal.ID, "drop", 0); !errors.Is(err, ErrBatchBusy) {
+		t.Fatalf("expected commit to wait for streaming uploads, got %v", err)
+	}
+
+	if _, err := store.MarkUploadStaged(portal.ID, "one", "sha", 1); err != nil {
+		t.Fatalf("stage upload: %v", err)
+	}
+	staged, err := store.BeginBatchCommit(portal.ID, "drop", 0)
+	if err != nil {
+		t.Fatalf("begin commit: %v", err)
+	}
+	if len(staged) != 1 || staged[0].ID != "one" {
+		t.Fatalf("expected only the staged upload, got %+v", staged)
+	}
+
+	if _, err := store.StartUpload(portal.ID, "two"); !errors.Is(err, ErrBatchClosed) {
+		t.Fatalf("expected a committing batch to refuse uploads, got %v", err)
+	}
+	if _, err := store.CreateUpload(CreateUploadInput{PortalID: portal.ID, BatchID: "drop", UploadID: "three", Relpath: "a/three"}); !errors.Is(err, ErrBatchClosed) {
+		t.Fatalf("expected a committing batch to refuse new uploads, got %v", err)
+	}
+	if err := store.CancelBatch(portal.ID, "drop"); !errors.Is(err, ErrBatchClosed) {
+		t.Fatalf("expected cancel after commit to fail, got %v", err)
+	}
+
+	if _, err := store.ReserveBatchFolder(portal.ID, "plain", "Photos", "Photos (2)"); err != nil {
+		t.Fatalf("reserve folder: %v", err)
+	}
+	if err := store.CancelBatch(portal.ID, "plain"); !errors.Is(err, ErrBatchNotAtomic) {
+		t.Fatalf("expected implicit batch to be non-atomic, got %v", err)
+	}
+}
+
+func TestReserveBatchFolderKeepsBatchesApart(t *testing.T) {
+	store := NewStore()
+	portal, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	for _, id := range []string{"first", "second"} {
+		if _, err := store.CreateBatch(portal.ID, id, true); err != nil {
+			t.Fatalf("create batch: %v", err)
+		}
+	}
+
+	if target, err := store.ReserveBatchFolder(portal.ID, "first", "Album", "Album"); err != nil || target != "Album" {
+		t.Fatalf("reserve folder: %q, %v", target, err)
+	}
+	if target, err := store.ReserveBatchFolder(portal.ID, "first", "Album", "Album (2)"); err != nil || target != "Album" {
+		t.Fatalf("expected the batch's first reservation to win, got %q, %v", target, err)
+	}
+	if _, err := store.ReserveBatchFolder(portal.ID, "second", "Album", "album"); !errors.Is(err, ErrFolderReserved) {
+		t.Fatalf("expected another batch's folder to be refused, got %v", err)
+	}
+	if folders := store.BatchFolders(portal.ID); len(folders) != 0 {
+		t.Fatalf("expected atomic reservations not to be removed from disk, got %v", folders)
+	}
+
+	if err := store.CancelBatch(portal.ID, "first"); err != nil {
+		t.Fatalf("cancel batch: %v", err)
+	}
+	if target, err := store.ReserveBatchFolder(portal.ID, "second", "Album", "Album"); err != nil || target != "Album" {
+		t.Fatalf("expected a cancelled batch to free its folder, got %q, %v", target, err)
+	}
+}
+
+func TestFinishedBatchesAreForgotten(t *testing.T) {
+	store := NewStore()
+	portal, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	for _, id := range []string{"done", "open"} {
+		if _, err := store.CreateBatch(portal.ID, id, true); err != nil {
+			t.Fatalf("create batch: %v", err)
+		}
+	}
+	if err := store.CancelBatch(portal.ID, "done"); err != nil {
+		t.Fatalf("cancel batch: %v", err)
+	}
+
+	store.SweepBatches(time.Now())
+	if _, err := store.GetBatch(portal.ID, "done"); err != nil {
+		t.Fatalf("expected a just-cancelled batch to be remembered, got %v", err)
+	}
+	store.SweepBatches(time.Now().Add(finishedBatchMemory + time.Second))
+	if _, err := store.GetBatch(portal.ID, "done"); !errors.Is(err, ErrBatchNotFound) {
+		t.Fatalf("expected the cancelled batch to be forgotten, got %v", err)
+	}
+	if _, err := store.GetBatch(portal.ID, "open"); err != nil {
+		t.Fatalf("expected the open batch to stay, got %v", err)
+	}
+
+	RemoveUnusedBatchFolders(store, portal)
+	if _, err := store.GetBatch(portal.ID, "open"); !errors.Is(err, ErrBatchNotFound) {
+		t.Fatalf("expected the closed portal's batches to be forgotten, got %v", err)
+	}
+}
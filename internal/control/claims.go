@@ -0,0 +1,250 @@
+package control
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// claimRequestTTL is how long a claim request waits for the operator,
+	// and how long its outcome can be collected afterwards.
+	claimRequestTTL = 5 * time.Minute
+	// maxPendingClaims caps the requests one portal keeps waiting, so a
+	// leaked link cannot flood the operator's terminal.
+	maxPendingClaims = 5
+)
+
+var (
+	ErrClaimNotFound = errors.New("claim request not found")
+	ErrClaimDenied   = errors.New("claim denied")
+	ErrClaimDecided  = errors.New("claim request already decided")
+	ErrTooManyClaims = errors.New("too many pending claims")
+)
+
+type ClaimState string
+
+const (
+	ClaimPending  ClaimState = "pending"
+	ClaimApproved ClaimState = "approved"
+	ClaimDenied   ClaimState = "denied"
+)
+
+// ClaimRequest is a claim on a portal that requires the operator's
+// approval. The browser shows Code and polls with Token; the operator sees
+// Code together with where the request came from. Result holds the issued
+// client token once the request is approved.
+type ClaimRequest struct {
+	ID          string
+	PortalID    string
+	Token       string
+	Code        string
+	RemoteAddr  string
+	UserAgent   string
+	RequestedAt time.Time
+	State       ClaimState
+	Result      ClaimPortalResult
+}
+
+type claimKey struct {
+	portalID string
+	claimID  string
+}
+
+// RequestClaim records a claim that waits for DecideClaim instead of
+// issuing a client token right away.
+func (s *Store) RequestClaim(portalID, remoteAddr, userAgent string) (ClaimRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	portal, ok := s.portals[portalID]
+	if !ok {
+		return ClaimRequest{}, ErrPortalNotFound
+	}
+	now := time.Now()
+	updated, changed := s.refreshPortalLocked(portal, now)
+	if changed {
+		portal = updated
+		s.setPortalLocked(portal)
+	}
+	if portal.State == PortalClosed || portal.State == PortalExpired || portal.State == PortalClosing {
+		return ClaimRequest{}, ErrPortalClosed
+	}
+	if !portal.Reusable && len(portal.ClientTokens) > 0 {
+		return ClaimRequest{}, ErrPortalAlreadyClaimed
+	}
+
+	s.pruneClaimsLocked(portalID, now)
+	if len(s.pendingClaimsLocked(portalID)) >= maxPendingClaims {
+		return ClaimRequest{}, ErrTooManyClaims
+	}
+
+	id, err := newClaimID()
+	if err != nil {
+		return ClaimRequest{}, err
+	}
+	token, err := newClaimToken()
+	if err != nil {
+		return ClaimRequest{}, err
+	}
+	code, err := newPairingCode()
+	if err != nil {
+		return ClaimRequest{}, err
+	}
+	request := ClaimRequest{
+		ID:          id,
+		PortalID:    portalID,
+		Token:       token,
+		Code:        code,
+		RemoteAddr:  remoteAddr,
+		UserAgent:   userAgent,
+		RequestedAt: now,
+		State:       ClaimPending,
+	}
+	s.claims[claimKey{portalID: portalID, claimID: id}] = request
+	return request, nil
+}
+
+// PendingClaims lists the portal's claim requests still waiting for a
+// decision, oldest first. It fails with ErrPortalClosed once the portal no
+// longer accepts claims.
+func (s *Store) PendingClaims(portalID string) ([]ClaimRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	portal, ok := s.portals[portalID]
+	if !ok {
+		return nil, ErrPortalNotFound
+	}
+	now := time.Now()
+	updated, changed := s.refreshPortalLocked(portal, now)
+	if changed {
+		portal = updated
+		s.setPortalLocked(portal)
+	}
+	if portal.State == PortalClosed || portal.State == PortalExpired || portal.State == PortalClosing {
+		return nil, ErrPortalClosed
+	}
+	s.pruneClaimsLocked(portalID, now)
+	return s.pendingClaimsLocked(portalID), nil
+}
+
+// DecideClaim approves or denies a pending claim request. Approval claims
+// the portal exactly as ClaimPortal does and keeps the result for the
+// browser to collect.
+func (s *Store) DecideClaim(portalID, claimID string, approve bool) (ClaimRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneClaimsLocked(portalID, time.Now())
+	key := claimKey{portalID: portalID, claimID: claimID}
+	request, ok := s.claims[key]
+	if !ok {
+		return ClaimRequest{}, ErrClaimNotFound
+	}
+	if request.State != ClaimPending {
+		return ClaimRequest{}, ErrClaimDecided
+	}
+
+	if !approve {
+		request.State = ClaimDenied
+		s.claims[key] = request
+		return request, nil
+	}
+
+	portal, ok := s.portals[portalID]
+	if !ok {
+		return ClaimRequest{}, ErrPortalNotFound
+	}
+	updated, changed := s.refreshPortalLocked(portal, time.Now())
+	if changed {
+		portal = updated
+		s.setPortalLocked(portal)
+	}
+	if portal.State == PortalClosed || portal.State == PortalExpired || portal.State == PortalClosing {
+		return ClaimRequest{}, ErrPortalClosed
+	}
+	result, err := s.claimLocked(portal)
+	if err != nil {
+		return ClaimRequest{}, err
+	}
+	request.State = ClaimApproved
+	request.Result = result
+	s.claims[key] = request
+	return request, nil
+}
+
+// ClaimStatus returns a claim request to the browser that made it, which
+// proves itself with the request's token.
+func (s *Store) ClaimStatus(portalID, claimID, token string) (ClaimRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneClaimsLocked(portalID, time.Now())
+	request, ok := s.claims[claimKey{portalID: portalID, claimID: claimID}]
+	if !ok || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(request.Token)) != 1 {
+		return ClaimRequest{}, ErrClaimNotFound
+	}
+	if request.State == ClaimDenied {
+		return request, ErrClaimDenied
+	}
+	return request, nil
+}
+
+func (s *Store) pendingClaimsLocked(portalID string) []ClaimRequest {
+	pending := []ClaimRequest{}
+	for key, request := range s.claims {
+		if key.portalID == portalID && request.State == ClaimPending {
+			pending = append(pending, request)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].RequestedAt.Before(pending[j].RequestedAt)
+	})
+	return pending
+}
+
+func (s *Store) pruneClaimsLocked(portalID string, now time.Time) {
+	for key, request := range s.claims {
+		if key.portalID == portalID && now.Sub(request.RequestedAt) > claimRequestTTL {
+			delete(s.claims, key)
+		}
+	}
+}
+
+func newClaimID() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate claim id: %w", err)
+	}
+
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+	return "cr_" + strings.ToLower(encoded), nil
+}
+
+func newClaimToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate claim token: %w", err)
+	}
+
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+	return "ck_" + strings.ToLower(encoded), nil
+}
+
+// newPairingCode returns six random digits as "123-456", easy to read out
+// and compare.
+func newPairingCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", fmt.Errorf("generate pairing code: %w", err)
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	return code[:3] + "-" + code[3:], nil
+}
@@ -0,0 +1,82 @@
+package control
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func TestClaimRequestsWaitForTheOperator(t *testing.T) {
+	store := NewStore()
+	portal, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir(), ApproveClaims: true})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+
+	first, err := store.RequestClaim(portal.ID, "192.0.2.10", "phone")
+	if err != nil {
+		t.Fatalf("request claim: %v", err)
+	}
+	if !regexp.MustCompile(`^\d{3}-\d{3}$`).MatchString(first.Code) || first.Token == "" {
+		t.Fatalf("unexpected claim request %+v", first)
+	}
+	if _, err := store.ClaimStatus(portal.ID, first.ID, "wrong"); !errors.Is(err, ErrClaimNotFound) {
+		t.Fatalf("expected a wrong claim token to be refused, got %v", err)
+	}
+	if status, err := store.ClaimStatus(portal.ID, first.ID, first.Token); err != nil || status.State != ClaimPending {
+		t.Fatalf("expected the claim to be pending, got %+v: %v", status, err)
+	}
+
+	second, err := store.RequestClaim(portal.ID, "198.51.100.7", "laptop")
+	if err != nil {
+		t.Fatalf("request claim: %v", err)
+	}
+	pending, err := store.PendingClaims(portal.ID)
+	if err != nil || len(pending) != 2 || pending[0].ID != first.ID {
+		t.Fatalf("expected both claims pending oldest first, got %+v: %v", pending, err)
+	}
+
+	if _, err := store.DecideClaim(portal.ID, second.ID, false); err != nil {
+		t.Fatalf("deny claim: %v", err)
+	}
+	if _, err := store.ClaimStatus(portal.ID, second.ID, second.Token); !errors.Is(err, ErrClaimDenied) {
+		t.Fatalf("expected the denied claim to report it, got %v", err)
+	}
+	if _, err := store.DecideClaim(portal.ID, second.ID, true); !errors.Is(err, ErrClaimDecided) {
+		t.Fatalf("expected a decided claim to stay decided, got %v", err)
+	}
+
+	approved, err := store.DecideClaim(portal.ID, first.ID, true)
+	if err != nil || approved.Result.ClientToken == "" {
+		t.Fatalf("expected approval to issue a client token, got %+v: %v", approved, err)
+	}
+	if _, err := store.RequireClientToken(portal.ID, approved.Result.ClientToken); err != nil {
+		t.Fatal("expected the issued client token to be valid")
+	}
+	if _, err := store.RequestClaim(portal.ID, "203.0.113.5", "other"); !errors.Is(err, ErrPortalAlreadyClaimed) {
+		t.Fatalf("expected a one-time portal to refuse further claims, got %v", err)
+	}
+}
+
+func TestClaimRequestsAreCapped(t *testing.T) {
+	store := NewStore()
+	portal, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir(), Reusable: true, ApproveClaims: true})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	for i := 0; i < maxPendingClaims; i++ {
+		if _, err := store.RequestClaim(portal.ID, "192.0.2.10", "phone"); err != nil {
+			t.Fatalf("request claim: %v", err)
+		}
+	}
+	if _, err := store.RequestClaim(portal.ID, "192.0.2.10", "phone"); !errors.Is(err, ErrTooManyClaims) {
+		t.Fatalf("expected ErrTooManyClaims, got %v", err)
+	}
+
+	if _, err := store.ClosePortal(portal.ID); err != nil {
+		t.Fatalf("close portal: %v", err)
+	}
+	if _, err := store.PendingClaims(portal.ID); !errors.Is(err, ErrPortalClosed) {
+		t.Fatalf("expected a closed portal to report it, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package control
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// CodeLookupWindow is how long code lookups are counted.
+	CodeLookupWindow = time.Minute
+	// maxCodeLookups is how many codes one address may try per window.
+	// Unknown codes from all addresses together are only counted for the
+	// logs, so one busy guesser cannot lock everyone else out.
+	maxCodeLookups = 10
+)
+
+var ErrCodeLookups = errors.New("too many code lookups")
+
+// Code words are short, common and spelled the way they sound, with no two
+// words alike enough to be misheard. Together with the two-digit suffix
+// they give 100 * 100 * 90 codes.
+var (
+	codeAdjectives = [...]string{
+		"amber", "azure", "bold", "brave", "brisk", "bright", "calm", "candid", "cheery", "chilly",
+		"clever", "cosy", "crisp", "curly", "daring", "dusty", "eager", "early", "easy", "fancy",
+		"fast", "fierce", "fluffy", "fond", "frosty", "funny", "fuzzy", "gentle", "giant", "glad",
+		"golden", "grand", "happy", "hardy", "hasty", "humble", "icy", "jolly", "jumpy", "keen",
+		"kind", "lazy", "lemon", "little", "lively", "loud", "lucky", "lunar", "magic", "mellow",
+		"merry", "mighty", "misty", "modest", "noble", "olive", "orange", "plain", "plucky", "polite",
+		"proud", "purple", "quick", "quiet", "rapid", "rosy", "royal", "rusty", "sandy", "shiny",
+		"silent", "silver", "simple", "sleepy", "slow", "smart", "smooth", "snowy", "solar", "sparkly",
+		"speedy", "spicy", "steady", "stormy", "sunny", "sweet", "swift", "tidy", "tiny", "topaz",
+		"tough", "violet", "warm", "wavy", "wild", "windy", "wise", "witty", "young", "zesty",
+	}
+	codeNouns = [...]string{
+		"badger", "beaver", "bison", "bobcat", "camel", "canary", "cheetah", "cobra", "condor", "coyote",
+		"crane", "cricket", "dingo", "dolphin", "donkey", "eagle", "falcon", "ferret", "finch", "flamingo",
+		"gecko", "gerbil", "gibbon", "giraffe", "goose", "gopher", "gorilla", "hamster", "hedgehog", "heron",
+		"hippo", "hornet", "husky", "iguana", "impala", "jackal", "jaguar", "kitten", "koala", "lemur",
+		"leopard", "lizard", "llama", "lobster", "magpie", "mammoth", "marmot", "meerkat", "mole", "monkey",
+		"moose", "narwhal", "newt", "ocelot", "octopus", "oriole", "osprey", "otter", "owl", "panda",
+		"panther", "parrot", "pelican", "penguin", "pigeon", "puffin", "puma", "python", "quail", "rabbit",
+		"raccoon", "raven", "robin", "salmon", "seal", "shark", "sloth", "spider", "squid", "stork",
+		"swan", "tapir", "tiger", "toucan", "turkey", "turtle", "viper", "walrus", "weasel", "whale",
+		"wombat", "yak", "zebra", "alpaca", "beetle", "buffalo", "chipmunk", "dragon", "kiwi", "mongoose",
+	}
+)
+
+// NormalizeCode turns a code as someone typed it into the form it was
+// issued in: lower case, words separated by single hyphens.
+func NormalizeCode(code string) string {
+	fields := strings.FieldsFunc(strings.ToLower(code), func(r rune) bool {
+		return r == '-' || r == '_' || r == '.' || r == ' ' || r == '\t'
+	})
+	return strings.Join(fields, "-")
+}
+
+// PortalByCode finds the open portal a code was issued to. Lookups from
+// remoteAddr, or from its /64 for IPv6, are limited per window; past the
+// limit every lookup from it fails with ErrCodeLookups.
+func (s *Store) PortalByCode(code, remoteAddr string) (Portal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	key := addressKey(remoteAddr)
+	if s.codeLookups.count(key, now) >= maxCodeLookups {
+		return Portal{}, ErrCodeLookups
+	}
+	s.codeLookups.add(key, now, 1)
+
+	portal, ok := s.portals[s.codes[NormalizeCode(code)]]
+	if ok {
+		updated, changed := s.refreshPortalLocked(portal, now)
+		if changed {
+			portal = updated
+			s.setPortalLocked(portal)
+		}
+	}
+	if !ok || portal.State == PortalClosed || portal.State == PortalExpired || portal.State == PortalClosing {
+		s.codeLookups.add("", now, 1)
+		return Portal{}, ErrPortalNotFound
+	}
+	return portal, nil
+}
+
+// FailedCodeLookups reports how many unknown codes were entered from all
+// addresses together within the current window.
+func (s *Store) FailedCodeLookups() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.codeLookups.count("", time.Now())
+}
+
+// SweepAttempts forgets lookup counts whose window ended before now and
+// passphrase failures old enough to be forgiven, so addresses that never
+// come back do not pile up.
+func (s *Store) SweepAttempts(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codeLookups.prune(now)
+	s.passphraseFailures.prune(now)
+}
+
+// issueCodeLocked picks a code no open portal holds and assigns it to
+// portalID. Codes of closed portals are reused.
+func (s *Store) issueCodeLocked(portalID string) (string, error) {
+	for attempt := 0; attempt < 20; attempt++ {
+		code, err := newPortalCode()
+		if err != nil {
+			return "", err
+		}
+		if holder, ok := s.portals[s.codes[code]]; ok && holder.State != PortalClosed && holder.State != PortalExpired {
+			continue
+		}
+		s.codes[code] = portalID
+		return code, nil
+	}
+	return "", errors.New("no free portal code")
+}
+
+func newPortalCode() (string, error) {
+	pick := func(n int) (int, error) {
+		v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+		if err != nil {
+			return 0, fmt.Errorf("generate portal code: %w", err)
+		}
+		return int(v.Int64()), nil
+	}
+	adjective, err := pick(len(codeAdjectives))
+	if err != nil {
+		return "", err
+	}
+	noun, err := pick(len(codeNouns))
+	if err != nil {
+		return "", err
+	}
+	number, err := pick(90)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%d", codeAdjectives[adjective], codeNouns[noun], number+10), nil
+}
@@ -0,0 +1,106 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCodeWordsAreDistinct(t *testing.T) {
+	seen := map[string]bool{}
+	for _, word := range append(codeAdjectives[:], codeNouns[:]...) {
+		if seen[word] || !regexp.MustCompile(`^[a-z]+$`).MatchString(word) {
+			t.Fatalf("code word %q is repeated or not plain lower case", word)
+		}
+		seen[word] = true
+	}
+}
+
+func TestPortalByCode(t *testing.T) {
+	store := NewStore()
+	portal, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	if !regexp.MustCompile(`^[a-z]+-[a-z]+-[1-9][0-9]$`).MatchString(portal.Code) {
+		t.Fatalf("unexpected code %q", portal.Code)
+	}
+
+	typed := "  " + strings.ToUpper(strings.ReplaceAll(portal.Code, "-", " ")) + " "
+	if found, err := store.PortalByCode(typed, "192.0.2.10"); err != nil || found.ID != portal.ID {
+		t.Fatalf("expected %q to find the portal, got %+v: %v", typed, found, err)
+	}
+	if _, err := store.PortalByCode("no-such-code-10", "192.0.2.10"); !errors.Is(err, ErrPortalNotFound) {
+		t.Fatalf("expected ErrPortalNotFound, got %v", err)
+	}
+
+	if _, err := store.ClosePortal(portal.ID); err != nil {
+		t.Fatalf("close portal: %v", err)
+	}
+	if _, err := store.PortalByCode(portal.Code, "192.0.2.10"); !errors.Is(err, ErrPortalNotFound) {
+		t.Fatalf("expected a closed portal's code to stop working, got %v", err)
+	}
+}
+
+func TestPortalByCodeLimitsLookups(t *testing.T) {
+	store := NewStore()
+	portal, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	for i := 0; i < maxCodeLookups; i++ {
+		_, _ = store.PortalByCode("no-such-code-10", "192.0.2.10")
+	}
+	if _, err := store.PortalByCode(portal.Code, "192.0.2.10"); !errors.Is(err, ErrCodeLookups) {
+		t.Fatalf("expected the address to be limited, got %v", err)
+	}
+	if _, err := store.PortalByCode(portal.Code, "198.51.100.7"); err != nil {
+		t.Fatalf("expected another address to get through, got %v", err)
+	}
+
+	for i := 0; i < 2*maxCodeLookups; i++ {
+		_, _ = store.PortalByCode("no-such-code-10", fmt.Sprintf("203.0.113.%d", i))
+	}
+	if _, err := store.PortalByCode(portal.Code, "198.51.100.8"); err != nil {
+		t.Fatalf("expected unknown codes from other addresses not to lock this one out, got %v", err)
+	}
+	if got := store.FailedCodeLookups(); got != 3*maxCodeLookups {
+		t.Fatalf("expected %d failed lookups to be counted, got %d", 3*maxCodeLookups, got)
+	}
+}
+
+func TestPortalByCodeLimitsIPv6ByPrefix(t *testing.T) {
+	store := NewStore()
+	portal, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	// Each lookup comes from a new address in the same /64.
+	for i := 0; i < maxCodeLookups; i++ {
+		_, _ = store.PortalByCode("no-such-code-10", fmt.Sprintf("2001:db8:1:2::%x", i+1))
+	}
+	if _, err := store.PortalByCode(portal.Code, "2001:db8:1:2:ffff::1"); !errors.Is(err, ErrCodeLookups) {
+		t.Fatalf("expected the /64 to be limited, got %v", err)
+	}
+	if _, err := store.PortalByCode(portal.Code, "2001:db8:1:3::1"); err != nil {
+		t.Fatalf("expected another /64 to get through, got %v", err)
+	}
+}
+
+func TestSweepAttemptsForgetsIdleAddresses(t *testing.T) {
+	store := NewStore()
+	for i := 0; i < 5; i++ {
+		_, _ = store.PortalByCode("no-such-code-10", fmt.Sprintf("192.0.2.%d", i))
+	}
+	store.SweepAttempts(time.Now())
+	if got := len(store.codeLookups.counts); got != 6 {
+		t.Fatalf("expected current windows to be kept, got %d keys", got)
+	}
+	store.SweepAttempts(time.Now().Add(CodeLookupWindow + time.Second))
+	if got := len(store.codeLookups.counts); got != 0 {
+		t.Fatalf("expected ended windows to be swept, got %d keys", got)
+	}
+}
@@ -0,0 +1,167 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var ErrFileTypeDenied = errors.New("file type not allowed")
+
+// FileTypes restricts what a portal accepts. Extensions are matched against
+// the file name at preflight and init; content types are matched against
+// what is sniffed from the uploaded bytes at commit, and with extension
+// rules the sniffed type must also agree with the name's extension. An
+// empty allow list allows everything, and a deny match always wins.
+type FileTypes struct {
+	AllowExtensions []string
+	DenyExtensions  []string
+	AllowTypes      []string
+	DenyTypes       []string
+}
+
+// ParseFileTypes normalizes the four lists: extensions lose a leading dot
+// and are lowercased ("PDF", ".pdf" and "pdf" are the same), content types
+// are lowercased and must look like "type/subtype" or "type/*".
+func ParseFileTypes(allowExtensions, denyExtensions, allowTypes, denyTypes []string) (FileTypes, error) {
+	var rules FileTypes
+	var err error
+	if rules.AllowExtensions, err = parseExtensions(allowExtensions); err != nil {
+		return FileTypes{}, err
+	}
+	if rules.DenyExtensions, err = parseExtensions(denyExtensions); err != nil {
+		return FileTypes{}, err
+	}
+	if rules.AllowTypes, err = parseContentTypes(allowTypes); err != nil {
+		return FileTypes{}, err
+	}
+	if rules.DenyTypes, err = parseContentTypes(denyTypes); err != nil {
+		return FileTypes{}, err
+	}
+	return rules, nil
+}
+
+func parseExtensions(values []string) ([]string, error) {
+	var out []string
+	for _, value := range values {
+		ext := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(value), "."))
+		if ext == "" {
+			continue
+		}
+		if strings.ContainsAny(ext, `/\`) || strings.HasSuffix(ext, ".") {
+			return nil, fmt.Errorf("invalid extension %q", value)
+		}
+		out = append(out, ext)
+	}
+	return out, nil
+}
+
+func parseContentTypes(values []string) ([]string, error) {
+	var out []string
+	for _, value := range values {
+		contentType := strings.ToLower(strings.TrimSpace(value))
+		if contentType == "" {
+			continue
+		}
+		major, minor, ok := strings.Cut(contentType, "/")
+		if !ok || major == "" || major == "*" || minor == "" || strings.ContainsAny(minor, "/; ") {
+			return nil, fmt.Errorf("invalid content type %q", value)
+		}
+		out = append(out, contentType)
+	}
+	return out, nil
+}
+
+// Empty reports whether the portal accepts every file.
+func (f FileTypes) Empty() bool {
+	return len(f.AllowExtensions) == 0 && len(f.DenyExtensions) == 0 &&
+		len(f.AllowTypes) == 0 && len(f.DenyTypes) == 0
+}
+
+// AllowsName checks relpath's file name against the extension lists.
+// Multi-part extensions such as "tar.gz" match too.
+func (f FileTypes) AllowsName(relpath string) bool {
+	name := strings.ToLower(path.Base(relpath))
+	if matchesExtension(name, f.DenyExtensions) {
+		return false
+	}
+	return len(f.AllowExtensions) == 0 || matchesExtension(name, f.AllowExtensions)
+}
+
+// AllowsContent checks a sniffed content type, parameters and all, against
+// the content type lists.
+func (f FileTypes) AllowsContent(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if matchesContentType(mediaType, f.DenyTypes) {
+		return false
+	}
+	return len(f.AllowTypes) == 0 || matchesContentType(mediaType, f.AllowTypes)
+}
+
+// sniffedTypes maps extensions whose content has a signature the sniffer
+// recognizes to the media type it reports for them. A name with one of
+// these extensions only passes extension rules if its bytes say the same.
+var sniffedTypes = map[string]string{
+	"jpg": "image/jpeg", "jpeg": "image/jpeg", "jpe": "image/jpeg", "jfif": "image/jpeg",
+	"png": "image/png", "gif": "image/gif", "webp": "image/webp", "bmp": "image/bmp",
+	"ico": "image/x-icon", "pdf": "application/pdf", "ps": "application/postscript",
+	"zip": "application/zip", "docx": "application/zip", "xlsx": "application/zip",
+	"pptx": "application/zip", "odt": "application/zip", "ods": "application/zip",
+	"odp": "application/zip", "epub": "application/zip", "jar": "application/zip",
+	"apk": "application/zip", "gz": "application/x-gzip", "tgz": "application/x-gzip",
+	"rar": "application/x-rar-compressed", "wasm": "application/wasm",
+	"mp4": "video/mp4", "m4v": "video/mp4", "webm": "video/webm", "avi": "video/avi",
+	"wav": "audio/wave", "ogg": "application/ogg", "oga": "application/ogg",
+	"ogv": "application/ogg", "opus": "application/ogg", "mid": "audio/midi",
+	"midi": "audio/midi", "ttf": "font/ttf", "otf": "font/otf", "woff": "font/woff",
+	"woff2": "font/woff2", "txt": "text/*",
+	"csv": "text/*", "tsv": "text/*", "md": "text/*", "log": "text/*",
+}
+
+// NameMatchesContent reports whether a sniffed content type agrees with
+// relpath's extension, so a renamed executable cannot pass extension rules.
+// Without extension rules, or for an extension the sniffer has no signature
+// for, any content matches.
+func (f FileTypes) NameMatchesContent(relpath, contentType string) bool {
+	if len(f.AllowExtensions) == 0 && len(f.DenyExtensions) == 0 {
+		return true
+	}
+	name := strings.ToLower(path.Base(relpath))
+	dot := strings.LastIndexByte(name, '.')
+	if dot <= 0 {
+		return true
+	}
+	want, ok := sniffedTypes[name[dot+1:]]
+	if !ok {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return matchesContentType(strings.ToLower(strings.TrimSpace(mediaType)), []string{want})
+}
+
+func matchesExtension(name string, exts []string) bool {
+	for _, ext := range exts {
+		// A dotfile such as ".pdf" has no extension, only a name.
+		if len(name) > len(ext)+1 && strings.HasSuffix(name, "."+ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesContentType(mediaType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+			continue
+		}
+		if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
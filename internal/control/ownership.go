@@ -0,0 +1,44 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+var ErrGroupUnknown = errors.New("group not found")
+
+// ParseMode reads permission bits written in octal, such as "0664" or
+// "664". Special bits are refused; setgid on directories comes from
+// inheritance instead. Empty means unset and returns 0.
+func ParseMode(value, field string) (os.FileMode, error) {
+	trimmed := strings.TrimSpace(value)
+	if trimmed == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(trimmed, 8, 32)
+	if err != nil || mode == 0 || mode > 0o777 {
+		return 0, fmt.Errorf("%s must be octal permission bits between 0001 and 0777", field)
+	}
+	return os.FileMode(mode), nil
+}
+
+// LookupGroup resolves a group name or numeric gid.
+func LookupGroup(group string) (int, error) {
+	trimmed := strings.TrimSpace(group)
+	if gid, err := strconv.Atoi(trimmed); err == nil && gid >= 0 {
+		return gid, nil
+	}
+	found, err := user.LookupGroup(trimmed)
+	if err != nil {
+		return -1, fmt.Errorf("%w: %s", ErrGroupUnknown, trimmed)
+	}
+	gid, err := strconv.Atoi(found.Gid)
+	if err != nil {
+		return -1, fmt.Errorf("%w: %s", ErrGroupUnknown, trimmed)
+	}
+	return gid, nil
+}
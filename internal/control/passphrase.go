@@ -0,0 +1,143 @@
+package control
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	minPassphraseLength = 4
+	maxPassphraseLength = 256
+	passphraseSaltSize  = 16
+	// passphraseIterations makes each guess cost a few milliseconds of
+	// PBKDF2-HMAC-SHA256, on top of the attempt limits below.
+	passphraseIterations = 100_000
+
+	// freePassphraseFailures is how many wrong guesses one address may make
+	// in a row before it has to wait: a minute, then twice as long after
+	// each further wrong guess, up to an hour. An address is forgotten a
+	// day after its last wrong guess. Addresses are limited one by one, so
+	// nobody can lock the recipient out by guessing from elsewhere.
+	freePassphraseFailures  = 5
+	passphraseDelay         = time.Minute
+	maxPassphraseDelay      = time.Hour
+	passphraseFailureMemory = 24 * time.Hour
+)
+
+var (
+	ErrPassphraseInvalid  = fmt.Errorf("passphrase must be %d to %d characters", minPassphraseLength, maxPassphraseLength)
+	ErrPassphraseRequired = errors.New("passphrase required")
+	ErrPassphraseWrong    = errors.New("wrong passphrase")
+	ErrPassphraseAttempts = errors.New("too many passphrase attempts")
+)
+
+// PassphraseAttemptsError is ErrPassphraseAttempts with how long the
+// address has to wait before its next guess.
+type PassphraseAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *PassphraseAttemptsError) Error() string {
+	return ErrPassphraseAttempts.Error()
+}
+
+func (e *PassphraseAttemptsError) Unwrap() error {
+	return ErrPassphraseAttempts
+}
+
+// PassphraseHash is a portal's passphrase or PIN as stored: salted
+// PBKDF2-HMAC-SHA256. The zero value means the portal has none.
+type PassphraseHash struct {
+	Salt []byte
+	Sum  []byte
+}
+
+func (h PassphraseHash) IsSet() bool {
+	return len(h.Sum) > 0
+}
+
+// ValidatePassphrase checks a passphrase before a portal is created with it.
+func ValidatePassphrase(passphrase string) error {
+	if n := utf8.RuneCountInString(passphrase); n < minPassphraseLength || len(passphrase) > maxPassphraseLength {
+		return ErrPassphraseInvalid
+	}
+	return nil
+}
+
+func hashPassphrase(passphrase string) (PassphraseHash, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return PassphraseHash{}, fmt.Errorf("generate passphrase salt: %w", err)
+	}
+	return PassphraseHash{Salt: salt, Sum: pbkdf2SHA256([]byte(passphrase), salt, passphraseIterations)}, nil
+}
+
+func (h PassphraseHash) matches(passphrase string) bool {
+	sum := pbkdf2SHA256([]byte(passphrase), h.Salt, passphraseIterations)
+	return subtle.ConstantTimeCompare(sum, h.Sum) == 1
+}
+
+// pbkdf2SHA256 derives one 32-byte block, as in RFC 8018.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+// CheckPassphrase lets a claim from remoteAddr through if the portal has no
+// passphrase or passphrase matches it. Wrong guesses are counted per
+// address, or per /64 for IPv6; while an address has to wait, every attempt from it fails with a
+// *PassphraseAttemptsError, right passphrase or not.
+func (s *Store) CheckPassphrase(portalID, remoteAddr, passphrase string) error {
+	s.mu.Lock()
+	portal, ok := s.portals[portalID]
+	if !ok {
+		s.mu.Unlock()
+		return ErrPortalNotFound
+	}
+	if !portal.Passphrase.IsSet() {
+		s.mu.Unlock()
+		return nil
+	}
+	if passphrase == "" {
+		s.mu.Unlock()
+		return ErrPassphraseRequired
+	}
+	key := portalID + " " + addressKey(remoteAddr)
+	now := time.Now()
+	if wait := s.passphraseFailures.wait(key, now); wait > 0 {
+		s.mu.Unlock()
+		return &PassphraseAttemptsError{RetryAfter: wait}
+	}
+	// Every attempt counts as a failure until it is known to be right, so
+	// guesses sent in parallel cannot get past the delays.
+	s.passphraseFailures.fail(key, now)
+	s.mu.Unlock()
+
+	// Hashing is slow on purpose, so it runs outside the lock.
+	if !portal.Passphrase.matches(passphrase) {
+		return ErrPassphraseWrong
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passphraseFailures.reset(key)
+	return nil
+}
@@ -0,0 +1,137 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCheckPassphraseLimitsGuesses(t *testing.T) {
+	store := NewStore()
+	portal, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir(), Reusable: true, Passphrase: "4821"})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	if string(portal.Passphrase.Sum) == "4821" || !portal.Passphrase.IsSet() {
+		t.Fatalf("expected the passphrase to be stored hashed, got %+v", portal.Passphrase)
+	}
+
+	if err := store.CheckPassphrase(portal.ID, "192.0.2.10", ""); !errors.Is(err, ErrPassphraseRequired) {
+		t.Fatalf("expected ErrPassphraseRequired, got %v", err)
+	}
+	if err := store.CheckPassphrase(portal.ID, "192.0.2.10", "4821"); err != nil {
+		t.Fatalf("expected the right passphrase to pass, got %v", err)
+	}
+	for i := 0; i < freePassphraseFailures; i++ {
+		if err := store.CheckPassphrase(portal.ID, "192.0.2.10", "0000"); !errors.Is(err, ErrPassphraseWrong) {
+			t.Fatalf("expected ErrPassphraseWrong, got %v", err)
+		}
+	}
+	var attempts *PassphraseAttemptsError
+	if err := store.CheckPassphrase(portal.ID, "192.0.2.10", "4821"); !errors.As(err, &attempts) || attempts.RetryAfter <= 0 || attempts.RetryAfter > passphraseDelay {
+		t.Fatalf("expected the address to have to wait, got %v", err)
+	}
+	if err := store.CheckPassphrase(portal.ID, "198.51.100.7", "4821"); err != nil {
+		t.Fatalf("expected another address to get through, got %v", err)
+	}
+
+	other, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir()})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	if err := store.CheckPassphrase(other.ID, "192.0.2.10", "anything"); err != nil {
+		t.Fatalf("expected a portal without passphrase to let claims through, got %v", err)
+	}
+}
+
+func TestCheckPassphraseGuessesElsewhereDoNotLockOut(t *testing.T) {
+	store := NewStore()
+	portal, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir(), Passphrase: "correct horse"})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := store.CheckPassphrase(portal.ID, fmt.Sprintf("192.0.2.%d", i), "wrong"); !errors.Is(err, ErrPassphraseWrong) {
+			t.Fatalf("expected ErrPassphraseWrong, got %v", err)
+		}
+	}
+	if err := store.CheckPassphrase(portal.ID, "203.0.113.1", "correct horse"); err != nil {
+		t.Fatalf("expected the recipient to get through, got %v", err)
+	}
+}
+
+func TestCheckPassphraseLimitsIPv6ByPrefix(t *testing.T) {
+	store := NewStore()
+	portal, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir(), Passphrase: "4821"})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	// Each guess comes from a new address in the same /64.
+	for i := 0; i < freePassphraseFailures; i++ {
+		if err := store.CheckPassphrase(portal.ID, fmt.Sprintf("2001:db8:1:2::%x", i+1), "0000"); !errors.Is(err, ErrPassphraseWrong) {
+			t.Fatalf("expected ErrPassphraseWrong, got %v", err)
+		}
+	}
+	var attempts *PassphraseAttemptsError
+	if err := store.CheckPassphrase(portal.ID, "2001:db8:1:2:ffff::1", "4821"); !errors.As(err, &attempts) {
+		t.Fatalf("expected the /64 to wait, got %v", err)
+	}
+	if err := store.CheckPassphrase(portal.ID, "2001:db8:1:3::1", "4821"); err != nil {
+		t.Fatalf("expected another /64 to get through, got %v", err)
+	}
+}
+
+func TestSweepAttemptsForgetsOldFailures(t *testing.T) {
+	store := NewStore()
+	portal, err := store.CreatePortal(CreatePortalInput{DestAbs: t.TempDir(), Passphrase: "4821"})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		_ = store.CheckPassphrase(portal.ID, fmt.Sprintf("192.0.2.%d", i), "0000")
+	}
+	store.SweepAttempts(time.Now())
+	if got := len(store.passphraseFailures.failures); got != 5 {
+		t.Fatalf("expected recent failures to be kept, got %d keys", got)
+	}
+	store.SweepAttempts(time.Now().Add(passphraseFailureMemory + time.Second))
+	if got := len(store.passphraseFailures.failures); got != 0 {
+		t.Fatalf("expected old failures to be swept, got %d keys", got)
+	}
+}
+
+func TestFailureDelayGrows(t *testing.T) {
+	delay := newFailureDelay(2, time.Minute, 10*time.Minute, time.Hour)
+	now := time.Now()
+	waits := make([]time.Duration, 0, 7)
+	for i := 0; i < 7; i++ {
+		waits = append(waits, delay.wait("a", now))
+		delay.fail("a", now)
+	}
+	if fmt.Sprint(waits) != "[0s 0s 1m0s 2m0s 4m0s 8m0s 10m0s]" {
+		t.Fatalf("unexpected waits %v", waits)
+	}
+	if wait := delay.wait("a", now.Add(4*time.Minute)); wait != 6*time.Minute {
+		t.Fatalf("expected the wait to count from the last failure, got %v", wait)
+	}
+	if wait := delay.wait("b", now); wait != 0 {
+		t.Fatalf("expected other keys to be unaffected, got %v", wait)
+	}
+	if wait := delay.wait("a", now.Add(2*time.Hour)); wait != 0 {
+		t.Fatalf("expected the key to be forgotten, got %v", wait)
+	}
+}
+
+func TestValidatePassphrase(t *testing.T) {
+	for _, valid := range []string{"1234", "correct horse battery staple", "ключ"} {
+		if err := ValidatePassphrase(valid); err != nil {
+			t.Fatalf("unexpected error for %q: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"", "123"} {
+		if err := ValidatePassphrase(invalid); !errors.Is(err, ErrPassphraseInvalid) {
+			t.Fatalf("expected ErrPassphraseInvalid for %q, got %v", invalid, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package control
+
+import (
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PolicyOverwrite       = "overwrite"
+	PolicyAutorename      = "autorename"
+	PolicySkip            = "skip"
+	PolicyFail            = "fail"
+	PolicySkipIfIdentical = "skip-if-identical"
+)
+
+const (
+	RenameTemplateTimestamp = "{name}_{timestamp}{ext}"
+	RenameTemplateNumbered  = "{name} ({n}){ext}"
+)
+
+// Case modes decide whether relpaths differing only in case name the same
+// file. Auto probes the destination filesystem.
+const (
+	CaseModeAuto        = "auto"
+	CaseModeSensitive   = "sensitive"
+	CaseModeInsensitive = "insensitive"
+)
+
+// Folder policies decide what happens when a dropped folder already exists
+// at the top of the destination: merge leaves each file to the conflict
+// policy, autorename moves the whole batch into "name (2)" and so on.
+const (
+	FolderPolicyMerge      = "merge"
+	FolderPolicyAutorename = "autorename"
+)
+
+const renameTimestampLayout = "2006-01-02_150405"
+
+var ErrRenameTemplateInvalid = errors.New("rename_template must contain {name} and {n} or {timestamp}, and no path separators")
+
+func NormalizePolicy(policy string) (string, error) {
+	trimmed := strings.TrimSpace(strings.ToLower(policy))
+	if trimmed == "" {
+		return PolicyOverwrite, nil
+	}
+
+	switch trimmed {
+	case PolicyOverwrite, PolicyAutorename, PolicySkip, PolicyFail, PolicySkipIfIdentical:
+		return trimmed, nil
+	default:
+		return "", errors.New("policy must be overwrite, autorename, skip, fail, or skip-if-identical")
+	}
+}
+
+func NormalizeCaseMode(mode string) (string, error) {
+	trimmed := strings.TrimSpace(strings.ToLower(mode))
+	switch trimmed {
+	case "":
+		return CaseModeAuto, nil
+	case CaseModeAuto, CaseModeSensitive, CaseModeInsensitive:
+		return trimmed, nil
+	default:
+		return "", errors.New("case_mode must be auto, sensitive, or insensitive")
+	}
+}
+
+func NormalizeFolderPolicy(policy string) (string, error) {
+	trimmed := strings.TrimSpace(strings.ToLower(policy))
+	switch trimmed {
+	case "":
+		return FolderPolicyMerge, nil
+	case FolderPolicyMerge, FolderPolicyAutorename:
+		return trimmed, nil
+	default:
+		return "", errors.New("folder_policy must be merge or autorename")
+	}
+}
+
+// NormalizeRenameTemplate accepts the preset names "timestamp" and "numbered"
+// or a custom template built from {name}, {ext}, {timestamp} and {n}. A
+// custom template needs {name} and at least one of {n} or {timestamp}, so
+// its first candidate always differs from the original name.
+func NormalizeRenameTemplate(template string) (string, error) {
+	trimmed := strings.TrimSpace(template)
+	switch strings.ToLower(trimmed) {
+	case "", "timestamp":
+		return RenameTemplateTimestamp, nil
+	case "numbered":
+		return RenameTemplateNumbered, nil
+	}
+
+	if !strings.Contains(trimmed, "{name}") {
+		return "", ErrRenameTemplateInvalid
+	}
+	if !strings.Contains(trimmed, "{n}") && !strings.Contains(trimmed, "{timestamp}") {
+		return "", ErrRenameTemplateInvalid
+	}
+	if strings.ContainsAny(trimmed, "/\\\x00") {
+		return "", ErrRenameTemplateInvalid
+	}
+
+	return trimmed, nil
+}
+
+// RenameCandidate returns the attempt-th (starting at 1) autorename candidate
+// for relpath. Templates without {n} get a "_2", "_3", ... suffix before the
+// extension once the first candidate is taken.
+func RenameCandidate(template, relpath string, now time.Time, attempt int) string {
+	if template == "" {
+		template = RenameTemplateTimestamp
+	}
+
+	dir, base := path.Split(relpath)
+	ext := path.Ext(base)
+	if ext == base {
+		// A dotfile such as ".bashrc" is all name and no extension.
+		ext = ""
+	}
+	name := strings.TrimSuffix(base, ext)
+
+	if !strings.Contains(template, "{n}") && attempt > 1 {
+		if strings.Contains(template, "{ext}") {
+			template = strings.Replace(template, "{ext}", "_{n}{ext}", 1)
+		} else {
+			template += "_{n}"
+		}
+	}
+
+	candidate := strings.NewReplacer(
+		"{name}", name,
+		"{ext}", ext,
+		"{timestamp}", now.Format(renameTimestampLayout),
+		"{n}", strconv.Itoa(attempt),
+	).Replace(template)
+
+	return path.Join(dir, candidate)
+}
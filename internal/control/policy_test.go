@@ -0,0 +1,231 @@
+package control
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNormalizePolicyAcceptsAllPolicies(t *testing.T) {
+	accepts := map[string]string{
+		"":                  PolicyOverwrite,
+		"Overwrite":         PolicyOverwrite,
+		"autorename":        PolicyAutorename,
+		" skip ":            PolicySkip,
+		"fail":              PolicyFail,
+		"SKIP-IF-IDENTICAL": PolicySkipIfIdentical,
+	}
+
+	for input, expected := range accepts {
+		result, err := NormalizePolicy(input)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", input, err)
+		}
+		if result != expected {
+			t.Fatalf("expected %q for %q, got %q", expected, input, result)
+		}
+	}
+
+	if _, err := NormalizePolicy("merge"); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+}
+
+func TestNormalizeRenameTemplate(t *testing.T) {
+	presets := map[string]string{
+		"":                    RenameTemplateTimestamp,
+		"timestamp":           RenameTemplateTimestamp,
+		"Numbered":            RenameTemplateNumbered,
+		"{name}-copy{n}{ext}": "{name}-copy{n}{ext}",
+	}
+	for input, expected := range presets {
+		result, err := NormalizeRenameTemplate(input)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", input, err)
+		}
+		if result != expected {
+			t.Fatalf("expected %q for %q, got %q", expected, input, result)
+		}
+	}
+
+	rejects := []string{"copy{ext}", "{name}/x{ext}", "..\\{name}", "{name}", "{name}-copy{ext}"}
+	for _, input := range rejects {
+		if _, err := NormalizeRenameTemplate(input); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestRenameCandidate(t *testing.T) {
+	now := time.Date(2024, 3, 9, 14, 5, 6, 0, time.UTC)
+	cases := []struct {
+		template string
+		relpath  string
+		attempt  int
+		expected string
+	}{
+		{RenameTemplateTimestamp, "a/report.pdf", 1, "a/report_2024-03-09_140506.pdf"},
+		{RenameTemplateTimestamp, "a/report.pdf", 3, "a/report_2024-03-09_140506_3.pdf"},
+		{RenameTemplateNumbered, "report.pdf", 1, "report (1).pdf"},
+		{RenameTemplateNumbered, "photos/img.tar.gz", 2, "photos/img.tar (2).gz"},
+		{"{name}-copy-{timestamp}", "notes.txt", 2, "notes-copy-2024-03-09_140506_2"},
+		{RenameTemplateNumbered, "home/.bashrc", 1, "home/.bashrc (1)"},
+		{RenameTemplateTimestamp, ".env.local", 1, ".env_2024-03-09_140506.local"},
+	}
+
+	for _, tc := range cases {
+		result := RenameCandidate(tc.template, tc.relpath, now, tc.attempt)
+		if result != tc.expected {
+			t.Fatalf("expected %q for %q attempt %d, got %q", tc.expected, tc.relpath, tc.attempt, result)
+		}
+	}
+}
+
+func TestNormalizeCaseMode(t *testing.T) {
+	accepts := map[string]string{
+		"":            CaseModeAuto,
+		"Auto":        CaseModeAuto,
+		"sensitive":   CaseModeSensitive,
+		"INSENSITIVE": CaseModeInsensitive,
+	}
+	for input, expected := range accepts {
+		result, err := NormalizeCaseMode(input)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", input, err)
+		}
+		if result != expected {
+			t.Fatalf("expected %q for %q, got %q", expected, input, result)
+		}
+	}
+
+	if _, err := NormalizeCaseMode("fold"); err == nil {
+		t.Fatalf("expected error for unknown case mode")
+	}
+}
+
+func TestNormalizeFolderPolicy(t *testing.T) {
+	accepts := map[string]string{
+		"":           FolderPolicyMerge,
+		"Merge":      FolderPolicyMerge,
+		"autorename": FolderPolicyAutorename,
+	}
+	for input, expected := range accepts {
+		result, err := NormalizeFolderPolicy(input)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", input, err)
+		}
+		if result != expected {
+			t.Fatalf("expected %q for %q, got %q", expected, input, result)
+		}
+	}
+
+	if _, err := NormalizeFolderPolicy("overwrite"); err == nil {
+		t.Fatalf("expected error for unknown folder policy")
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	accepts := map[string]os.FileMode{
+		"":     0,
+		"0664": 0o664,
+		"770":  0o770,
+	}
+	for input, expected := range accepts {
+		result, err := ParseMode(input, "file_mode")
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", input, err)
+		}
+		if result != expected {
+			t.Fatalf("expected %o for %q, got %o", expected, input, result)
+		}
+	}
+
+	for _, input := range []string{"0", "2775", "0o644", "rw-r--r--", "888"} {
+		if _, err := ParseMode(input, "file_mode"); err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+	}
+}
+
+func TestLookupGroupAcceptsNumericGID(t *testing.T) {
+	gid, err := LookupGroup(strconv.Itoa(os.Getgid()))
+	if err != nil || gid != os.Getgid() {
+		t.Fatalf("expected gid %d, got %d (%v)", os.Getgid(), gid, err)
+	}
+	if _, err := LookupGroup("no-such-group-dropserve"); !errors.Is(err, ErrGroupUnknown) {
+		t.Fatalf("expected ErrGroupUnknown, got %v", err)
+	}
+}
+
+func TestFileTypesMatchNamesAndContent(t *testing.T) {
+	rules, err := ParseFileTypes([]string{".PDF", "tar.gz", "jpg"}, []string{"exe"}, []string{"application/pdf", "image/*"}, []string{"image/svg+xml"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	names := map[string]bool{
+		"docs/report.pdf":  true,
+		"Scan.PDF":         true,
+		"backup.tar.gz":    true,
+		"photo.jpg":        true,
+		"notes.txt":        false,
+		".pdf":             false,
+		"setup.exe":        false,
+		"archive.gz":       false,
+		"folder.pdf/x.txt": false,
+	}
+	for name, expected := range names {
+		if rules.AllowsName(name) != expected {
+			t.Fatalf("expected AllowsName(%q) = %v", name, expected)
+		}
+	}
+
+	contentTypes := map[string]bool{
+		"application/pdf":           true,
+		"image/png":                 true,
+		"image/svg+xml":             false,
+		"text/plain; charset=utf-8": false,
+		"application/octet-stream":  false,
+	}
+	for contentType, expected := range contentTypes {
+		if rules.AllowsContent(contentType) != expected {
+			t.Fatalf("expected AllowsContent(%q) = %v", contentType, expected)
+		}
+	}
+
+	agreements := []struct {
+		name, contentType string
+		expected          bool
+	}{
+		{"photo.jpg", "image/jpeg", true},
+		{"photo.JPG", "application/octet-stream", false},
+		{"report.pdf", "text/plain; charset=utf-8", false},
+		{"notes.txt", "text/plain; charset=utf-8", true},
+		{"backup.tar.gz", "application/x-gzip", true},
+		{"data.bin", "application/octet-stream", true},
+	}
+	for _, c := range agreements {
+		if rules.NameMatchesContent(c.name, c.contentType) != c.expected {
+			t.Fatalf("expected NameMatchesContent(%q, %q) = %v", c.name, c.contentType, c.expected)
+		}
+	}
+	if !(FileTypes{}).NameMatchesContent("photo.jpg", "application/octet-stream") {
+		t.Fatalf("expected names to go unchecked without extension rules")
+	}
+
+	if !(FileTypes{}).AllowsName("anything.exe") || !(FileTypes{}).AllowsContent("application/x-msdownload") {
+		t.Fatalf("expected empty rules to allow everything")
+	}
+	for _, bad := range [][]string{{"a/b"}, {"pdf."}} {
+		if _, err := ParseFileTypes(bad, nil, nil, nil); err == nil {
+			t.Fatalf("expected error for extension %q", bad)
+		}
+	}
+	for _, bad := range []string{"pdf", "*/*", "image/", "text/plain; charset=utf-8"} {
+		if _, err := ParseFileTypes(nil, nil, []string{bad}, nil); err == nil {
+			t.Fatalf("expected error for content type %q", bad)
+		}
+	}
+}
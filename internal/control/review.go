@@ -0,0 +1,32 @@
+package control
+
+import (
+	"errors"
+
+	"dropserve/internal/review"
+)
+
+var (
+	ErrReviewAtomicBatches = errors.New("review and atomic_batches cannot be combined")
+	ErrReviewDirUnset      = errors.New("review portals need DROPSERVE_REVIEW_DIR set on the server")
+)
+
+// ReviewListResponse lists uploads held for review, oldest first.
+type ReviewListResponse struct {
+	Items []review.Item `json:"items"`
+}
+
+// ReviewDecisionRequest optionally overrides the conflict policy an item
+// is approved with.
+type ReviewDecisionRequest struct {
+	Policy string `json:"policy,omitempty"`
+}
+
+// ReviewDecisionResponse reports what became of an item: "committed" or
+// "skipped" on approval, "rejected" on rejection.
+type ReviewDecisionResponse struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	Relpath      string `json:"relpath"`
+	FinalRelpath string `json:"final_relpath,omitempty"`
+}
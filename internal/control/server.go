@@ -6,13 +6,24 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
+
+	"dropserve/internal/config"
+	"dropserve/internal/webhooks"
 )
 
+var ErrWebhookOutboxUnset = errors.New("webhooks need DROPSERVE_WEBHOOK_OUTBOX set on the server")
+
 type Server struct {
-	store  *Store
-	logger *log.Logger
+	store        *Store
+	logger       *log.Logger
+	tempDirName  string
+	stagingRoots []string
+	reviewDir    string
+	outboxDir    string
 }
 
 type errorResponse struct {
@@ -22,13 +33,21 @@ type errorResponse struct {
 type requestIDKey struct{}
 
 func NewServer(store *Store, logger *log.Logger) *Server {
-	return &Server{store: store, logger: logger}
+	return &Server{
+		store:        store,
+		logger:       logger,
+		tempDirName:  config.TempDirName(),
+		stagingRoots: config.StagingRoots(),
+		reviewDir:    config.ReviewDir(),
+		outboxDir:    config.WebhookOutbox(),
+	}
 }
 
 func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/control/health", s.handleHealth)
 	mux.HandleFunc("/api/control/portals", s.handleCreatePortal)
+	mux.HandleFunc("/api/control/portals/", s.handlePortal)
 	return s.withRequestID(mux)
 }
 
@@ -66,11 +85,86 @@ func (s *Server) handleCreatePortal(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	renameTemplate, err := NormalizeRenameTemplate(req.RenameTemplate)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	caseMode, err := NormalizeCaseMode(req.CaseMode)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	folderPolicy, err := NormalizeFolderPolicy(req.FolderPolicy)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	fileMode, err := ParseMode(req.FileMode, "file_mode")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	dirMode, err := ParseMode(req.DirMode, "dir_mode")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Group) != "" {
+		if _, err := LookupGroup(req.Group); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+	}
+	fileTypes, err := ParseFileTypes(req.AllowExtensions, req.DenyExtensions, req.AllowTypes, req.DenyTypes)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	if err := webhooks.ValidateURL(req.WebhookURL); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.WebhookURL) != "" && s.outboxDir == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: ErrWebhookOutboxUnset.Error()})
+		return
+	}
+	if req.Review && req.AtomicBatches {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: ErrReviewAtomicBatches.Error()})
+		return
+	}
+	if req.Review && s.reviewDir == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: ErrReviewDirUnset.Error()})
+		return
+	}
+	if req.Passphrase != "" {
+		if err := ValidatePassphrase(req.Passphrase); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+	}
+
 	portal, err := s.store.CreatePortal(CreatePortalInput{
 		DestAbs:              req.DestAbs,
 		OpenMinutes:          req.OpenMinutes,
 		Reusable:             req.Reusable,
 		DefaultPolicy:        policy,
+		RenameTemplate:       renameTemplate,
+		CaseMode:             caseMode,
+		FolderPolicy:         folderPolicy,
+		AtomicBatches:        req.AtomicBatches,
+		FileMode:             fileMode,
+		DirMode:              dirMode,
+		Group:                req.Group,
+		FileTypes:            fileTypes,
+		WebhookURL:           req.WebhookURL,
+		WebhookSecret:        req.WebhookSecret,
+		Review:               req.Review,
+		ApproveClaims:        req.ApproveClaims,
+		Passphrase:           req.Passphrase,
 		AutorenameOnConflict: req.AutorenameOnConflict,
 	})
 	if err != nil {
@@ -79,13 +173,184 @@ func (s *Server) handleCreatePortal(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := CreatePortalResponse{
-		PortalID:  portal.ID,
-		ExpiresAt: portal.OpenUntil.Format(time.RFC3339),
+		PortalID:   portal.ID,
+		Code:       portal.Code,
+		ExpiresAt:  portal.OpenUntil.Format(time.RFC3339),
+		OwnerToken: portal.OwnerToken,
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handlePortal(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/control/portals/"), "/"), "/")
+	switch {
+	case len(segments) == 1 && segments[0] != "":
+		s.handlePortalStatus(w, r, segments[0])
+	case len(segments) == 2 && segments[1] == "close":
+		s.handleClosePortal(w, r, segments[0])
+	case len(segments) == 2 && segments[1] == "claims":
+		s.handlePendingClaims(w, r, segments[0])
+	case len(segments) == 4 && segments[1] == "claims" && (segments[3] == "approve" || segments[3] == "deny"):
+		s.handleDecideClaim(w, r, segments[0], segments[2], segments[3] == "approve")
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
+	}
+}
+
+func (s *Server) handlePortalStatus(w http.ResponseWriter, r *http.Request, portalID string) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	portal, err := s.store.PortalByID(portalID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrPortalNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
+		case errors.Is(err, ErrPortalClosed):
+			writeJSON(w, http.StatusGone, errorResponse{Error: "portal closed"})
+		default:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load portal"})
+		}
+		return
+	}
+
+	clients, err := s.store.PortalClients(portalID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load portal"})
+		return
+	}
+
+	resp := PortalStatusResponse{
+		PortalID:      portal.ID,
+		Code:          portal.Code,
+		State:         string(portal.State),
+		Reusable:      portal.Reusable,
+		ExpiresAt:     portal.OpenUntil.Format(time.RFC3339),
+		ActiveUploads: portal.ActiveUploads,
+		Clients:       make([]PortalClientResponse, 0, len(clients)),
+	}
+	for _, client := range clients {
+		resp.Clients = append(resp.Clients, PortalClientResponse{
+			ClientID:       client.ID,
+			ClaimedAt:      client.ClaimedAt.Format(time.RFC3339),
+			FilesCommitted: client.FilesCommitted,
+			BytesCommitted: client.BytesCommitted,
+		})
 	}
 
 	writeJSON(w, http.StatusOK, resp)
 }
 
+func (s *Server) handleClosePortal(w http.ResponseWriter, r *http.Request, portalID string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	portal, err := s.store.ClosePortal(portalID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrPortalNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
+		case errors.Is(err, ErrPortalClosed):
+			writeJSON(w, http.StatusGone, errorResponse{Error: "portal closed"})
+		default:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to close portal"})
+		}
+		return
+	}
+
+	if portal.State == PortalClosing && portal.ActiveUploads > 0 {
+		writeJSON(w, http.StatusConflict, errorResponse{Error: "portal has active uploads"})
+		return
+	}
+
+	if strings.TrimSpace(portal.DestAbs) != "" {
+		for _, portalPath := range PortalTempDirs(portal, s.tempDirName, s.stagingRoots) {
+			if err := os.RemoveAll(portalPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				s.logger.Printf("failed to remove portal temp dir: %v", err)
+			}
+		}
+		RemoveUnusedBatchFolders(s.store, portal)
+	}
+
+	writeJSON(w, http.StatusOK, ClosePortalResponse{Status: "closed"})
+}
+
+func (s *Server) handlePendingClaims(w http.ResponseWriter, r *http.Request, portalID string) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	claims, err := s.store.PendingClaims(portalID)
+	if err != nil {
+		if errors.Is(err, ErrPortalNotFound) {
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
+			return
+		}
+		if errors.Is(err, ErrPortalClosed) {
+			writeJSON(w, http.StatusGone, errorResponse{Error: "portal closed"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load claims"})
+		return
+	}
+
+	resp := PendingClaimsResponse{Claims: make([]PendingClaimResponse, 0, len(claims))}
+	for _, claim := range claims {
+		resp.Claims = append(resp.Claims, PendingClaimResponse{
+			ClaimID:     claim.ID,
+			Code:        claim.Code,
+			RemoteAddr:  claim.RemoteAddr,
+			UserAgent:   claim.UserAgent,
+			RequestedAt: claim.RequestedAt.Format(time.RFC3339),
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleDecideClaim(w http.ResponseWriter, r *http.Request, portalID, claimID string, approve bool) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	claim, err := s.store.DecideClaim(portalID, claimID, approve)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrClaimNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: err.Error()})
+		case errors.Is(err, ErrPortalNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
+		case errors.Is(err, ErrClaimDecided), errors.Is(err, ErrPortalAlreadyClaimed):
+			writeJSON(w, http.StatusConflict, errorResponse{Error: err.Error()})
+		case errors.Is(err, ErrPortalClosed):
+			writeJSON(w, http.StatusGone, errorResponse{Error: "portal closed"})
+		default:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to decide claim"})
+		}
+		return
+	}
+
+	s.logger.Printf("claim %s portal_id=%s claim_id=%s remote_addr=%s", claim.State, portalID, claim.ID, claim.RemoteAddr)
+	writeJSON(w, http.StatusOK, ClaimDecisionResponse{ClaimID: claim.ID, Status: string(claim.State), ClientID: claim.Result.ClientID})
+}
+
+// PortalTempDirs lists every place the portal's temp tree may live: under
+// the destination, or under whichever staging root the public server picked
+// for it.
+func PortalTempDirs(portal Portal, tempDirName string, stagingRoots []string) []string {
+	paths := []string{filepath.Join(portal.DestAbs, tempDirName, portal.ID)}
+	for _, root := range stagingRoots {
+		paths = append(paths, filepath.Join(root, tempDirName, portal.ID))
+	}
+	return paths
+}
+
 func (s *Server) withRequestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		requestID := r.Header.Get("X-Request-Id")
@@ -104,20 +369,6 @@ func newRequestID() string {
 	return "r_" + time.Now().UTC().Format("20060102T150405.000000000")
 }
 
-func NormalizePolicy(policy string) (string, error) {
-	trimmed := strings.TrimSpace(strings.ToLower(policy))
-	if trimmed == "" {
-		return "overwrite", nil
-	}
-
-	switch trimmed {
-	case "overwrite", "autorename":
-		return trimmed, nil
-	default:
-		return "", errors.New("policy must be overwrite or autorename")
-	}
-}
-
 func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -0,0 +1,123 @@
+package control
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestControlPortalStatusAndClose(t *testing.T) {
+	store := NewStore()
+	server := httptest.NewServer(NewServer(store, log.New(io.Discard, "", 0)).Handler())
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/api/control/portals", "application/json", strings.NewReader(`{"dest_abs":"`+t.TempDir()+`","reusable":true}`))
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	var created CreatePortalResponse
+	decodeJSON(t, resp, http.StatusOK, &created)
+	if !strings.HasPrefix(created.OwnerToken, "ot_") {
+		t.Fatalf("expected owner token, got %q", created.OwnerToken)
+	}
+
+	claim, err := store.ClaimPortal(created.PortalID)
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if _, err := store.CreateUpload(CreateUploadInput{PortalID: created.PortalID, ClientID: claim.ClientID, UploadID: "u1", Relpath: "a.txt", Size: 3}); err != nil {
+		t.Fatalf("create upload: %v", err)
+	}
+	if _, err := store.MarkUploadCommitted(created.PortalID, "u1", "sha", "a.txt", 3); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	resp, err = http.Get(server.URL + "/api/control/portals/" + created.PortalID)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	var status PortalStatusResponse
+	decodeJSON(t, resp, http.StatusOK, &status)
+	if len(status.Clients) != 1 || status.Clients[0].ClientID != claim.ClientID {
+		t.Fatalf("unexpected clients %+v", status.Clients)
+	}
+	if status.Clients[0].FilesCommitted != 1 || status.Clients[0].BytesCommitted != 3 {
+		t.Fatalf("unexpected accounting %+v", status.Clients[0])
+	}
+
+	resp, err = http.Post(server.URL+"/api/control/portals/"+created.PortalID+"/close", "application/json", nil)
+	if err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	decodeJSON(t, resp, http.StatusOK, nil)
+
+	if _, err := store.PortalByID(created.PortalID); err != ErrPortalClosed {
+		t.Fatalf("expected closed portal, got %v", err)
+	}
+}
+
+func decodeJSON(t *testing.T, resp *http.Response, status int, out interface{}) {
+	t.Helper()
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != status {
+		t.Fatalf("expected status %d, got %d: %s", status, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+}
+
+func TestReviewPortalsNeedReviewDir(t *testing.T) {
+	create := func() *http.Response {
+		t.Helper()
+		server := httptest.NewServer(NewServer(NewStore(), log.New(io.Discard, "", 0)).Handler())
+		defer server.Close()
+		resp, err := http.Post(server.URL+"/api/control/portals", "application/json", strings.NewReader(`{"dest_abs":"`+t.TempDir()+`","review":true}`))
+		if err != nil {
+			t.Fatalf("create portal: %v", err)
+		}
+		return resp
+	}
+
+	t.Setenv("DROPSERVE_REVIEW_DIR", "")
+	var refused errorResponse
+	decodeJSON(t, create(), http.StatusBadRequest, &refused)
+	if refused.Error != ErrReviewDirUnset.Error() {
+		t.Fatalf("unexpected error %q", refused.Error)
+	}
+
+	t.Setenv("DROPSERVE_REVIEW_DIR", t.TempDir())
+	decodeJSON(t, create(), http.StatusOK, nil)
+}
+
+func TestPortalWebhooksNeedOutbox(t *testing.T) {
+	create := func() *http.Response {
+		t.Helper()
+		server := httptest.NewServer(NewServer(NewStore(), log.New(io.Discard, "", 0)).Handler())
+		defer server.Close()
+		resp, err := http.Post(server.URL+"/api/control/portals", "application/json", strings.NewReader(`{"dest_abs":"`+t.TempDir()+`","webhook_url":"https://example.com/hook"}`))
+		if err != nil {
+			t.Fatalf("create portal: %v", err)
+		}
+		return resp
+	}
+
+	t.Setenv("DROPSERVE_WEBHOOK_OUTBOX", "")
+	var refused errorResponse
+	decodeJSON(t, create(), http.StatusBadRequest, &refused)
+	if refused.Error != ErrWebhookOutboxUnset.Error() {
+		t.Fatalf("unexpected error %q", refused.Error)
+	}
+
+	t.Setenv("DROPSERVE_WEBHOOK_OUTBOX", t.TempDir())
+	decodeJSON(t, create(), http.StatusOK, nil)
+}
@@ -2,9 +2,13 @@ package control
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base32"
 	"errors"
 	"fmt"
+	"maps"
+	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -18,9 +22,12 @@ var (
 	ErrPortalClosed           = errors.New("portal closed")
 	ErrClientTokenRequired    = errors.New("client token required")
 	ErrClientTokenInvalid     = errors.New("client token invalid")
+	ErrOwnerTokenRequired     = errors.New("owner token required")
+	ErrOwnerTokenInvalid      = errors.New("owner token invalid")
 	ErrUploadNotFound         = errors.New("upload not found")
 	ErrUploadAlreadyCommitted = errors.New("upload already committed")
 	ErrUploadAlreadyExists    = errors.New("upload already exists")
+	ErrUploadAmbiguous        = errors.New("upload id used by more than one portal")
 )
 
 type PortalState string
@@ -36,32 +43,64 @@ const (
 
 type Portal struct {
 	ID                   string
+	Code                 string
 	DestAbs              string
 	OpenUntil            time.Time
 	CreatedAt            time.Time
 	Reusable             bool
 	DefaultPolicy        string
+	RenameTemplate       string
+	CaseMode             string
+	FolderPolicy         string
+	AtomicBatches        bool
+	FileMode             os.FileMode
+	DirMode              os.FileMode
+	Group                string
+	FileTypes            FileTypes
+	WebhookURL           string
+	WebhookSecret        string
+	Review               bool
+	ApproveClaims        bool
+	Passphrase           PassphraseHash
 	AutorenameOnConflict bool
-	ClientTokens         map[string]struct{}
+	OwnerToken           string
+	ClientTokens         map[string]string
+	Clients              map[string]PortalClient
 	ActiveUploads        int
 	State                PortalState
 }
 
+// PortalClient is one claimed browser session and what it has committed.
+type PortalClient struct {
+	ID             string
+	ClaimedAt      time.Time
+	FilesCommitted int
+	BytesCommitted int64
+}
+
 type UploadStatus string
 
 const (
 	UploadWriting   UploadStatus = "writing"
+	UploadStaged    UploadStatus = "staged"
 	UploadCommitted UploadStatus = "committed"
+	UploadSkipped   UploadStatus = "skipped"
+	UploadHeld      UploadStatus = "held"
 	UploadFailed    UploadStatus = "failed"
 )
 
 type Upload struct {
 	ID            string
 	PortalID      string
+	ClientID      string
+	BatchID       string
 	Relpath       string
+	Dir           bool
 	Size          int64
 	ClientSHA256  string
 	Policy        string
+	LastModified  time.Time
+	Mode          os.FileMode
 	Status        UploadStatus
 	ServerSHA256  string
 	BytesReceived int64
@@ -76,31 +115,72 @@ type CreatePortalInput struct {
 	OpenMinutes          int
 	Reusable             bool
 	DefaultPolicy        string
+	RenameTemplate       string
+	CaseMode             string
+	FolderPolicy         string
+	AtomicBatches        bool
+	FileMode             os.FileMode
+	DirMode              os.FileMode
+	Group                string
+	FileTypes            FileTypes
+	WebhookURL           string
+	WebhookSecret        string
+	Review               bool
+	ApproveClaims        bool
+	Passphrase           string
 	AutorenameOnConflict bool
 }
 
 type CreateUploadInput struct {
 	PortalID     string
+	ClientID     string
+	BatchID      string
 	UploadID     string
 	Relpath      string
+	Dir          bool
 	Size         int64
 	ClientSHA256 string
 	Policy       string
+	LastModified time.Time
+	Mode         os.FileMode
 }
 
 type ClaimPortalResult struct {
 	Portal      Portal
+	ClientID    string
 	ClientToken string
 }
 
+// uploadKey namespaces upload IDs per portal so two portals can never
+// address, overwrite or observe each other's uploads.
+type uploadKey struct {
+	portalID string
+	uploadID string
+}
+
 type Store struct {
-	mu      sync.Mutex
-	portals map[string]Portal
-	uploads map[string]Upload
+	mu                 sync.Mutex
+	portals            map[string]Portal
+	uploads            map[uploadKey]Upload
+	batches            map[batchKey]Batch
+	claims             map[claimKey]ClaimRequest
+	codes              map[string]string
+	codeLookups        *attemptCounter
+	passphraseFailures *failureDelay
+	onClosed           func(Portal)
+	onFailed           func(Portal, Upload)
 }
 
 func NewStore() *Store {
-	return &Store{portals: make(map[string]Portal), uploads: make(map[string]Upload)}
+	return &Store{
+		portals:            make(map[string]Portal),
+		uploads:            make(map[uploadKey]Upload),
+		batches:            make(map[batchKey]Batch),
+		claims:             make(map[claimKey]ClaimRequest),
+		codes:              make(map[string]string),
+		codeLookups:        newAttemptCounter(CodeLookupWindow),
+		passphraseFailures: newFailureDelay(freePassphraseFailures, passphraseDelay, maxPassphraseDelay, passphraseFailureMemory),
+	}
 }
 
 func (s *Store) CreatePortal(input CreatePortalInput) (Portal, error) {
@@ -108,6 +188,18 @@ func (s *Store) CreatePortal(input CreatePortalInput) (Portal, error) {
 	if err != nil {
 		return Portal{}, err
 	}
+	ownerToken, err := newOwnerToken()
+	if err != nil {
+		return Portal{}, err
+	}
+
+	var passphrase PassphraseHash
+	if input.Passphrase != "" {
+		passphrase, err = hashPassphrase(input.Passphrase)
+		if err != nil {
+			return Portal{}, err
+		}
+	}
 
 	minutes := input.OpenMinutes
 	if minutes <= 0 {
@@ -122,14 +214,33 @@ func (s *Store) CreatePortal(input CreatePortalInput) (Portal, error) {
 		CreatedAt:            now,
 		Reusable:             input.Reusable,
 		DefaultPolicy:        input.DefaultPolicy,
+		RenameTemplate:       input.RenameTemplate,
+		CaseMode:             input.CaseMode,
+		FolderPolicy:         input.FolderPolicy,
+		AtomicBatches:        input.AtomicBatches,
+		FileMode:             input.FileMode,
+		DirMode:              input.DirMode,
+		Group:                strings.TrimSpace(input.Group),
+		FileTypes:            input.FileTypes,
+		WebhookURL:           strings.TrimSpace(input.WebhookURL),
+		WebhookSecret:        input.WebhookSecret,
+		Review:               input.Review,
+		ApproveClaims:        input.ApproveClaims,
+		Passphrase:           passphrase,
 		AutorenameOnConflict: input.AutorenameOnConflict,
-		ClientTokens:         make(map[string]struct{}),
+		OwnerToken:           ownerToken,
+		ClientTokens:         make(map[string]string),
+		Clients:              make(map[string]PortalClient),
 		State:                PortalOpen,
 	}
 
 	s.mu.Lock()
-	s.portals[id] = portal
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+	portal.Code, err = s.issueCodeLocked(portal.ID)
+	if err != nil {
+		return Portal{}, err
+	}
+	s.setPortalLocked(portal)
 
 	return portal, nil
 }
@@ -146,12 +257,17 @@ func (s *Store) ClaimPortal(id string) (ClaimPortalResult, error) {
 	updated, changed := s.refreshPortalLocked(portal, time.Now())
 	if changed {
 		portal = updated
-		s.portals[id] = portal
+		s.setPortalLocked(portal)
 	}
 	if portal.State == PortalClosed || portal.State == PortalExpired || portal.State == PortalClosing {
 		return ClaimPortalResult{}, ErrPortalClosed
 	}
 
+	return s.claimLocked(portal)
+}
+
+// claimLocked issues a client token for an open portal.
+func (s *Store) claimLocked(portal Portal) (ClaimPortalResult, error) {
 	if !portal.Reusable && len(portal.ClientTokens) > 0 {
 		return ClaimPortalResult{}, ErrPortalAlreadyClaimed
 	}
@@ -160,11 +276,19 @@ func (s *Store) ClaimPortal(id string) (ClaimPortalResult, error) {
 	if err != nil {
 		return ClaimPortalResult{}, err
 	}
+	clientID, err := newClientID()
+	if err != nil {
+		return ClaimPortalResult{}, err
+	}
 
 	if portal.ClientTokens == nil {
-		portal.ClientTokens = make(map[string]struct{})
+		portal.ClientTokens = make(map[string]string)
 	}
-	portal.ClientTokens[clientToken] = struct{}{}
+	if portal.Clients == nil {
+		portal.Clients = make(map[string]PortalClient)
+	}
+	portal.ClientTokens[clientToken] = clientID
+	portal.Clients[clientID] = PortalClient{ID: clientID, ClaimedAt: time.Now()}
 
 	if portal.Reusable {
 		if portal.State == PortalOpen {
@@ -174,50 +298,93 @@ func (s *Store) ClaimPortal(id string) (ClaimPortalResult, error) {
 		portal.State = PortalClaimed
 	}
 
-	s.portals[id] = portal
+	s.setPortalLocked(portal)
 
-	return ClaimPortalResult{Portal: portal, ClientToken: clientToken}, nil
+	return ClaimPortalResult{Portal: portal, ClientID: clientID, ClientToken: clientToken}, nil
 }
 
-func (s *Store) RequireClientToken(id, token string) error {
+// RequireClientToken checks token against the portal's claims and returns
+// the ID of the client it was issued to. One-time and reusable portals are
+// enforced the same way; reusable portals simply accept more than one claim.
+func (s *Store) RequireClientToken(id, token string) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	portal, ok := s.portals[id]
 	if !ok {
-		return ErrPortalNotFound
+		return "", ErrPortalNotFound
 	}
 
 	updated, changed := s.refreshPortalLocked(portal, time.Now())
 	if changed {
 		portal = updated
-		s.portals[id] = portal
+		s.setPortalLocked(portal)
 	}
 	if portal.State == PortalClosed || portal.State == PortalExpired {
-		return ErrPortalClosed
+		return "", ErrPortalClosed
 	}
 
-	if portal.Reusable {
-		return nil
+	if len(portal.ClientTokens) == 0 || token == "" {
+		return "", ErrClientTokenRequired
+	}
+
+	clientID, ok := portal.ClientTokens[token]
+	if !ok {
+		return "", ErrClientTokenInvalid
 	}
 
-	if !portal.Reusable && len(portal.ClientTokens) == 0 {
-		return ErrClientTokenRequired
+	return clientID, nil
+}
+
+// RequireOwner authorizes closing a portal from the public API. The owner
+// token issued at creation always qualifies; on a one-time portal the single
+// claiming client does too, since nobody else can use it.
+func (s *Store) RequireOwner(id, ownerToken, clientToken string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	portal, ok := s.portals[id]
+	if !ok {
+		return ErrPortalNotFound
 	}
 
-	if len(portal.ClientTokens) == 0 {
+	if ownerToken != "" {
+		if subtle.ConstantTimeCompare([]byte(ownerToken), []byte(portal.OwnerToken)) != 1 {
+			return ErrOwnerTokenInvalid
+		}
 		return nil
 	}
 
-	if token == "" {
-		return ErrClientTokenRequired
+	if !portal.Reusable && clientToken != "" {
+		if _, ok := portal.ClientTokens[clientToken]; ok {
+			return nil
+		}
 	}
 
-	if _, ok := portal.ClientTokens[token]; !ok {
-		return ErrClientTokenInvalid
+	return ErrOwnerTokenRequired
+}
+
+// PortalClients returns a copy of the portal's clients ordered by claim time.
+func (s *Store) PortalClients(id string) ([]PortalClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	portal, ok := s.portals[id]
+	if !ok {
+		return nil, ErrPortalNotFound
 	}
 
-	return nil
+	clients := make([]PortalClient, 0, len(portal.Clients))
+	for _, client := range portal.Clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].ClaimedAt.Equal(clients[j].ClaimedAt) {
+			return clients[i].ID < clients[j].ID
+		}
+		return clients[i].ClaimedAt.Before(clients[j].ClaimedAt)
+	})
+	return clients, nil
 }
 
 func (s *Store) PortalByID(id string) (Portal, error) {
@@ -232,7 +399,7 @@ func (s *Store) PortalByID(id string) (Portal, error) {
 	updated, changed := s.refreshPortalLocked(portal, time.Now())
 	if changed {
 		portal = updated
-		s.portals[id] = portal
+		s.setPortalLocked(portal)
 	}
 	if portal.State == PortalClosed || portal.State == PortalExpired {
 		return Portal{}, ErrPortalClosed
@@ -256,7 +423,7 @@ func (s *Store) ClosePortal(id string) (Portal, error) {
 	}
 	if portal.State == PortalClosed || portal.State == PortalExpired {
 		if changed {
-			s.portals[id] = portal
+			s.setPortalLocked(portal)
 		}
 		return Portal{}, ErrPortalClosed
 	}
@@ -267,11 +434,56 @@ func (s *Store) ClosePortal(id string) (Portal, error) {
 	if portal.ActiveUploads == 0 {
 		portal.State = PortalClosed
 	}
-	s.portals[id] = portal
+	s.setPortalLocked(portal)
 
 	return portal, nil
 }
 
+// OnPortalClosed registers fn to be called, on its own goroutine, each time
+// a portal becomes closed or expired.
+func (s *Store) OnPortalClosed(fn func(Portal)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onClosed = fn
+}
+
+// setPortalLocked stores portal and reports a transition to closed or
+// expired to the OnPortalClosed listener.
+func (s *Store) setPortalLocked(portal Portal) {
+	previous, existed := s.portals[portal.ID]
+	s.portals[portal.ID] = portal
+	if s.onClosed == nil || !existed || portalEnded(previous.State) || !portalEnded(portal.State) {
+		return
+	}
+	go s.onClosed(detachPortal(portal))
+}
+
+// OnUploadFailed registers fn to be called, on its own goroutine, each time
+// an upload is marked failed, including staged uploads of a cancelled batch.
+func (s *Store) OnUploadFailed(fn func(Portal, Upload)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onFailed = fn
+}
+
+func (s *Store) uploadFailedLocked(upload Upload) {
+	if s.onFailed == nil {
+		return
+	}
+	go s.onFailed(detachPortal(s.portals[upload.PortalID]), upload)
+}
+
+// detachPortal copies portal with its own maps, for use outside the lock.
+func detachPortal(portal Portal) Portal {
+	portal.Clients = maps.Clone(portal.Clients)
+	portal.ClientTokens = maps.Clone(portal.ClientTokens)
+	return portal
+}
+
+func portalEnded(state PortalState) bool {
+	return state == PortalClosed || state == PortalExpired
+}
+
 func (s *Store) ListPortals() []Portal {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -288,11 +500,11 @@ func (s *Store) SweepPortals(now time.Time) []Portal {
 	defer s.mu.Unlock()
 
 	closed := make([]Portal, 0)
-	for id, portal := range s.portals {
+	for _, portal := range s.portals {
 		previous := portal.State
 		updated, changed := s.refreshPortalLocked(portal, now)
 		if changed {
-			s.portals[id] = updated
+			s.setPortalLocked(updated)
 		}
 		if previous != updated.State && (updated.State == PortalClosed || updated.State == PortalExpired) {
 			closed = append(closed, updated)
@@ -325,15 +537,20 @@ func (s *Store) refreshPortalLocked(portal Portal, now time.Time) (Portal, bool)
 	return portal, changed
 }
 
-func (s *Store) ActiveUploadIDs() map[string]struct{} {
+// ActiveUploadIDs returns the IDs of in-flight uploads grouped by portal ID.
+func (s *Store) ActiveUploadIDs() map[string]map[string]struct{} {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	active := make(map[string]struct{})
-	for id, upload := range s.uploads {
-		if upload.Active {
-			active[id] = struct{}{}
+	active := make(map[string]map[string]struct{})
+	for key, upload := range s.uploads {
+		if !upload.Active {
+			continue
 		}
+		if active[key.portalID] == nil {
+			active[key.portalID] = make(map[string]struct{})
+		}
+		active[key.portalID][key.uploadID] = struct{}{}
 	}
 	return active
 }
@@ -353,26 +570,42 @@ func (s *Store) CreateUpload(input CreateUploadInput) (Upload, error) {
 	}
 	if portal.State == PortalClosed || portal.State == PortalExpired || portal.State == PortalClosing {
 		if changed {
-			s.portals[input.PortalID] = portal
+			s.setPortalLocked(portal)
 		}
 		return Upload{}, ErrPortalClosed
 	}
 
-	if existing, ok := s.uploads[input.UploadID]; ok {
-		if existing.Status == UploadCommitted {
+	if err := ValidateUploadID(input.UploadID); err != nil {
+		return Upload{}, err
+	}
+	if !s.batchAcceptsUploadsLocked(input.PortalID, input.BatchID) {
+		return Upload{}, ErrBatchClosed
+	}
+
+	key := uploadKey{portalID: input.PortalID, uploadID: input.UploadID}
+	if existing, ok := s.uploads[key]; ok {
+		if existing.Status == UploadCommitted || existing.Status == UploadSkipped || existing.Status == UploadHeld {
 			return Upload{}, ErrUploadAlreadyCommitted
 		}
 		return Upload{}, ErrUploadAlreadyExists
 	}
+	if err := s.claimAtomicFolderLocked(input); err != nil {
+		return Upload{}, err
+	}
 
 	now := time.Now()
 	upload := Upload{
 		ID:            input.UploadID,
 		PortalID:      input.PortalID,
+		ClientID:      input.ClientID,
+		BatchID:       input.BatchID,
 		Relpath:       input.Relpath,
+		Dir:           input.Dir,
 		Size:          input.Size,
 		ClientSHA256:  input.ClientSHA256,
 		Policy:        input.Policy,
+		LastModified:  input.LastModified,
+		Mode:          input.Mode,
 		Status:        UploadWriting,
 		BytesReceived: 0,
 		CreatedAt:     now,
@@ -382,16 +615,16 @@ func (s *Store) CreateUpload(input CreateUploadInput) (Upload, error) {
 	if portal.State == PortalOpen || portal.State == PortalClaimed {
 		portal.State = PortalInUse
 	}
-	s.portals[input.PortalID] = portal
-	s.uploads[input.UploadID] = upload
+	s.setPortalLocked(portal)
+	s.uploads[key] = upload
 	return upload, nil
 }
 
-func (s *Store) GetUpload(id string) (Upload, error) {
+func (s *Store) GetUpload(portalID, id string) (Upload, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	upload, ok := s.uploads[id]
+	upload, ok := s.uploads[uploadKey{portalID: portalID, uploadID: id}]
 	if !ok {
 		return Upload{}, ErrUploadNotFound
 	}
@@ -399,11 +632,37 @@ func (s *Store) GetUpload(id string) (Upload, error) {
 	return upload, nil
 }
 
-func (s *Store) StartUpload(id string) (Upload, error) {
+// LookupUpload finds an upload by ID alone for the legacy /api/uploads/{id}
+// routes. An ID claimed by more than one portal is never resolved.
+func (s *Store) LookupUpload(id string) (Upload, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	upload, ok := s.uploads[id]
+	var found Upload
+	matches := 0
+	for key, upload := range s.uploads {
+		if key.uploadID == id {
+			found = upload
+			matches++
+		}
+	}
+
+	switch matches {
+	case 0:
+		return Upload{}, ErrUploadNotFound
+	case 1:
+		return found, nil
+	default:
+		return Upload{}, ErrUploadAmbiguous
+	}
+}
+
+func (s *Store) StartUpload(portalID, id string) (Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := uploadKey{portalID: portalID, uploadID: id}
+	upload, ok := s.uploads[key]
 	if !ok {
 		return Upload{}, ErrUploadNotFound
 	}
@@ -423,25 +682,29 @@ func (s *Store) StartUpload(id string) (Upload, error) {
 	}
 	if portal.State == PortalClosed || portal.State == PortalExpired {
 		if changed {
-			s.portals[portal.ID] = portal
+			s.setPortalLocked(portal)
 		}
 		return Upload{}, ErrPortalClosed
 	}
+	if !s.batchAcceptsUploadsLocked(portalID, upload.BatchID) {
+		return Upload{}, ErrBatchClosed
+	}
 
 	portal.ActiveUploads++
 	upload.Active = true
 	upload.UpdatedAt = time.Now()
-	s.portals[portal.ID] = portal
-	s.uploads[id] = upload
+	s.setPortalLocked(portal)
+	s.uploads[key] = upload
 
 	return upload, nil
 }
 
-func (s *Store) DeleteUpload(id string) {
+func (s *Store) DeleteUpload(portalID, id string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	upload, ok := s.uploads[id]
+	key := uploadKey{portalID: portalID, uploadID: id}
+	upload, ok := s.uploads[key]
 	if ok && upload.Active {
 		portal, ok := s.portals[upload.PortalID]
 		if ok {
@@ -449,18 +712,19 @@ func (s *Store) DeleteUpload(id string) {
 				portal.ActiveUploads--
 			}
 			updated, _ := s.refreshPortalLocked(portal, time.Now())
-			s.portals[portal.ID] = updated
+			s.setPortalLocked(updated)
 		}
 	}
 
-	delete(s.uploads, id)
+	delete(s.uploads, key)
 }
 
-func (s *Store) MarkUploadCommitted(id, serverSHA256, finalRelpath string, bytesReceived int64) (Upload, error) {
+func (s *Store) MarkUploadCommitted(portalID, id, serverSHA256, finalRelpath string, bytesReceived int64) (Upload, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	upload, ok := s.uploads[id]
+	key := uploadKey{portalID: portalID, uploadID: id}
+	upload, ok := s.uploads[key]
 	if !ok {
 		return Upload{}, ErrUploadNotFound
 	}
@@ -472,26 +736,71 @@ func (s *Store) MarkUploadCommitted(id, serverSHA256, finalRelpath string, bytes
 				portal.ActiveUploads--
 			}
 			updated, _ := s.refreshPortalLocked(portal, time.Now())
-			s.portals[portal.ID] = updated
+			s.setPortalLocked(updated)
 		}
 		upload.Active = false
 	}
 
+	if portal, ok := s.portals[upload.PortalID]; ok {
+		if client, ok := portal.Clients[upload.ClientID]; ok && !upload.Dir {
+			client.FilesCommitted++
+			client.BytesCommitted += bytesReceived
+			portal.Clients[upload.ClientID] = client
+		}
+	}
+
 	upload.Status = UploadCommitted
 	upload.ServerSHA256 = serverSHA256
 	upload.BytesReceived = bytesReceived
 	upload.FinalRelpath = finalRelpath
 	upload.UpdatedAt = time.Now()
-	s.uploads[id] = upload
+	s.uploads[key] = upload
+
+	return upload, nil
+}
+
+// MarkUploadSkipped finishes an upload whose bytes were verified but not
+// placed because the conflict policy chose to keep the existing file.
+func (s *Store) MarkUploadSkipped(portalID, id, serverSHA256, finalRelpath string, bytesReceived int64) (Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := uploadKey{portalID: portalID, uploadID: id}
+	upload, ok := s.uploads[key]
+	if !ok {
+		return Upload{}, ErrUploadNotFound
+	}
+
+	if upload.Active {
+		portal, ok := s.portals[upload.PortalID]
+		if ok {
+			if portal.ActiveUploads > 0 {
+				portal.ActiveUploads--
+			}
+			updated, _ := s.refreshPortalLocked(portal, time.Now())
+			s.setPortalLocked(updated)
+		}
+		upload.Active = false
+	}
+
+	upload.Status = UploadSkipped
+	upload.ServerSHA256 = serverSHA256
+	upload.BytesReceived = bytesReceived
+	upload.FinalRelpath = finalRelpath
+	upload.UpdatedAt = time.Now()
+	s.uploads[key] = upload
 
 	return upload, nil
 }
 
-func (s *Store) MarkUploadFailed(id string) (Upload, error) {
+// MarkUploadStaged finishes streaming an upload of an atomic batch. Its
+// verified bytes wait in the batch's staging tree until the batch commits.
+func (s *Store) MarkUploadStaged(portalID, id, serverSHA256 string, bytesReceived int64) (Upload, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	upload, ok := s.uploads[id]
+	key := uploadKey{portalID: portalID, uploadID: id}
+	upload, ok := s.uploads[key]
 	if !ok {
 		return Upload{}, ErrUploadNotFound
 	}
@@ -503,14 +812,79 @@ func (s *Store) MarkUploadFailed(id string) (Upload, error) {
 				portal.ActiveUploads--
 			}
 			updated, _ := s.refreshPortalLocked(portal, time.Now())
-			s.portals[portal.ID] = updated
+			s.setPortalLocked(updated)
+		}
+		upload.Active = false
+	}
+
+	upload.Status = UploadStaged
+	upload.ServerSHA256 = serverSHA256
+	upload.BytesReceived = bytesReceived
+	upload.UpdatedAt = time.Now()
+	s.uploads[key] = upload
+
+	return upload, nil
+}
+
+// MarkUploadHeld finishes an upload to a review portal. Its verified bytes
+// wait in the review area until an operator approves or rejects them.
+func (s *Store) MarkUploadHeld(portalID, id, serverSHA256 string, bytesReceived int64) (Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := uploadKey{portalID: portalID, uploadID: id}
+	upload, ok := s.uploads[key]
+	if !ok {
+		return Upload{}, ErrUploadNotFound
+	}
+
+	if upload.Active {
+		portal, ok := s.portals[upload.PortalID]
+		if ok {
+			if portal.ActiveUploads > 0 {
+				portal.ActiveUploads--
+			}
+			updated, _ := s.refreshPortalLocked(portal, time.Now())
+			s.setPortalLocked(updated)
+		}
+		upload.Active = false
+	}
+
+	upload.Status = UploadHeld
+	upload.ServerSHA256 = serverSHA256
+	upload.BytesReceived = bytesReceived
+	upload.UpdatedAt = time.Now()
+	s.uploads[key] = upload
+
+	return upload, nil
+}
+
+func (s *Store) MarkUploadFailed(portalID, id string) (Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := uploadKey{portalID: portalID, uploadID: id}
+	upload, ok := s.uploads[key]
+	if !ok {
+		return Upload{}, ErrUploadNotFound
+	}
+
+	if upload.Active {
+		portal, ok := s.portals[upload.PortalID]
+		if ok {
+			if portal.ActiveUploads > 0 {
+				portal.ActiveUploads--
+			}
+			updated, _ := s.refreshPortalLocked(portal, time.Now())
+			s.setPortalLocked(updated)
 		}
 		upload.Active = false
 	}
 
 	upload.Status = UploadFailed
 	upload.UpdatedAt = time.Now()
-	s.uploads[id] = upload
+	s.uploads[key] = upload
+	s.uploadFailedLocked(upload)
 
 	return upload, nil
 }
@@ -525,6 +899,26 @@ func newPortalID() (string, error) {
 	return "p_" + strings.ToLower(encoded), nil
 }
 
+func newOwnerToken() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate owner token: %w", err)
+	}
+
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+	return "ot_" + strings.ToLower(encoded), nil
+}
+
+func newClientID() (string, error) {
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate client id: %w", err)
+	}
+
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+	return "c_" + strings.ToLower(encoded), nil
+}
+
 func newClientToken() (string, error) {
 	buf := make([]byte, 16)
 	if _, err := rand.Read(buf); err != nil {
@@ -0,0 +1,43 @@
+package control
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MaxUploadIDLength bounds client-supplied upload IDs. It fits a UUID with
+// room to spare and keeps temp file names well under NAME_MAX.
+const MaxUploadIDLength = 64
+
+var ErrUploadIDInvalid = errors.New("upload_id must be 1-64 characters of A-Z, a-z, 0-9, '-' or '_'")
+
+// ValidateUploadID rejects anything outside [A-Za-z0-9_-]{1,64}. Upload IDs
+// become temp file names, so separators, dots and control bytes never pass.
+func ValidateUploadID(id string) error {
+	if id == "" || len(id) > MaxUploadIDLength {
+		return ErrUploadIDInvalid
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return ErrUploadIDInvalid
+		}
+	}
+	return nil
+}
+
+// NewUploadID mints an ID for clients that leave upload_id empty.
+func NewUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate upload id: %w", err)
+	}
+
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+	return "u_" + strings.ToLower(encoded), nil
+}
@@ -0,0 +1,92 @@
+package control
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateUploadID(t *testing.T) {
+	accepts := []string{
+		"a",
+		"0b9c7a52-9d1e-4c55-9b8e-3c1f0f6f4b8e",
+		"u_abc123",
+		strings.Repeat("Z", MaxUploadIDLength),
+	}
+	for _, id := range accepts {
+		if err := ValidateUploadID(id); err != nil {
+			t.Errorf("expected %q to be valid: %v", id, err)
+		}
+	}
+
+	rejects := []string{
+		"",
+		".",
+		"..",
+		"../x",
+		"a/b",
+		`a\b`,
+		"a.b",
+		"a b",
+		"tab\t",
+		"nul\x00",
+		"é",
+		strings.Repeat("a", MaxUploadIDLength+1),
+	}
+	for _, id := range rejects {
+		if err := ValidateUploadID(id); !errors.Is(err, ErrUploadIDInvalid) {
+			t.Errorf("expected %q to be rejected, got %v", id, err)
+		}
+	}
+}
+
+func TestNewUploadIDIsValid(t *testing.T) {
+	id, err := NewUploadID()
+	if err != nil {
+		t.Fatalf("new upload id: %v", err)
+	}
+	if err := ValidateUploadID(id); err != nil {
+		t.Fatalf("minted id %q is invalid: %v", id, err)
+	}
+}
+
+func TestStoreNamespacesUploadsPerPortal(t *testing.T) {
+	store := NewStore()
+	first, err := store.CreatePortal(CreatePortalInput{DestAbs: "/tmp/first"})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	second, err := store.CreatePortal(CreatePortalInput{DestAbs: "/tmp/second"})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+
+	for _, portal := range []Portal{first, second} {
+		if _, err := store.CreateUpload(CreateUploadInput{PortalID: portal.ID, UploadID: "same", Relpath: portal.ID}); err != nil {
+			t.Fatalf("create upload in %s: %v", portal.ID, err)
+		}
+	}
+
+	upload, err := store.GetUpload(second.ID, "same")
+	if err != nil {
+		t.Fatalf("get upload: %v", err)
+	}
+	if upload.PortalID != second.ID || upload.Relpath != second.ID {
+		t.Fatalf("expected second portal's upload, got %+v", upload)
+	}
+
+	if _, err := store.LookupUpload("same"); !errors.Is(err, ErrUploadAmbiguous) {
+		t.Fatalf("expected ambiguous lookup, got %v", err)
+	}
+
+	if _, err := store.MarkUploadFailed(first.ID, "same"); err != nil {
+		t.Fatalf("mark failed: %v", err)
+	}
+	if upload, _ := store.GetUpload(second.ID, "same"); upload.Status != UploadWriting {
+		t.Fatalf("failing one portal's upload changed the other: %+v", upload)
+	}
+
+	if _, err := store.CreateUpload(CreateUploadInput{PortalID: first.ID, UploadID: "../x"}); !errors.Is(err, ErrUploadIDInvalid) {
+		t.Fatalf("expected invalid id error, got %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+package hooks
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killGroup starts the command in its own process group and makes a
+// timeout kill the whole group, so children of the shell die with it.
+func killGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package hooks
+
+import "os/exec"
+
+// killGroup leaves the default cancellation, which kills the shell only.
+func killGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,236 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events a hook command can be configured for.
+const (
+	EventCommit = "commit"
+	EventClose  = "close"
+)
+
+// maxOutput caps how much of a hook's combined output is kept for the log.
+const maxOutput = 4096
+
+type Config struct {
+	OnCommit    string
+	OnClose     string
+	Timeout     time.Duration
+	Concurrency int
+	// QueueSize is how many events may wait for a free slot; events fired
+	// while the queue is full are dropped and logged.
+	QueueSize int
+}
+
+// Event describes what happened. It is passed to the command as JSON on
+// stdin and as DROPSERVE_* environment variables.
+type Event struct {
+	Event    string `json:"event"`
+	PortalID string `json:"portal_id"`
+	Dest     string `json:"dest"`
+	Relpath  string `json:"relpath,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	// Files and State describe a closed portal: how many files its clients
+	// committed (Size is then their total bytes) and whether it was closed
+	// or expired.
+	Files int    `json:"files,omitempty"`
+	State string `json:"state,omitempty"`
+}
+
+// Runner runs hook commands in the background, at most Concurrency at a
+// time, and logs how each run went.
+type Runner struct {
+	cfg     Config
+	logger  *log.Logger
+	queue   chan queuedRun
+	workers sync.Once
+	wg      sync.WaitGroup
+}
+
+type queuedRun struct {
+	command string
+	event   Event
+}
+
+func New(cfg Config, logger *log.Logger) *Runner {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Minute
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1000
+	}
+	if logger == nil {
+		logger = log.New(os.Stdout, "hook ", log.LstdFlags)
+	}
+	return &Runner{cfg: cfg, logger: logger, queue: make(chan queuedRun, cfg.QueueSize)}
+}
+
+// Fire queues the command configured for the event, if any, and returns
+// without waiting for it. If the queue is full the event is dropped and
+// logged, so a burst of commits cannot pile up without bound.
+func (r *Runner) Fire(event Event) {
+	command := r.command(event.Event)
+	if command == "" {
+		return
+	}
+	r.workers.Do(func() {
+		for i := 0; i < r.cfg.Concurrency; i++ {
+			go r.work()
+		}
+	})
+	r.wg.Add(1)
+	select {
+	case r.queue <- queuedRun{command: command, event: event}:
+	default:
+		r.wg.Done()
+		line := "hook event=" + event.Event + " portal=" + event.PortalID
+		if event.Relpath != "" {
+			line += " relpath=" + event.Relpath
+		}
+		r.logger.Print(line + " status=dropped err=queue full")
+	}
+}
+
+func (r *Runner) work() {
+	for queued := range r.queue {
+		r.run(queued.command, queued.event)
+		r.wg.Done()
+	}
+}
+
+// Wait blocks until every queued hook has finished.
+func (r *Runner) Wait() {
+	r.wg.Wait()
+}
+
+func (r *Runner) command(event string) string {
+	switch event {
+	case EventCommit:
+		return r.cfg.OnCommit
+	case EventClose:
+		return r.cfg.OnClose
+	default:
+		return ""
+	}
+}
+
+func (r *Runner) run(command string, event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		r.logger.Printf("hook event=%s portal=%s status=failed err=%v", event.Event, event.PortalID, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, command)
+	cmd.Env = append(os.Environ(), environment(event)...)
+	cmd.Stdin = bytes.NewReader(payload)
+	output := &limitedBuffer{limit: maxOutput}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// Output pipes held open by a leftover child must not stall the run
+	// past its timeout.
+	cmd.WaitDelay = time.Second
+	killGroup(cmd)
+
+	started := time.Now()
+	err = cmd.Run()
+	duration := time.Since(started).Round(time.Millisecond)
+
+	status := "ok"
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		status = "timeout"
+	case err != nil:
+		status = "failed"
+	}
+	line := "hook event=" + event.Event + " portal=" + event.PortalID
+	if event.Relpath != "" {
+		line += " relpath=" + event.Relpath
+	}
+	line += " status=" + status + " duration=" + duration.String()
+	if err != nil {
+		line += " err=" + err.Error()
+	}
+	if text := strings.TrimSpace(output.String()); text != "" {
+		line += " output=" + strconv.Quote(text)
+	}
+	r.logger.Print(line)
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
+
+func environment(event Event) []string {
+	env := []string{
+		"DROPSERVE_EVENT=" + event.Event,
+		"DROPSERVE_PORTAL_ID=" + event.PortalID,
+		"DROPSERVE_DEST=" + event.Dest,
+		"DROPSERVE_SIZE=" + strconv.FormatInt(event.Size, 10),
+	}
+	if event.Event == EventClose {
+		return append(env,
+			"DROPSERVE_FILES="+strconv.Itoa(event.Files),
+			"DROPSERVE_STATE="+event.State,
+		)
+	}
+	return append(env,
+		"DROPSERVE_RELPATH="+event.Relpath,
+		"DROPSERVE_PATH="+event.Path,
+		"DROPSERVE_SHA256="+event.SHA256,
+	)
+}
+
+// limitedBuffer keeps the first limit bytes written to it and drops the
+// rest, so a chatty command cannot grow the log without bound.
+type limitedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	room := b.limit - b.buf.Len()
+	if len(p) > room {
+		b.truncated = true
+	}
+	if room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.truncated {
+		return b.buf.String() + "..."
+	}
+	return b.buf.String()
+}
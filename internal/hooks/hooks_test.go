@@ -0,0 +1,90 @@
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunnerPassesEventAsEnvAndJSON(t *testing.T) {
+	dir := t.TempDir()
+	var logs bytes.Buffer
+	runner := New(Config{
+		OnCommit: `printf '%s|%s|%s' "$DROPSERVE_RELPATH" "$DROPSERVE_SIZE" "$DROPSERVE_SHA256" > "$OUT_DIR/env"; cat > "$OUT_DIR/stdin"; echo done`,
+	}, log.New(&logs, "", 0))
+	t.Setenv("OUT_DIR", dir)
+
+	runner.Fire(Event{Event: EventCommit, PortalID: "p1", Dest: "/srv", Relpath: "a b.txt", Path: "/srv/a b.txt", Size: 3, SHA256: "abc"})
+	runner.Fire(Event{Event: EventClose, PortalID: "p1"})
+	runner.Wait()
+
+	env, _ := os.ReadFile(filepath.Join(dir, "env"))
+	if string(env) != "a b.txt|3|abc" {
+		t.Fatalf("unexpected env %q", env)
+	}
+	var event Event
+	stdin, _ := os.ReadFile(filepath.Join(dir, "stdin"))
+	if err := json.Unmarshal(stdin, &event); err != nil || event.Path != "/srv/a b.txt" || event.Event != EventCommit {
+		t.Fatalf("unexpected stdin %q: %v", stdin, err)
+	}
+	if !strings.Contains(logs.String(), `status=ok`) || !strings.Contains(logs.String(), `output="done"`) {
+		t.Fatalf("expected the run to be logged, got %q", logs.String())
+	}
+	if strings.Count(logs.String(), "\n") != 1 {
+		t.Fatalf("expected no run for an unconfigured event, got %q", logs.String())
+	}
+}
+
+func TestRunnerKillsCommandsAfterTimeout(t *testing.T) {
+	var logs bytes.Buffer
+	runner := New(Config{OnClose: "sleep 5 & sleep 5", Timeout: 100 * time.Millisecond}, log.New(&logs, "", 0))
+
+	started := time.Now()
+	runner.Fire(Event{Event: EventClose, PortalID: "p1"})
+	runner.Wait()
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Fatalf("expected the hook to be killed, took %s", elapsed)
+	}
+	if !strings.Contains(logs.String(), "status=timeout") {
+		t.Fatalf("expected a timeout to be logged, got %q", logs.String())
+	}
+}
+
+func TestRunnerDropsEventsWhenQueueIsFull(t *testing.T) {
+	var logs bytes.Buffer
+	runner := New(Config{OnCommit: "sleep 0.2", Concurrency: 1, QueueSize: 1}, log.New(&logs, "", 0))
+
+	for i := 0; i < 5; i++ {
+		runner.Fire(Event{Event: EventCommit, PortalID: "p1", Relpath: "f"})
+	}
+	runner.Wait()
+	// One run may have left the queue before the rest were fired.
+	ran, dropped := strings.Count(logs.String(), "status=ok"), strings.Count(logs.String(), "status=dropped")
+	if ran+dropped != 5 || ran > 2 || dropped < 3 {
+		t.Fatalf("expected the overflow to be dropped, got %q", logs.String())
+	}
+}
+
+func TestRunnerBoundsConcurrency(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OUT_DIR", dir)
+	var logs bytes.Buffer
+	// Each run fails if another one holds the lock directory.
+	runner := New(Config{
+		OnCommit:    `mkdir "$OUT_DIR/lock" || exit 1; sleep 0.05; rmdir "$OUT_DIR/lock"`,
+		Concurrency: 1,
+	}, log.New(&logs, "", 0))
+
+	for i := 0; i < 4; i++ {
+		runner.Fire(Event{Event: EventCommit, PortalID: "p1", Relpath: "f"})
+	}
+	runner.Wait()
+	if strings.Count(logs.String(), "status=ok") != 4 {
+		t.Fatalf("expected four serialized runs, got %q", logs.String())
+	}
+}
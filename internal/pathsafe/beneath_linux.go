@@ -0,0 +1,181 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || mips || mips64 || mips64le || mipsle || ppc64 || ppc64le || riscv64 || s390x)
+
+package pathsafe
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// O_PATH is not exported by syscall on every architecture. 0x200000 is the
+// generic Linux value; sparc, alpha and parisc use others, which is why this
+// file is limited to the architectures listed in its build constraint.
+const oPath = 0x200000
+
+// OpenDirBeneath opens the directory relDir beneath root one component at a
+// time with O_NOFOLLOW, so a symlink planted anywhere below root fails with
+// ErrSymlinkInPath instead of redirecting the walk. Missing directories are
+// created with perm when create is set. relDir must be a sanitized relpath or
+// "." for root itself.
+func OpenDirBeneath(root, relDir string, create bool, perm os.FileMode) (*os.File, error) {
+	return openDirBeneath(root, relDir, create, perm, nil)
+}
+
+// CreateDirBeneath is OpenDirBeneath with create set that also passes every
+// directory it makes, and that directory's parent, to hook before walking
+// into it. Directories that already existed are left alone.
+func CreateDirBeneath(root, relDir string, perm os.FileMode, hook DirHook) (*os.File, error) {
+	return openDirBeneath(root, relDir, true, perm, hook)
+}
+
+func openDirBeneath(root, relDir string, create bool, perm os.FileMode, hook DirHook) (*os.File, error) {
+	current, err := syscall.Open(root, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	currentPath := root
+
+	for _, segment := range relSegments(relDir) {
+		next, err := openDirAt(current, segment)
+		if errors.Is(err, syscall.ENOENT) && create {
+			made := true
+			if err := syscall.Mkdirat(current, segment, uint32(perm.Perm())); err != nil {
+				if !errors.Is(err, syscall.EEXIST) {
+					_ = syscall.Close(current)
+					return nil, &os.PathError{Op: "mkdir", Path: filepath.Join(currentPath, segment), Err: err}
+				}
+				made = false
+			}
+			next, err = openDirAt(current, segment)
+			if err == nil && made && hook != nil {
+				if err := runDirHook(hook, current, next, currentPath, segment); err != nil {
+					_ = syscall.Close(next)
+					_ = syscall.Close(current)
+					return nil, err
+				}
+			}
+		}
+		if err != nil {
+			isLink := errors.Is(err, syscall.ELOOP) || errors.Is(err, syscall.ENOTDIR) && isSymlinkAt(current, segment)
+			_ = syscall.Close(current)
+			if isLink {
+				return nil, ErrSymlinkInPath
+			}
+			return nil, &os.PathError{Op: "open", Path: filepath.Join(currentPath, segment), Err: err}
+		}
+		_ = syscall.Close(current)
+		current = next
+		currentPath = filepath.Join(currentPath, segment)
+	}
+
+	return os.NewFile(uintptr(current), currentPath), nil
+}
+
+// LstatBeneath stats relpath beneath root without following symlinks in any
+// component, including the last one.
+func LstatBeneath(root, relpath string) (os.FileInfo, error) {
+	dir, err := OpenDirBeneath(root, path.Dir(relpath), false, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+
+	name := path.Base(relpath)
+	fd, err := syscall.Openat(int(dir.Fd()), name, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: filepath.Join(dir.Name(), name), Err: err}
+	}
+	file := os.NewFile(uintptr(fd), filepath.Join(dir.Name(), name))
+	defer func() {
+		_ = file.Close()
+	}()
+	return file.Stat()
+}
+
+// OpenFileBeneath opens an existing file beneath root for reading without
+// following symlinks in any component.
+func OpenFileBeneath(root, relpath string) (*os.File, error) {
+	dir, err := OpenDirBeneath(root, path.Dir(relpath), false, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+
+	name := path.Base(relpath)
+	fd, err := syscall.Openat(int(dir.Fd()), name, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, syscall.ELOOP) {
+			return nil, ErrSymlinkInPath
+		}
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(dir.Name(), name), Err: err}
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(dir.Name(), name)), nil
+}
+
+// RemoveBeneath unlinks the file relpath beneath root relative to its
+// parent directory's descriptor, so a symlink swapped in above it cannot
+// redirect the unlink elsewhere.
+func RemoveBeneath(root, relpath string) error {
+	dir, err := OpenDirBeneath(root, path.Dir(relpath), false, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+
+	name := path.Base(relpath)
+	if err := syscall.Unlinkat(int(dir.Fd()), name); err != nil {
+		return &os.PathError{Op: "unlinkat", Path: filepath.Join(dir.Name(), name), Err: err}
+	}
+	return nil
+}
+
+// runDirHook hands duplicates of the parent and new directory descriptors
+// to hook, so closing the *os.File wrappers leaves the walk's own intact.
+func runDirHook(hook DirHook, parentfd, dirfd int, parentPath, name string) error {
+	parentDup, err := syscall.Dup(parentfd)
+	if err != nil {
+		return err
+	}
+	parent := os.NewFile(uintptr(parentDup), parentPath)
+	defer func() {
+		_ = parent.Close()
+	}()
+	dirDup, err := syscall.Dup(dirfd)
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(dirDup), filepath.Join(parentPath, name))
+	defer func() {
+		_ = dir.Close()
+	}()
+	return hook(parent, dir)
+}
+
+func openDirAt(dirfd int, name string) (int, error) {
+	return syscall.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+}
+
+func isSymlinkAt(dirfd int, name string) bool {
+	fd, err := syscall.Openat(dirfd, name, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = syscall.Close(fd)
+	}()
+
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err != nil {
+		return false
+	}
+	return stat.Mode&syscall.S_IFMT == syscall.S_IFLNK
+}
@@ -0,0 +1,101 @@
+//go:build !linux || !(386 || amd64 || arm || arm64 || loong64 || mips || mips64 || mips64le || mipsle || ppc64 || ppc64le || riscv64 || s390x)
+
+package pathsafe
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// OpenDirBeneath opens the directory relDir beneath root, refusing to pass
+// through symlinks. Without openat this is a best-effort Lstat walk.
+func OpenDirBeneath(root, relDir string, create bool, perm os.FileMode) (*os.File, error) {
+	return openDirBeneath(root, relDir, create, perm, nil)
+}
+
+// CreateDirBeneath is OpenDirBeneath with create set that also passes every
+// directory it makes, and that directory's parent, to hook.
+func CreateDirBeneath(root, relDir string, perm os.FileMode, hook DirHook) (*os.File, error) {
+	return openDirBeneath(root, relDir, true, perm, hook)
+}
+
+func openDirBeneath(root, relDir string, create bool, perm os.FileMode, hook DirHook) (*os.File, error) {
+	current := root
+	for _, segment := range relSegments(relDir) {
+		parentPath := current
+		current = filepath.Join(current, segment)
+		info, err := os.Lstat(current)
+		if errors.Is(err, os.ErrNotExist) && create {
+			err = os.Mkdir(current, perm)
+			if err == nil && hook != nil {
+				if err := runDirHook(hook, parentPath, current); err != nil {
+					return nil, err
+				}
+			}
+			if err != nil && !errors.Is(err, os.ErrExist) {
+				return nil, err
+			}
+			info, err = os.Lstat(current)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil, ErrSymlinkInPath
+		}
+	}
+	return os.Open(current)
+}
+
+func runDirHook(hook DirHook, parentPath, dirPath string) error {
+	parent, err := os.Open(parentPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = parent.Close()
+	}()
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	return hook(parent, dir)
+}
+
+func LstatBeneath(root, relpath string) (os.FileInfo, error) {
+	dir, err := OpenDirBeneath(root, path.Dir(relpath), false, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	return os.Lstat(filepath.Join(dir.Name(), path.Base(relpath)))
+}
+
+func OpenFileBeneath(root, relpath string) (*os.File, error) {
+	info, err := LstatBeneath(root, relpath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil, ErrSymlinkInPath
+	}
+	return os.Open(filepath.Join(root, filepath.FromSlash(relpath)))
+}
+
+func RemoveBeneath(root, relpath string) error {
+	dir, err := OpenDirBeneath(root, path.Dir(relpath), false, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	return os.Remove(filepath.Join(dir.Name(), path.Base(relpath)))
+}
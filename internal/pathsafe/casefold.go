@@ -0,0 +1,101 @@
+package pathsafe
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// FoldName returns the key under which two names collide on a case-folding
+// filesystem such as exFAT, NTFS or most SMB shares.
+func FoldName(name string) string {
+	return strings.ToLower(strings.ToUpper(NFC(name)))
+}
+
+// ResolveCaseBeneath maps every component of relpath that already exists
+// beneath root, compared case-insensitively, to its on-disk spelling.
+// Components that do not exist yet keep the requested spelling. An exact
+// match always wins over a case variant.
+func ResolveCaseBeneath(root, relpath string) (string, error) {
+	segments := relSegments(relpath)
+	resolved := make([]string, 0, len(segments))
+
+	for i, segment := range segments {
+		parent := "."
+		if len(resolved) > 0 {
+			parent = strings.Join(resolved, "/")
+		}
+		names, err := readDirNamesBeneath(root, parent)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+				return path.Join(append(resolved, segments[i:]...)...), nil
+			}
+			return "", err
+		}
+		resolved = append(resolved, matchFolded(names, segment))
+	}
+
+	return strings.Join(resolved, "/"), nil
+}
+
+func readDirNamesBeneath(root, relDir string) ([]string, error) {
+	dir, err := OpenDirBeneath(root, relDir, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	return dir.Readdirnames(-1)
+}
+
+func matchFolded(names []string, segment string) string {
+	key := FoldName(segment)
+	matches := make([]string, 0, 1)
+	for _, name := range names {
+		if name == segment {
+			return segment
+		}
+		if FoldName(name) == key {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) == 0 {
+		return segment
+	}
+	sort.Strings(matches)
+	return matches[0]
+}
+
+// ProbeCaseInsensitive reports whether the filesystem holding dir treats
+// names case-insensitively, by creating a lowercase file and looking it up
+// in upper case. dir must exist and be writable.
+func ProbeCaseInsensitive(dir string) (bool, error) {
+	file, err := os.CreateTemp(dir, "casecheck-*")
+	if err != nil {
+		return false, err
+	}
+	name := file.Name()
+	_ = file.Close()
+	defer func() {
+		_ = os.Remove(name)
+	}()
+
+	created, err := os.Lstat(name)
+	if err != nil {
+		return false, err
+	}
+	upper := filepath.Join(filepath.Dir(name), strings.ToUpper(filepath.Base(name)))
+	folded, err := os.Lstat(upper)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return os.SameFile(created, folded), nil
+}
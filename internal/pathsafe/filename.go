@@ -0,0 +1,206 @@
+package pathsafe
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	DefaultMaxSegmentBytes = 255
+	DefaultMaxPathBytes    = 1024
+	DefaultReplacement     = "_"
+)
+
+var (
+	ErrNameControlChar = errors.New("relpath contains control characters")
+	ErrNameCharacter   = errors.New("relpath contains a character not allowed on Windows")
+	ErrNameTrailing    = errors.New("relpath segment ends with a dot or space")
+	ErrNameReserved    = errors.New("relpath uses a name reserved on Windows")
+	ErrNameTooLong     = errors.New("relpath too long")
+)
+
+// windowsForbidden are the printable characters Windows and SMB refuse in
+// names; the backslash never gets this far because SanitizeRelpath turns it
+// into a separator.
+const windowsForbidden = `<>:"|?*`
+
+// FilenamePolicy decides which names may be written into a destination.
+// In reject mode a violating name fails the request; with Replace set it
+// is rewritten instead: control characters are stripped, forbidden
+// characters become Replacement, trailing dots and spaces are trimmed,
+// reserved names gain a Replacement suffix and long segments are truncated.
+// The total length limit is always enforced by rejection.
+type FilenamePolicy struct {
+	NFC             bool
+	Portable        bool
+	Replace         bool
+	Replacement     string
+	MaxSegmentBytes int
+	MaxPathBytes    int
+}
+
+func DefaultFilenamePolicy() FilenamePolicy {
+	return FilenamePolicy{
+		NFC:             true,
+		Portable:        true,
+		Replacement:     DefaultReplacement,
+		MaxSegmentBytes: DefaultMaxSegmentBytes,
+		MaxPathBytes:    DefaultMaxPathBytes,
+	}
+}
+
+// Clean runs SanitizeRelpath and then Apply, which is what every request
+// handler needs.
+func (p FilenamePolicy) Clean(input string) (string, error) {
+	cleaned, err := SanitizeRelpath(input)
+	if err != nil {
+		return "", err
+	}
+	return p.Apply(cleaned)
+}
+
+// Apply checks or rewrites each segment of an already sanitized relpath.
+// It is idempotent, so names that passed once pass unchanged again.
+func (p FilenamePolicy) Apply(cleanedRelpath string) (string, error) {
+	segments := strings.Split(cleanedRelpath, "/")
+	for i, segment := range segments {
+		fixed, err := p.applySegment(segment)
+		if err != nil {
+			return "", err
+		}
+		segments[i] = fixed
+	}
+
+	result := path.Clean(strings.Join(segments, "/"))
+	if p.MaxPathBytes > 0 && len(result) > p.MaxPathBytes {
+		return "", ErrNameTooLong
+	}
+	return result, nil
+}
+
+func (p FilenamePolicy) applySegment(segment string) (string, error) {
+	if p.NFC {
+		segment = NFC(segment)
+	}
+	if !utf8.ValidString(segment) {
+		if !p.Replace {
+			return "", ErrRelpathInvalid
+		}
+		segment = strings.ToValidUTF8(segment, p.replacement())
+	}
+
+	if strings.IndexFunc(segment, unicode.IsControl) >= 0 {
+		if !p.Replace {
+			return "", ErrNameControlChar
+		}
+		segment = replaceRunes(segment, unicode.IsControl, "")
+	}
+
+	if p.Portable {
+		if strings.ContainsAny(segment, windowsForbidden) {
+			if !p.Replace {
+				return "", ErrNameCharacter
+			}
+			segment = replaceRunes(segment, isWindowsForbidden, p.replacement())
+		}
+
+		if trimmed := strings.TrimRight(segment, ". "); trimmed != segment {
+			if !p.Replace {
+				return "", ErrNameTrailing
+			}
+			segment = trimmed
+		}
+
+		if isWindowsReserved(segment) {
+			if !p.Replace {
+				return "", ErrNameReserved
+			}
+			stem, rest := segment, ""
+			if dot := strings.IndexByte(segment, '.'); dot >= 0 {
+				stem, rest = segment[:dot], segment[dot:]
+			}
+			segment = stem + p.replacement() + rest
+		}
+	}
+
+	if segment == "" || segment == "." || segment == ".." {
+		if !p.Replace {
+			return "", ErrRelpathInvalid
+		}
+		segment = p.replacement()
+	}
+
+	if p.MaxSegmentBytes > 0 && len(segment) > p.MaxSegmentBytes {
+		if !p.Replace {
+			return "", ErrNameTooLong
+		}
+		segment = truncateSegment(segment, p.MaxSegmentBytes)
+	}
+
+	return segment, nil
+}
+
+// replacement falls back to the default when the configured replacement
+// would itself be unsafe in a name.
+func (p FilenamePolicy) replacement() string {
+	value := p.Replacement
+	if value == "" || strings.ContainsAny(value, "/\\"+windowsForbidden) || strings.IndexFunc(value, unicode.IsControl) >= 0 ||
+		strings.Trim(value, ". ") == "" {
+		return DefaultReplacement
+	}
+	return value
+}
+
+func replaceRunes(segment string, match func(rune) bool, replacement string) string {
+	var builder strings.Builder
+	for _, r := range segment {
+		if match(r) {
+			builder.WriteString(replacement)
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+func isWindowsForbidden(r rune) bool {
+	return strings.ContainsRune(windowsForbidden, r)
+}
+
+// isWindowsReserved matches device names such as CON, NUL or LPT1, with or
+// without an extension, in any case.
+func isWindowsReserved(segment string) bool {
+	stem := segment
+	if dot := strings.IndexByte(stem, '.'); dot >= 0 {
+		stem = stem[:dot]
+	}
+	stem = strings.ToUpper(strings.TrimRight(stem, " "))
+
+	switch stem {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(stem) == 4 && (strings.HasPrefix(stem, "COM") || strings.HasPrefix(stem, "LPT")) {
+		return stem[3] >= '1' && stem[3] <= '9'
+	}
+	return false
+}
+
+// truncateSegment shortens the stem so the segment fits in limit bytes,
+// keeping the extension when it is short enough and never splitting a rune.
+func truncateSegment(segment string, limit int) string {
+	ext := path.Ext(segment)
+	if len(ext) >= limit/2 {
+		ext = ""
+	}
+	stem := segment[:len(segment)-len(ext)]
+	budget := limit - len(ext)
+	for len(stem) > budget {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
+	}
+	return strings.TrimRight(stem, ". ") + ext
+}
@@ -0,0 +1,229 @@
+// Command gen writes pathsafe's NFC tables (nfc_tables.go) from the Unicode
+// Character Database. It reads UnicodeData.txt and CompositionExclusions.txt
+// from -ucd, which is either a local directory or a URL such as the
+// unicode.org directory of the version the tables should follow:
+//
+//	go run ./gen -ucd https://www.unicode.org/Public/14.0.0/ucd -o nfc_tables.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const perLine = 4
+
+type decomposition struct {
+	r     rune
+	parts [2]rune
+}
+
+type composition struct {
+	pair [2]rune
+	r    rune
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("gen: ")
+	ucd := flag.String("ucd", "https://www.unicode.org/Public/14.0.0/ucd", "directory or URL holding the Unicode Character Database")
+	version := flag.String("version", "14.0.0", "Unicode version named in the generated file")
+	out := flag.String("o", "nfc_tables.go", "file to write")
+	flag.Parse()
+
+	data, err := fetch(*ucd, "UnicodeData.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	exclusionData, err := fetch(*ucd, "CompositionExclusions.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	classes, decompositions, err := parseUnicodeData(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	exclusions, err := parseExclusions(exclusionData)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	src, err := format.Source(generate(*version, classes, decompositions, exclusions))
+	if err != nil {
+		log.Fatalf("format generated source: %v", err)
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func fetch(base, name string) ([]byte, error) {
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		return os.ReadFile(filepath.Join(base, name))
+	}
+	u := strings.TrimRight(base, "/") + "/" + path.Clean(name)
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s: %s", u, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// parseUnicodeData returns the canonical combining class of every code point
+// with a nonzero one, and every canonical (untagged) decomposition.
+func parseUnicodeData(data []byte) (map[rune]uint8, []decomposition, error) {
+	classes := map[rune]uint8{}
+	var decompositions []decomposition
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), ";")
+		if len(fields) < 6 {
+			continue
+		}
+		r, err := parseRune(fields[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("UnicodeData.txt:%d: %w", line, err)
+		}
+		class, err := strconv.ParseUint(fields[3], 10, 8)
+		if err != nil {
+			return nil, nil, fmt.Errorf("UnicodeData.txt:%d: combining class: %w", line, err)
+		}
+		if class != 0 {
+			classes[r] = uint8(class)
+		}
+
+		mapping := strings.Fields(fields[5])
+		if len(mapping) == 0 || strings.HasPrefix(mapping[0], "<") {
+			continue
+		}
+		if len(mapping) > 2 {
+			return nil, nil, fmt.Errorf("UnicodeData.txt:%d: canonical decomposition of %d code points", line, len(mapping))
+		}
+		d := decomposition{r: r}
+		for i, field := range mapping {
+			if d.parts[i], err = parseRune(field); err != nil {
+				return nil, nil, fmt.Errorf("UnicodeData.txt:%d: %w", line, err)
+			}
+		}
+		decompositions = append(decompositions, d)
+	}
+	return classes, decompositions, scanner.Err()
+}
+
+// parseExclusions returns the code points CompositionExclusions.txt lists.
+func parseExclusions(data []byte) (map[rune]bool, error) {
+	exclusions := map[rune]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		r, err := parseRune(text)
+		if err != nil {
+			return nil, fmt.Errorf("CompositionExclusions.txt:%d: %w", line, err)
+		}
+		exclusions[r] = true
+	}
+	return exclusions, scanner.Err()
+}
+
+func parseRune(s string) (rune, error) {
+	v, err := strconv.ParseUint(strings.TrimSpace(s), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("code point %q: %w", s, err)
+	}
+	return rune(v), nil
+}
+
+func generate(version string, classes map[rune]uint8, decompositions []decomposition, exclusions map[rune]bool) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by go run ./gen; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package pathsafe\n\n")
+	fmt.Fprintf(&b, "// Tables derived from the Unicode %s Character Database (UnicodeData.txt\n", version)
+	fmt.Fprintf(&b, "// and CompositionExclusions.txt) by ./gen. Run go generate to rebuild\n")
+	fmt.Fprintf(&b, "// them when moving to a newer Unicode version.\n\n")
+
+	var entries []string
+	for _, r := range classRanges(classes) {
+		entries = append(entries, fmt.Sprintf("{0x%X, 0x%X, %d}", r[0], r[1], r[2]))
+	}
+	writeTable(&b, "// combiningClasses lists canonical combining classes as sorted, inclusive\n"+
+		"// {lo, hi, class} ranges. Code points not listed have class 0.\n"+
+		"var combiningClasses = [...]cccRange{", entries)
+
+	sort.Slice(decompositions, func(i, j int) bool { return decompositions[i].r < decompositions[j].r })
+	entries = entries[:0]
+	var compositions []composition
+	for _, d := range decompositions {
+		entries = append(entries, fmt.Sprintf("0x%X: {0x%X, 0x%X}", d.r, d.parts[0], d.parts[1]))
+		// Singletons, decompositions starting with a non-starter and the
+		// listed exclusions make up Full_Composition_Exclusion.
+		if d.parts[1] != 0 && classes[d.parts[0]] == 0 && !exclusions[d.r] {
+			compositions = append(compositions, composition{pair: d.parts, r: d.r})
+		}
+	}
+	writeTable(&b, "// canonicalDecompositions maps a code point to its single-level canonical\n"+
+		"// decomposition; the second rune is 0 for singletons. Hangul is algorithmic.\n"+
+		"var canonicalDecompositions = map[rune][2]rune{", entries)
+
+	sort.Slice(compositions, func(i, j int) bool {
+		a, c := compositions[i].pair, compositions[j].pair
+		return a[0] < c[0] || a[0] == c[0] && a[1] < c[1]
+	})
+	entries = entries[:0]
+	for _, c := range compositions {
+		entries = append(entries, fmt.Sprintf("{0x%X, 0x%X}: 0x%X", c.pair[0], c.pair[1], c.r))
+	}
+	writeTable(&b, "// canonicalCompositions maps starter/combiner pairs to their primary\n"+
+		"// composite, with composition exclusions already removed.\n"+
+		"var canonicalCompositions = map[[2]rune]rune{", entries)
+	return b.Bytes()
+}
+
+// classRanges merges consecutive code points of equal class into
+// {lo, hi, class} ranges.
+func classRanges(classes map[rune]uint8) [][3]rune {
+	runes := make([]rune, 0, len(classes))
+	for r := range classes {
+		runes = append(runes, r)
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+
+	var ranges [][3]rune
+	for _, r := range runes {
+		class := rune(classes[r])
+		if n := len(ranges); n > 0 && ranges[n-1][1] == r-1 && ranges[n-1][2] == class {
+			ranges[n-1][1] = r
+			continue
+		}
+		ranges = append(ranges, [3]rune{r, r, class})
+	}
+	return ranges
+}
+
+func writeTable(b *bytes.Buffer, header string, entries []string) {
+	b.WriteString(header + "\n")
+	for i := 0; i < len(entries); i += perLine {
+		line := entries[i:min(i+perLine, len(entries))]
+		b.WriteString("\t" + strings.Join(line, ", ") + ",\n")
+	}
+	b.WriteString("}\n\n")
+}
@@ -0,0 +1,175 @@
+package pathsafe
+
+//go:generate go run ./gen -ucd https://www.unicode.org/Public/14.0.0/ucd -o nfc_tables.go
+
+import (
+	"sort"
+	"unicode/utf8"
+)
+
+type cccRange struct {
+	lo, hi rune
+	class  uint8
+}
+
+// Hangul syllables decompose and compose algorithmically (Unicode 3.12).
+const (
+	hangulSBase  = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+// composingRunes holds every code point that can be the second half of a
+// canonical composition, i.e. whose presence means composition may apply.
+var composingRunes = func() map[rune]struct{} {
+	runes := make(map[rune]struct{})
+	for pair := range canonicalCompositions {
+		runes[pair[1]] = struct{}{}
+	}
+	return runes
+}()
+
+// NFC returns s in Unicode Normalization Form C, so that a name typed as
+// "é" and one decomposed by macOS as "é" map to the same file.
+func NFC(s string) string {
+	if isNFCQuick(s) {
+		return s
+	}
+
+	runes := make([]rune, 0, len(s))
+	for _, r := range s {
+		runes = decompose(runes, r)
+	}
+	reorder(runes)
+	return string(compose(runes))
+}
+
+// isNFCQuick reports inputs that cannot change: ASCII, and text without
+// combining marks, decomposable code points, composing starters or Hangul
+// jamo.
+func isNFCQuick(s string) bool {
+	for i := 0; i < len(s); {
+		if s[i] < utf8.RuneSelf {
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if combiningClass(r) != 0 || isHangulJamo(r) {
+			return false
+		}
+		if _, ok := canonicalDecompositions[r]; ok {
+			return false
+		}
+		if _, ok := composingRunes[r]; ok {
+			return false
+		}
+		i += size
+	}
+	return true
+}
+
+func decompose(out []rune, r rune) []rune {
+	if r >= hangulSBase && r < hangulSBase+hangulSCount {
+		index := r - hangulSBase
+		out = append(out, hangulLBase+index/hangulNCount, hangulVBase+(index%hangulNCount)/hangulTCount)
+		if t := index % hangulTCount; t != 0 {
+			out = append(out, hangulTBase+t)
+		}
+		return out
+	}
+
+	pair, ok := canonicalDecompositions[r]
+	if !ok {
+		return append(out, r)
+	}
+	out = decompose(out, pair[0])
+	if pair[1] != 0 {
+		out = decompose(out, pair[1])
+	}
+	return out
+}
+
+// reorder applies the canonical ordering algorithm: each run of non-starters
+// is stably sorted by combining class.
+func reorder(runes []rune) {
+	for start := 0; start < len(runes); {
+		if combiningClass(runes[start]) == 0 {
+			start++
+			continue
+		}
+		end := start
+		for end < len(runes) && combiningClass(runes[end]) != 0 {
+			end++
+		}
+		run := runes[start:end]
+		sort.SliceStable(run, func(i, j int) bool {
+			return combiningClass(run[i]) < combiningClass(run[j])
+		})
+		start = end
+	}
+}
+
+// compose applies canonical composition in place over decomposed, reordered
+// input.
+func compose(runes []rune) []rune {
+	if len(runes) == 0 {
+		return runes
+	}
+
+	out := runes[:1]
+	starterPos := 0
+	lastClass := combiningClass(runes[0])
+	if lastClass != 0 {
+		// A leading non-starter can never be composed onto.
+		lastClass = 256
+	}
+
+	for _, r := range runes[1:] {
+		class := int(combiningClass(r))
+		if lastClass < class || lastClass == 0 {
+			if composite, ok := composePair(out[starterPos], r); ok {
+				out[starterPos] = composite
+				continue
+			}
+		}
+		if class == 0 {
+			starterPos = len(out)
+		}
+		lastClass = class
+		out = append(out, r)
+	}
+	return out
+}
+
+func composePair(a, b rune) (rune, bool) {
+	if a >= hangulLBase && a < hangulLBase+hangulLCount && b >= hangulVBase && b < hangulVBase+hangulVCount {
+		return hangulSBase + ((a-hangulLBase)*hangulVCount+(b-hangulVBase))*hangulTCount, true
+	}
+	if a >= hangulSBase && a < hangulSBase+hangulSCount && (a-hangulSBase)%hangulTCount == 0 &&
+		b > hangulTBase && b < hangulTBase+hangulTCount {
+		return a + (b - hangulTBase), true
+	}
+
+	composite, ok := canonicalCompositions[[2]rune{a, b}]
+	return composite, ok
+}
+
+func combiningClass(r rune) int {
+	i := sort.Search(len(combiningClasses), func(i int) bool {
+		return combiningClasses[i].hi >= r
+	})
+	if i < len(combiningClasses) && combiningClasses[i].lo <= r {
+		return int(combiningClasses[i].class)
+	}
+	return 0
+}
+
+func isHangulJamo(r rune) bool {
+	return r >= 0x1100 && r <= 0x11FF
+}
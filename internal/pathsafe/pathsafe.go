@@ -2,6 +2,7 @@ package pathsafe
 
 import (
 	"errors"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
@@ -13,8 +14,13 @@ var (
 	ErrRelpathInvalid = errors.New("relpath invalid")
 	ErrDestAbsInvalid = errors.New("dest_abs must be absolute")
 	ErrRelpathEscapes = errors.New("relpath escapes destination")
+	ErrSymlinkInPath  = errors.New("relpath traverses a symlink")
 )
 
+// DirHook is called with each directory a create walk makes, opened, and
+// the directory it was made in.
+type DirHook func(parent, dir *os.File) error
+
 func SanitizeRelpath(input string) (string, error) {
 	if input == "" {
 		return "", ErrRelpathEmpty
@@ -83,3 +89,10 @@ func hasWindowsDrivePrefix(segment string) bool {
 	}
 	return unicode.IsLetter(rune(segment[0]))
 }
+
+func relSegments(relDir string) []string {
+	if relDir == "" || relDir == "." {
+		return nil
+	}
+	return strings.Split(relDir, "/")
+}
@@ -1,6 +1,8 @@
 package pathsafe
 
 import (
+	"errors"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -66,3 +68,256 @@ func TestJoinAndVerifyRejectsEscapes(t *testing.T) {
 		t.Fatalf("expected escape error")
 	}
 }
+
+func TestOpenDirBeneathRejectsSymlinkedDirectories(t *testing.T) {
+	destAbs := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(destAbs, "photos")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(destAbs, "real", "nested"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(destAbs, "real", "nested", "link")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	for _, relDir := range []string{"photos", "photos/sub", "real/nested/link", "real/nested/link/deeper"} {
+		dir, err := OpenDirBeneath(destAbs, relDir, true, 0o755)
+		if err == nil {
+			_ = dir.Close()
+			t.Fatalf("expected error for %q", relDir)
+		}
+		if !errors.Is(err, ErrSymlinkInPath) {
+			t.Fatalf("expected ErrSymlinkInPath for %q, got %v", relDir, err)
+		}
+	}
+
+	entries, _ := os.ReadDir(outside)
+	if len(entries) != 0 {
+		t.Fatalf("expected nothing created outside destination, got %d entries", len(entries))
+	}
+}
+
+func TestOpenDirBeneathCreatesMissingDirectories(t *testing.T) {
+	destAbs := t.TempDir()
+	dir, err := OpenDirBeneath(destAbs, "a/b/c", true, 0o755)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer dir.Close()
+
+	info, err := os.Stat(filepath.Join(destAbs, "a", "b", "c"))
+	if err != nil || !info.IsDir() {
+		t.Fatalf("expected directory to be created: %v", err)
+	}
+
+	if _, err := OpenDirBeneath(destAbs, "missing", false, 0); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected not-exist error without create, got %v", err)
+	}
+}
+
+func TestLstatAndOpenBeneathDoNotFollowSymlinks(t *testing.T) {
+	destAbs := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(outside, []byte("secret"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(destAbs, "link.txt")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	info, err := LstatBeneath(destAbs, "link.txt")
+	if err != nil {
+		t.Fatalf("unexpected lstat error: %v", err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected symlink mode, got %v", info.Mode())
+	}
+
+	if file, err := OpenFileBeneath(destAbs, "link.txt"); err == nil {
+		_ = file.Close()
+		t.Fatalf("expected open through symlink to fail")
+	}
+}
+
+func TestRemoveBeneathDoesNotFollowSymlinks(t *testing.T) {
+	destAbs := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "a.txt"), []byte("keep"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(destAbs, "dir")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	if err := RemoveBeneath(destAbs, "dir/a.txt"); !errors.Is(err, ErrSymlinkInPath) {
+		t.Fatalf("expected a symlinked parent to be refused, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "a.txt")); err != nil {
+		t.Fatalf("expected the file outside to survive: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(destAbs, "b.txt"), nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := RemoveBeneath(destAbs, "b.txt"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(destAbs, "b.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected b.txt to be removed, got %v", err)
+	}
+}
+
+func TestNFC(t *testing.T) {
+	cases := map[string]string{
+		"plain.txt":                      "plain.txt",
+		"Cafe\u0301.txt":                 "Caf\u00e9.txt",
+		"Caf\u00e9.txt":                  "Caf\u00e9.txt",
+		"\u212b":                         "\u00c5",
+		"A\u030a":                        "\u00c5",
+		"q\u0307\u0323":                  "q\u0323\u0307",
+		"\u1e0b\u0323":                   "\u1e0d\u0307",
+		"\u1100\u1161\u11a8":             "\uac01",
+		"\u09c7\u09be":                   "\u09cb",
+		"\u0344":                         "\u0308\u0301",
+		"\u0301leading":                  "\u0301leading",
+		"\u30cf\u309a\u30f3\u30bf\u3099": "\u30d1\u30f3\u30c0",
+	}
+
+	for input, expected := range cases {
+		if result := NFC(input); result != expected {
+			t.Errorf("NFC(%+q) = %+q, want %+q", input, result, expected)
+		}
+	}
+}
+
+func TestFilenamePolicyRejects(t *testing.T) {
+	policy := DefaultFilenamePolicy()
+	policy.MaxSegmentBytes = 16
+	policy.MaxPathBytes = 32
+
+	rejects := map[string]error{
+		"bell\a.txt":                        ErrNameControlChar,
+		"dir/tab\tname":                     ErrNameControlChar,
+		"what?.txt":                         ErrNameCharacter,
+		"a<b>.txt":                          ErrNameCharacter,
+		"trailing.":                         ErrNameTrailing,
+		"dir /file.txt":                     ErrNameTrailing,
+		"CON":                               ErrNameReserved,
+		"docs/nul.txt":                      ErrNameReserved,
+		"Lpt9.log":                          ErrNameReserved,
+		"seventeen-bytes.xy":                ErrNameTooLong,
+		"aaaaaaa/bbbbbbb/ccccccc/ddddddd/e": ErrNameTooLong,
+	}
+	for input, expected := range rejects {
+		if _, err := policy.Clean(input); !errors.Is(err, expected) {
+			t.Errorf("Clean(%q) error = %v, want %v", input, err, expected)
+		}
+	}
+
+	accepts := map[string]string{
+		"Cafe\u0301/notes.txt": "Caf\u00e9/notes.txt",
+		"CONSOLE.txt":          "CONSOLE.txt",
+		"COM0":                 "COM0",
+		".hidden":              ".hidden",
+	}
+	for input, expected := range accepts {
+		result, err := policy.Clean(input)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", input, err)
+		}
+		if result != expected {
+			t.Fatalf("expected %q for %q, got %q", expected, input, result)
+		}
+	}
+}
+
+func TestFilenamePolicyReplaces(t *testing.T) {
+	policy := DefaultFilenamePolicy()
+	policy.Replace = true
+	policy.Replacement = "-"
+	policy.MaxSegmentBytes = 12
+
+	cases := map[string]string{
+		"bell\a.txt":        "bell.txt",
+		"what?.txt":         "what-.txt",
+		"trailing. .":       "trailing",
+		"dir. /file.txt":    "dir/file.txt",
+		"CON":               "CON-",
+		"nul.tar.gz":        "nul-.tar.gz",
+		"...":               "-",
+		"long-name-here.md": "long-name.md",
+		"\u00e9\u00e9\u00e9\u00e9\u00e9\u00e9\u00e9.txt": "\u00e9\u00e9\u00e9\u00e9.txt",
+	}
+
+	for input, expected := range cases {
+		result, err := policy.Clean(input)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", input, err)
+		}
+		if result != expected {
+			t.Errorf("Clean(%q) = %q, want %q", input, result, expected)
+		}
+		again, err := policy.Apply(result)
+		if err != nil || again != result {
+			t.Errorf("Apply is not idempotent for %q: %q, %v", result, again, err)
+		}
+	}
+
+	policy.Replacement = "/"
+	if result, _ := policy.Clean("a?b"); result != "a_b" {
+		t.Fatalf("expected unsafe replacement to fall back to %q, got %q", DefaultReplacement, result)
+	}
+}
+
+func TestResolveCaseBeneath(t *testing.T) {
+	destAbs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(destAbs, "Photos", "2024"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(destAbs, "Photos", "Report.PDF"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	cases := map[string]string{
+		"photos/report.pdf":     "Photos/Report.PDF",
+		"PHOTOS/2024/new.jpg":   "Photos/2024/new.jpg",
+		"photos/missing/a.txt":  "Photos/missing/a.txt",
+		"other/Report.pdf":      "other/Report.pdf",
+		"Photos/Report.PDF":     "Photos/Report.PDF",
+		"photos/report.pdf/sub": "Photos/Report.PDF/sub",
+	}
+	for input, expected := range cases {
+		result, err := ResolveCaseBeneath(destAbs, input)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", input, err)
+		}
+		if result != expected {
+			t.Errorf("ResolveCaseBeneath(%q) = %q, want %q", input, result, expected)
+		}
+	}
+}
+
+func TestFoldName(t *testing.T) {
+	if FoldName("Café.TXT") != FoldName("café.txt") {
+		t.Fatalf("expected NFC case-folded names to match")
+	}
+	if FoldName("a.txt") == FoldName("b.txt") {
+		t.Fatalf("expected different names to differ")
+	}
+}
+
+func TestProbeCaseInsensitiveLeavesNothingBehind(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := ProbeCaseInsensitive(dir); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("probe left %d entries behind", len(entries))
+	}
+}
@@ -0,0 +1,419 @@
+package publicapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"dropserve/internal/commit"
+	"dropserve/internal/config"
+	"dropserve/internal/control"
+	"dropserve/internal/pathsafe"
+)
+
+type CreateBatchRequest struct {
+	BatchID string `json:"batch_id"`
+	Atomic  *bool  `json:"atomic"`
+}
+
+type BatchResponse struct {
+	BatchID string `json:"batch_id"`
+	Atomic  bool   `json:"atomic"`
+	State   string `json:"state"`
+}
+
+type CommitBatchRequest struct {
+	Files int `json:"files"`
+}
+
+type BatchFileResponse struct {
+	UploadID     string `json:"upload_id"`
+	Status       string `json:"status"`
+	Relpath      string `json:"relpath"`
+	FinalRelpath string `json:"final_relpath,omitempty"`
+}
+
+type CommitBatchResponse struct {
+	BatchID string              `json:"batch_id"`
+	State   string              `json:"state"`
+	Files   []BatchFileResponse `json:"files"`
+}
+
+func (s *Server) handleCreateBatch(w http.ResponseWriter, r *http.Request, portalID string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	if _, ok := s.requireClientToken(w, r, portalID); !ok {
+		return
+	}
+
+	portal, err := s.store.PortalByID(portalID)
+	if err != nil {
+		switch {
+		case errors.Is(err, control.ErrPortalNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
+		case errors.Is(err, control.ErrPortalClosed):
+			writeJSON(w, http.StatusGone, errorResponse{Error: "portal closed"})
+		default:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load portal"})
+		}
+		return
+	}
+
+	var req CreateBatchRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid json"})
+		return
+	}
+
+	batchID := req.BatchID
+	if batchID == "" {
+		minted, err := control.NewBatchID()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to create batch"})
+			return
+		}
+		batchID = minted
+	}
+	atomic := portal.AtomicBatches
+	if req.Atomic != nil {
+		atomic = *req.Atomic
+	}
+	// Files to a review portal are held one by one; approval is the
+	// point where they land.
+	if portal.Review {
+		atomic = false
+	}
+	// A staging tree on another filesystem can only be copied in file by
+	// file, which is not what the client asked for.
+	if atomic && !s.stagesOnDestDevice(portal.DestAbs) {
+		writeJSON(w, http.StatusConflict, errorResponse{Error: "atomic batches need a staging root on the destination's filesystem"})
+		return
+	}
+
+	batch, err := s.store.CreateBatch(portal.ID, batchID, atomic)
+	if err != nil {
+		switch {
+		case errors.Is(err, control.ErrBatchIDInvalid):
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid batch_id"})
+		case errors.Is(err, control.ErrBatchExists):
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "batch already exists"})
+		case errors.Is(err, control.ErrPortalNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
+		case errors.Is(err, control.ErrPortalClosed):
+			writeJSON(w, http.StatusGone, errorResponse{Error: "portal closed"})
+		default:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to create batch"})
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, BatchResponse{BatchID: batch.ID, Atomic: batch.Atomic, State: string(batch.State)})
+}
+
+// handleBatch serves DELETE /api/portals/{portal_id}/batches/{batch_id},
+// which cancels an atomic batch and discards its staged files.
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request, portalID, batchID string) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	if _, ok := s.requireClientToken(w, r, portalID); !ok {
+		return
+	}
+	if err := control.ValidateBatchID(batchID); err != nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "batch not found"})
+		return
+	}
+
+	portal, err := s.store.PortalByID(portalID)
+	if err != nil {
+		switch {
+		case errors.Is(err, control.ErrPortalNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
+		case errors.Is(err, control.ErrPortalClosed):
+			writeJSON(w, http.StatusGone, errorResponse{Error: "portal closed"})
+		default:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load portal"})
+		}
+		return
+	}
+
+	if err := s.store.CancelBatch(portal.ID, batchID); err != nil {
+		writeBatchError(w, err, "failed to cancel batch")
+		return
+	}
+	if err := os.RemoveAll(s.batchStagingDir(portal, batchID)); err != nil {
+		s.logger.Printf("failed to remove batch staging dir batch_id=%s err=%v", batchID, err)
+	}
+
+	writeJSON(w, http.StatusOK, BatchResponse{BatchID: batchID, Atomic: true, State: string(control.BatchCancelled)})
+}
+
+func (s *Server) handleCommitBatch(w http.ResponseWriter, r *http.Request, portalID, batchID string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	if _, ok := s.requireClientToken(w, r, portalID); !ok {
+		return
+	}
+	if err := control.ValidateBatchID(batchID); err != nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "batch not found"})
+		return
+	}
+
+	var req CommitBatchRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid json"})
+		return
+	}
+
+	portal, err := s.store.PortalByID(portalID)
+	if err != nil {
+		switch {
+		case errors.Is(err, control.ErrPortalNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
+		case errors.Is(err, control.ErrPortalClosed):
+			writeJSON(w, http.StatusGone, errorResponse{Error: "portal closed"})
+		default:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load portal"})
+		}
+		return
+	}
+
+	staged, err := s.store.BeginBatchCommit(portal.ID, batchID, req.Files)
+	if err != nil {
+		writeBatchError(w, err, "failed to commit batch")
+		return
+	}
+
+	files, err := s.commitStagedBatch(portal, batchID, staged)
+	if err != nil {
+		s.logger.Printf("batch commit failed batch_id=%s err=%v", batchID, err)
+		s.store.FinishBatch(portal.ID, batchID, control.BatchCancelled)
+	} else {
+		s.store.FinishBatch(portal.ID, batchID, control.BatchCommitted)
+	}
+	if err := os.RemoveAll(s.batchStagingDir(portal, batchID)); err != nil {
+		s.logger.Printf("failed to remove batch staging dir batch_id=%s err=%v", batchID, err)
+	}
+	switch {
+	case errors.Is(err, commit.ErrExists):
+		writeJSON(w, http.StatusConflict, errorResponse{Error: "batch folder already exists"})
+		return
+	case errors.Is(err, pathsafe.ErrSymlinkInPath):
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+		return
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to commit batch"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, CommitBatchResponse{BatchID: batchID, State: string(control.BatchCommitted), Files: files})
+}
+
+func writeBatchError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, control.ErrBatchNotFound):
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "batch not found"})
+	case errors.Is(err, control.ErrBatchNotAtomic),
+		errors.Is(err, control.ErrBatchClosed),
+		errors.Is(err, control.ErrBatchBusy),
+		errors.Is(err, control.ErrBatchIncomplete):
+		writeJSON(w, http.StatusConflict, errorResponse{Error: err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: fallback})
+	}
+}
+
+func (s *Server) batchStagingDir(portal control.Portal, batchID string) string {
+	return filepath.Join(s.portalTempDir(portal), "batches", batchID)
+}
+
+// stageUpload links a verified upload of an atomic batch into the batch's
+// staging tree at its relpath instead of placing it in the destination.
+// Two files of one batch may not share a relpath.
+func (s *Server) stageUpload(pending *commit.Pending, portal control.Portal, upload control.Upload) error {
+	stagingRoot := s.batchStagingDir(portal, upload.BatchID)
+	own := s.ownershipFor(portal)
+	if err := s.makePortalTempDir(portal, path.Join("batches", upload.BatchID), own.dirPerm()); err != nil {
+		return err
+	}
+	hook, err := s.stagedDirHook(portal, stagingRoot, own)
+	if err != nil {
+		return err
+	}
+	dir, err := pathsafe.CreateDirBeneath(stagingRoot, path.Dir(upload.Relpath), own.dirPerm(), hook)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+
+	if err := pending.LinkNoReplace(dir, path.Base(upload.Relpath)); err != nil {
+		return err
+	}
+	// The staged name shares its inode with whatever lands in the
+	// destination, so metadata applied now survives the commit.
+	s.finishPlacedFile(stagingRoot, upload.Relpath, upload, own)
+	if s.fsyncMode == config.FsyncFull {
+		return syncParentDirs(stagingRoot, filepath.Join(stagingRoot, filepath.FromSlash(upload.Relpath)))
+	}
+	return nil
+}
+
+// stagedDirHook is own.setupDir for an atomic batch's staging tree. A
+// folder made directly in the staging root is renamed into the destination
+// at commit, and a rename keeps group and setgid bit, so it takes them from
+// the destination rather than from the temp dir it is made in. Deeper
+// folders inherit from it as they would in the destination.
+func (s *Server) stagedDirHook(portal control.Portal, stagingRoot string, own ownership) (pathsafe.DirHook, error) {
+	rootInfo, err := statDirBeneath(stagingRoot, ".")
+	if err != nil {
+		return nil, err
+	}
+	destInfo, err := statDirBeneath(portal.DestAbs, ".")
+	if err != nil {
+		return nil, err
+	}
+	return func(parent, dir *os.File) error {
+		parentInfo, err := parent.Stat()
+		if err != nil {
+			return err
+		}
+		if os.SameFile(parentInfo, rootInfo) {
+			parentInfo = destInfo
+		}
+		return own.setupDirUnder(parentInfo, dir)
+	}, nil
+}
+
+// finishStagedUpload answers the PUT of an atomic batch's upload: the file
+// is staged, not placed, and reports status "staged" until the batch
+// commits.
+func (s *Server) finishStagedUpload(w http.ResponseWriter, pending *commit.Pending, portal control.Portal, upload control.Upload, serverSHA string, bytesWritten int64, partPath, metaPath string) {
+	if err := s.stageUpload(pending, portal, upload); err != nil {
+		s.failUpload(portal.ID, upload.ID, partPath, metaPath)
+		switch {
+		case errors.Is(err, commit.ErrExists):
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "duplicate relpath in batch"})
+		case errors.Is(err, pathsafe.ErrSymlinkInPath):
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+		default:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to stage upload"})
+		}
+		return
+	}
+
+	if err := os.Remove(metaPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.logger.Printf("failed to remove metadata: %v", err)
+	}
+
+	staged, err := s.store.MarkUploadStaged(portal.ID, upload.ID, serverSHA, bytesWritten)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to stage upload"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, UploadCommitResponse{
+		Status:        string(staged.Status),
+		Relpath:       staged.Relpath,
+		ServerSHA256:  staged.ServerSHA256,
+		BytesReceived: staged.BytesReceived,
+	})
+}
+
+// commitStagedBatch moves a batch's staged folder into the destination with
+// one directory rename, so the whole batch appears complete or not at all.
+// Init keeps every entry of an atomic batch inside that one folder. If the
+// folder cannot be moved, nothing is placed and the error is returned.
+func (s *Server) commitStagedBatch(portal control.Portal, batchID string, staged []control.Upload) ([]BatchFileResponse, error) {
+	files := make([]BatchFileResponse, 0, len(staged))
+	if len(staged) == 0 {
+		return files, nil
+	}
+	top, _, _ := strings.Cut(staged[0].Relpath, "/")
+	if err := s.moveStagedFolder(portal, s.batchStagingDir(portal, batchID), top); err != nil {
+		return nil, err
+	}
+	for _, upload := range staged {
+		files = append(files, s.finishMovedUpload(portal, upload))
+	}
+	return files, nil
+}
+
+// moveStagedFolder renames a staged top-level folder into the destination,
+// relative to a descriptor of the destination and without replacing
+// anything: an existing entry of that name, in any case spelling the portal
+// folds, makes it fail with commit.ErrExists.
+func (s *Server) moveStagedFolder(portal control.Portal, stagingRoot, top string) error {
+	if _, exists, err := s.existingFolder(portal, top); err != nil {
+		return err
+	} else if exists {
+		return commit.ErrExists
+	}
+	dest, err := pathsafe.OpenDirBeneath(portal.DestAbs, ".", false, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dest.Close()
+	}()
+	if err := commit.RenameDirNoReplace(filepath.Join(stagingRoot, top), dest, top); err != nil {
+		return err
+	}
+	if s.fsyncMode == config.FsyncFull {
+		if err := dest.Sync(); err != nil {
+			s.logger.Printf("failed to sync destination after batch move dest=%s err=%v", portal.DestAbs, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) finishMovedUpload(portal control.Portal, upload control.Upload) BatchFileResponse {
+	if s.verifyCommits && !upload.Dir {
+		placedSHA, err := fileSHA256(portal.DestAbs, upload.Relpath)
+		if err != nil || !strings.EqualFold(placedSHA, upload.ServerSHA256) {
+			s.logger.Printf("commit check failed upload_id=%s relpath=%s err=%v", upload.ID, upload.Relpath, err)
+			_ = pathsafe.RemoveBeneath(portal.DestAbs, upload.Relpath)
+			return s.failStagedUpload(upload)
+		}
+	}
+
+	committed, err := s.store.MarkUploadCommitted(portal.ID, upload.ID, upload.ServerSHA256, upload.Relpath, upload.BytesReceived)
+	if err != nil {
+		return BatchFileResponse{UploadID: upload.ID, Status: string(control.UploadFailed), Relpath: upload.Relpath}
+	}
+	s.fileCommitted(portal, committed)
+	return batchFileResponse(committed)
+}
+
+func (s *Server) failStagedUpload(upload control.Upload) BatchFileResponse {
+	if failed, err := s.store.MarkUploadFailed(upload.PortalID, upload.ID); err == nil {
+		upload = failed
+	}
+	return BatchFileResponse{UploadID: upload.ID, Status: string(control.UploadFailed), Relpath: upload.Relpath}
+}
+
+func batchFileResponse(upload control.Upload) BatchFileResponse {
+	return BatchFileResponse{
+		UploadID:     upload.ID,
+		Status:       string(upload.Status),
+		Relpath:      upload.Relpath,
+		FinalRelpath: upload.FinalRelpath,
+	}
+}
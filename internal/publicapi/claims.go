@@ -0,0 +1,100 @@
+package publicapi
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"dropserve/internal/control"
+)
+
+const claimStatusPending = "pending"
+
+// ClaimPendingResponse answers a claim on a portal that needs the
+// operator's approval. The browser shows Code and polls the claim with
+// ClaimToken until it is approved or denied.
+type ClaimPendingResponse struct {
+	Status     string `json:"status"`
+	ClaimID    string `json:"claim_id"`
+	ClaimToken string `json:"claim_token"`
+	Code       string `json:"code"`
+}
+
+// requestClaim is handleClaim for a portal opened with claim approval: no
+// client token is issued until the operator approves the request.
+func (s *Server) requestClaim(w http.ResponseWriter, r *http.Request, portalID string) {
+	request, err := s.store.RequestClaim(portalID, remoteHost(r), r.UserAgent())
+	if err != nil {
+		switch {
+		case errors.Is(err, control.ErrPortalNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
+		case errors.Is(err, control.ErrPortalAlreadyClaimed):
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "Portal already claimed"})
+		case errors.Is(err, control.ErrPortalClosed):
+			writeJSON(w, http.StatusGone, errorResponse{Error: "portal closed"})
+		case errors.Is(err, control.ErrTooManyClaims):
+			writeJSON(w, http.StatusTooManyRequests, errorResponse{Error: err.Error()})
+		default:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to claim portal"})
+		}
+		return
+	}
+
+	s.logger.Printf("claim awaiting approval portal_id=%s claim_id=%s remote_addr=%s", portalID, request.ID, request.RemoteAddr)
+	writeJSON(w, http.StatusAccepted, ClaimPendingResponse{
+		Status:     claimStatusPending,
+		ClaimID:    request.ID,
+		ClaimToken: request.Token,
+		Code:       request.Code,
+	})
+}
+
+// handleClaimStatus lets the browser that made a claim request collect the
+// outcome: 202 while it waits, the usual claim response once approved.
+func (s *Server) handleClaimStatus(w http.ResponseWriter, r *http.Request, portalID, claimID string) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	token := strings.TrimSpace(r.Header.Get("X-Claim-Token"))
+	request, err := s.store.ClaimStatus(portalID, claimID, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, control.ErrClaimDenied):
+			writeJSON(w, http.StatusForbidden, errorResponse{Error: err.Error()})
+		default:
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: control.ErrClaimNotFound.Error()})
+		}
+		return
+	}
+
+	if request.State == control.ClaimPending {
+		writeJSON(w, http.StatusAccepted, ClaimPendingResponse{
+			Status:  claimStatusPending,
+			ClaimID: request.ID,
+			Code:    request.Code,
+		})
+		return
+	}
+
+	result := request.Result
+	writeJSON(w, http.StatusOK, ClaimPortalResponse{
+		PortalID:    result.Portal.ID,
+		ClientID:    result.ClientID,
+		ClientToken: result.ClientToken,
+		ExpiresAt:   result.Portal.OpenUntil.Format(time.RFC3339),
+		Policy:      claimPolicy(result.Portal),
+		Reusable:    result.Portal.Reusable,
+	})
+}
+
+// remoteHost is the address a request came from, without the port.
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,36 @@
+package publicapi
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"dropserve/internal/control"
+)
+
+// maxCodeFormBytes is far more than any code needs.
+const maxCodeFormBytes = 1 << 10
+
+// handleCodeEntry takes the landing page's code form and sends the browser
+// on to the portal the code belongs to, or back to the landing page with
+// ?error= set to unknown-code or too-many-lookups.
+func (s *Server) handleCodeEntry(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCodeFormBytes)
+	if err := r.ParseForm(); err != nil {
+		http.Redirect(w, r, "/?error=unknown-code", http.StatusSeeOther)
+		return
+	}
+
+	host := remoteHost(r)
+	portal, err := s.store.PortalByCode(r.PostForm.Get("code"), host)
+	switch {
+	case errors.Is(err, control.ErrCodeLookups):
+		s.logger.Printf("code lookup refused remote_addr=%s err=%v", host, err)
+		http.Redirect(w, r, "/?error=too-many-lookups", http.StatusSeeOther)
+	case err != nil:
+		s.logger.Printf("unknown portal code remote_addr=%s failed_lookups=%d", host, s.store.FailedCodeLookups())
+		http.Redirect(w, r, "/?error=unknown-code", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/p/"+url.PathEscape(portal.ID), http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,174 @@
+package publicapi
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+
+	"dropserve/internal/config"
+	"dropserve/internal/control"
+	"dropserve/internal/pathsafe"
+)
+
+// Entry types accepted by preflight and init. Files are the default; a
+// directory entry declares a folder, typically an empty one, that would
+// otherwise be lost because no file travels inside it.
+const (
+	entryTypeFile = "file"
+	entryTypeDir  = "dir"
+)
+
+// actionMerge is reported for a directory entry that already exists as a
+// directory: nothing is created and files simply join it.
+const actionMerge = "merge"
+
+var errEntryType = errors.New("type must be file or dir")
+
+func isDirEntry(entryType string) (bool, error) {
+	switch entryType {
+	case "", entryTypeFile:
+		return false, nil
+	case entryTypeDir:
+		return true, nil
+	default:
+		return false, errEntryType
+	}
+}
+
+// createDirBeneath creates relpath and any missing parents beneath root
+// without following symlinks. An existing directory is fine; a file in the
+// way fails with ENOTDIR.
+func (s *Server) createDirBeneath(root, relpath string, own ownership, hook pathsafe.DirHook) error {
+	dir, err := pathsafe.CreateDirBeneath(root, relpath, own.dirPerm(), hook)
+	if err != nil {
+		return err
+	}
+	if err := dir.Close(); err != nil {
+		return err
+	}
+	if s.fsyncMode == config.FsyncFull {
+		return syncParentDirs(root, filepath.Join(root, filepath.FromSlash(relpath)))
+	}
+	return nil
+}
+
+// initDirectory finishes the init of a directory entry on the spot: there
+// is nothing to PUT. The directory is created in the destination, or in the
+// staging tree when the entry belongs to an atomic batch, in which case it
+// lands with the rest of the batch at commit. A review portal holds it for
+// approval like a file.
+func (s *Server) initDirectory(w http.ResponseWriter, r *http.Request, portal control.Portal, clientID, batchID, uploadID, relpath, policy string) {
+	upload, err := s.store.CreateUpload(control.CreateUploadInput{
+		PortalID: portal.ID,
+		ClientID: clientID,
+		BatchID:  batchID,
+		UploadID: uploadID,
+		Relpath:  relpath,
+		Dir:      true,
+		Policy:   policy,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, control.ErrPortalNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
+		case errors.Is(err, control.ErrPortalClosed):
+			writeJSON(w, http.StatusGone, errorResponse{Error: "portal closed"})
+		case errors.Is(err, control.ErrUploadAlreadyCommitted):
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "upload already committed"})
+		case errors.Is(err, control.ErrUploadAlreadyExists):
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "upload already exists"})
+		case errors.Is(err, control.ErrBatchClosed):
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "batch already committed or cancelled"})
+		case errors.Is(err, control.ErrBatchFolders):
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		default:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to initialize upload"})
+		}
+		return
+	}
+
+	if portal.Review {
+		if _, err := s.holdForReview(r, nil, portal, upload, "", 0); err != nil {
+			s.store.DeleteUpload(portal.ID, uploadID)
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to create directory"})
+			return
+		}
+		held, err := s.store.MarkUploadHeld(portal.ID, uploadID, "", 0)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to create directory"})
+			return
+		}
+		writeJSON(w, http.StatusOK, InitUploadResponse{UploadID: uploadID, Relpath: held.Relpath, Status: string(held.Status)})
+		return
+	}
+
+	atomic := false
+	if batchID != "" {
+		if batch, err := s.store.GetBatch(portal.ID, batchID); err == nil {
+			atomic = batch.Atomic
+		}
+	}
+
+	if atomic {
+		stagingRoot := s.batchStagingDir(portal, batchID)
+		own := s.ownershipFor(portal)
+		err := s.makePortalTempDir(portal, path.Join("batches", batchID), own.dirPerm())
+		var hook pathsafe.DirHook
+		if err == nil {
+			hook, err = s.stagedDirHook(portal, stagingRoot, own)
+		}
+		if err == nil {
+			err = s.createDirBeneath(stagingRoot, relpath, own, hook)
+		}
+		if err != nil {
+			s.store.DeleteUpload(portal.ID, uploadID)
+			writeDirError(w, err, "duplicate relpath in batch")
+			return
+		}
+		staged, err := s.store.MarkUploadStaged(portal.ID, uploadID, "", 0)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to stage upload"})
+			return
+		}
+		writeJSON(w, http.StatusOK, InitUploadResponse{UploadID: uploadID, Relpath: staged.Relpath, Status: string(staged.Status)})
+		return
+	}
+
+	committed, err := s.commitDirectory(portal, uploadID, relpath)
+	if err != nil {
+		s.store.DeleteUpload(portal.ID, uploadID)
+		writeDirError(w, err, "file exists")
+		return
+	}
+	writeJSON(w, http.StatusOK, InitUploadResponse{UploadID: uploadID, Relpath: committed.FinalRelpath, Status: string(committed.Status)})
+}
+
+// commitDirectory creates a directory entry in the destination, joining an
+// existing folder of the same name in another case when case is folded.
+func (s *Server) commitDirectory(portal control.Portal, uploadID, relpath string) (control.Upload, error) {
+	resolved, err := s.resolveCase(portal, relpath)
+	if err != nil {
+		return control.Upload{}, err
+	}
+	own := s.ownershipFor(portal)
+	if err := s.createDirBeneath(portal.DestAbs, resolved, own, own.setupDir); err != nil {
+		return control.Upload{}, err
+	}
+	return s.store.MarkUploadCommitted(portal.ID, uploadID, "", resolved, 0)
+}
+
+// writeDirError reports a failed directory creation; notDir is the message
+// for a file standing where the directory should go.
+func writeDirError(w http.ResponseWriter, err error, notDir string) {
+	switch {
+	case errors.Is(err, pathsafe.ErrSymlinkInPath):
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+	case errors.Is(err, syscall.ENOTDIR), errors.Is(err, os.ErrExist):
+		writeJSON(w, http.StatusConflict, errorResponse{Error: notDir})
+	default:
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to create directory"})
+	}
+}
@@ -0,0 +1,27 @@
+package publicapi
+
+import "net/http"
+
+// actionReject is reported by preflight for a file the portal's file type
+// rules refuse by name; its init fails with 415.
+const actionReject = "reject"
+
+// sniffLen is how much of the stream http.DetectContentType looks at.
+const sniffLen = 512
+
+// sniffBuffer keeps the first bytes of an upload stream so the content type
+// can be detected from the data instead of trusting the name.
+type sniffBuffer struct {
+	data []byte
+}
+
+func (b *sniffBuffer) Write(p []byte) (int, error) {
+	if room := sniffLen - len(b.data); room > 0 {
+		b.data = append(b.data, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+func (b *sniffBuffer) contentType() string {
+	return http.DetectContentType(b.data)
+}
@@ -0,0 +1,126 @@
+package publicapi
+
+import (
+	"log"
+	"path/filepath"
+
+	"dropserve/internal/config"
+	"dropserve/internal/control"
+	"dropserve/internal/hooks"
+	"dropserve/internal/webhooks"
+)
+
+func serverHooks(logger *log.Logger) *hooks.Runner {
+	return hooks.New(hooks.Config{
+		OnCommit:    config.HookOnCommit(),
+		OnClose:     config.HookOnClose(),
+		Timeout:     config.HookTimeout(),
+		Concurrency: config.HookConcurrency(),
+		QueueSize:   config.HookQueueSize(),
+	}, logger)
+}
+
+func serverWebhooks(logger *log.Logger) *webhooks.Dispatcher {
+	dispatcher := webhooks.New(webhooks.Config{
+		OutboxDir:   config.WebhookOutbox(),
+		MaxAttempts: config.WebhookMaxAttempts(),
+	}, logger)
+	dispatcher.Start()
+	return dispatcher
+}
+
+// serverWebhook is the receiver configured for every portal, if any.
+func serverWebhook(logger *log.Logger) webhooks.Target {
+	target := webhooks.Target{URL: config.WebhookURL(), Secret: config.WebhookSecret()}
+	if err := webhooks.ValidateURL(target.URL); err != nil {
+		logger.Printf("ignoring DROPSERVE_WEBHOOK_URL: %v", err)
+		return webhooks.Target{}
+	}
+	if target.URL != "" && config.WebhookOutbox() == "" {
+		logger.Printf("ignoring DROPSERVE_WEBHOOK_URL: DROPSERVE_WEBHOOK_OUTBOX is not set")
+		return webhooks.Target{}
+	}
+	return target
+}
+
+// webhookTargets are the server-wide receiver and the portal's own, if set.
+func (s *Server) webhookTargets(portal control.Portal) []webhooks.Target {
+	return []webhooks.Target{
+		s.webhook,
+		{URL: portal.WebhookURL, Secret: portal.WebhookSecret},
+	}
+}
+
+func (s *Server) sendWebhook(portal control.Portal, event webhooks.Event) {
+	event.PortalID = portal.ID
+	event.Dest = portal.DestAbs
+	if err := s.webhooks.Enqueue(event, s.webhookTargets(portal)...); err != nil {
+		s.logger.Printf("webhook enqueue failed event=%s portal=%s err=%v", event.Type, portal.ID, err)
+	}
+}
+
+// fileCommitted announces a file that has just landed: the commit hook runs
+// and an upload.committed webhook is sent. Directory entries and skipped
+// uploads announce nothing.
+func (s *Server) fileCommitted(portal control.Portal, upload control.Upload) {
+	if upload.Dir || upload.Status != control.UploadCommitted {
+		return
+	}
+	s.hooks.Fire(hooks.Event{
+		Event:    hooks.EventCommit,
+		PortalID: portal.ID,
+		Dest:     portal.DestAbs,
+		Relpath:  upload.FinalRelpath,
+		Path:     filepath.Join(portal.DestAbs, filepath.FromSlash(upload.FinalRelpath)),
+		Size:     upload.BytesReceived,
+		SHA256:   upload.ServerSHA256,
+	})
+	s.sendWebhook(portal, webhooks.Event{Type: webhooks.UploadCommitted, Upload: webhookUpload(upload)})
+}
+
+// uploadFailed sends an upload.failed webhook for any upload the store
+// marks failed, whatever the cause.
+func (s *Server) uploadFailed(portal control.Portal, upload control.Upload) {
+	if upload.Dir {
+		return
+	}
+	s.sendWebhook(portal, webhooks.Event{Type: webhooks.UploadFailed, Upload: webhookUpload(upload)})
+}
+
+// portalClosed announces a portal closed by its owner or expired, with what
+// its clients committed: the close hook runs and a portal.closed or
+// portal.expired webhook is sent.
+func (s *Server) portalClosed(portal control.Portal) {
+	event := hooks.Event{
+		Event:    hooks.EventClose,
+		PortalID: portal.ID,
+		Dest:     portal.DestAbs,
+		State:    string(portal.State),
+	}
+	for _, client := range portal.Clients {
+		event.Files += client.FilesCommitted
+		event.Size += client.BytesCommitted
+	}
+	s.hooks.Fire(event)
+
+	eventType := webhooks.PortalClosed
+	if portal.State == control.PortalExpired {
+		eventType = webhooks.PortalExpired
+	}
+	s.sendWebhook(portal, webhooks.Event{
+		Type:   eventType,
+		Portal: &webhooks.Portal{State: string(portal.State), FilesCommitted: event.Files, BytesCommitted: event.Size},
+	})
+}
+
+func webhookUpload(upload control.Upload) *webhooks.Upload {
+	return &webhooks.Upload{
+		UploadID:     upload.ID,
+		ClientID:     upload.ClientID,
+		BatchID:      upload.BatchID,
+		Relpath:      upload.Relpath,
+		FinalRelpath: upload.FinalRelpath,
+		Size:         upload.Size,
+		SHA256:       upload.ServerSHA256,
+	}
+}
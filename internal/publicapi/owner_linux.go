@@ -0,0 +1,42 @@
+package publicapi
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// fileGID returns the group owning info's file, or -1 if unknown.
+func fileGID(info os.FileInfo) int {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(stat.Gid)
+	}
+	return -1
+}
+
+// fileDevice returns the device holding info's file.
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev), true
+	}
+	return 0, false
+}
+
+// utimeOmit tells utimensat to leave a timestamp unchanged.
+const utimeOmit = (1 << 30) - 2
+
+// setModTime sets file's modification time through its descriptor, leaving
+// the access time alone. utimensat has no descriptor form in the syscall
+// package, so it is handed the descriptor's /proc/self/fd link.
+func setModTime(file *os.File, mtime time.Time) error {
+	times := []syscall.Timespec{
+		{Nsec: utimeOmit},
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+	path := "/proc/self/fd/" + strconv.Itoa(int(file.Fd()))
+	if err := syscall.UtimesNano(path, times); err != nil {
+		return &os.PathError{Op: "utimensat", Path: file.Name(), Err: err}
+	}
+	return nil
+}
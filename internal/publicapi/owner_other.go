@@ -0,0 +1,23 @@
+//go:build !linux
+
+package publicapi
+
+import (
+	"os"
+	"time"
+)
+
+// fileGID is unknown off Linux; setgid inheritance is then left to the
+// operating system.
+func fileGID(info os.FileInfo) int {
+	return -1
+}
+
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// setModTime falls back to setting the time by path off Linux.
+func setModTime(file *os.File, mtime time.Time) error {
+	return os.Chtimes(file.Name(), time.Time{}, mtime)
+}
@@ -0,0 +1,186 @@
+package publicapi
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"dropserve/internal/config"
+	"dropserve/internal/control"
+	"dropserve/internal/pathsafe"
+)
+
+// ownership is what a portal's new files and directories get: the portal's
+// settings where it has them, the server's otherwise.
+type ownership struct {
+	fileMode      os.FileMode // 0 keeps 0644 under the umask
+	dirMode       os.FileMode // 0 keeps 0755 under the umask
+	gid           int         // -1 keeps the server user's group
+	inheritSetgid bool
+}
+
+func serverOwnership() ownership {
+	own := ownership{
+		fileMode:      config.FileMode(),
+		dirMode:       config.DirMode(),
+		gid:           -1,
+		inheritSetgid: config.InheritSetgid(),
+	}
+	if group := config.Group(); group != "" {
+		if gid, err := control.LookupGroup(group); err == nil {
+			own.gid = gid
+		}
+	}
+	return own
+}
+
+func (s *Server) ownershipFor(portal control.Portal) ownership {
+	own := s.ownership
+	if portal.FileMode != 0 {
+		own.fileMode = portal.FileMode
+	}
+	if portal.DirMode != 0 {
+		own.dirMode = portal.DirMode
+	}
+	if portal.Group != "" {
+		gid, err := control.LookupGroup(portal.Group)
+		if err != nil {
+			s.logger.Printf("ignoring portal group portal_id=%s err=%v", portal.ID, err)
+		} else {
+			own.gid = gid
+		}
+	}
+	return own
+}
+
+func (o ownership) filePerm() os.FileMode {
+	if o.fileMode != 0 {
+		return o.fileMode
+	}
+	return 0o644
+}
+
+func (o ownership) dirPerm() os.FileMode {
+	if o.dirMode != 0 {
+		return o.dirMode
+	}
+	return 0o755
+}
+
+// groupUnder returns the group a new entry in parent should get, or -1 to
+// leave it alone. A configured group wins over setgid inheritance.
+func (o ownership) groupUnder(parent os.FileInfo) int {
+	if o.gid >= 0 {
+		return o.gid
+	}
+	if o.inheritSetgid && parent.Mode()&os.ModeSetgid != 0 {
+		return fileGID(parent)
+	}
+	return -1
+}
+
+// setupDir is the pathsafe.DirHook for every directory the server creates.
+// mkdir already applied dirPerm under the umask; the explicit chmod bypasses
+// the umask when a mode is configured. The group is set first because
+// chown may clear the setgid bit.
+func (o ownership) setupDir(parent, dir *os.File) error {
+	parentInfo, err := parent.Stat()
+	if err != nil {
+		return err
+	}
+	return o.setupDirUnder(parentInfo, dir)
+}
+
+// setupDirUnder is setupDir with the parent given by its FileInfo, for a
+// directory that is made in one place and will end up in another.
+func (o ownership) setupDirUnder(parentInfo os.FileInfo, dir *os.File) error {
+	if gid := o.groupUnder(parentInfo); gid >= 0 {
+		if err := dir.Chown(-1, gid); err != nil {
+			return err
+		}
+	}
+
+	setgid := o.inheritSetgid && parentInfo.Mode()&os.ModeSetgid != 0
+	if o.dirMode == 0 && !setgid {
+		return nil
+	}
+	mode := o.dirMode
+	if mode == 0 {
+		info, err := dir.Stat()
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+	}
+	if setgid {
+		mode |= os.ModeSetgid
+	}
+	return dir.Chmod(mode)
+}
+
+// finishPlacedFile gives a placed file its group and mode, and the
+// modification time the client sent at init. A configured file mode wins
+// over the client's; the client's applies only while
+// DROPSERVE_PRESERVE_METADATA is on. Everything goes through a descriptor
+// opened without following symlinks. Failures are
+// logged and do not fail the upload: the bytes are already in place and
+// verified.
+func (s *Server) finishPlacedFile(root, relpath string, upload control.Upload, own ownership) {
+	mode := own.fileMode
+	if mode == 0 && s.keepMetadata {
+		mode = upload.Mode
+	}
+	var lastModified time.Time
+	if s.keepMetadata {
+		lastModified = upload.LastModified
+	}
+	if mode == 0 && lastModified.IsZero() && own.gid < 0 && !own.inheritSetgid {
+		return
+	}
+
+	file, err := pathsafe.OpenFileBeneath(root, relpath)
+	if err != nil {
+		s.logger.Printf("failed to open placed file upload_id=%s relpath=%s err=%v", upload.ID, relpath, err)
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	// A rename keeps the group the file had in the temp dir, so setgid
+	// inheritance has to be applied by hand. The parent is opened with the
+	// same symlink-refusing walk, so its group cannot come from elsewhere.
+	if parentInfo, err := statDirBeneath(root, path.Dir(relpath)); err == nil {
+		if gid := own.groupUnder(parentInfo); gid >= 0 {
+			if err := file.Chown(-1, gid); err != nil {
+				s.logger.Printf("failed to set group upload_id=%s relpath=%s err=%v", upload.ID, relpath, err)
+			}
+		}
+	}
+	if mode != 0 {
+		if err := file.Chmod(mode); err != nil {
+			s.logger.Printf("failed to set mode upload_id=%s relpath=%s err=%v", upload.ID, relpath, err)
+		}
+	}
+	if !lastModified.IsZero() {
+		if err := setModTime(file, lastModified); err != nil {
+			s.logger.Printf("failed to set mtime upload_id=%s relpath=%s err=%v", upload.ID, relpath, err)
+		}
+	}
+	if s.fsyncMode != config.FsyncOff {
+		if err := file.Sync(); err != nil {
+			s.logger.Printf("failed to sync metadata upload_id=%s relpath=%s err=%v", upload.ID, relpath, err)
+		}
+	}
+}
+
+func statDirBeneath(root, relDir string) (os.FileInfo, error) {
+	dir, err := pathsafe.OpenDirBeneath(root, relDir, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	return dir.Stat()
+}
@@ -0,0 +1,278 @@
+package publicapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"dropserve/internal/commit"
+	"dropserve/internal/control"
+	"dropserve/internal/pathsafe"
+	"dropserve/internal/review"
+)
+
+const statusRejected = "rejected"
+
+// holdForReview moves a verified upload to a review portal into the review
+// queue instead of the destination. pending is nil for a directory entry.
+func (s *Server) holdForReview(r *http.Request, pending *commit.Pending, portal control.Portal, upload control.Upload, serverSHA string, size int64) (review.Item, error) {
+	item, err := s.review.Add(review.Item{
+		PortalID:       portal.ID,
+		Dest:           portal.DestAbs,
+		UploadID:       upload.ID,
+		Relpath:        upload.Relpath,
+		Dir:            upload.Dir,
+		Size:           size,
+		SHA256:         serverSHA,
+		ClientID:       upload.ClientID,
+		RemoteAddr:     remoteHost(r),
+		UserAgent:      r.UserAgent(),
+		ReceivedAt:     time.Now().UTC(),
+		Policy:         upload.Policy,
+		RenameTemplate: portal.RenameTemplate,
+		CaseMode:       portal.CaseMode,
+		FileMode:       portal.FileMode,
+		DirMode:        portal.DirMode,
+		Group:          portal.Group,
+		LastModified:   upload.LastModified,
+		Mode:           upload.Mode,
+	}, pending)
+	if err != nil {
+		return review.Item{}, err
+	}
+	s.logger.Printf("held for review id=%s portal_id=%s upload_id=%s relpath=%s", item.ID, portal.ID, upload.ID, upload.Relpath)
+	return item, nil
+}
+
+// finishHeldUpload completes the PUT of a file to a review portal.
+func (s *Server) finishHeldUpload(w http.ResponseWriter, r *http.Request, pending *commit.Pending, portal control.Portal, upload control.Upload, serverSHA string, bytesWritten int64, partPath, metaPath string) {
+	if _, err := s.holdForReview(r, pending, portal, upload, serverSHA, bytesWritten); err != nil {
+		s.logger.Printf("failed to hold upload for review upload_id=%s err=%v", upload.ID, err)
+		s.failUpload(portal.ID, upload.ID, partPath, metaPath)
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to commit upload"})
+		return
+	}
+	cleanupUploadArtifacts(partPath, metaPath)
+
+	held, err := s.store.MarkUploadHeld(portal.ID, upload.ID, serverSHA, bytesWritten)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to commit upload"})
+		return
+	}
+	writeJSON(w, http.StatusOK, UploadCommitResponse{
+		Status:        string(held.Status),
+		Relpath:       held.Relpath,
+		ServerSHA256:  held.ServerSHA256,
+		BytesReceived: held.BytesReceived,
+	})
+}
+
+// ReviewHandler serves the operator's side of review portals under
+// /api/control/review. Like the rest of /api/control it must only be
+// reachable from the server's host.
+func (s *Server) ReviewHandler() http.Handler {
+	return s.withRequestID(http.HandlerFunc(s.handleReview))
+}
+
+func (s *Server) handleReview(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/control/review"), "/"), "/")
+	switch {
+	case len(segments) == 1 && segments[0] == "":
+		s.handleReviewList(w, r)
+	case len(segments) == 2 && segments[1] == "approve":
+		s.handleReviewDecision(w, r, segments[0], true)
+	case len(segments) == 2 && segments[1] == "reject":
+		s.handleReviewDecision(w, r, segments[0], false)
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
+	}
+}
+
+func (s *Server) handleReviewList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+	items, err := s.review.List(r.URL.Query().Get("portal_id"))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to list review items"})
+		return
+	}
+	if items == nil {
+		items = []review.Item{}
+	}
+	writeJSON(w, http.StatusOK, control.ReviewListResponse{Items: items})
+}
+
+func (s *Server) handleReviewDecision(w http.ResponseWriter, r *http.Request, id string, approve bool) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+	var req control.ReviewDecisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid json"})
+		return
+	}
+	policy := ""
+	if strings.TrimSpace(req.Policy) != "" {
+		normalized, err := control.NormalizePolicy(req.Policy)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		policy = normalized
+	}
+
+	// Decisions are rare; one at a time keeps two operators from placing
+	// the same item twice.
+	s.reviewMu.Lock()
+	defer s.reviewMu.Unlock()
+
+	item, err := s.review.Get(id)
+	if err != nil {
+		if errors.Is(err, review.ErrNotFound) {
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: review.ErrNotFound.Error()})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load review item"})
+		return
+	}
+
+	if !approve {
+		if err := s.review.Remove(item.ID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to reject review item"})
+			return
+		}
+		s.logger.Printf("review rejected id=%s portal_id=%s relpath=%s", item.ID, item.PortalID, item.Relpath)
+		writeJSON(w, http.StatusOK, control.ReviewDecisionResponse{ID: item.ID, Status: statusRejected, Relpath: item.Relpath})
+		return
+	}
+
+	if policy != "" {
+		item.Policy = policy
+	}
+	resp, status, err := s.approveItem(item)
+	if err != nil {
+		s.logger.Printf("review approval failed id=%s relpath=%s err=%v", item.ID, item.Relpath, err)
+		writeJSON(w, status, errorResponse{Error: err.Error()})
+		return
+	}
+	if err := s.review.Remove(item.ID); err != nil {
+		s.logger.Printf("failed to remove review item id=%s err=%v", item.ID, err)
+	}
+	s.logger.Printf("review approved id=%s portal_id=%s relpath=%s status=%s final_relpath=%s", item.ID, item.PortalID, item.Relpath, resp.Status, resp.FinalRelpath)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// approveItem places a held item in its destination exactly as a fresh
+// upload with the item's conflict policy would be. A conflict under the
+// "fail" policy leaves the item held, so it can be approved again with
+// another policy or rejected.
+func (s *Server) approveItem(item review.Item) (control.ReviewDecisionResponse, int, error) {
+	portal, upload := reviewPlacement(item)
+	for _, known := range s.store.ListPortals() {
+		if known.ID == item.PortalID {
+			portal.WebhookURL, portal.WebhookSecret = known.WebhookURL, known.WebhookSecret
+		}
+	}
+	resp := control.ReviewDecisionResponse{ID: item.ID, Relpath: item.Relpath}
+
+	if item.Dir {
+		own := s.ownershipFor(portal)
+		relpath, err := s.resolveCase(portal, item.Relpath)
+		if err == nil {
+			err = s.createDirBeneath(portal.DestAbs, relpath, own, own.setupDir)
+		}
+		switch {
+		case errors.Is(err, pathsafe.ErrSymlinkInPath):
+			return resp, http.StatusBadRequest, errors.New("invalid relpath")
+		case errors.Is(err, syscall.ENOTDIR), errors.Is(err, os.ErrExist):
+			return resp, http.StatusConflict, errors.New("file exists")
+		case err != nil:
+			return resp, http.StatusInternalServerError, errors.New("failed to create directory")
+		}
+		resp.Status, resp.FinalRelpath = string(control.UploadCommitted), relpath
+		return resp, http.StatusOK, nil
+	}
+
+	pending, err := commit.Open(s.review.DataPath(item.ID))
+	if err != nil {
+		return resp, http.StatusInternalServerError, errors.New("review data missing")
+	}
+	defer func() {
+		_ = pending.Close()
+	}()
+
+	placement, err := s.placeUpload(pending, portal, upload, item.SHA256)
+	if err != nil {
+		if errors.Is(err, pathsafe.ErrSymlinkInPath) {
+			return resp, http.StatusBadRequest, errors.New("invalid relpath")
+		}
+		if errors.Is(err, control.ErrFileTypeDenied) {
+			return resp, http.StatusUnsupportedMediaType, err
+		}
+		if message := relpathError(err); message != "invalid relpath" {
+			return resp, http.StatusBadRequest, errors.New(message)
+		}
+		return resp, http.StatusInternalServerError, errors.New("failed to commit upload")
+	}
+	switch placement.Action {
+	case actionFail:
+		return resp, http.StatusConflict, errors.New("file exists")
+	case actionSkip:
+		resp.Status, resp.FinalRelpath = string(control.UploadSkipped), placement.Relpath
+		return resp, http.StatusOK, nil
+	}
+
+	own := s.ownershipFor(portal)
+	s.finishPlacedFile(portal.DestAbs, placement.Relpath, upload, own)
+	if err := s.syncAndVerify(portal.DestAbs, placement, item.SHA256); err != nil {
+		s.logger.Printf("commit check failed review_id=%s path=%s err=%v", item.ID, placement.Abs, err)
+		if errors.Is(err, errCommitVerification) {
+			_ = pathsafe.RemoveBeneath(portal.DestAbs, placement.Relpath)
+		}
+		return resp, http.StatusInternalServerError, errors.New("failed to commit upload")
+	}
+
+	upload.Status = control.UploadCommitted
+	upload.FinalRelpath = placement.Relpath
+	s.fileCommitted(portal, upload)
+	resp.Status, resp.FinalRelpath = string(control.UploadCommitted), placement.Relpath
+	return resp, http.StatusOK, nil
+}
+
+// reviewPlacement rebuilds the portal settings and upload a held item was
+// received with.
+func reviewPlacement(item review.Item) (control.Portal, control.Upload) {
+	portal := control.Portal{
+		ID:             item.PortalID,
+		DestAbs:        filepath.Clean(item.Dest),
+		RenameTemplate: item.RenameTemplate,
+		CaseMode:       item.CaseMode,
+		FileMode:       item.FileMode,
+		DirMode:        item.DirMode,
+		Group:          item.Group,
+		Review:         true,
+	}
+	upload := control.Upload{
+		ID:            item.UploadID,
+		PortalID:      item.PortalID,
+		ClientID:      item.ClientID,
+		Relpath:       item.Relpath,
+		Dir:           item.Dir,
+		Size:          item.Size,
+		Policy:        item.Policy,
+		LastModified:  item.LastModified,
+		Mode:          item.Mode,
+		ServerSHA256:  item.SHA256,
+		BytesReceived: item.Size,
+	}
+	return portal, upload
+}
@@ -0,0 +1,140 @@
+package publicapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"dropserve/internal/clamd"
+	"dropserve/internal/commit"
+	"dropserve/internal/config"
+	"dropserve/internal/control"
+)
+
+var (
+	errInfected        = errors.New("file infected")
+	errScanUnavailable = errors.New("virus scan unavailable")
+)
+
+// serverScanner is the virus scanner uploads pass before they are
+// committed, or nil when none is configured.
+func serverScanner(logger *log.Logger) *clamd.Client {
+	address := config.ClamdAddress()
+	if address == "" {
+		return nil
+	}
+	scanner, err := clamd.New(address, config.ScanTimeout())
+	if err != nil {
+		logger.Printf("ignoring DROPSERVE_CLAMD_ADDRESS: %v", err)
+		return nil
+	}
+	return scanner
+}
+
+// scanUpload streams the pending data to the scanner. It fails with
+// errInfected for a file the scanner flags, after quarantining it if a
+// quarantine directory is set, and with errScanUnavailable when no verdict
+// could be reached; either way nothing is committed.
+func (s *Server) scanUpload(ctx context.Context, pending *commit.Pending, portal control.Portal, upload control.Upload, serverSHA string) error {
+	if s.scanner == nil {
+		return nil
+	}
+	contents, err := pending.Contents()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errScanUnavailable, err)
+	}
+	started := time.Now()
+	result, err := s.scanner.Scan(ctx, contents)
+	if err != nil {
+		s.logger.Printf("scan failed upload_id=%s relpath=%s err=%v", upload.ID, upload.Relpath, err)
+		return fmt.Errorf("%w: %v", errScanUnavailable, err)
+	}
+	if !result.Infected() {
+		return nil
+	}
+
+	line := fmt.Sprintf("infected upload refused upload_id=%s relpath=%s signature=%q duration=%s",
+		upload.ID, upload.Relpath, result.Signature, time.Since(started).Round(time.Millisecond))
+	if s.quarantineDir != "" {
+		quarantined, err := s.quarantine(pending, portal, upload, serverSHA, result.Signature)
+		if err != nil {
+			line += " quarantine_err=" + err.Error()
+		} else {
+			line += " quarantined=" + quarantined
+		}
+	}
+	s.logger.Print(line)
+	return errInfected
+}
+
+// quarantineRecord sits next to a quarantined file and says where it came
+// from.
+type quarantineRecord struct {
+	PortalID  string `json:"portal_id"`
+	Dest      string `json:"dest"`
+	UploadID  string `json:"upload_id"`
+	ClientID  string `json:"client_id"`
+	Relpath   string `json:"relpath"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+	Time      string `json:"time"`
+}
+
+// quarantine moves the pending data into the quarantine directory and
+// returns its path. The name is the portal ID and a random suffix, as upload
+// IDs repeat across portals and a relpath can be long; the relpath is kept
+// in the record only. A taken name gets a fresh suffix.
+func (s *Server) quarantine(pending *commit.Pending, portal control.Portal, upload control.Upload, serverSHA, signature string) (string, error) {
+	if err := os.MkdirAll(s.quarantineDir, 0o700); err != nil {
+		return "", err
+	}
+	dir, err := os.Open(s.quarantineDir)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = dir.Close() }()
+
+	var name string
+	for attempt := 0; ; attempt++ {
+		suffix := make([]byte, 8)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+		name = portal.ID + "-" + hex.EncodeToString(suffix) + ".quarantine"
+		err := pending.LinkNoReplace(dir, name)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, commit.ErrExists) || attempt >= 3 {
+			return "", err
+		}
+	}
+	quarantined := filepath.Join(s.quarantineDir, name)
+	// Nobody should be able to open the file by accident, whatever mode
+	// the upload was created with.
+	_ = os.Chmod(quarantined, 0o600)
+
+	record, err := json.MarshalIndent(quarantineRecord{
+		PortalID:  portal.ID,
+		Dest:      portal.DestAbs,
+		UploadID:  upload.ID,
+		ClientID:  upload.ClientID,
+		Relpath:   upload.Relpath,
+		Size:      upload.Size,
+		SHA256:    serverSHA,
+		Signature: signature,
+		Time:      time.Now().UTC().Format(time.RFC3339),
+	}, "", "  ")
+	if err == nil {
+		err = os.WriteFile(quarantined+".json", append(record, '\n'), 0o600)
+	}
+	return quarantined, err
+}
@@ -15,21 +15,43 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"dropserve/internal/clamd"
+	"dropserve/internal/commit"
 	"dropserve/internal/config"
 	"dropserve/internal/control"
+	"dropserve/internal/hooks"
 	"dropserve/internal/pathsafe"
+	"dropserve/internal/review"
 	"dropserve/internal/webassets"
+	"dropserve/internal/webhooks"
 )
 
 type Server struct {
-	store       *control.Store
-	logger      *log.Logger
-	tempDirName string
-	assets      fs.FS
-	indexHTML   []byte
+	store         *control.Store
+	logger        *log.Logger
+	tempDirName   string
+	stagingRoots  []string
+	tempBases     sync.Map
+	filenames     pathsafe.FilenamePolicy
+	fsyncMode     string
+	verifyCommits bool
+	keepMetadata  bool
+	ownership     ownership
+	hooks         *hooks.Runner
+	webhooks      *webhooks.Dispatcher
+	webhook       webhooks.Target
+	scanner       *clamd.Client
+	quarantineDir string
+	review        *review.Queue
+	reviewMu      sync.Mutex
+	caseProbes    sync.Map
+	assets        fs.FS
+	indexHTML     []byte
 }
 
 type errorResponse struct {
@@ -38,17 +60,23 @@ type errorResponse struct {
 
 type ClaimPortalResponse struct {
 	PortalID    string      `json:"portal_id"`
+	ClientID    string      `json:"client_id"`
 	ClientToken string      `json:"client_token"`
 	ExpiresAt   string      `json:"expires_at"`
 	Policy      ClaimPolicy `json:"policy"`
 	Reusable    bool        `json:"reusable"`
 }
 
+type ClaimPortalRequest struct {
+	Passphrase string `json:"passphrase"`
+}
+
 type PortalInfoResponse struct {
-	PortalID  string      `json:"portal_id"`
-	ExpiresAt string      `json:"expires_at"`
-	Policy    ClaimPolicy `json:"policy"`
-	Reusable  bool        `json:"reusable"`
+	PortalID   string      `json:"portal_id"`
+	ExpiresAt  string      `json:"expires_at"`
+	Policy     ClaimPolicy `json:"policy"`
+	Reusable   bool        `json:"reusable"`
+	Passphrase bool        `json:"passphrase,omitempty"`
 }
 
 type ClosePortalResponse struct {
@@ -56,41 +84,69 @@ type ClosePortalResponse struct {
 }
 
 type ClaimPolicy struct {
-	Overwrite  bool `json:"overwrite"`
-	Autorename bool `json:"autorename"`
+	Overwrite     bool   `json:"overwrite"`
+	Autorename    bool   `json:"autorename"`
+	Default       string `json:"default"`
+	FolderPolicy  string `json:"folder_policy"`
+	AtomicBatches bool   `json:"atomic_batches"`
+	Review        bool   `json:"review,omitempty"`
 }
 
 type InitUploadRequest struct {
 	UploadID     string  `json:"upload_id"`
 	Relpath      string  `json:"relpath"`
+	Type         string  `json:"type"`
 	Size         int64   `json:"size"`
 	ClientSHA256 *string `json:"client_sha256"`
+	LastModified *int64  `json:"last_modified"`
+	Mode         *uint32 `json:"mode"`
 	Policy       string  `json:"policy"`
+	FolderPolicy string  `json:"folder_policy"`
+	BatchID      string  `json:"batch_id"`
 }
 
 type InitUploadResponse struct {
 	UploadID string `json:"upload_id"`
-	PutURL   string `json:"put_url"`
+	PutURL   string `json:"put_url,omitempty"`
+	Relpath  string `json:"relpath"`
+	Status   string `json:"status"`
 }
 
 type PreflightItem struct {
 	Relpath string `json:"relpath"`
+	Type    string `json:"type"`
 	Size    int64  `json:"size"`
 }
 
 type PreflightRequest struct {
-	Items []PreflightItem `json:"items"`
+	Items        []PreflightItem `json:"items"`
+	Policy       string          `json:"policy"`
+	FolderPolicy string          `json:"folder_policy"`
 }
 
 type PreflightConflict struct {
-	Relpath string `json:"relpath"`
-	Reason  string `json:"reason"`
+	Relpath          string `json:"relpath"`
+	RequestedRelpath string `json:"requested_relpath,omitempty"`
+	Type             string `json:"type"`
+	Reason           string `json:"reason"`
+	Action           string `json:"action"`
+}
+
+type PreflightAction struct {
+	Relpath          string `json:"relpath"`
+	RequestedRelpath string `json:"requested_relpath,omitempty"`
+	Type             string `json:"type"`
+	Action           string `json:"action"`
 }
 
 type PreflightResponse struct {
-	TotalFiles int                 `json:"total_files"`
-	TotalBytes int64               `json:"total_bytes"`
-	Conflicts  []PreflightConflict `json:"conflicts"`
+	TotalFiles   int                 `json:"total_files"`
+	TotalDirs    int                 `json:"total_dirs"`
+	TotalBytes   int64               `json:"total_bytes"`
+	Policy       string              `json:"policy"`
+	FolderPolicy string              `json:"folder_policy"`
+	Items        []PreflightAction   `json:"items"`
+	Conflicts    []PreflightConflict `json:"conflicts"`
 }
 
 type UploadCommitResponse struct {
@@ -111,6 +167,20 @@ type UploadStatusResponse struct {
 
 type requestIDKey struct{}
 
+const maxRenameAttempts = 10000
+
+var errCommitVerification = errors.New("placed file does not match uploaded sha256")
+
+// Actions reported by preflight and applied at commit for each item.
+const (
+	actionCreate          = "create"
+	actionOverwrite       = "overwrite"
+	actionAutorename      = "autorename"
+	actionSkip            = "skip"
+	actionFail            = "fail"
+	actionSkipIfIdentical = "skip-if-identical"
+)
+
 const landingPageHTML = `<!DOCTYPE html>
 <html lang="en">
 <head>
@@ -1036,13 +1106,28 @@ func NewServer(store *control.Store, logger *log.Logger) *Server {
 		logger.Printf("failed to load index.html: %v", err)
 	}
 
-	return &Server{
-		store:       store,
-		logger:      logger,
-		tempDirName: config.TempDirName(),
-		assets:      assets,
-		indexHTML:   indexHTML,
-	}
+	s := &Server{
+		store:         store,
+		logger:        logger,
+		tempDirName:   config.TempDirName(),
+		stagingRoots:  config.StagingRoots(),
+		filenames:     config.FilenamePolicy(),
+		fsyncMode:     config.FsyncMode(),
+		verifyCommits: config.VerifyCommits(),
+		keepMetadata:  config.PreserveMetadata(),
+		ownership:     serverOwnership(),
+		hooks:         serverHooks(logger),
+		webhooks:      serverWebhooks(logger),
+		webhook:       serverWebhook(logger),
+		scanner:       serverScanner(logger),
+		quarantineDir: config.QuarantineDir(),
+		review:        review.New(config.ReviewDir()),
+		assets:        assets,
+		indexHTML:     indexHTML,
+	}
+	store.OnPortalClosed(s.portalClosed)
+	store.OnUploadFailed(s.uploadFailed)
+	return s
 }
 
 func (s *Server) Handler() http.Handler {
@@ -1061,6 +1146,10 @@ func (s *Server) handleLanding(w http.ResponseWriter, r *http.Request) {
 		s.serveNotFound(w, r)
 		return
 	}
+	if r.Method == http.MethodPost {
+		s.handleCodeEntry(w, r)
+		return
+	}
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
 		return
@@ -1107,6 +1196,22 @@ func (s *Server) handlePortals(w http.ResponseWriter, r *http.Request) {
 	}
 
 	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) == 3 && segments[1] == "uploads" {
+		s.handleUpload(w, r, segments[0], segments[2])
+		return
+	}
+	if len(segments) == 3 && segments[1] == "batches" {
+		s.handleBatch(w, r, segments[0], segments[2])
+		return
+	}
+	if len(segments) == 3 && segments[1] == "claims" {
+		s.handleClaimStatus(w, r, segments[0], segments[2])
+		return
+	}
+	if len(segments) == 4 && segments[1] == "batches" && segments[3] == "commit" {
+		s.handleCommitBatch(w, r, segments[0], segments[2])
+		return
+	}
 	if len(segments) != 2 {
 		writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
 		return
@@ -1122,6 +1227,8 @@ func (s *Server) handlePortals(w http.ResponseWriter, r *http.Request) {
 		s.handleClaim(w, r, portalID)
 	case "uploads":
 		s.handleInitUpload(w, r, portalID)
+	case "batches":
+		s.handleCreateBatch(w, r, portalID)
 	case "preflight":
 		s.handlePreflight(w, r, portalID)
 	case "close":
@@ -1156,13 +1263,11 @@ func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request, portalID str
 	}
 
 	resp := PortalInfoResponse{
-		PortalID:  portal.ID,
-		ExpiresAt: portal.OpenUntil.Format(time.RFC3339),
-		Policy: ClaimPolicy{
-			Overwrite:  portal.DefaultPolicy == "overwrite",
-			Autorename: portal.DefaultPolicy == "autorename",
-		},
-		Reusable: portal.Reusable,
+		PortalID:   portal.ID,
+		ExpiresAt:  portal.OpenUntil.Format(time.RFC3339),
+		Policy:     claimPolicy(portal),
+		Reusable:   portal.Reusable,
+		Passphrase: portal.Passphrase.IsSet(),
 	}
 
 	writeJSON(w, http.StatusOK, resp)
@@ -1174,11 +1279,36 @@ func (s *Server) handleClaim(w http.ResponseWriter, r *http.Request, portalID st
 		return
 	}
 
-	if err := decodeEmptyJSON(r); err != nil {
+	var req ClaimPortalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
 		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid json"})
 		return
 	}
 
+	if err := s.store.CheckPassphrase(portalID, remoteHost(r), req.Passphrase); err != nil {
+		switch {
+		case errors.Is(err, control.ErrPortalNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
+		case errors.Is(err, control.ErrPassphraseRequired), errors.Is(err, control.ErrPassphraseWrong):
+			s.logger.Printf("claim refused portal_id=%s remote_addr=%s err=%v", portalID, remoteHost(r), err)
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: err.Error()})
+		case errors.Is(err, control.ErrPassphraseAttempts):
+			var attempts *control.PassphraseAttemptsError
+			if errors.As(err, &attempts) {
+				w.Header().Set("Retry-After", strconv.Itoa(int((attempts.RetryAfter+time.Second-1)/time.Second)))
+			}
+			writeJSON(w, http.StatusTooManyRequests, errorResponse{Error: err.Error()})
+		default:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to claim portal"})
+		}
+		return
+	}
+
+	if portal, err := s.store.PortalByID(portalID); err == nil && portal.ApproveClaims {
+		s.requestClaim(w, r, portalID)
+		return
+	}
+
 	result, err := s.store.ClaimPortal(portalID)
 	if err != nil {
 		switch {
@@ -1196,13 +1326,11 @@ func (s *Server) handleClaim(w http.ResponseWriter, r *http.Request, portalID st
 
 	resp := ClaimPortalResponse{
 		PortalID:    result.Portal.ID,
+		ClientID:    result.ClientID,
 		ClientToken: result.ClientToken,
 		ExpiresAt:   result.Portal.OpenUntil.Format(time.RFC3339),
-		Policy: ClaimPolicy{
-			Overwrite:  result.Portal.DefaultPolicy == "overwrite",
-			Autorename: result.Portal.DefaultPolicy == "autorename",
-		},
-		Reusable: result.Portal.Reusable,
+		Policy:      claimPolicy(result.Portal),
+		Reusable:    result.Portal.Reusable,
 	}
 
 	writeJSON(w, http.StatusOK, resp)
@@ -1232,7 +1360,7 @@ func (s *Server) handlePreflight(w http.ResponseWriter, r *http.Request, portalI
 		return
 	}
 
-	if !s.requireClientToken(w, r, portalID) {
+	if _, ok := s.requireClientToken(w, r, portalID); !ok {
 		return
 	}
 
@@ -1244,38 +1372,198 @@ func (s *Server) handlePreflight(w http.ResponseWriter, r *http.Request, portalI
 		return
 	}
 
+	policy := strings.TrimSpace(req.Policy)
+	if policy == "" {
+		policy = portal.DefaultPolicy
+	}
+	policy, err = control.NormalizePolicy(policy)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	folderPolicy, err := s.folderPolicy(portal, req.FolderPolicy)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
 	totalBytes := int64(0)
-	conflicts := make([]PreflightConflict, 0)
-	for _, item := range req.Items {
+	totalDirs := 0
+	cleaned := make([]string, len(req.Items))
+	dirs := make([]bool, len(req.Items))
+	for i, item := range req.Items {
+		dir, err := isDirEntry(item.Type)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
 		if item.Size < 0 {
 			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "size must be non-negative"})
 			return
 		}
-		cleanedRelpath, err := pathsafe.SanitizeRelpath(item.Relpath)
-		if err != nil {
-			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+		if dir && item.Size != 0 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "directory entries have no content"})
 			return
 		}
-		finalAbs, err := pathsafe.JoinAndVerify(portal.DestAbs, cleanedRelpath)
+		cleanedRelpath, err := s.filenames.Clean(item.Relpath)
 		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: relpathError(err)})
+			return
+		}
+		if _, err := pathsafe.JoinAndVerify(portal.DestAbs, cleanedRelpath); err != nil {
 			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
 			return
 		}
+		cleaned[i] = cleanedRelpath
+		dirs[i] = dir
+		if dir {
+			totalDirs++
+		}
 		totalBytes += item.Size
-		if _, err := os.Stat(finalAbs); err != nil {
+	}
+
+	// Under folder autorename a dropped folder that already exists is
+	// reported once, and its files are shown where they will land in the
+	// first free "name (n)". Merge leaves every file to the conflict policy.
+	conflicts := make([]PreflightConflict, 0)
+	renamedFolders := make(map[string]string)
+	var folders []string
+	if folderPolicy == control.FolderPolicyAutorename {
+		folders = topFolders(cleaned, dirs)
+	}
+	for _, folder := range folders {
+		_, exists, err := s.existingFolder(portal, folder)
+		if err != nil {
+			if errors.Is(err, pathsafe.ErrSymlinkInPath) {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to preflight upload"})
+			return
+		}
+		if !exists {
+			continue
+		}
+		target, err := s.freeFolder(portal, folder)
+		if err != nil {
+			if errors.Is(err, pathsafe.ErrSymlinkInPath) {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+				return
+			}
+			if errors.Is(err, pathsafe.ErrNameTooLong) {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: relpathError(err)})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to preflight upload"})
+			return
+		}
+		renamedFolders[folder] = target
+		conflicts = append(conflicts, PreflightConflict{Relpath: target, RequestedRelpath: folder, Type: entryTypeDir, Reason: "folder_exists", Action: actionAutorename})
+	}
+
+	type batchEntry struct {
+		size int64
+		dir  bool
+	}
+
+	foldCase := s.foldsCase(portal)
+	batch := make(map[string]batchEntry, len(req.Items))
+	actions := make([]PreflightAction, 0, len(req.Items))
+	for i, item := range req.Items {
+		cleanedRelpath := cleaned[i]
+		dir := dirs[i]
+		entryType := entryTypeFile
+		if dir {
+			entryType = entryTypeDir
+		}
+		if folder, rest, ok := splitTopFolder(cleanedRelpath, dir); ok {
+			if target, ok := renamedFolders[folder]; ok {
+				cleanedRelpath = path.Join(target, rest)
+			}
+		}
+
+		// Two items in one batch that land on the same name collide with
+		// each other even though neither exists yet. A folder declared twice
+		// is harmless.
+		batchKey := cleanedRelpath
+		if foldCase {
+			batchKey = pathsafe.FoldName(cleanedRelpath)
+		}
+		first, duplicate := batch[batchKey]
+		if !duplicate {
+			batch[batchKey] = batchEntry{size: item.Size, dir: dir}
+		}
+		if duplicate && first.dir && dir {
+			duplicate = false
+		}
+
+		cleanedRelpath, err = s.resolveCase(portal, cleanedRelpath)
+		if err != nil {
+			if errors.Is(err, pathsafe.ErrSymlinkInPath) {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to preflight upload"})
+			return
+		}
+		requested := ""
+		if cleanedRelpath != item.Relpath {
+			requested = item.Relpath
+		}
+
+		if !dir && !portal.FileTypes.AllowsName(cleanedRelpath) {
+			actions = append(actions, PreflightAction{Relpath: cleanedRelpath, RequestedRelpath: requested, Type: entryType, Action: actionReject})
+			conflicts = append(conflicts, PreflightConflict{Relpath: cleanedRelpath, RequestedRelpath: requested, Type: entryType, Reason: "file_type", Action: actionReject})
+			continue
+		}
+
+		if duplicate {
+			action := policyAction(policy, first.size == item.Size)
+			if dir || first.dir {
+				action = actionFail
+			}
+			actions = append(actions, PreflightAction{Relpath: cleanedRelpath, RequestedRelpath: requested, Type: entryType, Action: action})
+			conflicts = append(conflicts, PreflightConflict{Relpath: cleanedRelpath, RequestedRelpath: requested, Type: entryType, Reason: "duplicate", Action: action})
+			continue
+		}
+
+		info, err := pathsafe.LstatBeneath(portal.DestAbs, cleanedRelpath)
+		if err != nil {
 			if errors.Is(err, os.ErrNotExist) {
+				actions = append(actions, PreflightAction{Relpath: cleanedRelpath, RequestedRelpath: requested, Type: entryType, Action: actionCreate})
 				continue
 			}
+			if errors.Is(err, pathsafe.ErrSymlinkInPath) {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+				return
+			}
 			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to preflight upload"})
 			return
 		}
-		conflicts = append(conflicts, PreflightConflict{Relpath: cleanedRelpath, Reason: "exists"})
+		if dir {
+			// An existing folder is merged into; anything else in the way
+			// fails the directory whatever the conflict policy.
+			if info.IsDir() {
+				actions = append(actions, PreflightAction{Relpath: cleanedRelpath, RequestedRelpath: requested, Type: entryType, Action: actionMerge})
+				continue
+			}
+			actions = append(actions, PreflightAction{Relpath: cleanedRelpath, RequestedRelpath: requested, Type: entryType, Action: actionFail})
+			conflicts = append(conflicts, PreflightConflict{Relpath: cleanedRelpath, RequestedRelpath: requested, Type: entryType, Reason: "exists", Action: actionFail})
+			continue
+		}
+		action := conflictAction(policy, info, item.Size)
+		actions = append(actions, PreflightAction{Relpath: cleanedRelpath, RequestedRelpath: requested, Type: entryType, Action: action})
+		conflicts = append(conflicts, PreflightConflict{Relpath: cleanedRelpath, RequestedRelpath: requested, Type: entryType, Reason: "exists", Action: action})
 	}
 
 	writeJSON(w, http.StatusOK, PreflightResponse{
-		TotalFiles: len(req.Items),
-		TotalBytes: totalBytes,
-		Conflicts:  conflicts,
+		TotalFiles:   len(req.Items) - totalDirs,
+		TotalDirs:    totalDirs,
+		TotalBytes:   totalBytes,
+		Policy:       policy,
+		FolderPolicy: folderPolicy,
+		Items:        actions,
+		Conflicts:    conflicts,
 	})
 }
 
@@ -1303,7 +1591,8 @@ func (s *Server) handleInitUpload(w http.ResponseWriter, r *http.Request, portal
 		return
 	}
 
-	if !s.requireClientToken(w, r, portalID) {
+	clientID, ok := s.requireClientToken(w, r, portalID)
+	if !ok {
 		return
 	}
 
@@ -1315,24 +1604,61 @@ func (s *Server) handleInitUpload(w http.ResponseWriter, r *http.Request, portal
 		return
 	}
 
-	if strings.TrimSpace(req.UploadID) == "" {
-		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "upload_id required"})
+	uploadID := req.UploadID
+	if uploadID == "" {
+		minted, err := control.NewUploadID()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to initialize upload"})
+			return
+		}
+		uploadID = minted
+	} else if err := control.ValidateUploadID(uploadID); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid upload_id"})
 		return
 	}
 	if req.Size < 0 {
 		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "size must be non-negative"})
 		return
 	}
+	dir, err := isDirEntry(req.Type)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	if dir && (req.Size != 0 || req.ClientSHA256 != nil) {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "directory entries have no content"})
+		return
+	}
+	var lastModified time.Time
+	if req.LastModified != nil {
+		if *req.LastModified < 0 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "last_modified must be non-negative"})
+			return
+		}
+		lastModified = time.UnixMilli(*req.LastModified)
+	}
+	var mode os.FileMode
+	if req.Mode != nil {
+		if *req.Mode > 0o777 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "mode must be permission bits (0-0777)"})
+			return
+		}
+		mode = clientFileMode(*req.Mode)
+	}
 
-	cleanedRelpath, err := pathsafe.SanitizeRelpath(req.Relpath)
+	cleanedRelpath, err := s.filenames.Clean(req.Relpath)
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: relpathError(err)})
 		return
 	}
 	if _, err := pathsafe.JoinAndVerify(portal.DestAbs, cleanedRelpath); err != nil {
 		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
 		return
 	}
+	if !dir && !portal.FileTypes.AllowsName(cleanedRelpath) {
+		writeJSON(w, http.StatusUnsupportedMediaType, errorResponse{Error: control.ErrFileTypeDenied.Error()})
+		return
+	}
 
 	policy := strings.TrimSpace(req.Policy)
 	if policy == "" {
@@ -1343,6 +1669,82 @@ func (s *Server) handleInitUpload(w http.ResponseWriter, r *http.Request, portal
 		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
 		return
 	}
+	folderPolicy, err := s.folderPolicy(portal, req.FolderPolicy)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	if req.BatchID != "" {
+		if err := control.ValidateBatchID(req.BatchID); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid batch_id"})
+			return
+		}
+	}
+
+	if _, _, inFolder := splitTopFolder(cleanedRelpath, dir); folderPolicy == control.FolderPolicyAutorename && inFolder {
+		if req.BatchID == "" {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "batch_id required with folder_policy autorename"})
+			return
+		}
+		cleanedRelpath, err = s.batchRelpath(portal, req.BatchID, cleanedRelpath, dir)
+		if err != nil {
+			switch {
+			case errors.Is(err, pathsafe.ErrSymlinkInPath):
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+			case errors.Is(err, pathsafe.ErrNameTooLong):
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: relpathError(err)})
+			default:
+				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to initialize upload"})
+			}
+			return
+		}
+	}
+
+	// An atomic batch lands with one rename of its top-level folder, which
+	// must not exist yet; merging into an existing one is file by file.
+	if req.BatchID != "" {
+		if batch, err := s.store.GetBatch(portal.ID, req.BatchID); err == nil && batch.Atomic {
+			folder, _, inFolder := splitTopFolder(cleanedRelpath, dir)
+			if !inFolder {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: control.ErrBatchFolders.Error()})
+				return
+			}
+			if _, exists, err := s.existingFolder(portal, folder); err != nil {
+				if errors.Is(err, pathsafe.ErrSymlinkInPath) {
+					writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+					return
+				}
+				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to initialize upload"})
+				return
+			} else if exists {
+				writeJSON(w, http.StatusConflict, errorResponse{Error: "batch folder already exists"})
+				return
+			}
+		}
+	}
+
+	if dir {
+		s.initDirectory(w, r, portal, clientID, req.BatchID, uploadID, cleanedRelpath, policy)
+		return
+	}
+
+	if policy == control.PolicyFail {
+		existingRelpath, err := s.resolveCase(portal, cleanedRelpath)
+		if err == nil {
+			_, err = pathsafe.LstatBeneath(portal.DestAbs, existingRelpath)
+		}
+		if err == nil {
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "file exists"})
+			return
+		} else if errors.Is(err, pathsafe.ErrSymlinkInPath) {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+			return
+		} else if !errors.Is(err, os.ErrNotExist) {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to initialize upload"})
+			return
+		}
+	}
 
 	clientSHA := ""
 	if req.ClientSHA256 != nil {
@@ -1351,11 +1753,15 @@ func (s *Server) handleInitUpload(w http.ResponseWriter, r *http.Request, portal
 
 	if _, err := s.store.CreateUpload(control.CreateUploadInput{
 		PortalID:     portal.ID,
-		UploadID:     req.UploadID,
+		ClientID:     clientID,
+		BatchID:      req.BatchID,
+		UploadID:     uploadID,
 		Relpath:      cleanedRelpath,
 		Size:         req.Size,
 		ClientSHA256: clientSHA,
 		Policy:       policy,
+		LastModified: lastModified,
+		Mode:         mode,
 	}); err != nil {
 		switch {
 		case errors.Is(err, control.ErrPortalNotFound):
@@ -1366,39 +1772,49 @@ func (s *Server) handleInitUpload(w http.ResponseWriter, r *http.Request, portal
 			writeJSON(w, http.StatusConflict, errorResponse{Error: "upload already committed"})
 		case errors.Is(err, control.ErrUploadAlreadyExists):
 			writeJSON(w, http.StatusConflict, errorResponse{Error: "upload already exists"})
+		case errors.Is(err, control.ErrBatchClosed):
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "batch already committed or cancelled"})
+		case errors.Is(err, control.ErrBatchFolders):
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
 		default:
 			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to initialize upload"})
 		}
 		return
 	}
 
-	tempDir := s.uploadTempDir(portal.DestAbs, portal.ID)
-	if err := os.MkdirAll(tempDir, 0o755); err != nil {
-		s.store.DeleteUpload(req.UploadID)
+	tempDir := s.uploadTempDir(portal)
+	if err := s.makePortalTempDir(portal, "uploads", s.ownershipFor(portal).dirPerm()); err != nil {
+		s.store.DeleteUpload(portal.ID, uploadID)
 		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to prepare upload"})
 		return
 	}
 
-	_, metaPath := uploadTempPaths(tempDir, req.UploadID)
+	_, metaPath := uploadTempPaths(tempDir, uploadID)
 	meta := uploadMetadata{
 		PortalID:     portal.ID,
-		UploadID:     req.UploadID,
+		UploadID:     uploadID,
 		Relpath:      cleanedRelpath,
 		Size:         req.Size,
 		Policy:       policy,
 		ClientSHA256: clientSHA,
+		Mode:         uint32(mode),
 		CreatedAt:    time.Now().UTC().Format(time.RFC3339),
 	}
+	if !lastModified.IsZero() {
+		meta.LastModified = lastModified.UTC().Format(time.RFC3339Nano)
+	}
 	if err := writeUploadMetadata(metaPath, meta); err != nil {
 		cleanupUploadArtifacts("", metaPath)
-		s.store.DeleteUpload(req.UploadID)
+		s.store.DeleteUpload(portal.ID, uploadID)
 		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to prepare upload"})
 		return
 	}
 
 	writeJSON(w, http.StatusOK, InitUploadResponse{
-		UploadID: req.UploadID,
-		PutURL:   "/api/uploads/" + req.UploadID,
+		UploadID: uploadID,
+		PutURL:   "/api/portals/" + portal.ID + "/uploads/" + uploadID,
+		Relpath:  cleanedRelpath,
+		Status:   string(control.UploadWriting),
 	})
 }
 
@@ -1413,7 +1829,7 @@ func (s *Server) handleClose(w http.ResponseWriter, r *http.Request, portalID st
 		return
 	}
 
-	if !s.requireClientToken(w, r, portalID) {
+	if !s.requireOwner(w, r, portalID) {
 		return
 	}
 
@@ -1440,6 +1856,21 @@ func (s *Server) handleClose(w http.ResponseWriter, r *http.Request, portalID st
 	writeJSON(w, http.StatusOK, ClosePortalResponse{Status: "closed"})
 }
 
+// handleUpload serves the portal-scoped upload resource: PUT streams bytes,
+// GET reports status.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request, portalID, uploadID string) {
+	switch r.Method {
+	case http.MethodPut:
+		s.handleUploadStream(w, r, portalID, uploadID)
+	case http.MethodGet:
+		s.handleUploadStatus(w, r, portalID, uploadID)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+	}
+}
+
+// handleUploads serves the deprecated unscoped /api/uploads/{id} routes by
+// resolving the ID to its portal and delegating to the portal-scoped handlers.
 func (s *Server) handleUploads(w http.ResponseWriter, r *http.Request) {
 	pathValue := strings.TrimPrefix(r.URL.Path, "/api/uploads/")
 	if pathValue == r.URL.Path {
@@ -1448,25 +1879,54 @@ func (s *Server) handleUploads(w http.ResponseWriter, r *http.Request) {
 	}
 
 	segments := strings.Split(strings.Trim(pathValue, "/"), "/")
-	if len(segments) == 1 {
-		s.handleUploadStream(w, r, segments[0])
+	var method string
+	switch {
+	case len(segments) == 1:
+		method = http.MethodPut
+	case len(segments) == 2 && segments[1] == "status":
+		method = http.MethodGet
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
 		return
 	}
-	if len(segments) == 2 && segments[1] == "status" {
-		s.handleUploadStatus(w, r, segments[0])
+	if r.Method != method {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	upload, err := s.store.LookupUpload(segments[0])
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "upload not found"})
+		return
+	}
+
+	successor := "/api/portals/" + upload.PortalID + "/uploads/" + upload.ID
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+
+	// A caller holding another portal's token (or none) must not learn that
+	// the ID exists, so token failures look like a missing upload here.
+	token := strings.TrimSpace(r.Header.Get("X-Client-Token"))
+	if _, err := s.store.RequireClientToken(upload.PortalID, token); errors.Is(err, control.ErrClientTokenRequired) || errors.Is(err, control.ErrClientTokenInvalid) {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "upload not found"})
 		return
 	}
 
-	writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
+	s.handleUpload(w, r, upload.PortalID, upload.ID)
 }
 
-func (s *Server) handleUploadStream(w http.ResponseWriter, r *http.Request, uploadID string) {
+func (s *Server) handleUploadStream(w http.ResponseWriter, r *http.Request, portalID, uploadID string) {
 	if r.Method != http.MethodPut {
 		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
 		return
 	}
 
-	upload, err := s.store.GetUpload(uploadID)
+	if err := control.ValidateUploadID(uploadID); err != nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "upload not found"})
+		return
+	}
+
+	upload, err := s.store.GetUpload(portalID, uploadID)
 	if err != nil {
 		switch {
 		case errors.Is(err, control.ErrUploadNotFound):
@@ -1477,10 +1937,14 @@ func (s *Server) handleUploadStream(w http.ResponseWriter, r *http.Request, uplo
 		return
 	}
 
-	if upload.Status == control.UploadCommitted {
+	if upload.Status == control.UploadCommitted || upload.Status == control.UploadSkipped || upload.Status == control.UploadHeld {
 		writeJSON(w, http.StatusConflict, errorResponse{Error: "upload already committed"})
 		return
 	}
+	if upload.Dir {
+		writeJSON(w, http.StatusConflict, errorResponse{Error: "directory entries have no content"})
+		return
+	}
 
 	portal, err := s.store.PortalByID(upload.PortalID)
 	if err != nil {
@@ -1495,14 +1959,14 @@ func (s *Server) handleUploadStream(w http.ResponseWriter, r *http.Request, uplo
 		return
 	}
 
-	if !s.requireClientToken(w, r, portal.ID) {
+	if _, ok := s.requireClientToken(w, r, portal.ID); !ok {
 		return
 	}
 
-	tempDir := s.uploadTempDir(portal.DestAbs, portal.ID)
+	tempDir := s.uploadTempDir(portal)
 	partPath, metaPath := uploadTempPaths(tempDir, uploadID)
 
-	if _, err := s.store.StartUpload(uploadID); err != nil {
+	if _, err := s.store.StartUpload(portal.ID, uploadID); err != nil {
 		switch {
 		case errors.Is(err, control.ErrPortalNotFound):
 			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
@@ -1510,6 +1974,8 @@ func (s *Server) handleUploadStream(w http.ResponseWriter, r *http.Request, uplo
 			writeJSON(w, http.StatusGone, errorResponse{Error: "portal closed"})
 		case errors.Is(err, control.ErrUploadNotFound):
 			writeJSON(w, http.StatusNotFound, errorResponse{Error: "upload not found"})
+		case errors.Is(err, control.ErrBatchClosed):
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "batch already committed or cancelled"})
 		default:
 			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to start upload"})
 		}
@@ -1517,64 +1983,137 @@ func (s *Server) handleUploadStream(w http.ResponseWriter, r *http.Request, uplo
 	}
 
 	if r.ContentLength < 0 || r.ContentLength != upload.Size {
-		s.failUpload(uploadID, partPath, metaPath)
+		s.failUpload(portal.ID, uploadID, partPath, metaPath)
 		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "size mismatch"})
 		return
 	}
 
-	if err := os.MkdirAll(tempDir, 0o755); err != nil {
-		s.failUpload(uploadID, partPath, metaPath)
+	own := s.ownershipFor(portal)
+	if err := s.makePortalTempDir(portal, "uploads", own.dirPerm()); err != nil {
+		s.failUpload(portal.ID, uploadID, partPath, metaPath)
 		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to prepare upload"})
 		return
 	}
 
-	file, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	pending, err := commit.Create(partPath, own.filePerm())
 	if err != nil {
-		s.failUpload(uploadID, partPath, metaPath)
+		s.failUpload(portal.ID, uploadID, partPath, metaPath)
 		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to write upload"})
 		return
 	}
 	defer func() {
-		_ = file.Close()
+		_ = pending.Close()
 	}()
 	defer func() {
 		_ = r.Body.Close()
 	}()
 
 	hasher := sha256.New()
-	bytesWritten, err := io.Copy(io.MultiWriter(file, hasher), r.Body)
+	sniffed := &sniffBuffer{}
+	bytesWritten, err := io.Copy(io.MultiWriter(pending, hasher, sniffed), r.Body)
 	if err != nil {
-		s.failUpload(uploadID, partPath, metaPath)
+		s.failUpload(portal.ID, uploadID, partPath, metaPath)
 		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to stream upload"})
 		return
 	}
 	if bytesWritten != upload.Size {
-		s.failUpload(uploadID, partPath, metaPath)
+		s.failUpload(portal.ID, uploadID, partPath, metaPath)
 		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "size mismatch"})
 		return
 	}
 
 	serverSHA := hex.EncodeToString(hasher.Sum(nil))
 	if upload.ClientSHA256 != "" && !strings.EqualFold(serverSHA, upload.ClientSHA256) {
-		s.failUpload(uploadID, partPath, metaPath)
+		s.failUpload(portal.ID, uploadID, partPath, metaPath)
 		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "sha256 mismatch"})
 		return
 	}
+	if contentType := sniffed.contentType(); !portal.FileTypes.AllowsContent(contentType) ||
+		(len(sniffed.data) > 0 && !portal.FileTypes.NameMatchesContent(upload.Relpath, contentType)) {
+		s.logger.Printf("refused file type upload_id=%s relpath=%s content_type=%s", uploadID, upload.Relpath, contentType)
+		s.failUpload(portal.ID, uploadID, partPath, metaPath)
+		writeJSON(w, http.StatusUnsupportedMediaType, errorResponse{Error: control.ErrFileTypeDenied.Error()})
+		return
+	}
+	if err := s.scanUpload(r.Context(), pending, portal, upload, serverSHA); err != nil {
+		s.failUpload(portal.ID, uploadID, partPath, metaPath)
+		if errors.Is(err, errInfected) {
+			writeJSON(w, http.StatusUnprocessableEntity, errorResponse{Error: errInfected.Error()})
+			return
+		}
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: errScanUnavailable.Error()})
+		return
+	}
 
-	finalRelpath, finalAbs, err := resolveFinalRelpath(portal.DestAbs, upload.Relpath, upload.Policy)
+	if s.fsyncMode != config.FsyncOff {
+		if err := pending.Sync(); err != nil {
+			s.failUpload(portal.ID, uploadID, partPath, metaPath)
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to write upload"})
+			return
+		}
+	}
+
+	if portal.Review {
+		s.finishHeldUpload(w, r, pending, portal, upload, serverSHA, bytesWritten, partPath, metaPath)
+		return
+	}
+
+	if upload.BatchID != "" {
+		if batch, err := s.store.GetBatch(portal.ID, upload.BatchID); err == nil && batch.Atomic {
+			s.finishStagedUpload(w, pending, portal, upload, serverSHA, bytesWritten, partPath, metaPath)
+			return
+		}
+	}
+
+	placement, err := s.placeUpload(pending, portal, upload, serverSHA)
 	if err != nil {
-		s.failUpload(uploadID, partPath, metaPath)
-		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to finalize upload"})
+		s.failUpload(portal.ID, uploadID, partPath, metaPath)
+		if errors.Is(err, pathsafe.ErrSymlinkInPath) {
+			s.logger.Printf("refused symlinked destination upload_id=%s relpath=%s", uploadID, upload.Relpath)
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid relpath"})
+			return
+		}
+		if errors.Is(err, control.ErrFileTypeDenied) {
+			s.logger.Printf("refused file type upload_id=%s relpath=%s", uploadID, upload.Relpath)
+			writeJSON(w, http.StatusUnsupportedMediaType, errorResponse{Error: err.Error()})
+			return
+		}
+		if message := relpathError(err); message != "invalid relpath" {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: message})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to commit upload"})
 		return
 	}
-	if err := os.MkdirAll(filepath.Dir(finalAbs), 0o755); err != nil {
-		s.failUpload(uploadID, partPath, metaPath)
-		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to finalize upload"})
+	switch placement.Action {
+	case actionFail:
+		s.failUpload(portal.ID, uploadID, partPath, metaPath)
+		writeJSON(w, http.StatusConflict, errorResponse{Error: "file exists"})
+		return
+	case actionSkip:
+		cleanupUploadArtifacts(partPath, metaPath)
+		skipped, err := s.store.MarkUploadSkipped(portal.ID, uploadID, serverSHA, placement.Relpath, bytesWritten)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to commit upload"})
+			return
+		}
+		writeJSON(w, http.StatusOK, UploadCommitResponse{
+			Status:        string(skipped.Status),
+			Relpath:       skipped.Relpath,
+			ServerSHA256:  skipped.ServerSHA256,
+			BytesReceived: skipped.BytesReceived,
+			FinalRelpath:  skipped.FinalRelpath,
+		})
 		return
 	}
 
-	if err := os.Rename(partPath, finalAbs); err != nil {
-		s.failUpload(uploadID, partPath, metaPath)
+	s.finishPlacedFile(portal.DestAbs, placement.Relpath, upload, own)
+	if err := s.syncAndVerify(portal.DestAbs, placement, serverSHA); err != nil {
+		s.logger.Printf("commit check failed upload_id=%s path=%s err=%v", uploadID, placement.Abs, err)
+		if errors.Is(err, errCommitVerification) {
+			_ = pathsafe.RemoveBeneath(portal.DestAbs, placement.Relpath)
+		}
+		s.failUpload(portal.ID, uploadID, partPath, metaPath)
 		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to commit upload"})
 		return
 	}
@@ -1583,11 +2122,12 @@ func (s *Server) handleUploadStream(w http.ResponseWriter, r *http.Request, uplo
 		s.logger.Printf("failed to remove metadata: %v", err)
 	}
 
-	committed, err := s.store.MarkUploadCommitted(uploadID, serverSHA, finalRelpath, bytesWritten)
+	committed, err := s.store.MarkUploadCommitted(portal.ID, uploadID, serverSHA, placement.Relpath, bytesWritten)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to commit upload"})
 		return
 	}
+	s.fileCommitted(portal, committed)
 
 	writeJSON(w, http.StatusOK, UploadCommitResponse{
 		Status:        string(committed.Status),
@@ -1598,22 +2138,25 @@ func (s *Server) handleUploadStream(w http.ResponseWriter, r *http.Request, uplo
 	})
 }
 
-func (s *Server) handleUploadStatus(w http.ResponseWriter, r *http.Request, uploadID string) {
+func (s *Server) handleUploadStatus(w http.ResponseWriter, r *http.Request, portalID, uploadID string) {
 	if r.Method != http.MethodGet {
 		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
 		return
 	}
 
-	upload, err := s.store.GetUpload(uploadID)
+	if _, ok := s.requireClientToken(w, r, portalID); !ok {
+		return
+	}
+
+	if err := control.ValidateUploadID(uploadID); err != nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "upload not found"})
+		return
+	}
+
+	upload, err := s.store.GetUpload(portalID, uploadID)
 	if err != nil {
 		if errors.Is(err, control.ErrUploadNotFound) {
-			writeJSON(w, http.StatusOK, UploadStatusResponse{
-				UploadID:      uploadID,
-				Status:        "not_found",
-				ServerSHA256:  nil,
-				FinalRelpath:  nil,
-				BytesReceived: 0,
-			})
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "upload not found"})
 			return
 		}
 		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load upload"})
@@ -1668,14 +2211,18 @@ func (s *Server) serveNotFound(w http.ResponseWriter, r *http.Request) {
 	_, _ = io.WriteString(w, notFoundHTML)
 }
 
-func (s *Server) failUpload(uploadID, partPath, metaPath string) {
-	_, _ = s.store.MarkUploadFailed(uploadID)
+func (s *Server) failUpload(portalID, uploadID, partPath, metaPath string) {
+	_, _ = s.store.MarkUploadFailed(portalID, uploadID)
 	cleanupUploadArtifacts(partPath, metaPath)
 }
 
-func (s *Server) requireClientToken(w http.ResponseWriter, r *http.Request, portalID string) bool {
+// requireClientToken writes the error response and returns false when the
+// request's X-Client-Token does not belong to the portal. On success it
+// returns the ID of the client the token was issued to.
+func (s *Server) requireClientToken(w http.ResponseWriter, r *http.Request, portalID string) (string, bool) {
 	token := strings.TrimSpace(r.Header.Get("X-Client-Token"))
-	if err := s.store.RequireClientToken(portalID, token); err != nil {
+	clientID, err := s.store.RequireClientToken(portalID, token)
+	if err != nil {
 		switch {
 		case errors.Is(err, control.ErrPortalNotFound):
 			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
@@ -1688,6 +2235,28 @@ func (s *Server) requireClientToken(w http.ResponseWriter, r *http.Request, port
 		default:
 			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to validate client token"})
 		}
+		return "", false
+	}
+
+	return clientID, true
+}
+
+// requireOwner gates the public close endpoint on X-Owner-Token, or on the
+// claiming client's token for one-time portals.
+func (s *Server) requireOwner(w http.ResponseWriter, r *http.Request, portalID string) bool {
+	ownerToken := strings.TrimSpace(r.Header.Get("X-Owner-Token"))
+	clientToken := strings.TrimSpace(r.Header.Get("X-Client-Token"))
+	if err := s.store.RequireOwner(portalID, ownerToken, clientToken); err != nil {
+		switch {
+		case errors.Is(err, control.ErrPortalNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "portal not found"})
+		case errors.Is(err, control.ErrOwnerTokenRequired):
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "owner token required"})
+		case errors.Is(err, control.ErrOwnerTokenInvalid):
+			writeJSON(w, http.StatusForbidden, errorResponse{Error: "owner token invalid"})
+		default:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to validate owner token"})
+		}
 		return false
 	}
 
@@ -1722,6 +2291,8 @@ type uploadMetadata struct {
 	Size         int64  `json:"size"`
 	Policy       string `json:"policy"`
 	ClientSHA256 string `json:"client_sha256,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Mode         uint32 `json:"mode,omitempty"`
 	CreatedAt    string `json:"created_at"`
 }
 
@@ -1729,16 +2300,20 @@ func (s *Server) cleanupPortalTempDir(portal control.Portal) {
 	if strings.TrimSpace(portal.DestAbs) == "" {
 		return
 	}
-	portalPath := filepath.Join(portal.DestAbs, s.tempDirName, portal.ID)
-	if err := os.RemoveAll(portalPath); err != nil && !errors.Is(err, os.ErrNotExist) {
-		s.logger.Printf("failed to remove portal temp dir: %v", err)
+	for _, portalPath := range control.PortalTempDirs(portal, s.tempDirName, s.stagingRoots) {
+		if err := os.RemoveAll(portalPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Printf("failed to remove portal temp dir: %v", err)
+		}
 	}
+	control.RemoveUnusedBatchFolders(s.store, portal)
 }
 
-func (s *Server) uploadTempDir(destAbs, portalID string) string {
-	return filepath.Join(destAbs, s.tempDirName, portalID, "uploads")
+func (s *Server) uploadTempDir(portal control.Portal) string {
+	return filepath.Join(s.portalTempDir(portal), "uploads")
 }
 
+// uploadTempPaths expects an ID that passed control.ValidateUploadID, so the
+// joined names always stay inside tempDir.
 func uploadTempPaths(tempDir, uploadID string) (string, string) {
 	partPath := filepath.Join(tempDir, uploadID+".part")
 	metaPath := filepath.Join(tempDir, uploadID+".json")
@@ -1758,6 +2333,14 @@ func writeUploadMetadata(path string, meta uploadMetadata) error {
 	return encoder.Encode(meta)
 }
 
+// clientFileMode limits the permission bits a client sends at init to
+// ones that cannot hurt the destination: group and other never get write,
+// and the owner always keeps read and write, so no uploader can leave a
+// world-writable file or one the operator cannot read.
+func clientFileMode(mode uint32) os.FileMode {
+	return os.FileMode(mode)&^0o022 | 0o600
+}
+
 func cleanupUploadArtifacts(partPath, metaPath string) {
 	if partPath != "" {
 		_ = os.Remove(partPath)
@@ -1767,46 +2350,452 @@ func cleanupUploadArtifacts(partPath, metaPath string) {
 	}
 }
 
-func resolveFinalRelpath(destAbs, relpath, policy string) (string, string, error) {
-	finalRelpath := relpath
-	finalAbs, err := pathsafe.JoinAndVerify(destAbs, relpath)
+type finalPlacement struct {
+	Relpath string
+	Abs     string
+	Action  string
+}
+
+// placeUpload moves the verified pending file into the destination according
+// to the upload's policy. Every policy except overwrite places the file with
+// a no-replace primitive, so concurrent uploads to the same relpath can never
+// clobber each other; autorename retries with the next candidate instead.
+// The parent directory is opened beneath destAbs without following symlinks
+// and all placement happens relative to it.
+func (s *Server) placeUpload(pending *commit.Pending, portal control.Portal, upload control.Upload, serverSHA string) (finalPlacement, error) {
+	destAbs := portal.DestAbs
+	relpath, err := s.filenames.Apply(upload.Relpath)
+	if err != nil {
+		return finalPlacement{}, err
+	}
+	upload.Relpath, err = s.resolveCase(portal, relpath)
+	if err != nil {
+		return finalPlacement{}, err
+	}
+	finalAbs, err := pathsafe.JoinAndVerify(destAbs, upload.Relpath)
 	if err != nil {
-		return "", "", err
+		return finalPlacement{}, err
 	}
+	own := s.ownershipFor(portal)
+	dir, err := pathsafe.CreateDirBeneath(destAbs, path.Dir(upload.Relpath), own.dirPerm(), own.setupDir)
+	if err != nil {
+		return finalPlacement{}, err
+	}
+	defer func() {
+		_ = dir.Close()
+		if pending.Copied() {
+			s.logger.Printf("upload copied across filesystems, not renamed upload_id=%s relpath=%s", upload.ID, upload.Relpath)
+		}
+	}()
+	name := path.Base(upload.Relpath)
+	placement := finalPlacement{Relpath: upload.Relpath, Abs: finalAbs, Action: actionOverwrite}
 
-	if policy != "autorename" {
-		return finalRelpath, finalAbs, nil
+	if upload.Policy == control.PolicyOverwrite {
+		if err := pending.Replace(dir, name); err != nil {
+			return finalPlacement{}, err
+		}
+		return placement, nil
 	}
 
-	if _, err := os.Stat(finalAbs); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return finalRelpath, finalAbs, nil
+	err = pending.LinkNoReplace(dir, name)
+	if err == nil {
+		placement.Action = actionCreate
+		return placement, nil
+	}
+	if !errors.Is(err, commit.ErrExists) {
+		return finalPlacement{}, err
+	}
+
+	switch upload.Policy {
+	case control.PolicyAutorename:
+		return s.autorenamePlacement(pending, dir, portal, upload.Relpath)
+	case control.PolicySkip, control.PolicyFail:
+		placement.Action = upload.Policy
+		return placement, nil
+	case control.PolicySkipIfIdentical:
+		info, err := pathsafe.LstatBeneath(destAbs, upload.Relpath)
+		if err != nil {
+			return finalPlacement{}, err
+		}
+		if conflictAction(upload.Policy, info, upload.Size) == actionSkipIfIdentical {
+			existingSHA, err := fileSHA256(destAbs, upload.Relpath)
+			if err != nil {
+				return finalPlacement{}, err
+			}
+			if strings.EqualFold(existingSHA, serverSHA) {
+				placement.Action = actionSkip
+				return placement, nil
+			}
 		}
-		return "", "", err
 	}
 
-	dir, base := path.Split(relpath)
-	ext := path.Ext(base)
-	name := strings.TrimSuffix(base, ext)
-	timestamp := time.Now().Format("2006-01-02_150405")
+	if err := pending.Replace(dir, name); err != nil {
+		return finalPlacement{}, err
+	}
+	return placement, nil
+}
 
-	for i := 0; ; i++ {
-		suffix := ""
-		if i > 0 {
-			suffix = fmt.Sprintf("_%d", i+1)
+// autorenamePlacement tries rename candidates in order. Each candidate goes
+// through the filename policy and the file type rules too, so a template
+// cannot produce a name that init would have refused.
+func (s *Server) autorenamePlacement(pending *commit.Pending, dir *os.File, portal control.Portal, relpath string) (finalPlacement, error) {
+	now := time.Now()
+	for attempt := 1; attempt <= maxRenameAttempts; attempt++ {
+		candidateRelpath, err := s.filenames.Apply(control.RenameCandidate(portal.RenameTemplate, relpath, now, attempt))
+		if err != nil {
+			return finalPlacement{}, err
+		}
+		if path.Dir(candidateRelpath) != path.Dir(relpath) {
+			return finalPlacement{}, pathsafe.ErrRelpathInvalid
 		}
-		candidate := fmt.Sprintf("%s_%s%s%s", name, timestamp, suffix, ext)
-		candidateRelpath := path.Join(dir, candidate)
-		candidateAbs, err := pathsafe.JoinAndVerify(destAbs, candidateRelpath)
+		// A template without {ext} can drop the extension init checked.
+		if !portal.FileTypes.AllowsName(candidateRelpath) {
+			return finalPlacement{}, control.ErrFileTypeDenied
+		}
+		// On a case-sensitive disk forced into case-insensitive mode, a
+		// variant spelling does not make the link fail, so skip it here.
+		if existing, err := s.resolveCase(portal, candidateRelpath); err != nil {
+			return finalPlacement{}, err
+		} else if existing != candidateRelpath {
+			continue
+		}
+		candidateAbs, err := pathsafe.JoinAndVerify(portal.DestAbs, candidateRelpath)
 		if err != nil {
-			return "", "", err
+			return finalPlacement{}, err
 		}
-		if _, err := os.Stat(candidateAbs); err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				return candidateRelpath, candidateAbs, nil
+		err = pending.LinkNoReplace(dir, path.Base(candidateRelpath))
+		if err == nil {
+			return finalPlacement{Relpath: candidateRelpath, Abs: candidateAbs, Action: actionAutorename}, nil
+		}
+		if !errors.Is(err, commit.ErrExists) {
+			return finalPlacement{}, err
+		}
+	}
+	return finalPlacement{}, errors.New("no free autorename candidate")
+}
+
+// foldsCase reports whether relpaths on this portal collide regardless of
+// case. In auto mode the destination's filesystem is probed once, in the
+// temp tree of the staging root tempBase picked for it, and the answer is
+// cached per device.
+func (s *Server) foldsCase(portal control.Portal) bool {
+	switch portal.CaseMode {
+	case control.CaseModeInsensitive:
+		return true
+	case control.CaseModeSensitive:
+		return false
+	}
+
+	destInfo, err := os.Stat(portal.DestAbs)
+	if err != nil {
+		s.logger.Printf("case probe failed dest=%s err=%v", portal.DestAbs, err)
+		return false
+	}
+	var key any = portal.DestAbs
+	destDev, known := fileDevice(destInfo)
+	if known {
+		key = destDev
+	}
+	if cached, ok := s.caseProbes.Load(key); ok {
+		return cached.(bool)
+	}
+
+	// A staging root on another filesystem says nothing about the
+	// destination's, so then the probe runs in the destination's own temp
+	// tree and removes it again.
+	base := s.tempBase(portal.DestAbs)
+	if baseInfo, err := os.Stat(base); err != nil {
+		base = portal.DestAbs
+	} else if dev, ok := fileDevice(baseInfo); !known || !ok || dev != destDev {
+		base = portal.DestAbs
+	}
+	tempRoot, err := pathsafe.OpenDirBeneath(base, s.tempDirName, true, 0o755)
+	if err != nil {
+		s.logger.Printf("case probe failed dest=%s err=%v", portal.DestAbs, err)
+		return false
+	}
+	folds, err := pathsafe.ProbeCaseInsensitive(tempRoot.Name())
+	_ = tempRoot.Close()
+	if err != nil {
+		s.logger.Printf("case probe failed dest=%s err=%v", portal.DestAbs, err)
+		return false
+	}
+	if base != s.tempBase(portal.DestAbs) {
+		_ = os.Remove(tempRoot.Name())
+	}
+	s.caseProbes.Store(key, folds)
+	return folds
+}
+
+// resolveCase maps relpath onto the spelling already on disk when the
+// portal folds case, so conflicts are found against "Report.pdf" when
+// "report.pdf" is uploaded and new files join the existing "Photos/".
+func (s *Server) resolveCase(portal control.Portal, relpath string) (string, error) {
+	if !s.foldsCase(portal) {
+		return relpath, nil
+	}
+	return pathsafe.ResolveCaseBeneath(portal.DestAbs, relpath)
+}
+
+func (s *Server) folderPolicy(portal control.Portal, requested string) (string, error) {
+	if strings.TrimSpace(requested) == "" {
+		requested = portal.FolderPolicy
+	}
+	return control.NormalizeFolderPolicy(requested)
+}
+
+// splitTopFolder returns the top-level folder an entry belongs to and the
+// rest of its relpath. A directory entry at the top level is that folder
+// itself; files at the top level have none.
+func splitTopFolder(relpath string, dir bool) (string, string, bool) {
+	folder, rest, nested := strings.Cut(relpath, "/")
+	if !nested && !dir {
+		return "", "", false
+	}
+	return folder, rest, true
+}
+
+// topFolders returns the distinct top-level folders of a batch's relpaths
+// in first-seen order; dirs marks the directory entries.
+func topFolders(relpaths []string, dirs []bool) []string {
+	seen := make(map[string]struct{})
+	folders := make([]string, 0)
+	for i, relpath := range relpaths {
+		folder, _, ok := splitTopFolder(relpath, dirs[i])
+		if !ok {
+			continue
+		}
+		if _, ok := seen[folder]; ok {
+			continue
+		}
+		seen[folder] = struct{}{}
+		folders = append(folders, folder)
+	}
+	return folders
+}
+
+// existingFolder reports whether a top-level name is already taken in the
+// destination, by a folder or anything else, and its on-disk spelling.
+func (s *Server) existingFolder(portal control.Portal, folder string) (string, bool, error) {
+	existing, err := s.resolveCase(portal, folder)
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := pathsafe.LstatBeneath(portal.DestAbs, existing); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return folder, false, nil
+		}
+		return "", false, err
+	}
+	return existing, true, nil
+}
+
+// freeFolder returns the first of "name (2)", "name (3)", ... that is free
+// right now. Preflight only reports it; init reserves it for real.
+func (s *Server) freeFolder(portal control.Portal, folder string) (string, error) {
+	for attempt := 2; attempt <= maxRenameAttempts; attempt++ {
+		candidate, err := s.filenames.Apply(folderCandidate(folder, attempt))
+		if err != nil {
+			return "", err
+		}
+		if _, taken, err := s.existingFolder(portal, candidate); err != nil {
+			return "", err
+		} else if !taken {
+			return candidate, nil
+		}
+	}
+	return "", errors.New("no free folder name")
+}
+
+// batchRelpath moves relpath into the folder its batch reserved for its
+// top-level folder, reserving one on first use: the requested name if it is
+// free, otherwise "name (2)", "name (3)" and so on. A non-atomic batch
+// reserves with an atomic mkdir beneath the destination, so two batches
+// dropping the same folder never share one. An atomic batch reserves in the
+// store only; its folder appears when the batch commits.
+func (s *Server) batchRelpath(portal control.Portal, batchID, relpath string, dir bool) (string, error) {
+	folder, rest, ok := splitTopFolder(relpath, dir)
+	if !ok {
+		return relpath, nil
+	}
+	if target, ok := s.store.BatchFolder(portal.ID, batchID, folder); ok {
+		return path.Join(target, rest), nil
+	}
+	atomic := false
+	if batch, err := s.store.GetBatch(portal.ID, batchID); err == nil {
+		atomic = batch.Atomic
+	}
+
+	for attempt := 1; attempt <= maxRenameAttempts; attempt++ {
+		candidate, err := s.filenames.Apply(folderCandidate(folder, attempt))
+		if err != nil {
+			return "", err
+		}
+		if _, taken, err := s.existingFolder(portal, candidate); err != nil {
+			return "", err
+		} else if taken {
+			continue
+		}
+
+		created := false
+		if !atomic {
+			if created, err = s.createBatchFolder(portal, candidate); err != nil {
+				return "", err
+			} else if !created {
+				continue
 			}
-			return "", "", err
 		}
+		target, err := s.store.ReserveBatchFolder(portal.ID, batchID, folder, candidate)
+		if created && (err != nil || target != candidate) {
+			_ = os.Remove(filepath.Join(portal.DestAbs, candidate))
+		}
+		if errors.Is(err, control.ErrFolderReserved) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return path.Join(target, rest), nil
+	}
+	return "", errors.New("no free folder name")
+}
+
+// createBatchFolder makes the top-level folder name beneath the destination
+// and reports false if it already existed.
+func (s *Server) createBatchFolder(portal control.Portal, name string) (bool, error) {
+	own := s.ownershipFor(portal)
+	created := false
+	dir, err := pathsafe.CreateDirBeneath(portal.DestAbs, name, own.dirPerm(), func(parent, dir *os.File) error {
+		created = true
+		return own.setupDir(parent, dir)
+	})
+	if err != nil {
+		if created {
+			_ = os.Remove(filepath.Join(portal.DestAbs, name))
+		}
+		return false, err
+	}
+	_ = dir.Close()
+	return created, nil
+}
+
+func folderCandidate(folder string, attempt int) string {
+	if attempt <= 1 {
+		return folder
+	}
+	return fmt.Sprintf("%s (%d)", folder, attempt)
+}
+
+// relpathError turns a filename policy violation into a client-facing
+// message; every other path error stays the generic "invalid relpath".
+func relpathError(err error) string {
+	for _, policyErr := range []error{
+		pathsafe.ErrNameControlChar,
+		pathsafe.ErrNameCharacter,
+		pathsafe.ErrNameTrailing,
+		pathsafe.ErrNameReserved,
+		pathsafe.ErrNameTooLong,
+	} {
+		if errors.Is(err, policyErr) {
+			return "invalid relpath: " + strings.TrimPrefix(policyErr.Error(), "relpath ")
+		}
+	}
+	return "invalid relpath"
+}
+
+// syncAndVerify makes a placed file durable according to the fsync mode and,
+// when read-back verification is enabled, re-hashes it before the commit is
+// acknowledged.
+func (s *Server) syncAndVerify(destAbs string, placement finalPlacement, serverSHA string) error {
+	if s.fsyncMode == config.FsyncFull {
+		if err := syncParentDirs(destAbs, placement.Abs); err != nil {
+			return fmt.Errorf("sync directory: %w", err)
+		}
+	}
+	if !s.verifyCommits {
+		return nil
+	}
+
+	placedSHA, err := fileSHA256(destAbs, placement.Relpath)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(placedSHA, serverSHA) {
+		return errCommitVerification
+	}
+	return nil
+}
+
+// syncParentDirs syncs every directory from the file's parent up to destAbs,
+// covering directories that MkdirAll may have just created.
+func syncParentDirs(destAbs, finalAbs string) error {
+	root := filepath.Clean(destAbs)
+	dir := filepath.Dir(finalAbs)
+	for {
+		if err := commit.SyncDir(dir); err != nil {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if dir == root || parent == dir || !strings.HasPrefix(dir, root) {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+// conflictAction reports what policy will do with an item whose destination
+// already exists. skip-if-identical can only be confirmed by hashing at commit
+// time, so a size mismatch is reported as an overwrite up front.
+func conflictAction(policy string, existing os.FileInfo, size int64) string {
+	return policyAction(policy, existing.Mode().IsRegular() && existing.Size() == size)
+}
+
+// policyAction is the preflight action for a conflict; sameSize marks a
+// conflict that skip-if-identical may resolve by hash at commit.
+func policyAction(policy string, sameSize bool) string {
+	switch policy {
+	case control.PolicyAutorename:
+		return actionAutorename
+	case control.PolicySkip:
+		return actionSkip
+	case control.PolicyFail:
+		return actionFail
+	case control.PolicySkipIfIdentical:
+		if sameSize {
+			return actionSkipIfIdentical
+		}
+		return actionOverwrite
+	default:
+		return actionOverwrite
+	}
+}
+
+// fileSHA256 hashes an existing file beneath destAbs without following
+// symlinks.
+func fileSHA256(destAbs, relpath string) (string, error) {
+	file, err := pathsafe.OpenFileBeneath(destAbs, relpath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func claimPolicy(portal control.Portal) ClaimPolicy {
+	return ClaimPolicy{
+		Overwrite:     portal.DefaultPolicy == control.PolicyOverwrite,
+		Autorename:    portal.DefaultPolicy == control.PolicyAutorename,
+		Default:       portal.DefaultPolicy,
+		FolderPolicy:  portal.FolderPolicy,
+		AtomicBatches: portal.AtomicBatches,
+		Review:        portal.Review,
 	}
 }
 
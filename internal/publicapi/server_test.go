@@ -0,0 +1,1617 @@
+package publicapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dropserve/internal/clamd/clamdtest"
+	"dropserve/internal/config"
+	"dropserve/internal/control"
+	"dropserve/internal/webhooks"
+)
+
+type testPortal struct {
+	api      *Server
+	server   *httptest.Server
+	store    *control.Store
+	portal   control.Portal
+	token    string
+	destAbs  string
+	tempName string
+}
+
+func newTestPortal(t *testing.T, input control.CreatePortalInput) *testPortal {
+	t.Helper()
+
+	if input.DestAbs == "" {
+		input.DestAbs = t.TempDir()
+	}
+	store := control.NewStore()
+	portal, err := store.CreatePortal(input)
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+
+	t.Setenv("DROPSERVE_WEBHOOK_OUTBOX", t.TempDir())
+	api := NewServer(store, log.New(io.Discard, "", 0))
+	server := httptest.NewServer(api.Handler())
+	t.Cleanup(server.Close)
+
+	tp := &testPortal{
+		api:      api,
+		server:   server,
+		store:    store,
+		portal:   portal,
+		destAbs:  input.DestAbs,
+		tempName: api.tempDirName,
+	}
+
+	var claim ClaimPortalResponse
+	resp := tp.do(t, http.MethodPost, "/api/portals/"+portal.ID+"/claim", "", []byte("{}"))
+	decodeResponse(t, resp, http.StatusOK, &claim)
+	tp.token = claim.ClientToken
+	return tp
+}
+
+func (tp *testPortal) do(t *testing.T, method, path, token string, body []byte) *http.Response {
+	t.Helper()
+
+	resp, err := tp.send(method, path, token, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// send is do for goroutines other than the test's, which must not call
+// t.Fatal.
+func (tp *testPortal) send(method, path, token string, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, tp.server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("X-Client-Token", token)
+	}
+	resp, err := tp.server.Client().Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	return resp, nil
+}
+
+// upload runs init + PUT for one file and returns the PUT response.
+func (tp *testPortal) upload(t *testing.T, uploadID, relpath, policy string, content []byte) *http.Response {
+	t.Helper()
+
+	resp, err := tp.tryUpload(uploadID, relpath, policy, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// tryUpload is upload for goroutines other than the test's.
+func (tp *testPortal) tryUpload(uploadID, relpath, policy string, content []byte) (*http.Response, error) {
+	payload, _ := json.Marshal(InitUploadRequest{
+		UploadID: uploadID,
+		Relpath:  relpath,
+		Size:     int64(len(content)),
+		Policy:   policy,
+	})
+	resp, err := tp.send(http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	defer resp.Body.Close()
+	var init InitUploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&init); err != nil {
+		return nil, fmt.Errorf("decode init response: %w", err)
+	}
+	return tp.send(http.MethodPut, init.PutURL, tp.token, content)
+}
+
+func decodeResponse(t *testing.T, resp *http.Response, status int, out interface{}) {
+	t.Helper()
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != status {
+		t.Fatalf("expected status %d, got %d: %s", status, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+}
+
+// destFiles lists regular files under destAbs, skipping the temp dir.
+func destFiles(t *testing.T, destAbs, tempName string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	err := filepath.Walk(destAbs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == tempName {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(destAbs, path)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk destination: %v", err)
+	}
+	return files
+}
+
+func TestConflictPolicies(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{DefaultPolicy: control.PolicyOverwrite})
+	if err := os.WriteFile(filepath.Join(tp.destAbs, "a.txt"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	var committed UploadCommitResponse
+	decodeResponse(t, tp.upload(t, "u1", "a.txt", control.PolicySkip, []byte("new")), http.StatusOK, &committed)
+	if committed.Status != string(control.UploadSkipped) || committed.FinalRelpath != "a.txt" {
+		t.Fatalf("expected skip, got %+v", committed)
+	}
+
+	decodeResponse(t, tp.upload(t, "u2", "a.txt", control.PolicyFail, []byte("new")), http.StatusConflict, nil)
+
+	decodeResponse(t, tp.upload(t, "u3", "a.txt", control.PolicySkipIfIdentical, []byte("old")), http.StatusOK, &committed)
+	if committed.Status != string(control.UploadSkipped) {
+		t.Fatalf("expected identical file to be skipped, got %+v", committed)
+	}
+
+	decodeResponse(t, tp.upload(t, "u4", "a.txt", control.PolicySkipIfIdentical, []byte("neu")), http.StatusOK, &committed)
+	if committed.Status != string(control.UploadCommitted) {
+		t.Fatalf("expected differing file to overwrite, got %+v", committed)
+	}
+
+	files := destFiles(t, tp.destAbs, tp.tempName)
+	if len(files) != 1 || files["a.txt"] != "neu" {
+		t.Fatalf("unexpected destination contents: %v", files)
+	}
+}
+
+func TestPreflightReportsActions(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{DefaultPolicy: control.PolicySkipIfIdentical})
+	if err := os.WriteFile(filepath.Join(tp.destAbs, "same.txt"), []byte("abc"), 0o644); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tp.destAbs, "grown.txt"), []byte("abc"), 0o644); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	payload, _ := json.Marshal(PreflightRequest{Items: []PreflightItem{
+		{Relpath: "same.txt", Size: 3},
+		{Relpath: "grown.txt", Size: 4},
+		{Relpath: "new.txt", Size: 1},
+	}})
+	var preflight PreflightResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/preflight", tp.token, payload), http.StatusOK, &preflight)
+
+	expected := map[string]string{
+		"same.txt":  actionSkipIfIdentical,
+		"grown.txt": actionOverwrite,
+		"new.txt":   actionCreate,
+	}
+	for _, item := range preflight.Items {
+		if expected[item.Relpath] != item.Action {
+			t.Fatalf("expected %s for %s, got %s", expected[item.Relpath], item.Relpath, item.Action)
+		}
+	}
+	if len(preflight.Items) != 3 || len(preflight.Conflicts) != 2 {
+		t.Fatalf("unexpected preflight response: %+v", preflight)
+	}
+}
+
+func TestConcurrentAutorenameNeverClobbers(t *testing.T) {
+	templates := map[string]string{
+		"timestamp": control.RenameTemplateTimestamp,
+		"numbered":  control.RenameTemplateNumbered,
+	}
+	for name, template := range templates {
+		t.Run(name, func(t *testing.T) {
+			tp := newTestPortal(t, control.CreatePortalInput{
+				DefaultPolicy:  control.PolicyAutorename,
+				RenameTemplate: template,
+			})
+
+			const uploads = 32
+			var wg sync.WaitGroup
+			start := make(chan struct{})
+			errs := make(chan error, uploads)
+			for i := 0; i < uploads; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					<-start
+					content := []byte(fmt.Sprintf("upload-%02d", i))
+					resp, err := tp.tryUpload(fmt.Sprintf("u%02d", i), "dir/same.txt", "", content)
+					if err != nil {
+						errs <- err
+						return
+					}
+					body, _ := io.ReadAll(resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						errs <- fmt.Errorf("upload %d: status %d: %s", i, resp.StatusCode, strings.TrimSpace(string(body)))
+					}
+				}(i)
+			}
+			close(start)
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+			if t.Failed() {
+				return
+			}
+
+			files := destFiles(t, tp.destAbs, tp.tempName)
+			contents := make([]string, 0, len(files))
+			for _, content := range files {
+				contents = append(contents, content)
+			}
+			sort.Strings(contents)
+			if len(contents) != uploads {
+				t.Fatalf("expected %d files, got %d: %v", uploads, len(contents), files)
+			}
+			for i, content := range contents {
+				if content != fmt.Sprintf("upload-%02d", i) {
+					t.Fatalf("missing or clobbered upload %d: %v", i, contents)
+				}
+			}
+		})
+	}
+}
+
+func TestCommitWithFullSyncAndVerification(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{DefaultPolicy: control.PolicyOverwrite})
+	tp.api.fsyncMode = config.FsyncFull
+	tp.api.verifyCommits = true
+
+	var committed UploadCommitResponse
+	decodeResponse(t, tp.upload(t, "u1", "nested/dir/a.txt", "", []byte("durable")), http.StatusOK, &committed)
+	if committed.Status != string(control.UploadCommitted) {
+		t.Fatalf("expected committed upload, got %+v", committed)
+	}
+
+	files := destFiles(t, tp.destAbs, tp.tempName)
+	if files["nested/dir/a.txt"] != "durable" {
+		t.Fatalf("unexpected destination contents: %v", files)
+	}
+}
+
+func TestUploadRefusesSymlinkedDestinationDirectory(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{DefaultPolicy: control.PolicyOverwrite})
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(tp.destAbs, "photos")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	for i, policy := range []string{control.PolicyOverwrite, control.PolicyAutorename} {
+		resp := tp.upload(t, fmt.Sprintf("u%d", i), "photos/x.txt", policy, []byte("payload"))
+		decodeResponse(t, resp, http.StatusBadRequest, nil)
+	}
+
+	payload, _ := json.Marshal(PreflightRequest{Items: []PreflightItem{{Relpath: "photos/x.txt", Size: 7}}})
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/preflight", tp.token, payload), http.StatusBadRequest, nil)
+
+	entries, _ := os.ReadDir(outside)
+	if len(entries) != 0 {
+		t.Fatalf("expected nothing written outside destination, got %d entries", len(entries))
+	}
+}
+
+func TestUploadRefusesSymlinkedTempDirectory(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{})
+	outside := t.TempDir()
+	if err := os.RemoveAll(filepath.Join(tp.destAbs, tp.tempName)); err != nil {
+		t.Fatalf("remove temp dir: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(tp.destAbs, tp.tempName)); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	decodeResponse(t, tp.upload(t, "u1", "x.txt", "", []byte("payload")), http.StatusInternalServerError, nil)
+
+	entries, _ := os.ReadDir(outside)
+	if len(entries) != 0 {
+		t.Fatalf("expected nothing written through the symlinked temp dir, got %d entries", len(entries))
+	}
+}
+
+func TestInitRejectsHostileUploadIDs(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{})
+
+	hostile := []string{
+		"../../escape",
+		"..",
+		"a/b",
+		`a\b`,
+		"id.part",
+		"with space",
+		"nul\x00byte",
+		"café",
+		strings.Repeat("a", control.MaxUploadIDLength+1),
+	}
+	for _, id := range hostile {
+		payload, _ := json.Marshal(InitUploadRequest{UploadID: id, Relpath: "file.txt", Size: 1})
+		resp := tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload)
+		var body errorResponse
+		decodeResponse(t, resp, http.StatusBadRequest, &body)
+		if body.Error != "invalid upload_id" {
+			t.Fatalf("expected invalid upload_id for %q, got %q", id, body.Error)
+		}
+	}
+
+	resp := tp.do(t, http.MethodPut, "/api/portals/"+tp.portal.ID+"/uploads/..", tp.token, []byte("x"))
+	decodeResponse(t, resp, http.StatusNotFound, nil)
+
+	entries, err := os.ReadDir(filepath.Dir(tp.destAbs))
+	if err != nil {
+		t.Fatalf("read parent: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "escape") {
+			t.Fatalf("hostile upload id escaped the temp dir: %s", entry.Name())
+		}
+	}
+	if files := destFiles(t, tp.destAbs, tp.tempName); len(files) != 0 {
+		t.Fatalf("expected no files, got %v", files)
+	}
+}
+
+func TestInitMintsUploadIDWhenEmpty(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{})
+
+	payload, _ := json.Marshal(InitUploadRequest{Relpath: "minted.txt", Size: 5})
+	resp := tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload)
+	var init InitUploadResponse
+	decodeResponse(t, resp, http.StatusOK, &init)
+	if err := control.ValidateUploadID(init.UploadID); err != nil {
+		t.Fatalf("minted id %q is invalid: %v", init.UploadID, err)
+	}
+	if init.PutURL != "/api/portals/"+tp.portal.ID+"/uploads/"+init.UploadID {
+		t.Fatalf("unexpected put_url %q", init.PutURL)
+	}
+
+	resp = tp.do(t, http.MethodPut, init.PutURL, tp.token, []byte("hello"))
+	decodeResponse(t, resp, http.StatusOK, nil)
+	if files := destFiles(t, tp.destAbs, tp.tempName); files["minted.txt"] != "hello" {
+		t.Fatalf("unexpected files %v", files)
+	}
+}
+
+// sibling creates and claims another portal served by the same store.
+func (tp *testPortal) sibling(t *testing.T) *testPortal {
+	t.Helper()
+
+	destAbs := t.TempDir()
+	portal, err := tp.store.CreatePortal(control.CreatePortalInput{DestAbs: destAbs})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	var claim ClaimPortalResponse
+	resp := tp.do(t, http.MethodPost, "/api/portals/"+portal.ID+"/claim", "", []byte("{}"))
+	decodeResponse(t, resp, http.StatusOK, &claim)
+	return &testPortal{
+		api:      tp.api,
+		server:   tp.server,
+		store:    tp.store,
+		portal:   portal,
+		token:    claim.ClientToken,
+		destAbs:  destAbs,
+		tempName: tp.tempName,
+	}
+}
+
+func TestUploadIDsAreNamespacedPerPortal(t *testing.T) {
+	first := newTestPortal(t, control.CreatePortalInput{})
+	second := first.sibling(t)
+	var resp *http.Response
+
+	decodeResponse(t, first.upload(t, "shared-id", "a.txt", "", []byte("first")), http.StatusOK, nil)
+	decodeResponse(t, second.upload(t, "shared-id", "b.txt", "", []byte("second")), http.StatusOK, nil)
+
+	if files := destFiles(t, first.destAbs, first.tempName); len(files) != 1 || files["a.txt"] != "first" {
+		t.Fatalf("unexpected first portal files %v", files)
+	}
+	if files := destFiles(t, second.destAbs, second.tempName); len(files) != 1 || files["b.txt"] != "second" {
+		t.Fatalf("unexpected second portal files %v", files)
+	}
+
+	// The legacy unscoped route refuses to guess between portals.
+	resp = first.do(t, http.MethodPut, "/api/uploads/shared-id", first.token, nil)
+	decodeResponse(t, resp, http.StatusNotFound, nil)
+
+	payload, _ := json.Marshal(InitUploadRequest{UploadID: "only-second", Relpath: "c.txt", Size: 5})
+	resp = second.do(t, http.MethodPost, "/api/portals/"+second.portal.ID+"/uploads", second.token, payload)
+	decodeResponse(t, resp, http.StatusOK, nil)
+
+	// Another portal's upload is invisible under this portal's path.
+	resp = first.do(t, http.MethodPut, "/api/portals/"+first.portal.ID+"/uploads/only-second", first.token, []byte("third"))
+	decodeResponse(t, resp, http.StatusNotFound, nil)
+
+	// An unambiguous ID still resolves through the legacy route.
+	resp = second.do(t, http.MethodPut, "/api/uploads/only-second", second.token, []byte("third"))
+	decodeResponse(t, resp, http.StatusOK, nil)
+	if files := destFiles(t, second.destAbs, second.tempName); files["c.txt"] != "third" {
+		t.Fatalf("unexpected second portal files %v", files)
+	}
+}
+
+func TestUploadStatusIsPortalScopedAndAuthorized(t *testing.T) {
+	owner := newTestPortal(t, control.CreatePortalInput{})
+	other := owner.sibling(t)
+
+	decodeResponse(t, owner.upload(t, "secret", "private.txt", "", []byte("data")), http.StatusOK, nil)
+	statusPath := "/api/portals/" + owner.portal.ID + "/uploads/secret"
+
+	var status UploadStatusResponse
+	decodeResponse(t, owner.do(t, http.MethodGet, statusPath, owner.token, nil), http.StatusOK, &status)
+	if status.Status != "committed" || status.FinalRelpath == nil || *status.FinalRelpath != "private.txt" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	decodeResponse(t, owner.do(t, http.MethodGet, statusPath, "", nil), http.StatusUnauthorized, nil)
+	decodeResponse(t, owner.do(t, http.MethodGet, statusPath, other.token, nil), http.StatusForbidden, nil)
+
+	// Asked through another portal, the upload is indistinguishable from an
+	// unknown ID.
+	foreign := other.do(t, http.MethodGet, "/api/portals/"+other.portal.ID+"/uploads/secret", other.token, nil)
+	unknown := other.do(t, http.MethodGet, "/api/portals/"+other.portal.ID+"/uploads/missing", other.token, nil)
+	var foreignBody, unknownBody errorResponse
+	decodeResponse(t, foreign, http.StatusNotFound, &foreignBody)
+	decodeResponse(t, unknown, http.StatusNotFound, &unknownBody)
+	if foreignBody != unknownBody {
+		t.Fatalf("foreign and unknown uploads differ: %+v vs %+v", foreignBody, unknownBody)
+	}
+}
+
+func TestLegacyUploadStatusRouteIsDeprecatedAlias(t *testing.T) {
+	owner := newTestPortal(t, control.CreatePortalInput{})
+	other := owner.sibling(t)
+
+	decodeResponse(t, owner.upload(t, "legacy", "legacy.txt", "", []byte("data")), http.StatusOK, nil)
+
+	resp := owner.do(t, http.MethodGet, "/api/uploads/legacy/status", owner.token, nil)
+	if resp.Header.Get("Deprecation") != "true" {
+		t.Fatalf("expected Deprecation header, got %q", resp.Header.Get("Deprecation"))
+	}
+	if link := resp.Header.Get("Link"); !strings.Contains(link, "/api/portals/"+owner.portal.ID+"/uploads/legacy") {
+		t.Fatalf("expected successor link, got %q", link)
+	}
+	var status UploadStatusResponse
+	decodeResponse(t, resp, http.StatusOK, &status)
+	if status.Status != "committed" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	for _, token := range []string{"", other.token} {
+		resp := owner.do(t, http.MethodGet, "/api/uploads/legacy/status", token, nil)
+		var body errorResponse
+		decodeResponse(t, resp, http.StatusNotFound, &body)
+		if body.Error != "upload not found" {
+			t.Fatalf("unexpected error %q", body.Error)
+		}
+	}
+}
+
+func TestReusablePortalEnforcesPerClientTokens(t *testing.T) {
+	alice := newTestPortal(t, control.CreatePortalInput{Reusable: true})
+
+	var claim ClaimPortalResponse
+	resp := alice.do(t, http.MethodPost, "/api/portals/"+alice.portal.ID+"/claim", "", []byte("{}"))
+	decodeResponse(t, resp, http.StatusOK, &claim)
+	bob := *alice
+	bob.token = claim.ClientToken
+
+	payload, _ := json.Marshal(InitUploadRequest{UploadID: "anon", Relpath: "anon.txt", Size: 1})
+	resp = alice.do(t, http.MethodPost, "/api/portals/"+alice.portal.ID+"/uploads", "", payload)
+	decodeResponse(t, resp, http.StatusUnauthorized, nil)
+	resp = alice.do(t, http.MethodPost, "/api/portals/"+alice.portal.ID+"/uploads", "ct_forged", payload)
+	decodeResponse(t, resp, http.StatusForbidden, nil)
+
+	decodeResponse(t, alice.upload(t, "a1", "a1.txt", "", []byte("aaa")), http.StatusOK, nil)
+	decodeResponse(t, alice.upload(t, "a2", "a2.txt", "", []byte("aaaa")), http.StatusOK, nil)
+	decodeResponse(t, bob.upload(t, "b1", "b1.txt", "", []byte("bb")), http.StatusOK, nil)
+
+	upload, err := alice.store.GetUpload(alice.portal.ID, "b1")
+	if err != nil {
+		t.Fatalf("get upload: %v", err)
+	}
+	if upload.ClientID != claim.ClientID {
+		t.Fatalf("expected upload attributed to %s, got %s", claim.ClientID, upload.ClientID)
+	}
+
+	clients, err := alice.store.PortalClients(alice.portal.ID)
+	if err != nil {
+		t.Fatalf("portal clients: %v", err)
+	}
+	counts := make(map[string]control.PortalClient)
+	for _, client := range clients {
+		counts[client.ID] = client
+	}
+	if len(counts) != 2 {
+		t.Fatalf("expected two clients, got %+v", clients)
+	}
+	if got := counts[claim.ClientID]; got.FilesCommitted != 1 || got.BytesCommitted != 2 {
+		t.Fatalf("unexpected bob accounting %+v", got)
+	}
+	for id, client := range counts {
+		if id != claim.ClientID && (client.FilesCommitted != 2 || client.BytesCommitted != 7) {
+			t.Fatalf("unexpected alice accounting %+v", client)
+		}
+	}
+}
+
+func TestCloseRequiresOwner(t *testing.T) {
+	t.Run("reusable", func(t *testing.T) {
+		tp := newTestPortal(t, control.CreatePortalInput{Reusable: true})
+		closePath := "/api/portals/" + tp.portal.ID + "/close"
+
+		decodeResponse(t, tp.do(t, http.MethodPost, closePath, tp.token, nil), http.StatusUnauthorized, nil)
+
+		request, _ := http.NewRequest(http.MethodPost, tp.server.URL+closePath, nil)
+		request.Header.Set("X-Owner-Token", "ot_wrong")
+		resp, err := tp.server.Client().Do(request)
+		if err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		decodeResponse(t, resp, http.StatusForbidden, nil)
+
+		request, _ = http.NewRequest(http.MethodPost, tp.server.URL+closePath, nil)
+		request.Header.Set("X-Owner-Token", tp.portal.OwnerToken)
+		resp, err = tp.server.Client().Do(request)
+		if err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		decodeResponse(t, resp, http.StatusOK, nil)
+	})
+
+	t.Run("one-time claimer", func(t *testing.T) {
+		tp := newTestPortal(t, control.CreatePortalInput{})
+		closePath := "/api/portals/" + tp.portal.ID + "/close"
+
+		decodeResponse(t, tp.do(t, http.MethodPost, closePath, "", nil), http.StatusUnauthorized, nil)
+		decodeResponse(t, tp.do(t, http.MethodPost, closePath, tp.token, nil), http.StatusOK, nil)
+	})
+}
+
+func TestFilenamePolicyAppliesAcrossPreflightInitAndCommit(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{})
+
+	decomposed := "Cafe\u0301.txt"
+	composed := "Caf\u00e9.txt"
+
+	payload, _ := json.Marshal(PreflightRequest{Items: []PreflightItem{{Relpath: decomposed, Size: 1}}})
+	var preflight PreflightResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/preflight", tp.token, payload), http.StatusOK, &preflight)
+	if len(preflight.Items) != 1 || preflight.Items[0].Relpath != composed || preflight.Items[0].RequestedRelpath != decomposed {
+		t.Fatalf("unexpected preflight items %+v", preflight.Items)
+	}
+
+	decodeResponse(t, tp.upload(t, "nfd", decomposed, "", []byte("1")), http.StatusOK, nil)
+
+	// The composed spelling now names the same file.
+	var conflict errorResponse
+	decodeResponse(t, tp.upload(t, "nfc", composed, control.PolicyFail, []byte("2")), http.StatusConflict, &conflict)
+
+	if files := destFiles(t, tp.destAbs, tp.tempName); len(files) != 1 || files[composed] != "1" {
+		t.Fatalf("unexpected files %v", files)
+	}
+
+	var rejected errorResponse
+	decodeResponse(t, tp.upload(t, "reserved", "docs/CON.txt", "", []byte("x")), http.StatusBadRequest, &rejected)
+	if rejected.Error != "invalid relpath: uses a name reserved on Windows" {
+		t.Fatalf("unexpected error %q", rejected.Error)
+	}
+
+	tp.api.filenames.Replace = true
+	payload, _ = json.Marshal(InitUploadRequest{UploadID: "replaced", Relpath: "docs/CON.txt", Size: 1})
+	var init InitUploadResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), http.StatusOK, &init)
+	if init.Relpath != "docs/CON_.txt" {
+		t.Fatalf("expected replaced relpath, got %q", init.Relpath)
+	}
+	decodeResponse(t, tp.do(t, http.MethodPut, init.PutURL, tp.token, []byte("x")), http.StatusOK, nil)
+	if files := destFiles(t, tp.destAbs, tp.tempName); files["docs/CON_.txt"] != "x" {
+		t.Fatalf("unexpected files %v", files)
+	}
+}
+
+func TestCaseInsensitivePortalDetectsCaseVariants(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{CaseMode: control.CaseModeInsensitive})
+	if err := os.MkdirAll(filepath.Join(tp.destAbs, "Docs"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tp.destAbs, "Docs", "Report.pdf"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	payload, _ := json.Marshal(PreflightRequest{Items: []PreflightItem{
+		{Relpath: "docs/report.PDF", Size: 3},
+		{Relpath: "docs/new.txt", Size: 1},
+		{Relpath: "docs/NEW.txt", Size: 1},
+	}})
+	var preflight PreflightResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/preflight", tp.token, payload), http.StatusOK, &preflight)
+	if len(preflight.Conflicts) != 2 {
+		t.Fatalf("expected two conflicts, got %+v", preflight.Conflicts)
+	}
+	if got := preflight.Conflicts[0]; got.Relpath != "Docs/Report.pdf" || got.RequestedRelpath != "docs/report.PDF" || got.Reason != "exists" {
+		t.Fatalf("unexpected existing conflict %+v", got)
+	}
+	if got := preflight.Conflicts[1]; got.RequestedRelpath != "docs/NEW.txt" || got.Reason != "duplicate" {
+		t.Fatalf("unexpected duplicate conflict %+v", got)
+	}
+	if got := preflight.Items[1]; got.Relpath != "Docs/new.txt" || got.Action != actionCreate {
+		t.Fatalf("expected new file to join the existing folder, got %+v", got)
+	}
+
+	decodeResponse(t, tp.upload(t, "fail", "docs/REPORT.pdf", control.PolicyFail, []byte("new")), http.StatusConflict, nil)
+
+	var committed UploadStatusResponse
+	decodeResponse(t, tp.upload(t, "rename", "docs/report.pdf", control.PolicyAutorename, []byte("new")), http.StatusOK, &committed)
+	if committed.FinalRelpath == nil || !strings.HasPrefix(*committed.FinalRelpath, "Docs/Report_") {
+		t.Fatalf("expected autorename next to the existing file, got %+v", committed)
+	}
+
+	decodeResponse(t, tp.upload(t, "overwrite", "DOCS/REPORT.PDF", control.PolicyOverwrite, []byte("newest")), http.StatusOK, nil)
+
+	files := destFiles(t, tp.destAbs, tp.tempName)
+	if files["Docs/Report.pdf"] != "newest" {
+		t.Fatalf("expected overwrite to keep the existing spelling, got %v", files)
+	}
+	for relpath := range files {
+		if !strings.HasPrefix(relpath, "Docs/") {
+			t.Fatalf("case variant created a second folder: %v", files)
+		}
+	}
+}
+
+func TestCaseSensitivePortalKeepsVariantsApart(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{CaseMode: control.CaseModeSensitive})
+	if err := os.WriteFile(filepath.Join(tp.destAbs, "Report.pdf"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	decodeResponse(t, tp.upload(t, "lower", "report.pdf", control.PolicyFail, []byte("new")), http.StatusOK, nil)
+	if files := destFiles(t, tp.destAbs, tp.tempName); len(files) != 2 {
+		t.Fatalf("expected both spellings, got %v", files)
+	}
+}
+
+func TestFolderAutorenameMovesBatchIntoOneFolder(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{
+		CaseMode:     control.CaseModeSensitive,
+		FolderPolicy: control.FolderPolicyAutorename,
+	})
+	for _, dir := range []string{"Photos", "Photos (2)"} {
+		if err := os.MkdirAll(filepath.Join(tp.destAbs, dir), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tp.destAbs, "Photos", "a.jpg"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	payload, _ := json.Marshal(PreflightRequest{Items: []PreflightItem{
+		{Relpath: "Photos/a.jpg", Size: 1},
+		{Relpath: "Photos/b.jpg", Size: 1},
+		{Relpath: "top.txt", Size: 1},
+	}})
+	var preflight PreflightResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/preflight", tp.token, payload), http.StatusOK, &preflight)
+	if len(preflight.Conflicts) != 1 {
+		t.Fatalf("expected a single folder conflict, got %+v", preflight.Conflicts)
+	}
+	if got := preflight.Conflicts[0]; got.Relpath != "Photos (3)" || got.RequestedRelpath != "Photos" || got.Reason != "folder_exists" || got.Action != actionAutorename {
+		t.Fatalf("unexpected folder conflict %+v", got)
+	}
+	if got := preflight.Items[0]; got.Relpath != "Photos (3)/a.jpg" || got.Action != actionCreate {
+		t.Fatalf("expected item inside the renamed folder, got %+v", got)
+	}
+
+	initPath := "/api/portals/" + tp.portal.ID + "/uploads"
+	uploadInBatch := func(uploadID, batchID, folderPolicy, relpath string) string {
+		payload, _ := json.Marshal(InitUploadRequest{
+			UploadID:     uploadID,
+			Relpath:      relpath,
+			Size:         1,
+			FolderPolicy: folderPolicy,
+			BatchID:      batchID,
+		})
+		var init InitUploadResponse
+		decodeResponse(t, tp.do(t, http.MethodPost, initPath, tp.token, payload), http.StatusOK, &init)
+		decodeResponse(t, tp.do(t, http.MethodPut, init.PutURL, tp.token, []byte("x")), http.StatusOK, nil)
+		return init.Relpath
+	}
+
+	var missing errorResponse
+	payload, _ = json.Marshal(InitUploadRequest{UploadID: "nobatch", Relpath: "Photos/a.jpg", Size: 1})
+	decodeResponse(t, tp.do(t, http.MethodPost, initPath, tp.token, payload), http.StatusBadRequest, &missing)
+	if missing.Error != "batch_id required with folder_policy autorename" {
+		t.Fatalf("unexpected error %q", missing.Error)
+	}
+
+	if got := uploadInBatch("a", "drop-1", "", "Photos/a.jpg"); got != "Photos (3)/a.jpg" {
+		t.Fatalf("unexpected relpath %q", got)
+	}
+	if got := uploadInBatch("b", "drop-1", "", "Photos/b.jpg"); got != "Photos (3)/b.jpg" {
+		t.Fatalf("expected the batch to stay in one folder, got %q", got)
+	}
+	if got := uploadInBatch("c", "drop-2", "", "Photos/a.jpg"); got != "Photos (4)/a.jpg" {
+		t.Fatalf("expected a second batch to get its own folder, got %q", got)
+	}
+	if got := uploadInBatch("d", "drop-3", control.FolderPolicyMerge, "Photos/c.jpg"); got != "Photos/c.jpg" {
+		t.Fatalf("expected merge to use the existing folder, got %q", got)
+	}
+	if got := uploadInBatch("e", "", "", "top.txt"); got != "top.txt" {
+		t.Fatalf("expected top-level file to need no batch, got %q", got)
+	}
+
+	files := destFiles(t, tp.destAbs, tp.tempName)
+	if files["Photos/a.jpg"] != "old" || files["Photos (3)/b.jpg"] != "x" || files["Photos (4)/a.jpg"] != "x" {
+		t.Fatalf("unexpected files %v", files)
+	}
+
+	// A folder reserved by a batch that never uploads anything is removed
+	// when the portal closes.
+	payload, _ = json.Marshal(InitUploadRequest{UploadID: "abandoned", Relpath: "Photos/z.jpg", Size: 1, BatchID: "drop-4"})
+	decodeResponse(t, tp.do(t, http.MethodPost, initPath, tp.token, payload), http.StatusOK, nil)
+	if _, err := os.Stat(filepath.Join(tp.destAbs, "Photos (5)")); err != nil {
+		t.Fatalf("expected reserved folder: %v", err)
+	}
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/close", tp.token, nil), http.StatusOK, nil)
+	if _, err := os.Stat(filepath.Join(tp.destAbs, "Photos (5)")); !os.IsNotExist(err) {
+		t.Fatalf("expected unused reserved folder to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tp.destAbs, "Photos (3)", "a.jpg")); err != nil {
+		t.Fatalf("expected used folder to stay: %v", err)
+	}
+}
+
+func TestAtomicBatchReservesFolderWithoutCreatingIt(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{
+		AtomicBatches: true,
+		CaseMode:      control.CaseModeSensitive,
+		FolderPolicy:  control.FolderPolicyAutorename,
+	})
+
+	batchesPath := "/api/portals/" + tp.portal.ID + "/batches"
+	stage := func(batchID, uploadID, relpath string) string {
+		payload, _ := json.Marshal(InitUploadRequest{UploadID: uploadID, Relpath: relpath, Size: 1, BatchID: batchID})
+		var init InitUploadResponse
+		decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), http.StatusOK, &init)
+		decodeResponse(t, tp.do(t, http.MethodPut, init.PutURL, tp.token, []byte(uploadID)), http.StatusOK, nil)
+		return init.Relpath
+	}
+
+	var first, second BatchResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, batchesPath, tp.token, []byte("{}")), http.StatusOK, &first)
+	decodeResponse(t, tp.do(t, http.MethodPost, batchesPath, tp.token, []byte("{}")), http.StatusOK, &second)
+	if got := stage(first.BatchID, "a", "Album/1.txt"); got != "Album/1.txt" {
+		t.Fatalf("unexpected relpath %q", got)
+	}
+	if got := stage(second.BatchID, "b", "Album/1.txt"); got != "Album (2)/1.txt" {
+		t.Fatalf("expected the second batch to get its own folder, got %q", got)
+	}
+	if entries, _ := os.ReadDir(tp.destAbs); len(entries) != 1 || entries[0].Name() != tp.tempName {
+		t.Fatalf("expected no reserved folders on disk before commit, got %v", entries)
+	}
+
+	for _, batch := range []BatchResponse{second, first} {
+		decodeResponse(t, tp.do(t, http.MethodPost, batchesPath+"/"+batch.BatchID+"/commit", tp.token, []byte("{}")), http.StatusOK, nil)
+	}
+	files := destFiles(t, tp.destAbs, tp.tempName)
+	if files["Album/1.txt"] != "a" || files["Album (2)/1.txt"] != "b" {
+		t.Fatalf("unexpected files %v", files)
+	}
+}
+
+func TestAtomicBatchAppearsOnlyAfterCommit(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{AtomicBatches: true})
+	if err := os.MkdirAll(filepath.Join(tp.destAbs, "Docs"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tp.destAbs, "Docs", "old.txt"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	batchesPath := "/api/portals/" + tp.portal.ID + "/batches"
+	createBatch := func() BatchResponse {
+		var batch BatchResponse
+		decodeResponse(t, tp.do(t, http.MethodPost, batchesPath, tp.token, []byte("{}")), http.StatusOK, &batch)
+		if !batch.Atomic || batch.BatchID == "" {
+			t.Fatalf("expected an atomic batch by portal default, got %+v", batch)
+		}
+		return batch
+	}
+	stage := func(batchID, uploadID, relpath string) {
+		payload, _ := json.Marshal(InitUploadRequest{UploadID: uploadID, Relpath: relpath, Size: 1, BatchID: batchID})
+		var init InitUploadResponse
+		decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), http.StatusOK, &init)
+		var staged UploadCommitResponse
+		decodeResponse(t, tp.do(t, http.MethodPut, init.PutURL, tp.token, []byte("x")), http.StatusOK, &staged)
+		if staged.Status != string(control.UploadStaged) || staged.FinalRelpath != "" {
+			t.Fatalf("expected staged upload, got %+v", staged)
+		}
+	}
+
+	album := createBatch()
+	stage(album.BatchID, "a1", "Album/1.txt")
+	stage(album.BatchID, "a2", "Album/sub/2.txt")
+	if _, err := os.Stat(filepath.Join(tp.destAbs, "Album")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing in the destination before commit, got %v", err)
+	}
+
+	commitPath := batchesPath + "/" + album.BatchID + "/commit"
+	var incomplete errorResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, commitPath, tp.token, []byte(`{"files":3}`)), http.StatusConflict, &incomplete)
+	if incomplete.Error != control.ErrBatchIncomplete.Error() {
+		t.Fatalf("unexpected error %q", incomplete.Error)
+	}
+
+	var committed CommitBatchResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, commitPath, tp.token, []byte(`{"files":2}`)), http.StatusOK, &committed)
+	if len(committed.Files) != 2 || committed.Files[0].Status != string(control.UploadCommitted) || committed.Files[1].FinalRelpath != "Album/sub/2.txt" {
+		t.Fatalf("unexpected commit response %+v", committed)
+	}
+	decodeResponse(t, tp.do(t, http.MethodPost, commitPath, tp.token, []byte("{}")), http.StatusConflict, nil)
+
+	payload, _ := json.Marshal(InitUploadRequest{UploadID: "late", Relpath: "Album/3.txt", Size: 1, BatchID: album.BatchID})
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), http.StatusConflict, nil)
+
+	// Only one new top-level folder can land with one rename, so files
+	// merging into an existing folder, at the top level or in a second
+	// folder are refused rather than placed one by one.
+	refused := createBatch()
+	initInto := func(batchID, uploadID, relpath string, status int) {
+		payload, _ := json.Marshal(InitUploadRequest{UploadID: uploadID, Relpath: relpath, Size: 1, BatchID: batchID})
+		decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), status, nil)
+	}
+	initInto(refused.BatchID, "m1", "Docs/new.txt", http.StatusConflict)
+	initInto(refused.BatchID, "m2", "top.txt", http.StatusBadRequest)
+	stage(refused.BatchID, "m3", "Fresh/1.txt")
+	initInto(refused.BatchID, "m4", "Other/2.txt", http.StatusBadRequest)
+
+	// A folder that appears between init and commit fails the whole batch.
+	if err := os.Mkdir(filepath.Join(tp.destAbs, "Fresh"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	decodeResponse(t, tp.do(t, http.MethodPost, batchesPath+"/"+refused.BatchID+"/commit", tp.token, []byte("{}")), http.StatusConflict, nil)
+	var failed UploadStatusResponse
+	decodeResponse(t, tp.do(t, http.MethodGet, "/api/portals/"+tp.portal.ID+"/uploads/m3", tp.token, nil), http.StatusOK, &failed)
+	if failed.Status != string(control.UploadFailed) {
+		t.Fatalf("expected the refused batch's upload to fail, got %+v", failed)
+	}
+	if err := os.Remove(filepath.Join(tp.destAbs, "Fresh")); err != nil {
+		t.Fatalf("expected the blocking folder to stay empty: %v", err)
+	}
+
+	cancelled := createBatch()
+	stage(cancelled.BatchID, "c1", "Gone/x.txt")
+	decodeResponse(t, tp.do(t, http.MethodDelete, batchesPath+"/"+cancelled.BatchID, tp.token, nil), http.StatusOK, nil)
+	var status UploadStatusResponse
+	decodeResponse(t, tp.do(t, http.MethodGet, "/api/portals/"+tp.portal.ID+"/uploads/c1", tp.token, nil), http.StatusOK, &status)
+	if status.Status != string(control.UploadFailed) {
+		t.Fatalf("expected cancelled upload to fail, got %+v", status)
+	}
+
+	files := destFiles(t, tp.destAbs, tp.tempName)
+	expected := map[string]string{"Album/1.txt": "x", "Album/sub/2.txt": "x", "Docs/old.txt": "old"}
+	if fmt.Sprint(files) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, files)
+	}
+	batchesDir := filepath.Join(tp.destAbs, tp.tempName, tp.portal.ID, "batches")
+	if entries, _ := os.ReadDir(batchesDir); len(entries) != 0 {
+		t.Fatalf("expected staging trees to be removed, found %d", len(entries))
+	}
+}
+
+func TestDirectoryEntriesPreserveEmptyFolders(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{})
+	if err := os.MkdirAll(filepath.Join(tp.destAbs, "Shared"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tp.destAbs, "notes"), []byte("file"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	preflight, _ := json.Marshal(PreflightRequest{Items: []PreflightItem{
+		{Relpath: "Project/empty", Type: "dir"},
+		{Relpath: "Shared", Type: "dir"},
+		{Relpath: "notes", Type: "dir"},
+		{Relpath: "Project/a.txt", Size: 1},
+	}})
+	var plan PreflightResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/preflight", tp.token, preflight), http.StatusOK, &plan)
+	if plan.TotalFiles != 1 || plan.TotalDirs != 3 {
+		t.Fatalf("unexpected totals %+v", plan)
+	}
+	actions := []string{plan.Items[0].Action, plan.Items[1].Action, plan.Items[2].Action}
+	if fmt.Sprint(actions) != fmt.Sprint([]string{actionCreate, actionMerge, actionFail}) {
+		t.Fatalf("unexpected directory actions %v", actions)
+	}
+	if len(plan.Conflicts) != 1 || plan.Conflicts[0].Relpath != "notes" || plan.Conflicts[0].Type != entryTypeDir {
+		t.Fatalf("expected one directory conflict, got %+v", plan.Conflicts)
+	}
+
+	uploadsPath := "/api/portals/" + tp.portal.ID + "/uploads"
+	initDir := func(req InitUploadRequest, status int) InitUploadResponse {
+		req.Type = entryTypeDir
+		payload, _ := json.Marshal(req)
+		var init InitUploadResponse
+		decodeResponse(t, tp.do(t, http.MethodPost, uploadsPath, tp.token, payload), status, &init)
+		return init
+	}
+
+	created := initDir(InitUploadRequest{UploadID: "d1", Relpath: "Project/empty/deeper"}, http.StatusOK)
+	if created.Status != string(control.UploadCommitted) || created.PutURL != "" {
+		t.Fatalf("expected a finished directory entry, got %+v", created)
+	}
+	if info, err := os.Stat(filepath.Join(tp.destAbs, "Project", "empty", "deeper")); err != nil || !info.IsDir() {
+		t.Fatalf("expected directory to be created, got %v", err)
+	}
+	decodeResponse(t, tp.do(t, http.MethodPut, uploadsPath+"/d1", tp.token, []byte{}), http.StatusConflict, nil)
+	initDir(InitUploadRequest{UploadID: "d2", Relpath: "notes/inner"}, http.StatusConflict)
+	initDir(InitUploadRequest{UploadID: "d3", Relpath: "Project/x", Size: 1}, http.StatusBadRequest)
+
+	// Under folder autorename an empty top-level folder is renamed like any
+	// other dropped folder and survives the portal closing.
+	renamed := initDir(InitUploadRequest{UploadID: "d4", Relpath: "Shared", FolderPolicy: control.FolderPolicyAutorename, BatchID: "b1"}, http.StatusOK)
+	if renamed.Relpath != "Shared (2)" {
+		t.Fatalf("expected renamed folder, got %+v", renamed)
+	}
+	if folders := tp.store.BatchFolders(tp.portal.ID); len(folders) != 0 {
+		t.Fatalf("expected declared folder not to count as unused, got %v", folders)
+	}
+
+	// In an atomic batch an empty folder is staged and moved in on commit.
+	var batch BatchResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/batches", tp.token, []byte(`{"atomic":true}`)), http.StatusOK, &batch)
+	staged := initDir(InitUploadRequest{UploadID: "d5", Relpath: "Later/empty", BatchID: batch.BatchID}, http.StatusOK)
+	if staged.Status != string(control.UploadStaged) {
+		t.Fatalf("expected staged directory, got %+v", staged)
+	}
+	if _, err := os.Stat(filepath.Join(tp.destAbs, "Later")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing before commit, got %v", err)
+	}
+	var committed CommitBatchResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/batches/"+batch.BatchID+"/commit", tp.token, []byte(`{"files":1}`)), http.StatusOK, &committed)
+	if len(committed.Files) != 1 || committed.Files[0].Status != string(control.UploadCommitted) {
+		t.Fatalf("unexpected commit response %+v", committed)
+	}
+	if info, err := os.Stat(filepath.Join(tp.destAbs, "Later", "empty")); err != nil || !info.IsDir() {
+		t.Fatalf("expected staged directory to land, got %v", err)
+	}
+}
+
+func TestClientMetadataAppliedOnCommit(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{})
+	stamp := time.Date(2019, 6, 1, 12, 30, 0, 0, time.UTC)
+	put := func(uploadID, relpath string) {
+		lastModified := stamp.UnixMilli()
+		mode := uint32(0o640)
+		payload, _ := json.Marshal(InitUploadRequest{UploadID: uploadID, Relpath: relpath, Size: 1, LastModified: &lastModified, Mode: &mode})
+		var init InitUploadResponse
+		decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), http.StatusOK, &init)
+		decodeResponse(t, tp.do(t, http.MethodPut, init.PutURL, tp.token, []byte("x")), http.StatusOK, nil)
+	}
+
+	put("kept", "drawing.dwg")
+	info, err := os.Stat(filepath.Join(tp.destAbs, "drawing.dwg"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if !info.ModTime().Equal(stamp) || info.Mode().Perm() != 0o640 {
+		t.Fatalf("expected mtime %v and mode 0640, got %v and %v", stamp, info.ModTime(), info.Mode().Perm())
+	}
+
+	tp.api.keepMetadata = false
+	put("ignored", "other.dwg")
+	info, err = os.Stat(filepath.Join(tp.destAbs, "other.dwg"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.ModTime().Equal(stamp) {
+		t.Fatalf("expected mtime to be left alone when disabled")
+	}
+
+	mode := uint32(0o4755)
+	payload, _ := json.Marshal(InitUploadRequest{UploadID: "setuid", Relpath: "x.bin", Size: 1, Mode: &mode})
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), http.StatusBadRequest, nil)
+}
+
+func TestClientModeIsMasked(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{})
+	cases := map[uint32]os.FileMode{
+		0o777: 0o755,
+		0o666: 0o644,
+		0o000: 0o600,
+		0o704: 0o704,
+	}
+	i := 0
+	for sent, expected := range cases {
+		i++
+		mode := sent
+		relpath := fmt.Sprintf("f%d.bin", i)
+		payload, _ := json.Marshal(InitUploadRequest{UploadID: fmt.Sprintf("u%d", i), Relpath: relpath, Size: 1, Mode: &mode})
+		var init InitUploadResponse
+		decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), http.StatusOK, &init)
+		decodeResponse(t, tp.do(t, http.MethodPut, init.PutURL, tp.token, []byte("x")), http.StatusOK, nil)
+
+		info, err := os.Stat(filepath.Join(tp.destAbs, relpath))
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if info.Mode().Perm() != expected {
+			t.Fatalf("expected mode %04o to land as %v, got %v", sent, expected, info.Mode().Perm())
+		}
+	}
+}
+
+func TestPortalOwnershipAppliesModesAndSetgid(t *testing.T) {
+	destAbs := t.TempDir()
+	if err := os.Chmod(destAbs, 0o755|os.ModeSetgid); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	tp := newTestPortal(t, control.CreatePortalInput{
+		DestAbs:  destAbs,
+		FileMode: 0o660,
+		DirMode:  0o770,
+		Group:    strconv.Itoa(os.Getgid()),
+	})
+
+	lastModified := time.Now().UnixMilli()
+	mode := uint32(0o600)
+	payload, _ := json.Marshal(InitUploadRequest{UploadID: "u1", Relpath: "shared/sub/plan.txt", Size: 1, LastModified: &lastModified, Mode: &mode})
+	var init InitUploadResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), http.StatusOK, &init)
+	decodeResponse(t, tp.do(t, http.MethodPut, init.PutURL, tp.token, []byte("x")), http.StatusOK, nil)
+
+	file, err := os.Stat(filepath.Join(destAbs, "shared", "sub", "plan.txt"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if file.Mode().Perm() != 0o660 {
+		t.Fatalf("expected the portal's file mode to win over the client's, got %v", file.Mode().Perm())
+	}
+	for _, dir := range []string{"shared", filepath.Join("shared", "sub")} {
+		info, err := os.Stat(filepath.Join(destAbs, dir))
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if info.Mode().Perm() != 0o770 || info.Mode()&os.ModeSetgid == 0 {
+			t.Fatalf("expected %s to be 0770 with setgid inherited, got %v", dir, info.Mode())
+		}
+	}
+}
+
+func TestAtomicBatchTakesGroupAndSetgidFromDestination(t *testing.T) {
+	stagingRoot := t.TempDir()
+	t.Setenv("DROPSERVE_STAGING_ROOTS", stagingRoot)
+	destAbs := t.TempDir()
+	gid := os.Getgid()
+	if os.Getuid() == 0 {
+		// Root can hand the destination a group it is not running as, so
+		// a group taken from the staging tree would show.
+		gid = gid + 4
+		if err := os.Chown(destAbs, -1, gid); err != nil {
+			t.Fatalf("chown: %v", err)
+		}
+	}
+	if err := os.Chmod(destAbs, 0o755|os.ModeSetgid); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	tp := newTestPortal(t, control.CreatePortalInput{DestAbs: destAbs, AtomicBatches: true})
+
+	var batch BatchResponse
+	batchesPath := "/api/portals/" + tp.portal.ID + "/batches"
+	decodeResponse(t, tp.do(t, http.MethodPost, batchesPath, tp.token, []byte("{}")), http.StatusOK, &batch)
+	payload, _ := json.Marshal(InitUploadRequest{UploadID: "b1", Relpath: "Album/sub/1.txt", Size: 1, BatchID: batch.BatchID})
+	var init InitUploadResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), http.StatusOK, &init)
+	decodeResponse(t, tp.do(t, http.MethodPut, init.PutURL, tp.token, []byte("x")), http.StatusOK, nil)
+	decodeResponse(t, tp.do(t, http.MethodPost, batchesPath+"/"+batch.BatchID+"/commit", tp.token, []byte("{}")), http.StatusOK, nil)
+
+	for _, relpath := range []string{"Album", filepath.Join("Album", "sub"), filepath.Join("Album", "sub", "1.txt")} {
+		info, err := os.Stat(filepath.Join(destAbs, relpath))
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if got := fileGID(info); got != gid {
+			t.Fatalf("expected %s to get the destination's group %d, got %d", relpath, gid, got)
+		}
+		if info.IsDir() && info.Mode()&os.ModeSetgid == 0 {
+			t.Fatalf("expected %s to keep the setgid bit, got %v", relpath, info.Mode())
+		}
+	}
+}
+
+func TestStagingRootKeepsTempDataOutOfDestination(t *testing.T) {
+	stagingRoot := t.TempDir()
+	t.Setenv("DROPSERVE_STAGING_ROOTS", filepath.Join(stagingRoot, "missing")+string(os.PathListSeparator)+stagingRoot)
+	tp := newTestPortal(t, control.CreatePortalInput{})
+
+	decodeResponse(t, tp.upload(t, "u1", "a.txt", control.PolicyFail, []byte("data")), http.StatusOK, nil)
+
+	var batch BatchResponse
+	batchesPath := "/api/portals/" + tp.portal.ID + "/batches"
+	decodeResponse(t, tp.do(t, http.MethodPost, batchesPath, tp.token, []byte(`{"atomic":true}`)), http.StatusOK, &batch)
+	payload, _ := json.Marshal(InitUploadRequest{UploadID: "b1", Relpath: "Album/1.txt", Size: 1, BatchID: batch.BatchID})
+	var init InitUploadResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), http.StatusOK, &init)
+	decodeResponse(t, tp.do(t, http.MethodPut, init.PutURL, tp.token, []byte("x")), http.StatusOK, nil)
+
+	staged := filepath.Join(stagingRoot, tp.tempName, tp.portal.ID, "batches", batch.BatchID, "Album", "1.txt")
+	if _, err := os.Stat(staged); err != nil {
+		t.Fatalf("expected the staged file under the staging root: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tp.destAbs, tp.tempName)); !os.IsNotExist(err) {
+		t.Fatalf("expected no temp dir in the destination, got %v", err)
+	}
+
+	decodeResponse(t, tp.do(t, http.MethodPost, batchesPath+"/"+batch.BatchID+"/commit", tp.token, []byte("{}")), http.StatusOK, nil)
+	entries, _ := os.ReadDir(tp.destAbs)
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if fmt.Sprint(names) != "[Album a.txt]" {
+		t.Fatalf("expected only committed entries in the destination, got %v", names)
+	}
+	if files := destFiles(t, tp.destAbs, tp.tempName); files["a.txt"] != "data" || files["Album/1.txt"] != "x" {
+		t.Fatalf("unexpected destination files %v", files)
+	}
+}
+
+func TestFileTypeRulesApplyByNameAndContent(t *testing.T) {
+	rules, err := control.ParseFileTypes([]string{"pdf", "png"}, nil, []string{"application/pdf", "image/*"}, nil)
+	if err != nil {
+		t.Fatalf("parse rules: %v", err)
+	}
+	tp := newTestPortal(t, control.CreatePortalInput{FileTypes: rules})
+
+	payload, _ := json.Marshal(PreflightRequest{Items: []PreflightItem{
+		{Relpath: "a.pdf", Size: 4},
+		{Relpath: "b.exe", Size: 4},
+		{Relpath: "Empty", Type: entryTypeDir},
+	}})
+	var preflight PreflightResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/preflight", tp.token, payload), http.StatusOK, &preflight)
+	if len(preflight.Conflicts) != 1 || preflight.Conflicts[0].Relpath != "b.exe" || preflight.Conflicts[0].Reason != "file_type" || preflight.Conflicts[0].Action != actionReject {
+		t.Fatalf("expected only b.exe to be rejected, got %+v", preflight.Conflicts)
+	}
+
+	resp := tp.upload(t, "u1", "b.exe", control.PolicyFail, []byte("MZ.."))
+	decodeResponse(t, resp, http.StatusUnsupportedMediaType, nil)
+
+	// The name passes, but the bytes are not a PDF.
+	resp = tp.upload(t, "u2", "fake.pdf", control.PolicyFail, []byte("just text"))
+	decodeResponse(t, resp, http.StatusUnsupportedMediaType, nil)
+	var status UploadStatusResponse
+	decodeResponse(t, tp.do(t, http.MethodGet, "/api/portals/"+tp.portal.ID+"/uploads/u2", tp.token, nil), http.StatusOK, &status)
+	if status.Status != string(control.UploadFailed) {
+		t.Fatalf("expected the refused upload to fail, got %+v", status)
+	}
+
+	decodeResponse(t, tp.upload(t, "u3", "real.pdf", control.PolicyFail, []byte("%PDF-1.7\n")), http.StatusOK, nil)
+	files := destFiles(t, tp.destAbs, tp.tempName)
+	if len(files) != 1 || files["real.pdf"] != "%PDF-1.7\n" {
+		t.Fatalf("expected only real.pdf to land, got %v", files)
+	}
+}
+
+func TestExtensionRulesCheckSniffedContent(t *testing.T) {
+	rules, err := control.ParseFileTypes([]string{"jpg", "txt"}, []string{"exe"}, nil, nil)
+	if err != nil {
+		t.Fatalf("parse rules: %v", err)
+	}
+	tp := newTestPortal(t, control.CreatePortalInput{FileTypes: rules})
+
+	// An executable renamed to .jpg passes the name rule but not the bytes.
+	resp := tp.upload(t, "u1", "photo.jpg", control.PolicyFail, []byte("MZ\x90\x00\x03\x00\x00\x00"))
+	decodeResponse(t, resp, http.StatusUnsupportedMediaType, nil)
+
+	decodeResponse(t, tp.upload(t, "u2", "photo.jpg", control.PolicyFail, []byte("\xff\xd8\xff\xe0jfif")), http.StatusOK, nil)
+	decodeResponse(t, tp.upload(t, "u3", "notes.txt", control.PolicyFail, []byte("hello")), http.StatusOK, nil)
+	files := destFiles(t, tp.destAbs, tp.tempName)
+	if len(files) != 2 || files["notes.txt"] != "hello" {
+		t.Fatalf("expected only the real jpeg and text to land, got %v", files)
+	}
+}
+
+func TestAutorenameRechecksFileTypes(t *testing.T) {
+	rules, err := control.ParseFileTypes([]string{"txt"}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("parse rules: %v", err)
+	}
+	tp := newTestPortal(t, control.CreatePortalInput{
+		FileTypes:      rules,
+		DefaultPolicy:  control.PolicyAutorename,
+		RenameTemplate: "{name}-copy-{n}",
+	})
+
+	decodeResponse(t, tp.upload(t, "u1", "notes.txt", "", []byte("first")), http.StatusOK, nil)
+	// The template drops the extension, so the renamed file is refused.
+	decodeResponse(t, tp.upload(t, "u2", "notes.txt", "", []byte("second")), http.StatusUnsupportedMediaType, nil)
+	files := destFiles(t, tp.destAbs, tp.tempName)
+	if len(files) != 1 || files["notes.txt"] != "first" {
+		t.Fatalf("expected only the first upload to land, got %v", files)
+	}
+}
+
+func TestHooksRunAfterCommitAndClose(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "events")
+	t.Setenv("DROPSERVE_HOOK_ON_COMMIT", `echo "$DROPSERVE_EVENT $DROPSERVE_RELPATH $DROPSERVE_SIZE" >> "`+out+`"`)
+	t.Setenv("DROPSERVE_HOOK_ON_CLOSE", `echo "$DROPSERVE_EVENT $DROPSERVE_FILES $DROPSERVE_SIZE $DROPSERVE_STATE" >> "`+out+`"`)
+	tp := newTestPortal(t, control.CreatePortalInput{})
+
+	decodeResponse(t, tp.upload(t, "u1", "Docs/a.txt", control.PolicyFail, []byte("data")), http.StatusOK, nil)
+	tp.api.hooks.Wait()
+	decodeResponse(t, tp.upload(t, "u2", "Docs/a.txt", control.PolicySkip, []byte("data")), http.StatusOK, nil)
+
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/close", tp.token, nil), http.StatusOK, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tp.api.hooks.Wait()
+		events, _ := os.ReadFile(out)
+		if strings.Count(string(events), "\n") >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	events, _ := os.ReadFile(out)
+	if string(events) != "commit Docs/a.txt 4\nclose 1 4 closed\n" {
+		t.Fatalf("unexpected hook events %q", events)
+	}
+}
+
+func TestPortalWebhookReceivesSignedEvents(t *testing.T) {
+	var mu sync.Mutex
+	var events []webhooks.Event
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(webhooks.HeaderTimestamp), 10, 64)
+		if r.Header.Get(webhooks.HeaderSignature) != webhooks.Sign("portal-secret", timestamp, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event webhooks.Event
+		_ = json.Unmarshal(body, &event)
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}))
+	t.Cleanup(receiver.Close)
+	tp := newTestPortal(t, control.CreatePortalInput{WebhookURL: receiver.URL, WebhookSecret: "portal-secret"})
+
+	decodeResponse(t, tp.upload(t, "u1", "a.txt", control.PolicyFail, []byte("data")), http.StatusOK, nil)
+	payload, _ := json.Marshal(InitUploadRequest{UploadID: "u2", Relpath: "b.txt", Size: 4})
+	var init InitUploadResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), http.StatusOK, &init)
+	decodeResponse(t, tp.do(t, http.MethodPut, init.PutURL, tp.token, []byte("da")), http.StatusBadRequest, nil)
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/close", tp.token, nil), http.StatusOK, nil)
+
+	seen := func() map[string]webhooks.Event {
+		mu.Lock()
+		defer mu.Unlock()
+		byType := make(map[string]webhooks.Event)
+		for _, event := range events {
+			byType[event.Type] = event
+		}
+		return byType
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(seen()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	byType := seen()
+	committed, failed, closed := byType[webhooks.UploadCommitted], byType[webhooks.UploadFailed], byType[webhooks.PortalClosed]
+	if committed.Upload == nil || committed.Upload.FinalRelpath != "a.txt" || committed.PortalID != tp.portal.ID || committed.Dest != tp.destAbs {
+		t.Fatalf("unexpected committed event %+v", committed)
+	}
+	if failed.Upload == nil || failed.Upload.UploadID != "u2" {
+		t.Fatalf("unexpected failed event %+v", failed)
+	}
+	if closed.Portal == nil || closed.Portal.FilesCommitted != 1 || closed.Portal.BytesCommitted != 4 {
+		t.Fatalf("unexpected closed event %+v", closed)
+	}
+}
+
+func TestVirusScanRefusesAndQuarantinesInfectedUploads(t *testing.T) {
+	clamd := clamdtest.NewServer(t, map[string]string{"EICAR": "Eicar-Test-Signature"})
+	quarantine := filepath.Join(t.TempDir(), "quarantine")
+	t.Setenv("DROPSERVE_CLAMD_ADDRESS", clamd.Addr)
+	t.Setenv("DROPSERVE_QUARANTINE_DIR", quarantine)
+	tp := newTestPortal(t, control.CreatePortalInput{})
+
+	decodeResponse(t, tp.upload(t, "u1", "clean.txt", control.PolicyFail, []byte("clean")), http.StatusOK, nil)
+
+	var failure errorResponse
+	decodeResponse(t, tp.upload(t, "u2", "Docs/bad.txt", control.PolicyFail, []byte("xxEICARxx")), http.StatusUnprocessableEntity, &failure)
+	if failure.Error != "file infected" {
+		t.Fatalf("unexpected error %q", failure.Error)
+	}
+	var status UploadStatusResponse
+	decodeResponse(t, tp.do(t, http.MethodGet, "/api/portals/"+tp.portal.ID+"/uploads/u2", tp.token, nil), http.StatusOK, &status)
+	if status.Status != string(control.UploadFailed) {
+		t.Fatalf("expected the infected upload to fail, got %+v", status)
+	}
+
+	// Without a verdict nothing is committed.
+	clamd.SetFailing(true)
+	decodeResponse(t, tp.upload(t, "u3", "later.txt", control.PolicyFail, []byte("clean")), http.StatusServiceUnavailable, nil)
+
+	if clamd.Scans() != 3 {
+		t.Fatalf("expected 3 scans, got %d", clamd.Scans())
+	}
+	files := destFiles(t, tp.destAbs, tp.tempName)
+	if len(files) != 1 || files["clean.txt"] != "clean" {
+		t.Fatalf("expected only clean.txt to land, got %v", files)
+	}
+	matches, _ := filepath.Glob(filepath.Join(quarantine, tp.portal.ID+"-*.quarantine"))
+	if len(matches) != 1 {
+		t.Fatalf("expected one quarantined file, got %v", matches)
+	}
+	quarantined, err := os.ReadFile(matches[0])
+	if err != nil || string(quarantined) != "xxEICARxx" {
+		t.Fatalf("expected the infected file in quarantine, got %q: %v", quarantined, err)
+	}
+	var record quarantineRecord
+	data, _ := os.ReadFile(matches[0] + ".json")
+	if err := json.Unmarshal(data, &record); err != nil || record.Relpath != "Docs/bad.txt" || record.UploadID != "u2" || record.Signature != "Eicar-Test-Signature" {
+		t.Fatalf("unexpected quarantine record %s: %v", data, err)
+	}
+}
+
+func TestReviewPortalHoldsUploadsUntilApproved(t *testing.T) {
+	reviewDir := t.TempDir()
+	t.Setenv("DROPSERVE_REVIEW_DIR", reviewDir)
+	dest := t.TempDir()
+	tp := newTestPortal(t, control.CreatePortalInput{DestAbs: dest, Review: true})
+	operator := httptest.NewServer(tp.api.ReviewHandler())
+	t.Cleanup(operator.Close)
+	decide := func(id, action, body string, status int) control.ReviewDecisionResponse {
+		t.Helper()
+		resp, err := http.Post(operator.URL+"/api/control/review/"+id+"/"+action, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: %v", action, err)
+		}
+		var out control.ReviewDecisionResponse
+		if status != http.StatusOK {
+			decodeResponse(t, resp, status, nil)
+			return out
+		}
+		decodeResponse(t, resp, status, &out)
+		return out
+	}
+
+	var held UploadCommitResponse
+	decodeResponse(t, tp.upload(t, "u1", "Docs/a.txt", control.PolicyFail, []byte("data")), http.StatusOK, &held)
+	if held.Status != string(control.UploadHeld) {
+		t.Fatalf("expected the upload to be held, got %+v", held)
+	}
+	decodeResponse(t, tp.upload(t, "u2", "b.txt", control.PolicyFail, []byte("new")), http.StatusOK, nil)
+	decodeResponse(t, tp.upload(t, "u3", "c.txt", control.PolicyFail, []byte("junk")), http.StatusOK, nil)
+	payload, _ := json.Marshal(InitUploadRequest{UploadID: "d1", Relpath: "Empty", Type: entryTypeDir})
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+tp.portal.ID+"/uploads", tp.token, payload), http.StatusOK, nil)
+	// Someone else writes b.txt while the upload waits.
+	if err := os.WriteFile(filepath.Join(dest, "b.txt"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	if files := destFiles(t, dest, tp.tempName); len(files) != 1 || files["b.txt"] != "old" {
+		t.Fatalf("expected nothing to land before approval, got %v", files)
+	}
+
+	resp, err := http.Get(operator.URL + "/api/control/review?portal_id=" + tp.portal.ID)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	var list control.ReviewListResponse
+	decodeResponse(t, resp, http.StatusOK, &list)
+	items := map[string]string{}
+	for _, item := range list.Items {
+		items[item.Relpath] = item.ID
+		if item.Relpath == "Docs/a.txt" && (item.Size != 4 || item.SHA256 != "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7" || item.RemoteAddr != "127.0.0.1" || item.UserAgent == "") {
+			t.Fatalf("unexpected item %+v", item)
+		}
+	}
+	if len(items) != 4 {
+		t.Fatalf("expected 4 held items, got %+v", list.Items)
+	}
+
+	if out := decide(items["Docs/a.txt"], "approve", "", http.StatusOK); out.Status != string(control.UploadCommitted) || out.FinalRelpath != "Docs/a.txt" {
+		t.Fatalf("unexpected approval %+v", out)
+	}
+	// The upload's own policy applies, so the conflict is reported and the
+	// item stays until it is approved with another policy.
+	decide(items["b.txt"], "approve", "", http.StatusConflict)
+	if out := decide(items["b.txt"], "approve", `{"policy":"autorename"}`, http.StatusOK); out.FinalRelpath == "b.txt" {
+		t.Fatalf("expected b.txt to be renamed, got %+v", out)
+	}
+	decide(items["Empty"], "approve", "", http.StatusOK)
+	if out := decide(items["c.txt"], "reject", "", http.StatusOK); out.Status != "rejected" {
+		t.Fatalf("unexpected rejection %+v", out)
+	}
+	decide(items["c.txt"], "approve", "", http.StatusNotFound)
+
+	files := destFiles(t, dest, tp.tempName)
+	if len(files) != 3 || files["Docs/a.txt"] != "data" || files["b.txt"] != "old" {
+		t.Fatalf("unexpected destination after review %v", files)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "Empty")); err != nil || !info.IsDir() {
+		t.Fatalf("expected the approved folder: %v", err)
+	}
+	if left, _ := os.ReadDir(reviewDir); len(left) != 0 {
+		t.Fatalf("expected an empty review area, got %d entries", len(left))
+	}
+}
+
+func TestApproveClaimsIssuesTokenOnlyAfterApproval(t *testing.T) {
+	store := control.NewStore()
+	portal, err := store.CreatePortal(control.CreatePortalInput{DestAbs: t.TempDir(), Reusable: true, ApproveClaims: true})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	t.Setenv("DROPSERVE_WEBHOOK_OUTBOX", t.TempDir())
+	api := NewServer(store, log.New(io.Discard, "", 0))
+	server := httptest.NewServer(api.Handler())
+	t.Cleanup(server.Close)
+	tp := &testPortal{api: api, server: server, store: store, portal: portal}
+
+	claim := func() ClaimPendingResponse {
+		t.Helper()
+		var pending ClaimPendingResponse
+		decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+portal.ID+"/claim", "", []byte("{}")), http.StatusAccepted, &pending)
+		if pending.Status != "pending" || pending.ClaimToken == "" || pending.Code == "" {
+			t.Fatalf("unexpected pending claim %+v", pending)
+		}
+		return pending
+	}
+	status := func(pending ClaimPendingResponse) *http.Response {
+		t.Helper()
+		request, err := http.NewRequest(http.MethodGet, server.URL+"/api/portals/"+portal.ID+"/claims/"+pending.ClaimID, nil)
+		if err != nil {
+			t.Fatalf("build request: %v", err)
+		}
+		request.Header.Set("X-Claim-Token", pending.ClaimToken)
+		resp, err := server.Client().Do(request)
+		if err != nil {
+			t.Fatalf("claim status: %v", err)
+		}
+		return resp
+	}
+
+	approved := claim()
+	decodeResponse(t, status(approved), http.StatusAccepted, nil)
+	decodeResponse(t, tp.do(t, http.MethodGet, "/api/portals/"+portal.ID+"/claims/"+approved.ClaimID, "", nil), http.StatusNotFound, nil)
+
+	pending, err := store.PendingClaims(portal.ID)
+	if err != nil || len(pending) != 1 || pending[0].Code != approved.Code || pending[0].RemoteAddr != "127.0.0.1" {
+		t.Fatalf("expected the operator to see the claim, got %+v: %v", pending, err)
+	}
+	if _, err := store.DecideClaim(portal.ID, approved.ClaimID, true); err != nil {
+		t.Fatalf("approve claim: %v", err)
+	}
+	var result ClaimPortalResponse
+	decodeResponse(t, status(approved), http.StatusOK, &result)
+	if result.ClientToken == "" || result.PortalID != portal.ID {
+		t.Fatalf("unexpected claim result %+v", result)
+	}
+	tp.token = result.ClientToken
+	decodeResponse(t, tp.upload(t, "u1", "a.txt", control.PolicyOverwrite, []byte("data")), http.StatusOK, nil)
+
+	denied := claim()
+	if _, err := store.DecideClaim(portal.ID, denied.ClaimID, false); err != nil {
+		t.Fatalf("deny claim: %v", err)
+	}
+	decodeResponse(t, status(denied), http.StatusForbidden, nil)
+}
+
+func TestPassphraseProtectedClaim(t *testing.T) {
+	store := control.NewStore()
+	portal, err := store.CreatePortal(control.CreatePortalInput{DestAbs: t.TempDir(), Passphrase: "4821"})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	t.Setenv("DROPSERVE_WEBHOOK_OUTBOX", t.TempDir())
+	api := NewServer(store, log.New(io.Discard, "", 0))
+	server := httptest.NewServer(api.Handler())
+	t.Cleanup(server.Close)
+	tp := &testPortal{api: api, server: server, store: store, portal: portal}
+	claimPath := "/api/portals/" + portal.ID + "/claim"
+
+	var info PortalInfoResponse
+	decodeResponse(t, tp.do(t, http.MethodGet, "/api/portals/"+portal.ID+"/info", "", nil), http.StatusOK, &info)
+	if !info.Passphrase {
+		t.Fatalf("expected info to ask for the passphrase, got %+v", info)
+	}
+
+	decodeResponse(t, tp.do(t, http.MethodPost, claimPath, "", []byte("{}")), http.StatusUnauthorized, nil)
+	for i := 0; i < 5; i++ {
+		decodeResponse(t, tp.do(t, http.MethodPost, claimPath, "", []byte(`{"passphrase":"0000"}`)), http.StatusUnauthorized, nil)
+	}
+	resp := tp.do(t, http.MethodPost, claimPath, "", []byte(`{"passphrase":"4821"}`))
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatal("expected a Retry-After header once locked out")
+	}
+	decodeResponse(t, resp, http.StatusTooManyRequests, nil)
+
+	other, err := store.CreatePortal(control.CreatePortalInput{DestAbs: t.TempDir(), Passphrase: "4821"})
+	if err != nil {
+		t.Fatalf("create portal: %v", err)
+	}
+	var claim ClaimPortalResponse
+	decodeResponse(t, tp.do(t, http.MethodPost, "/api/portals/"+other.ID+"/claim", "", []byte(`{"passphrase":"4821"}`)), http.StatusOK, &claim)
+	if claim.ClientToken == "" {
+		t.Fatalf("expected a client token, got %+v", claim)
+	}
+}
+
+func TestLandingCodeFormRedirectsToPortal(t *testing.T) {
+	tp := newTestPortal(t, control.CreatePortalInput{})
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	enter := func(code string) string {
+		t.Helper()
+		resp, err := client.PostForm(tp.server.URL+"/", url.Values{"code": {code}})
+		if err != nil {
+			t.Fatalf("post code: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Fatalf("expected 303, got %d", resp.StatusCode)
+		}
+		return resp.Header.Get("Location")
+	}
+
+	if location := enter(strings.ToUpper(tp.portal.Code)); location != "/p/"+tp.portal.ID {
+		t.Fatalf("expected a redirect to the portal, got %q", location)
+	}
+	for i := 0; i < 9; i++ {
+		if location := enter("no-such-code-10"); location != "/?error=unknown-code" {
+			t.Fatalf("expected an unknown code to go back to the landing page, got %q", location)
+		}
+	}
+	if location := enter(tp.portal.Code); location != "/?error=too-many-lookups" {
+		t.Fatalf("expected lookups to be limited, got %q", location)
+	}
+}
@@ -0,0 +1,94 @@
+package publicapi
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+
+	"dropserve/internal/control"
+	"dropserve/internal/pathsafe"
+)
+
+// tempBase returns the directory that holds destAbs's temp tree, the
+// tempDirName folder with upload and batch staging data. Without staging
+// roots that is the destination itself. Otherwise it is the first staging
+// root on the destination's filesystem, so placing a file stays a rename;
+// when none shares it, the first usable root is taken and commits copy.
+// The choice is made once per destination.
+func (s *Server) tempBase(destAbs string) string {
+	if len(s.stagingRoots) == 0 {
+		return destAbs
+	}
+	if cached, ok := s.tempBases.Load(destAbs); ok {
+		return cached.(string)
+	}
+	base := s.pickStagingRoot(destAbs)
+	actual, _ := s.tempBases.LoadOrStore(destAbs, base)
+	return actual.(string)
+}
+
+func (s *Server) pickStagingRoot(destAbs string) string {
+	destInfo, err := os.Stat(destAbs)
+	if err != nil {
+		s.logger.Printf("staging root lookup failed dest=%s err=%v", destAbs, err)
+		return destAbs
+	}
+	destDev, known := fileDevice(destInfo)
+
+	fallback := ""
+	for _, root := range s.stagingRoots {
+		info, err := os.Stat(root)
+		if err != nil || !info.IsDir() {
+			s.logger.Printf("staging root unusable root=%s err=%v", root, err)
+			continue
+		}
+		if dev, ok := fileDevice(info); known && ok && dev == destDev {
+			return root
+		}
+		if fallback == "" {
+			fallback = root
+		}
+	}
+	if fallback == "" {
+		s.logger.Printf("no usable staging root, staging inside dest=%s", destAbs)
+		return destAbs
+	}
+	s.logger.Printf("no staging root on the filesystem of dest=%s; commits will copy from root=%s", destAbs, fallback)
+	return fallback
+}
+
+// stagesOnDestDevice reports whether destAbs's temp tree can be renamed
+// into it, which an atomic batch needs to land in one step.
+func (s *Server) stagesOnDestDevice(destAbs string) bool {
+	base := s.tempBase(destAbs)
+	if base == destAbs {
+		return true
+	}
+	destInfo, err := os.Stat(destAbs)
+	if err != nil {
+		return false
+	}
+	baseInfo, err := os.Stat(base)
+	if err != nil {
+		return false
+	}
+	destDev, destKnown := fileDevice(destInfo)
+	baseDev, baseKnown := fileDevice(baseInfo)
+	return destKnown && baseKnown && destDev == baseDev
+}
+
+// portalTempDir is the portal's folder inside the temp tree.
+func (s *Server) portalTempDir(portal control.Portal) string {
+	return filepath.Join(s.tempBase(portal.DestAbs), s.tempDirName, portal.ID)
+}
+
+// makePortalTempDir creates sub (a slash-separated path such as "uploads")
+// inside the portal's temp folder one component at a time, so a symlink
+// planted at the temp folder or below it is refused instead of followed.
+func (s *Server) makePortalTempDir(portal control.Portal, sub string, perm os.FileMode) error {
+	dir, err := pathsafe.OpenDirBeneath(s.tempBase(portal.DestAbs), path.Join(s.tempDirName, portal.ID, sub), true, perm)
+	if err != nil {
+		return err
+	}
+	return dir.Close()
+}
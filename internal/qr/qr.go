@@ -0,0 +1,411 @@
+// Package qr encodes short byte strings, such as portal links, as QR codes
+// (ISO/IEC 18004) and draws them in a terminal. It covers what a link
+// needs: byte mode, error correction level M, and versions 1 to 10, which
+// hold up to 213 bytes.
+package qr
+
+import (
+	"errors"
+)
+
+var ErrTooLong = errors.New("qr: data too long")
+
+// Code is an encoded QR symbol without its quiet zone.
+type Code struct {
+	Size    int
+	modules [][]bool
+}
+
+// Dark reports whether the module at column x, row y is dark. Anything
+// outside the symbol is light.
+func (c *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.modules[y][x]
+}
+
+// blockLayout describes the codewords of one version at level M: error
+// correction codewords per block, and the blocks of each of the two block
+// groups with their data codewords.
+type blockLayout struct {
+	ecPerBlock  int
+	blocks1     int
+	dataPerBlk1 int
+	blocks2     int
+	dataPerBlk2 int
+}
+
+var layouts = [...]blockLayout{
+	1:  {10, 1, 16, 0, 0},
+	2:  {16, 1, 28, 0, 0},
+	3:  {26, 1, 44, 0, 0},
+	4:  {18, 2, 32, 0, 0},
+	5:  {24, 2, 43, 0, 0},
+	6:  {16, 4, 27, 0, 0},
+	7:  {18, 4, 31, 0, 0},
+	8:  {22, 2, 38, 2, 39},
+	9:  {22, 3, 36, 2, 37},
+	10: {26, 4, 43, 1, 44},
+}
+
+var alignmentPositions = [...][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+const maxVersion = 10
+
+func (l blockLayout) dataCodewords() int {
+	return l.blocks1*l.dataPerBlk1 + l.blocks2*l.dataPerBlk2
+}
+
+// Encode returns the smallest symbol holding data, with the mask that
+// scores lowest under the standard's penalty rules.
+func Encode(data []byte) (*Code, error) {
+	version := 0
+	for v := 1; v <= maxVersion; v++ {
+		if 4+countBits(v)+8*len(data) <= 8*layouts[v].dataCodewords() {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	codewords := interleave(version, dataCodewords(version, data))
+	var best *Code
+	bestPenalty := 0
+	for mask := 0; mask < 8; mask++ {
+		code, function := newSymbol(version)
+		drawFunctionPatterns(code, function, version, mask)
+		drawCodewords(code, function, codewords)
+		applyMask(code, function, mask)
+		if penalty := code.penalty(); best == nil || penalty < bestPenalty {
+			best, bestPenalty = code, penalty
+		}
+	}
+	return best, nil
+}
+
+func countBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// dataCodewords lays data out in byte mode and pads it to the version's
+// data capacity.
+func dataCodewords(version int, data []byte) []byte {
+	var bits bitBuffer
+	bits.append(0b0100, 4)
+	bits.append(uint32(len(data)), countBits(version))
+	for _, b := range data {
+		bits.append(uint32(b), 8)
+	}
+
+	capacity := 8 * layouts[version].dataCodewords()
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := uint32(0xEC); len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	return bits.bytes()
+}
+
+// interleave splits the data into blocks, adds each block's error
+// correction codewords, and interleaves them as the symbol stores them.
+func interleave(version int, data []byte) []byte {
+	layout := layouts[version]
+	divisor := rsDivisor(layout.ecPerBlock)
+
+	var blocks, ecBlocks [][]byte
+	for i := 0; i < layout.blocks1+layout.blocks2; i++ {
+		n := layout.dataPerBlk1
+		if i >= layout.blocks1 {
+			n = layout.dataPerBlk2
+		}
+		blocks = append(blocks, data[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(data[:n], divisor))
+		data = data[n:]
+	}
+
+	var out []byte
+	for i := 0; i < layout.dataPerBlk1 || i < layout.dataPerBlk2; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < layout.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+func newSymbol(version int) (*Code, [][]bool) {
+	size := 17 + 4*version
+	code := &Code{Size: size, modules: make([][]bool, size)}
+	function := make([][]bool, size)
+	for y := range code.modules {
+		code.modules[y] = make([]bool, size)
+		function[y] = make([]bool, size)
+	}
+	return code, function
+}
+
+func drawFunctionPatterns(code *Code, function [][]bool, version, mask int) {
+	set := func(x, y int, dark bool) {
+		code.modules[y][x] = dark
+		function[y][x] = true
+	}
+	size := code.Size
+
+	for i := 0; i < size; i++ {
+		set(6, i, i%2 == 0)
+		set(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns with their separators.
+	for _, corner := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := corner[0]+dx, corner[1]+dy
+				if x < 0 || y < 0 || x >= size || y >= size {
+					continue
+				}
+				d := max(abs(dx), abs(dy))
+				set(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+
+	positions := alignmentPositions[version]
+	last := len(positions) - 1
+	for i, cy := range positions {
+		for j, cx := range positions {
+			// The corners taken by finder patterns get none.
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	format := formatBits(mask)
+	bit := func(i int) bool { return format>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		set(8, i, bit(i))
+	}
+	set(8, 7, bit(6))
+	set(8, 8, bit(7))
+	set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		set(size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		set(8, size-15+i, bit(i))
+	}
+	set(8, size-8, true)
+
+	if version >= 7 {
+		info := versionBits(version)
+		for i := 0; i < 18; i++ {
+			dark := info>>i&1 == 1
+			a, b := size-11+i%3, i/3
+			set(a, b, dark)
+			set(b, a, dark)
+		}
+	}
+}
+
+// formatBits is the 15-bit format information for level M and mask.
+func formatBits(mask int) uint32 {
+	const levelM = 0b00
+	data := uint32(levelM<<3 | mask)
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// versionBits is the 18-bit version information, for versions 7 and up.
+func versionBits(version int) uint32 {
+	rem := uint32(version)
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	return uint32(version)<<12 | rem
+}
+
+// drawCodewords places the codewords' bits in the zigzag order of the
+// standard: two-column strips from the right, alternately upwards and
+// downwards, stepping over the vertical timing pattern.
+func drawCodewords(code *Code, function [][]bool, codewords []byte) {
+	size := code.Size
+	i := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < size; vert++ {
+			y := vert
+			if upward {
+				y = size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				code.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+func applyMask(code *Code, function [][]bool, mask int) {
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if !function[y][x] && maskBit(mask, x, y) {
+				code.modules[y][x] = !code.modules[y][x]
+			}
+		}
+	}
+}
+
+func maskBit(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// penalty scores the symbol with the four rules the standard uses to pick
+// a mask; lower is better.
+func (c *Code) penalty() int {
+	size := c.Size
+	score := 0
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+	for _, vertical := range []bool{false, true} {
+		at := func(i, j int) bool {
+			if vertical {
+				return c.modules[j][i]
+			}
+			return c.modules[i][j]
+		}
+		for i := 0; i < size; i++ {
+			run := 1
+			for j := 1; j <= size; j++ {
+				if j < size && at(i, j) == at(i, j-1) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+			for j := 0; j+11 <= size; j++ {
+				for _, pattern := range finderLike {
+					matched := true
+					for k, dark := range pattern {
+						if at(i, j+k) != dark {
+							matched = false
+							break
+						}
+					}
+					if matched {
+						score += 40
+					}
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < size && y+1 < size {
+				m := c.modules[y][x]
+				if m == c.modules[y][x+1] && m == c.modules[y+1][x] && m == c.modules[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+	total := size * size
+	score += 10 * (abs(dark*20-total*10) / total)
+	return score
+}
+
+type bitBuffer []bool
+
+func (b *bitBuffer) append(value uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 == 1)
+	}
+}
+
+func (b bitBuffer) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return out
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
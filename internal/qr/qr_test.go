@@ -0,0 +1,197 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestReedSolomonMatchesStandardExample(t *testing.T) {
+	// "HELLO WORLD" at 1-M, from the worked example in ISO/IEC 18004.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestFormatAndVersionBits(t *testing.T) {
+	want := []uint32{
+		0b101010000010010, 0b101000100100101, 0b101111001111100, 0b101101101001011,
+		0b100010111111001, 0b100000011001110, 0b100111110010111, 0b100101010100000,
+	}
+	for mask, bits := range want {
+		if got := formatBits(mask); got != bits {
+			t.Fatalf("mask %d: expected %015b, got %015b", mask, bits, got)
+		}
+	}
+	if got := versionBits(7); got != 0b000111110010010100 {
+		t.Fatalf("version 7: got %018b", got)
+	}
+}
+
+func TestEncodePicksSmallestVersion(t *testing.T) {
+	for _, tc := range []struct {
+		length  int
+		version int
+	}{{1, 1}, {14, 1}, {15, 2}, {62, 4}, {63, 5}, {213, 10}} {
+		code, err := Encode(bytes.Repeat([]byte("a"), tc.length))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", tc.length, err)
+		}
+		if code.Size != 17+4*tc.version {
+			t.Fatalf("%d bytes: expected version %d, got size %d", tc.length, tc.version, code.Size)
+		}
+	}
+	if _, err := Encode(bytes.Repeat([]byte("a"), 214)); !errors.Is(err, ErrTooLong) {
+		t.Fatalf("expected ErrTooLong, got %v", err)
+	}
+}
+
+// TestEncodeReadsBack decodes the symbols Encode draws: it reads the format
+// information, unmasks, collects the codewords, and checks the data and
+// every block's error correction.
+func TestEncodeReadsBack(t *testing.T) {
+	for _, text := range []string{
+		"http://192.168.1.20:8080/p/p_kl3towsqskzminit56pbmvfeja",
+		strings.Repeat("https://example.com/", 8),
+		strings.Repeat("x", 200),
+	} {
+		code, err := Encode([]byte(text))
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		version := (code.Size - 17) / 4
+
+		var format uint32
+		for i, pos := range [][2]int{{8, 0}, {8, 1}, {8, 2}, {8, 3}, {8, 4}, {8, 5}, {8, 7}, {8, 8}, {7, 8}, {5, 8}, {4, 8}, {3, 8}, {2, 8}, {1, 8}, {0, 8}} {
+			if code.Dark(pos[0], pos[1]) {
+				format |= 1 << i
+			}
+		}
+		mask := -1
+		for m := 0; m < 8; m++ {
+			if formatBits(m) == format {
+				mask = m
+			}
+		}
+		if mask < 0 {
+			t.Fatalf("%q: unreadable format information %015b", text, format)
+		}
+
+		unmasked, function := newSymbol(version)
+		drawFunctionPatterns(unmasked, function, version, mask)
+		for y := 0; y < code.Size; y++ {
+			for x := 0; x < code.Size; x++ {
+				if function[y][x] {
+					if code.Dark(x, y) != unmasked.Dark(x, y) {
+						t.Fatalf("%q: function module (%d,%d) differs", text, x, y)
+					}
+					continue
+				}
+				unmasked.modules[y][x] = code.Dark(x, y) != maskBit(mask, x, y)
+			}
+		}
+		codewords := readCodewords(unmasked, function)
+
+		layout := layouts[version]
+		blocks := layout.blocks1 + layout.blocks2
+		data := make([][]byte, blocks)
+		i := 0
+		for k := 0; k < layout.dataPerBlk1 || k < layout.dataPerBlk2; k++ {
+			for b := 0; b < blocks; b++ {
+				n := layout.dataPerBlk1
+				if b >= layout.blocks1 {
+					n = layout.dataPerBlk2
+				}
+				if k < n {
+					data[b] = append(data[b], codewords[i])
+					i++
+				}
+			}
+		}
+		ec := make([][]byte, blocks)
+		for k := 0; k < layout.ecPerBlock; k++ {
+			for b := 0; b < blocks; b++ {
+				ec[b] = append(ec[b], codewords[i])
+				i++
+			}
+		}
+		for b := range data {
+			if !bytes.Equal(rsRemainder(data[b], rsDivisor(layout.ecPerBlock)), ec[b]) {
+				t.Fatalf("%q: block %d fails error correction", text, b)
+			}
+		}
+
+		stream := bytes.Join(data, nil)
+		if want := dataCodewords(version, []byte(text)); !bytes.Equal(stream, want) {
+			t.Fatalf("%q: data codewords differ", text)
+		}
+		header := 12
+		if version >= 10 {
+			header = 20
+		}
+		if got := readBits(stream, header, len(text)); got != text {
+			t.Fatalf("expected %q, read %q", text, got)
+		}
+	}
+}
+
+func readCodewords(code *Code, function [][]bool) []byte {
+	var bits bitBuffer
+	size := code.Size
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < size; vert++ {
+			y := vert
+			if (right+1)&2 == 0 {
+				y = size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				if x := right - j; !function[y][x] {
+					bits = append(bits, code.modules[y][x])
+				}
+			}
+		}
+	}
+	return bitBuffer(bits[:len(bits)/8*8]).bytes()
+}
+
+func readBits(stream []byte, offset, n int) string {
+	out := make([]byte, n)
+	for i := range out {
+		for k := 0; k < 8; k++ {
+			bit := offset + i*8 + k
+			out[i] = out[i]<<1 | stream[bit/8]>>(7-bit%8)&1
+		}
+	}
+	return string(out)
+}
+
+func TestWriteTerminal(t *testing.T) {
+	code, err := Encode([]byte("http://192.168.1.20:8080/p/p_kl3towsqskzminit56pbmvfeja"))
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	var out bytes.Buffer
+	if err := code.WriteTerminal(&out); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if want := (code.Size + 2*quietZone + 1) / 2; len(lines) != want {
+		t.Fatalf("expected %d lines, got %d", want, len(lines))
+	}
+	// The first two rows of the upper left finder pattern, after the quiet
+	// zone: its dark top edge over its two dark sides, then the separator.
+	row := []rune(strings.TrimSuffix(strings.TrimPrefix(lines[2], "\x1b[30;47m"), "\x1b[0m"))
+	if len(row) != code.Size+2*quietZone || string(row[quietZone:quietZone+8]) != "█▀▀▀▀▀█ " {
+		t.Fatalf("unexpected line %q", lines[2])
+	}
+	if !utf8.Valid(out.Bytes()) {
+		t.Fatal("expected valid UTF-8")
+	}
+}
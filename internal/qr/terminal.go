@@ -0,0 +1,34 @@
+package qr
+
+import (
+	"bufio"
+	"io"
+)
+
+// quietZone is the light border the standard asks for around a symbol.
+const quietZone = 4
+
+// WriteTerminal draws the code with UTF-8 half blocks, two module rows per
+// line. Colors are set explicitly, black on white, so the code scans the
+// same on dark and light terminal themes.
+func (c *Code) WriteTerminal(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	for y := -quietZone; y < c.Size+quietZone; y += 2 {
+		out.WriteString("\x1b[30;47m")
+		for x := -quietZone; x < c.Size+quietZone; x++ {
+			top, bottom := c.Dark(x, y), c.Dark(x, y+1)
+			switch {
+			case top && bottom:
+				out.WriteString("█")
+			case top:
+				out.WriteString("▀")
+			case bottom:
+				out.WriteString("▄")
+			default:
+				out.WriteString(" ")
+			}
+		}
+		out.WriteString("\x1b[0m\n")
+	}
+	return out.Flush()
+}
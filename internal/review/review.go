@@ -0,0 +1,216 @@
+package review
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dropserve/internal/commit"
+)
+
+var ErrNotFound = errors.New("review item not found")
+
+var idPattern = regexp.MustCompile(`^[0-9a-f]{10}$`)
+
+// Item is an upload held for an operator's decision. Besides describing
+// the upload and its uploader, it keeps the portal settings needed to
+// place it on approval, since the portal may be long gone by then.
+type Item struct {
+	ID         string    `json:"id"`
+	PortalID   string    `json:"portal_id"`
+	Dest       string    `json:"dest"`
+	UploadID   string    `json:"upload_id"`
+	Relpath    string    `json:"relpath"`
+	Dir        bool      `json:"dir,omitempty"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256,omitempty"`
+	ClientID   string    `json:"client_id"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+
+	Policy         string      `json:"policy"`
+	RenameTemplate string      `json:"rename_template,omitempty"`
+	CaseMode       string      `json:"case_mode,omitempty"`
+	FileMode       os.FileMode `json:"file_mode,omitempty"`
+	DirMode        os.FileMode `json:"dir_mode,omitempty"`
+	Group          string      `json:"group,omitempty"`
+	LastModified   time.Time   `json:"last_modified,omitempty"`
+	Mode           os.FileMode `json:"mode,omitempty"`
+}
+
+// Queue keeps held items in a directory, each as an "{id}.json" record and,
+// for files, an "{id}.data" file. Items survive restarts; the record is
+// written last, so an item is listed only once its data is in place.
+type Queue struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func New(dir string) *Queue {
+	return &Queue{dir: dir}
+}
+
+// Add moves pending into the queue as a new item and returns it with its
+// ID set. pending is nil for a directory entry.
+func (q *Queue) Add(item Item, pending *commit.Pending) (Item, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := os.MkdirAll(q.dir, 0o700); err != nil {
+		return Item{}, err
+	}
+	dir, err := os.Open(q.dir)
+	if err != nil {
+		return Item{}, err
+	}
+	defer func() { _ = dir.Close() }()
+
+	for attempt := 0; ; attempt++ {
+		item.ID, err = newID()
+		if err != nil {
+			return Item{}, err
+		}
+		if _, err := os.Lstat(q.recordPath(item.ID)); err == nil {
+			continue
+		}
+		if pending == nil {
+			break
+		}
+		err = pending.LinkNoReplace(dir, item.ID+".data")
+		if errors.Is(err, commit.ErrExists) && attempt < 10 {
+			continue
+		}
+		if err != nil {
+			return Item{}, err
+		}
+		// The data keeps the upload's mode until it is approved, but
+		// nobody else should read it while it waits.
+		_ = os.Chmod(q.DataPath(item.ID), 0o600)
+		break
+	}
+
+	if err := q.writeRecord(item); err != nil {
+		_ = os.Remove(q.DataPath(item.ID))
+		return Item{}, err
+	}
+	return item, nil
+}
+
+func (q *Queue) writeRecord(item Item) error {
+	data, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(q.dir, ".record-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), q.recordPath(item.ID))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// List returns the held items, oldest first. portalID, when set, limits
+// them to one portal.
+func (q *Queue) List(portalID string) ([]Item, error) {
+	entries, err := os.ReadDir(q.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	items := []Item{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !idPattern.MatchString(id) {
+			continue
+		}
+		item, err := q.Get(id)
+		if err != nil {
+			continue
+		}
+		if portalID == "" || item.PortalID == portalID {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ReceivedAt.Before(items[j].ReceivedAt)
+	})
+	return items, nil
+}
+
+func (q *Queue) Get(id string) (Item, error) {
+	if !idPattern.MatchString(id) {
+		return Item{}, ErrNotFound
+	}
+	data, err := os.ReadFile(q.recordPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Item{}, ErrNotFound
+	}
+	if err != nil {
+		return Item{}, err
+	}
+	var item Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return Item{}, fmt.Errorf("read review item %s: %w", id, err)
+	}
+	item.ID = id
+	return item, nil
+}
+
+// DataPath is where a file item's data waits.
+func (q *Queue) DataPath(id string) string {
+	return filepath.Join(q.dir, id+".data")
+}
+
+// Remove drops an item along with any data still left in the queue.
+func (q *Queue) Remove(id string) error {
+	if !idPattern.MatchString(id) {
+		return ErrNotFound
+	}
+	if err := os.Remove(q.DataPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(q.recordPath(id)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (q *Queue) recordPath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func newID() (string, error) {
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
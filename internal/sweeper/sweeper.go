@@ -17,6 +17,7 @@ type Config struct {
 	PartMaxAge       time.Duration
 	PortalIdleMaxAge time.Duration
 	Roots            []string
+	StagingRoots     []string
 }
 
 type Sweeper struct {
@@ -64,6 +65,11 @@ func (s *Sweeper) Run(ctx context.Context) {
 func (s *Sweeper) RunOnce(ctx context.Context) error {
 	closedPortals := s.refreshPortalStates()
 	s.cleanupClosedPortals(closedPortals)
+	if s.store != nil {
+		now := time.Now()
+		s.store.SweepBatches(now)
+		s.store.SweepAttempts(now)
+	}
 
 	activeUploads := s.activeUploadIDs()
 	activePortals := s.activePortalIDs()
@@ -87,7 +93,10 @@ func (s *Sweeper) RunOnce(ctx context.Context) error {
 
 func (s *Sweeper) sweepRoots() []string {
 	roots := make(map[string]struct{})
-	for _, root := range s.cfg.Roots {
+	configured := make([]string, 0, len(s.cfg.Roots)+len(s.cfg.StagingRoots))
+	configured = append(configured, s.cfg.Roots...)
+	configured = append(configured, s.cfg.StagingRoots...)
+	for _, root := range configured {
 		trimmed := strings.TrimSpace(root)
 		if trimmed == "" {
 			continue
@@ -121,14 +130,17 @@ func (s *Sweeper) cleanupClosedPortals(portals []control.Portal) {
 		if strings.TrimSpace(portal.DestAbs) == "" {
 			continue
 		}
-		portalPath := filepath.Join(portal.DestAbs, s.cfg.TempDirName, portal.ID)
-		if err := os.RemoveAll(portalPath); err != nil {
-			if !os.IsNotExist(err) {
+		control.RemoveUnusedBatchFolders(s.store, portal)
+		for _, portalPath := range control.PortalTempDirs(portal, s.cfg.TempDirName, s.cfg.StagingRoots) {
+			if _, err := os.Lstat(portalPath); err != nil {
+				continue
+			}
+			if err := os.RemoveAll(portalPath); err != nil {
 				s.logger.Printf("sweeper portal cleanup failed path=%s err=%v", portalPath, err)
+				continue
 			}
-			continue
+			s.logger.Printf("sweeper removed closed portal dir path=%s", portalPath)
 		}
-		s.logger.Printf("sweeper removed closed portal dir path=%s", portalPath)
 	}
 }
 
@@ -142,17 +154,21 @@ func (s *Sweeper) activePortalIDs() map[string]struct{} {
 			active[portal.ID] = struct{}{}
 		}
 	}
+	// Staged files of an open atomic batch wait for the client's commit.
+	for portalID := range s.store.PortalsWithOpenBatches() {
+		active[portalID] = struct{}{}
+	}
 	return active
 }
 
-func (s *Sweeper) activeUploadIDs() map[string]struct{} {
+func (s *Sweeper) activeUploadIDs() map[string]map[string]struct{} {
 	if s.store == nil {
-		return make(map[string]struct{})
+		return make(map[string]map[string]struct{})
 	}
 	return s.store.ActiveUploadIDs()
 }
 
-func (s *Sweeper) sweepRoot(root string, activeUploads, activePortals map[string]struct{}) error {
+func (s *Sweeper) sweepRoot(root string, activeUploads map[string]map[string]struct{}, activePortals map[string]struct{}) error {
 	tempRoot := filepath.Join(root, s.cfg.TempDirName)
 	entries, err := os.ReadDir(tempRoot)
 	if err != nil {
@@ -168,7 +184,7 @@ func (s *Sweeper) sweepRoot(root string, activeUploads, activePortals map[string
 		}
 		portalID := entry.Name()
 		portalPath := filepath.Join(tempRoot, portalID)
-		if err := s.sweepPortalDir(portalID, portalPath, activeUploads, activePortals); err != nil {
+		if err := s.sweepPortalDir(portalID, portalPath, activeUploads[portalID], activePortals); err != nil {
 			s.logger.Printf("sweeper portal=%s err=%v", portalID, err)
 		}
 	}
@@ -0,0 +1,30 @@
+package webhooks
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+var errOutboxLocked = errors.New("outbox locked")
+
+// lockOutbox creates dir and takes an exclusive flock on its lock file,
+// held for as long as the returned file stays open.
+func lockOutbox(dir string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errOutboxLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
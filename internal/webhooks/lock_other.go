@@ -0,0 +1,16 @@
+//go:build !linux
+
+package webhooks
+
+import (
+	"errors"
+	"os"
+)
+
+var errOutboxLocked = errors.New("outbox locked")
+
+// lockOutbox only creates dir off Linux; servers sharing an outbox there
+// must be given separate DROPSERVE_WEBHOOK_OUTBOX directories.
+func lockOutbox(dir string) (*os.File, error) {
+	return nil, os.MkdirAll(dir, 0o700)
+}
@@ -0,0 +1,539 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types delivered to receivers.
+const (
+	UploadCommitted = "upload.committed"
+	UploadFailed    = "upload.failed"
+	PortalClosed    = "portal.closed"
+	PortalExpired   = "portal.expired"
+)
+
+// Headers set on every delivery. The timestamp is the Unix time of the
+// attempt; the signature is the hex HMAC-SHA256 of the timestamp, a dot and
+// the raw body under the target's secret, prefixed with "sha256=".
+const (
+	HeaderEvent     = "X-Dropserve-Event"
+	HeaderDelivery  = "X-Dropserve-Delivery"
+	HeaderTimestamp = "X-Dropserve-Timestamp"
+	HeaderSignature = "X-Dropserve-Signature"
+)
+
+var (
+	ErrInvalidURL = errors.New("webhook url must be an absolute http or https URL")
+	ErrNoOutbox   = errors.New("no webhook outbox configured")
+)
+
+type Config struct {
+	// OutboxDir is claimed with a lock file by the first dispatcher to
+	// start; later ones running at the same time use "<dir>-2", "<dir>-3"
+	// and so on, so no delivery is sent by two of them. Deliveries left in
+	// a sibling no running dispatcher holds are moved into the claimed one.
+	OutboxDir   string
+	MaxAttempts int
+	// Backoff is the wait after the first failed attempt; it doubles after
+	// each further failure up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Timeout    time.Duration
+}
+
+// Target is one receiver: where to POST and the secret to sign with.
+// Deliveries to a target without a secret are not signed.
+type Target struct {
+	URL    string
+	Secret string
+}
+
+// Event is the JSON body POSTed to receivers. ID is the same on every
+// retry, so receivers can drop duplicates.
+type Event struct {
+	ID        string  `json:"id"`
+	Type      string  `json:"type"`
+	CreatedAt string  `json:"created_at"`
+	PortalID  string  `json:"portal_id"`
+	Dest      string  `json:"dest"`
+	Upload    *Upload `json:"upload,omitempty"`
+	Portal    *Portal `json:"portal,omitempty"`
+}
+
+type Upload struct {
+	UploadID     string `json:"upload_id"`
+	ClientID     string `json:"client_id,omitempty"`
+	BatchID      string `json:"batch_id,omitempty"`
+	Relpath      string `json:"relpath"`
+	FinalRelpath string `json:"final_relpath,omitempty"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256,omitempty"`
+}
+
+type Portal struct {
+	State          string `json:"state"`
+	FilesCommitted int    `json:"files_committed"`
+	BytesCommitted int64  `json:"bytes_committed"`
+}
+
+// delivery is one event on its way to one target, as kept in the outbox.
+// The secret is kept so every attempt is signed with its own timestamp; the
+// outbox is readable by the server's user only.
+type delivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Event       string          `json:"event"`
+	Secret      string          `json:"secret,omitempty"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// ValidateURL accepts absolute http and https URLs; empty means none.
+func ValidateURL(raw string) error {
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return ErrInvalidURL
+	}
+	return nil
+}
+
+// Sign returns the signature header value for body sent at timestamp, in
+// Unix seconds, under secret. Receivers should also refuse timestamps far
+// from their own clock, so a captured delivery cannot be replayed later.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher writes events to a persistent outbox and delivers them in the
+// background, retrying with exponential backoff until the receiver accepts
+// them or the attempts run out. Deliveries left in the outbox by a previous
+// run resume on Start.
+type Dispatcher struct {
+	cfg    Config
+	logger *log.Logger
+	client *http.Client
+	wake   chan struct{}
+	once   sync.Once
+	claim  sync.Once
+	// lock keeps the outbox claimed for as long as the dispatcher lives;
+	// claimErr is set instead if it could not be claimed.
+	lock     *os.File
+	claimErr error
+	// mu serializes outbox file access between Enqueue and the loop.
+	mu sync.Mutex
+}
+
+func New(cfg Config, logger *log.Logger) *Dispatcher {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 12
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = 2 * time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Hour
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if logger == nil {
+		logger = log.New(os.Stdout, "webhook ", log.LstdFlags)
+	}
+	return &Dispatcher{
+		cfg:    cfg,
+		logger: logger,
+		client: &http.Client{Timeout: cfg.Timeout},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Start claims the outbox and begins delivering if it holds deliveries
+// from an earlier run. Otherwise the loop starts with the first Enqueue.
+func (d *Dispatcher) Start() {
+	if d.claimOutbox() != nil {
+		return
+	}
+	if len(d.pendingFiles()) > 0 {
+		d.startLoop()
+	}
+}
+
+// Enqueue stores the event for every target and wakes the delivery loop.
+// It returns once the deliveries are on disk.
+func (d *Dispatcher) Enqueue(event Event, targets ...Target) error {
+	targets = usableTargets(targets)
+	if len(targets) == 0 {
+		return nil
+	}
+	if event.ID == "" {
+		id, err := newID("evt_")
+		if err != nil {
+			return err
+		}
+		event.ID = id
+	}
+	if event.CreatedAt == "" {
+		event.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if err := d.claimOutbox(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	err = os.MkdirAll(d.cfg.OutboxDir, 0o700)
+	for i := 0; err == nil && i < len(targets); i++ {
+		entry := delivery{
+			ID:          fmt.Sprintf("%s-%d", deliveryPrefix(), i),
+			URL:         targets[i].URL,
+			Event:       event.Type,
+			Secret:      targets[i].Secret,
+			Body:        body,
+			NextAttempt: time.Now(),
+		}
+		err = d.writeLocked(entry)
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	d.startLoop()
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// claimOutbox locks the configured outbox, or the first "<dir>-n" no other
+// running dispatcher holds, and switches to it for good. A lock that fails
+// for any other reason leaves the dispatcher without an outbox, so events
+// are refused rather than risk being sent twice.
+func (d *Dispatcher) claimOutbox() error {
+	d.claim.Do(func() {
+		base := d.cfg.OutboxDir
+		if base == "" {
+			d.claimErr = ErrNoOutbox
+			return
+		}
+		for n := 1; ; n++ {
+			dir := base
+			if n > 1 {
+				dir = fmt.Sprintf("%s-%d", base, n)
+			}
+			lock, err := lockOutbox(dir)
+			if errors.Is(err, errOutboxLocked) {
+				continue
+			}
+			if err != nil {
+				d.logger.Printf("webhook outbox lock failed dir=%s err=%v", dir, err)
+				d.claimErr = fmt.Errorf("webhook outbox %s: %w", dir, err)
+				return
+			}
+			if n > 1 {
+				d.logger.Printf("webhook outbox in use by another server, using dir=%s", dir)
+			}
+			d.cfg.OutboxDir = dir
+			d.lock = lock
+			if lock != nil {
+				d.adoptSiblings(base)
+			}
+			return
+		}
+	})
+	return d.claimErr
+}
+
+// adoptSiblings moves the deliveries out of every other "<base>" or
+// "<base>-n" outbox no running dispatcher holds, such as one a second
+// server used before it stopped, so they are not stranded there.
+func (d *Dispatcher) adoptSiblings(base string) {
+	siblings, _ := filepath.Glob(base + "-*")
+	for _, dir := range append([]string{base}, siblings...) {
+		suffix := strings.TrimPrefix(dir, base)
+		if dir == d.cfg.OutboxDir || (suffix != "" && !isSiblingSuffix(suffix)) {
+			continue
+		}
+		lock, err := lockOutbox(dir)
+		if err != nil {
+			if !errors.Is(err, errOutboxLocked) {
+				d.logger.Printf("webhook outbox lock failed dir=%s err=%v", dir, err)
+			}
+			continue
+		}
+		moved := 0
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if ext := filepath.Ext(entry.Name()); !entry.Type().IsRegular() || (ext != ".json" && ext != ".failed") {
+				continue
+			}
+			if err := os.Rename(filepath.Join(dir, entry.Name()), filepath.Join(d.cfg.OutboxDir, entry.Name())); err != nil {
+				d.logger.Printf("webhook outbox adopt failed file=%s err=%v", filepath.Join(dir, entry.Name()), err)
+				continue
+			}
+			moved++
+		}
+		_ = lock.Close()
+		if moved > 0 {
+			d.logger.Printf("webhook outbox adopted deliveries=%d from dir=%s", moved, dir)
+		}
+	}
+}
+
+// isSiblingSuffix reports whether suffix is the "-n" claimOutbox appends.
+func isSiblingSuffix(suffix string) bool {
+	n, err := strconv.Atoi(strings.TrimPrefix(suffix, "-"))
+	return err == nil && n > 1 && suffix == "-"+strconv.Itoa(n)
+}
+
+func usableTargets(targets []Target) []Target {
+	out := make([]Target, 0, len(targets))
+	seen := make(map[Target]bool)
+	for _, target := range targets {
+		target.URL = strings.TrimSpace(target.URL)
+		if target.URL == "" || seen[target] {
+			continue
+		}
+		seen[target] = true
+		out = append(out, target)
+	}
+	return out
+}
+
+// deliveryPrefix orders outbox files by creation time and keeps names
+// unique across restarts.
+func deliveryPrefix() string {
+	suffix, err := newID("")
+	if err != nil {
+		suffix = "0"
+	}
+	return fmt.Sprintf("%020d-%s", time.Now().UnixNano(), suffix)
+}
+
+func (d *Dispatcher) startLoop() {
+	d.once.Do(func() {
+		go d.loop()
+	})
+}
+
+func (d *Dispatcher) loop() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-d.wake:
+		case <-timer.C:
+		}
+		next := d.deliverDue()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(max(time.Until(next), 0))
+		}
+	}
+}
+
+// deliverDue attempts every delivery whose time has come and returns when
+// the earliest remaining one is due, or the zero time if none is left.
+func (d *Dispatcher) deliverDue() time.Time {
+	var next time.Time
+	for _, name := range d.pendingFiles() {
+		entry, err := d.read(name)
+		if err != nil {
+			d.logger.Printf("webhook outbox entry unreadable file=%s err=%v", name, err)
+			continue
+		}
+		if time.Now().Before(entry.NextAttempt) {
+			if next.IsZero() || entry.NextAttempt.Before(next) {
+				next = entry.NextAttempt
+			}
+			continue
+		}
+
+		err = d.post(entry)
+		if err == nil {
+			d.logger.Printf("webhook delivered event=%s url=%s delivery=%s attempts=%d", entry.Event, entry.URL, entry.ID, entry.Attempts+1)
+			d.remove(name)
+			continue
+		}
+
+		entry.Attempts++
+		entry.LastError = err.Error()
+		if entry.Attempts >= d.cfg.MaxAttempts {
+			d.logger.Printf("webhook gave up event=%s url=%s delivery=%s attempts=%d err=%v", entry.Event, entry.URL, entry.ID, entry.Attempts, err)
+			d.giveUp(name, entry)
+			continue
+		}
+		entry.NextAttempt = time.Now().Add(d.backoff(entry.Attempts))
+		d.logger.Printf("webhook failed event=%s url=%s delivery=%s attempts=%d retry_at=%s err=%v", entry.Event, entry.URL, entry.ID, entry.Attempts, entry.NextAttempt.Format(time.RFC3339), err)
+		d.mu.Lock()
+		if err := d.writeLocked(entry); err != nil {
+			d.logger.Printf("webhook outbox write failed delivery=%s err=%v", entry.ID, err)
+		}
+		d.mu.Unlock()
+		if next.IsZero() || entry.NextAttempt.Before(next) {
+			next = entry.NextAttempt
+		}
+	}
+	return next
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.cfg.Backoff
+	for i := 1; i < attempts && wait < d.cfg.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, d.cfg.MaxBackoff)
+}
+
+func (d *Dispatcher) post(entry delivery) error {
+	request, err := http.NewRequest(http.MethodPost, entry.URL, bytes.NewReader(entry.Body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "dropserve-webhook")
+	request.Header.Set(HeaderEvent, entry.Event)
+	request.Header.Set(HeaderDelivery, entry.ID)
+	if entry.Secret != "" {
+		timestamp := time.Now().Unix()
+		request.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+		request.Header.Set(HeaderSignature, Sign(entry.Secret, timestamp, entry.Body))
+	}
+
+	resp, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// pendingFiles lists outbox entries oldest first.
+func (d *Dispatcher) pendingFiles() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries, err := os.ReadDir(d.cfg.OutboxDir)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && filepath.Ext(entry.Name()) == ".json" {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *Dispatcher) read(name string) (delivery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, err := os.ReadFile(filepath.Join(d.cfg.OutboxDir, name))
+	if err != nil {
+		return delivery{}, err
+	}
+	var entry delivery
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return delivery{}, err
+	}
+	return entry, nil
+}
+
+// writeLocked replaces the entry's outbox file through a temp file and a
+// rename, so a crash leaves either the old or the new version.
+func (d *Dispatcher) writeLocked(entry delivery) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.cfg.OutboxDir, entry.ID+".json")
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+func (d *Dispatcher) remove(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := os.Remove(filepath.Join(d.cfg.OutboxDir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		d.logger.Printf("webhook outbox remove failed file=%s err=%v", name, err)
+	}
+}
+
+// giveUp keeps an undeliverable entry next to the outbox as .failed for
+// the operator to inspect or move back.
+func (d *Dispatcher) giveUp(name string, entry delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.writeLocked(entry); err != nil {
+		d.logger.Printf("webhook outbox write failed delivery=%s err=%v", entry.ID, err)
+	}
+	path := filepath.Join(d.cfg.OutboxDir, name)
+	if err := os.Rename(path, strings.TrimSuffix(path, ".json")+".failed"); err != nil {
+		d.logger.Printf("webhook outbox move failed file=%s err=%v", name, err)
+	}
+}
+
+func newID(prefix string) (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(buf), nil
+}
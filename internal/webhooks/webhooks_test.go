@@ -0,0 +1,250 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver answers 503 to its first failures requests and records the
+// deliveries it accepts after that.
+type receiver struct {
+	mu         sync.Mutex
+	failures   int
+	bodies     [][]byte
+	timestamps []string
+	signatures []string
+	server     *httptest.Server
+}
+
+func newReceiver(t *testing.T, failures int) *receiver {
+	t.Helper()
+	recv := &receiver{failures: failures}
+	recv.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		recv.mu.Lock()
+		defer recv.mu.Unlock()
+		if recv.failures > 0 {
+			recv.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		recv.bodies = append(recv.bodies, body)
+		recv.timestamps = append(recv.timestamps, r.Header.Get(HeaderTimestamp))
+		recv.signatures = append(recv.signatures, r.Header.Get(HeaderSignature))
+	}))
+	t.Cleanup(recv.server.Close)
+	return recv
+}
+
+func (r *receiver) waitFor(t *testing.T, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		got := len(r.bodies)
+		r.mu.Unlock()
+		if got >= count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d deliveries", count)
+}
+
+func testDispatcher(outbox string, maxAttempts int) *Dispatcher {
+	return New(Config{
+		OutboxDir:   outbox,
+		MaxAttempts: maxAttempts,
+		Backoff:     10 * time.Millisecond,
+		MaxBackoff:  40 * time.Millisecond,
+	}, log.New(io.Discard, "", 0))
+}
+
+func outboxFiles(t *testing.T, outbox, pattern string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(outbox, pattern))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	return matches
+}
+
+func TestDeliveriesAreSignedAndRetried(t *testing.T) {
+	recv := newReceiver(t, 2)
+	outbox := t.TempDir()
+	dispatcher := testDispatcher(outbox, 5)
+
+	event := Event{Type: UploadCommitted, PortalID: "p1", Upload: &Upload{UploadID: "u1", Relpath: "a.txt", Size: 4}}
+	if err := dispatcher.Enqueue(event, Target{URL: recv.server.URL, Secret: "s3cret"}, Target{}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	recv.waitFor(t, 1)
+
+	recv.mu.Lock()
+	body, timestamp, signature := recv.bodies[0], recv.timestamps[0], recv.signatures[0]
+	recv.mu.Unlock()
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Fatalf("unexpected timestamp %q", timestamp)
+	}
+	if signature != Sign("s3cret", sent, body) || signature == Sign("s3cret", sent-1, body) {
+		t.Fatalf("signature %q does not match the timestamp and body", signature)
+	}
+	var received Event
+	if err := json.Unmarshal(body, &received); err != nil || received.ID == "" || received.Type != UploadCommitted || received.Upload.Relpath != "a.txt" {
+		t.Fatalf("unexpected body %s: %v", body, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(outboxFiles(t, outbox, "*.json")) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Only the lock file stays behind.
+	if files := outboxFiles(t, outbox, "*"); len(files) != 1 || filepath.Base(files[0]) != "lock" {
+		t.Fatalf("expected an empty outbox after delivery, got %v", files)
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	recv := newReceiver(t, 0)
+	outbox := t.TempDir()
+
+	// A delivery left behind by a previous run, due a while ago.
+	previous := testDispatcher(outbox, 5)
+	body, _ := json.Marshal(Event{ID: "evt_1", Type: PortalExpired, PortalID: "p1"})
+	previous.mu.Lock()
+	err := previous.writeLocked(delivery{ID: "00000000000000000001-a-0", URL: recv.server.URL, Event: PortalExpired, Body: body, Attempts: 2, NextAttempt: time.Now().Add(-time.Hour)})
+	previous.mu.Unlock()
+	if err != nil {
+		t.Fatalf("write outbox entry: %v", err)
+	}
+
+	testDispatcher(outbox, 5).Start()
+	recv.waitFor(t, 1)
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	if string(recv.bodies[0]) != string(body) {
+		t.Fatalf("unexpected body %s", recv.bodies[0])
+	}
+}
+
+func TestConcurrentDispatchersUseSeparateOutboxes(t *testing.T) {
+	recv := newReceiver(t, 0)
+	outbox := filepath.Join(t.TempDir(), "webhooks")
+
+	first, second := testDispatcher(outbox, 5), testDispatcher(outbox, 5)
+	first.Start()
+	second.Start()
+	if first.cfg.OutboxDir != outbox || second.cfg.OutboxDir != outbox+"-2" {
+		t.Fatalf("expected separate outboxes, got %q and %q", first.cfg.OutboxDir, second.cfg.OutboxDir)
+	}
+	for _, dispatcher := range []*Dispatcher{first, second} {
+		if err := dispatcher.Enqueue(Event{Type: UploadCommitted, PortalID: "p1"}, Target{URL: recv.server.URL}); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	recv.waitFor(t, 2)
+	time.Sleep(100 * time.Millisecond)
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	if len(recv.bodies) != 2 {
+		t.Fatalf("expected each event delivered once, got %d deliveries", len(recv.bodies))
+	}
+}
+
+func TestStrandedSiblingOutboxIsAdopted(t *testing.T) {
+	recv := newReceiver(t, 0)
+	outbox := filepath.Join(t.TempDir(), "webhooks")
+
+	// A delivery left in "-2" by a second server that has since stopped.
+	stopped := testDispatcher(outbox+"-2", 5)
+	body, _ := json.Marshal(Event{ID: "evt_1", Type: PortalClosed, PortalID: "p1"})
+	if err := os.MkdirAll(outbox+"-2", 0o700); err != nil {
+		t.Fatalf("create sibling outbox: %v", err)
+	}
+	stopped.mu.Lock()
+	err := stopped.writeLocked(delivery{ID: "00000000000000000001-a-0", URL: recv.server.URL, Event: PortalClosed, Body: body, NextAttempt: time.Now()})
+	stopped.mu.Unlock()
+	if err != nil {
+		t.Fatalf("write outbox entry: %v", err)
+	}
+
+	dispatcher := testDispatcher(outbox, 5)
+	dispatcher.Start()
+	if dispatcher.cfg.OutboxDir != outbox {
+		t.Fatalf("expected the base outbox to be claimed, got %q", dispatcher.cfg.OutboxDir)
+	}
+	recv.waitFor(t, 1)
+	if left := outboxFiles(t, outbox+"-2", "*.json"); len(left) != 0 {
+		t.Fatalf("expected the sibling to be drained, got %v", left)
+	}
+}
+
+func TestUnlockableOutboxRefusesEvents(t *testing.T) {
+	parent := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(parent, nil, 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	dispatcher := testDispatcher(filepath.Join(parent, "webhooks"), 5)
+	dispatcher.Start()
+	if err := dispatcher.Enqueue(Event{Type: UploadCommitted, PortalID: "p1"}, Target{URL: "http://127.0.0.1:1/"}); err == nil {
+		t.Fatalf("expected events to be refused without an outbox")
+	}
+	if dispatcher.cfg.OutboxDir != filepath.Join(parent, "webhooks") {
+		t.Fatalf("expected no fallback outbox, got %q", dispatcher.cfg.OutboxDir)
+	}
+}
+
+func TestDispatcherWithoutOutboxRefusesEvents(t *testing.T) {
+	dispatcher := testDispatcher("", 5)
+	dispatcher.Start()
+	if err := dispatcher.Enqueue(Event{Type: UploadCommitted, PortalID: "p1"}, Target{URL: "http://127.0.0.1:1/"}); !errors.Is(err, ErrNoOutbox) {
+		t.Fatalf("expected ErrNoOutbox, got %v", err)
+	}
+}
+
+func TestUndeliverableEventsAreSetAside(t *testing.T) {
+	recv := newReceiver(t, 1000)
+	outbox := t.TempDir()
+	dispatcher := testDispatcher(outbox, 3)
+
+	if err := dispatcher.Enqueue(Event{Type: UploadFailed, PortalID: "p1"}, Target{URL: recv.server.URL}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(outboxFiles(t, outbox, "*.failed")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	failed := outboxFiles(t, outbox, "*.failed")
+	if len(failed) != 1 || len(outboxFiles(t, outbox, "*.json")) != 0 {
+		t.Fatalf("expected the delivery to be set aside, got %v", outboxFiles(t, outbox, "*"))
+	}
+	data, _ := os.ReadFile(failed[0])
+	var entry delivery
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Attempts != 3 || entry.LastError == "" {
+		t.Fatalf("unexpected failed entry %s: %v", data, err)
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	for _, valid := range []string{"", "http://10.0.0.5:9000/hook", "https://example.com/x"} {
+		if err := ValidateURL(valid); err != nil {
+			t.Fatalf("unexpected error for %q: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"example.com/hook", "ftp://example.com", "http://", "/relative"} {
+		if err := ValidateURL(invalid); err == nil {
+			t.Fatalf("expected error for %q", invalid)
+		}
+	}
+}
@@ -9,20 +9,28 @@ type StatusState = {
 
 type QueueItem = {
   id: string;
-  file: File;
+  file: File | null;
+  dir: boolean;
   relpath: string;
   status: string;
   progress: number;
 };
 
+// Empty folders have no file to carry their path, so they are queued as
+// directory entries of their own.
 type QueueCandidate = {
-  file: File;
+  file: File | null;
+  dir?: boolean;
   relpath: string;
 };
 
+type ConflictPolicy = "overwrite" | "autorename" | "skip" | "fail" | "skip-if-identical";
+
 type ClaimPolicy = {
   overwrite: boolean;
   autorename: boolean;
+  default?: ConflictPolicy;
+  review?: boolean;
 };
 
 type ClaimResponse = {
@@ -33,11 +41,19 @@ type ClaimResponse = {
   reusable: boolean;
 };
 
+type ClaimPendingResponse = {
+  status: "pending";
+  claim_id: string;
+  claim_token: string;
+  code: string;
+};
+
 type PortalInfoResponse = {
   portal_id: string;
   expires_at: string;
   policy: ClaimPolicy;
   reusable: boolean;
+  passphrase?: boolean;
 };
 
 type PortalRoute = {
@@ -45,9 +61,17 @@ type PortalRoute = {
   subpage: "" | "claimed";
 };
 
+type BatchResponse = {
+  batch_id: string;
+  atomic: boolean;
+};
+
 type PreflightConflict = {
   relpath: string;
+  requested_relpath?: string;
+  type?: "file" | "dir";
   reason: string;
+  action?: string;
 };
 
 type DropServeFileSystemEntry = {
@@ -80,6 +104,14 @@ const folderInputProps = {
   directory: "true"
 } as React.InputHTMLAttributes<HTMLInputElement>;
 
+const conflictVerbs: Record<ConflictPolicy, string> = {
+  overwrite: "overwritten",
+  autorename: "auto-renamed",
+  skip: "skipped",
+  fail: "rejected",
+  "skip-if-identical": "skipped if identical, otherwise overwritten"
+};
+
 const defaultStatus: StatusState = {
   message: "Preparing portal...",
   tone: "info"
@@ -114,7 +146,13 @@ function App() {
   );
 }
 
+const codeErrors: Record<string, string> = {
+  "unknown-code": "No open portal has that code. Check it and try again.",
+  "too-many-lookups": "Too many codes tried. Wait a minute and try again."
+};
+
 function LandingPage() {
+  const codeError = codeErrors[new URLSearchParams(window.location.search).get("error") ?? ""];
   return (
     <section className="splash-screen" aria-label="DropServe command">
       <div
@@ -127,6 +165,27 @@ function LandingPage() {
         <span className="splash-text">dropserve</span>
         <span className="splash-caret" aria-hidden="true" />
       </div>
+      <form className="code-form" method="post" action="/">
+        <label className="code-label" htmlFor="portal-code">
+          Got a portal code?
+        </label>
+        <div className="code-row">
+          <input
+            id="portal-code"
+            name="code"
+            className="code-input"
+            placeholder="amber-otter-42"
+            autoComplete="off"
+            autoCapitalize="none"
+            spellCheck={false}
+            required
+          />
+          <button type="submit" className="picker-button">
+            Open
+          </button>
+        </div>
+        {codeError && <div className="status status-error">{codeError}</div>}
+      </form>
     </section>
   );
 }
@@ -154,14 +213,16 @@ function PortalPage({ portalId }: { portalId: string }) {
   const [running, setRunning] = useState(false);
   const [queue, setQueue] = useState<QueueItem[]>([]);
   const [conflicts, setConflicts] = useState<PreflightConflict[]>([]);
-  const [defaultPolicy, setDefaultPolicy] = useState<"overwrite" | "autorename">(
-    "overwrite"
-  );
+  const [portalPolicy, setPortalPolicy] = useState<ConflictPolicy>("overwrite");
+  const [defaultPolicy, setDefaultPolicy] = useState<ConflictPolicy>("overwrite");
   const [totalBytes, setTotalBytes] = useState(0);
   const [uploadedBytes, setUploadedBytes] = useState(0);
   const [speedBps, setSpeedBps] = useState(0);
   const [expiresAt, setExpiresAt] = useState<string | null>(null);
   const [portalReusable, setPortalReusable] = useState(false);
+  const [passphraseNeeded, setPassphraseNeeded] = useState(false);
+  const [passphrase, setPassphrase] = useState("");
+  const reviewRef = useRef(false);
 
   const clientTokenRef = useRef("");
   const infoAttemptedRef = useRef(false);
@@ -234,7 +295,8 @@ function PortalPage({ portalId }: { portalId: string }) {
       const payload = {
         items: items.map((item) => ({
           relpath: item.relpath,
-          size: item.file.size
+          type: item.dir ? "dir" : "file",
+          size: itemSize(item)
         }))
       };
       try {
@@ -272,7 +334,7 @@ function PortalPage({ portalId }: { portalId: string }) {
       if (!claimed) {
         return;
       }
-      const normalized = items.filter((item) => item.file);
+      const normalized = items.filter((item) => item.file || (item.dir && item.relpath));
       if (normalized.length === 0) {
         return;
       }
@@ -280,15 +342,16 @@ function PortalPage({ portalId }: { portalId: string }) {
         const next = [...existing];
         let addedBytes = 0;
         for (const item of normalized) {
-          const relpath = item.relpath || item.file.webkitRelativePath || item.file.name;
+          const relpath = item.relpath || item.file?.webkitRelativePath || item.file?.name || "";
           next.push({
             id: makeLocalID(),
             file: item.file,
+            dir: Boolean(item.dir),
             relpath,
             status: "queued",
             progress: 0
           });
-          addedBytes += item.file.size;
+          addedBytes += item.file?.size ?? 0;
         }
         setTotalBytes((value) => value + addedBytes);
         runPreflight(next.filter((item) => item.status === "queued"), false);
@@ -298,18 +361,38 @@ function PortalPage({ portalId }: { portalId: string }) {
     [claimed, runPreflight]
   );
 
-  const claimPortal = useCallback(async () => {
+  const claimPortal = useCallback(async (secret?: string) => {
     if (!portalId) {
       updateStatus("Invalid portal URL.", "error");
       return;
     }
     updateStatus("Claiming portal...", "info");
     try {
-      const response = await fetch(`/api/portals/${portalId}/claim`, {
+      let response = await fetch(`/api/portals/${portalId}/claim`, {
         method: "POST",
         headers: { "Content-Type": "application/json" },
-        body: "{}"
+        body: JSON.stringify(secret ? { passphrase: secret } : {})
       });
+      if (response.status === 401 || response.status === 429) {
+        setPassphraseNeeded(true);
+        const message = await readError(response);
+        updateStatus(
+          response.status === 401
+            ? `${message}. Check the PIN or passphrase and try again.`
+            : `${message}. Wait ${waitText(response)} and try again.`,
+          "error"
+        );
+        return;
+      }
+      setPassphraseNeeded(false);
+      if (response.status === 202) {
+        const pending: ClaimPendingResponse = await response.json();
+        updateStatus(
+          `Waiting for approval. Read this code to the person who shared the link: ${pending.code}`,
+          "info"
+        );
+        response = await waitForClaimApproval(portalId, pending);
+      }
       if (!response.ok) {
         if (response.status === 409) {
           redirectToClaimedPortal(portalId);
@@ -322,9 +405,11 @@ function PortalPage({ portalId }: { portalId: string }) {
       const data: ClaimResponse = await response.json();
       clientTokenRef.current = data.client_token;
       setExpiresAt(data.expires_at || null);
-      const policy = data.policy && data.policy.autorename ? "autorename" : "overwrite";
+      const policy = policyFromClaim(data.policy);
+      setPortalPolicy(policy);
       setDefaultPolicy(policy);
       setPortalReusable(Boolean(data.reusable));
+      reviewRef.current = Boolean(data.policy?.review);
       setClaimed(true);
       updateStatus("Portal ready. Drop or click to add files.", "ok");
       runPreflight(queueRef.current, false);
@@ -348,30 +433,34 @@ function PortalPage({ portalId }: { portalId: string }) {
       }
       const data: PortalInfoResponse = await response.json();
       setExpiresAt(data.expires_at || null);
-      const policy = data.policy && data.policy.autorename ? "autorename" : "overwrite";
+      const policy = policyFromClaim(data.policy);
+      setPortalPolicy(policy);
       setDefaultPolicy(policy);
       const reusable = Boolean(data.reusable);
       setPortalReusable(reusable);
-      if (reusable) {
-        setClaimed(true);
-        updateStatus("Reuseable portal ready.", "ok");
-        runPreflight(queueRef.current, false);
+      reviewRef.current = Boolean(data.policy?.review);
+      if (data.passphrase) {
+        setPassphraseNeeded(true);
+        updateStatus("This portal is protected. Enter the PIN or passphrase you were given.", "info");
         return;
       }
       await claimPortal();
     } catch {
       updateStatus("Failed to load portal.", "error");
     }
-  }, [claimPortal, portalId, runPreflight, updateStatus]);
+  }, [claimPortal, portalId, updateStatus]);
 
   const initUpload = useCallback(
-    async (item: QueueItem) => {
+    async (item: QueueItem, batchID: string) => {
       const payload = {
         upload_id: makeUploadID(),
         relpath: item.relpath,
-        size: item.file.size,
+        type: item.dir ? "dir" : "file",
+        size: itemSize(item),
+        last_modified: item.file ? item.file.lastModified : null,
         client_sha256: null,
-        policy: defaultPolicy
+        policy: defaultPolicy,
+        batch_id: batchID
       };
       const response = await fetch(`/api/portals/${portalId}/uploads`, {
         method: "POST",
@@ -390,6 +479,25 @@ function PortalPage({ portalId }: { portalId: string }) {
     [defaultPolicy, portalId]
   );
 
+  const batchRequest = useCallback(
+    async (method: string, path: string, body?: unknown) => {
+      const response = await fetch(`/api/portals/${portalId}/batches${path}`, {
+        method,
+        headers: {
+          "Content-Type": "application/json",
+          "X-Client-Token": clientTokenRef.current
+        },
+        body: body === undefined ? undefined : JSON.stringify(body)
+      });
+      if (!response.ok) {
+        const message = await readError(response);
+        throw new Error(message);
+      }
+      return response.json();
+    },
+    [portalId]
+  );
+
   const putUpload = useCallback(
     (item: QueueItem, putUrl: string) =>
       new Promise<void>((resolve, reject) => {
@@ -402,7 +510,8 @@ function PortalPage({ portalId }: { portalId: string }) {
           }
           const current = completedBytesRef.current + event.loaded;
           updateUploadedBytes(current);
-          const percent = item.file.size > 0 ? Math.round((event.loaded / item.file.size) * 100) : 100;
+          const size = itemSize(item);
+          const percent = size > 0 ? Math.round((event.loaded / size) * 100) : 100;
           updateQueueItem(item.id, { status: "uploading", progress: percent });
         };
         request.onload = () => {
@@ -441,7 +550,7 @@ function PortalPage({ portalId }: { portalId: string }) {
     setRunning(true);
     const completedBytes = queueRef.current.reduce((sum, item) => {
       if (item.status === "done") {
-        return sum + item.file.size;
+        return sum + itemSize(item);
       }
       return sum;
     }, 0);
@@ -450,20 +559,57 @@ function PortalPage({ portalId }: { portalId: string }) {
     setSpeedBps(0);
     startSpeedTimer();
 
+    // One batch per run, so a renamed folder is renamed once for all its
+    // files. On atomic portals the batch only lands once it is committed.
+    let batch: BatchResponse;
+    try {
+      batch = await batchRequest("POST", "", {});
+    } catch (error) {
+      const message = error instanceof Error ? error.message : "upload failed";
+      updateStatus(`Upload failed: ${message}`, "error");
+      setRunning(false);
+      stopSpeedTimer();
+      return;
+    }
+    const batchID = batch.batch_id;
+    const stagedIds: string[] = [];
+    const abandonBatch = async () => {
+      if (!batch.atomic) {
+        return;
+      }
+      try {
+        await batchRequest("DELETE", `/${batchID}`);
+      } catch {
+      }
+      for (const id of stagedIds) {
+        updateQueueItem(id, { status: "queued", progress: 0 });
+      }
+    };
+
     for (const item of pendingItems) {
       updateQueueItem(item.id, { status: "initializing", progress: 0 });
       let initResponse;
       try {
-        initResponse = await initUpload(item);
+        initResponse = await initUpload(item, batchID);
       } catch (error) {
         const message = error instanceof Error ? error.message : "upload failed";
         updateQueueItem(item.id, { status: "failed" });
         updateStatus(`Upload failed: ${message}`, "error");
+        await abandonBatch();
         setRunning(false);
         stopSpeedTimer();
         return;
       }
 
+      // Directory entries are created (or staged) by init itself.
+      if (item.dir) {
+        if (initResponse.status === "staged") {
+          stagedIds.push(item.id);
+        }
+        updateQueueItem(item.id, { status: initResponse.status === "staged" ? "staged" : "done", progress: 100 });
+        continue;
+      }
+
       updateQueueItem(item.id, { status: "uploading", progress: 0 });
       try {
         await putUpload(item, initResponse.put_url);
@@ -471,20 +617,48 @@ function PortalPage({ portalId }: { portalId: string }) {
         const message = error instanceof Error ? error.message : "upload failed";
         updateQueueItem(item.id, { status: "failed" });
         updateStatus(`Upload failed: ${message}`, "error");
+        await abandonBatch();
         setRunning(false);
         stopSpeedTimer();
         return;
       }
 
-      updateQueueItem(item.id, { status: "done", progress: 100 });
-      completedBytesRef.current += item.file.size;
+      if (batch.atomic) {
+        stagedIds.push(item.id);
+        updateQueueItem(item.id, { status: "staged", progress: 100 });
+      } else {
+        updateQueueItem(item.id, { status: "done", progress: 100 });
+      }
+      completedBytesRef.current += itemSize(item);
       updateUploadedBytes(completedBytesRef.current);
     }
 
+    if (batch.atomic) {
+      try {
+        await batchRequest("POST", `/${batchID}/commit`, { files: stagedIds.length });
+      } catch (error) {
+        const message = error instanceof Error ? error.message : "commit failed";
+        updateStatus(`Upload failed: ${message}`, "error");
+        await abandonBatch();
+        setRunning(false);
+        stopSpeedTimer();
+        return;
+      }
+      for (const id of stagedIds) {
+        updateQueueItem(id, { status: "done", progress: 100 });
+      }
+    }
+
     setRunning(false);
     stopSpeedTimer();
-    updateStatus("All uploads complete. Portal remains open until it expires.", "ok");
+    updateStatus(
+      reviewRef.current
+        ? "All uploads received. They will appear once the recipient approves them."
+        : "All uploads complete. Portal remains open until it expires.",
+      "ok"
+    );
   }, [
+    batchRequest,
     claimed,
     initUpload,
     putUpload,
@@ -545,8 +719,15 @@ function PortalPage({ portalId }: { portalId: string }) {
   }, []);
 
   const queuedCount = queue.filter((item) => item.status === "queued").length;
-  const conflictCount = conflicts.length;
-  const conflictVerb = defaultPolicy === "autorename" ? "auto-renamed" : "overwritten";
+  const folderConflicts = conflicts.filter((conflict) => conflict.reason === "folder_exists");
+  const dirConflicts = conflicts.filter(
+    (conflict) => conflict.type === "dir" && conflict.reason !== "folder_exists"
+  );
+  const typeConflicts = conflicts.filter((conflict) => conflict.reason === "file_type");
+  const conflictCount =
+    conflicts.length - folderConflicts.length - dirConflicts.length - typeConflicts.length;
+  const conflictVerb = conflictVerbs[defaultPolicy] ?? conflictVerbs.overwrite;
+  const fallbackPolicy: ConflictPolicy = portalPolicy === "autorename" ? "overwrite" : portalPolicy;
   const expiryLabel = expiresAt ? formatTimestamp(expiresAt) : "";
   const overallProgress = totalBytes > 0 ? Math.min(100, Math.round((uploadedBytes / totalBytes) * 100)) : 0;
 
@@ -574,6 +755,33 @@ function PortalPage({ portalId }: { portalId: string }) {
   return (
     <div className="portal-layout">
       <section className="portal-splash">
+        {passphraseNeeded && !claimed && (
+          <form
+            className="passphrase-panel"
+            onSubmit={(event) => {
+              event.preventDefault();
+              if (passphrase) {
+                claimPortal(passphrase);
+              }
+            }}
+          >
+            <label className="passphrase-label" htmlFor="portal-passphrase">
+              PIN or passphrase
+            </label>
+            <input
+              id="portal-passphrase"
+              className="passphrase-input"
+              type="password"
+              autoComplete="off"
+              autoFocus
+              value={passphrase}
+              onChange={(event) => setPassphrase(event.target.value)}
+            />
+            <button type="submit" className="picker-button" disabled={!passphrase}>
+              Unlock
+            </button>
+          </form>
+        )}
         <div
           className={`splash-drop ${!claimed ? "disabled" : ""}`}
           onDrop={handleDrop}
@@ -656,9 +864,32 @@ function PortalPage({ portalId }: { portalId: string }) {
           </div>
         </div>
 
-        <div className={`conflict-panel ${conflictCount === 0 ? "hidden" : ""}`}>
+        <div
+          className={`conflict-panel ${
+            conflictCount === 0 &&
+            folderConflicts.length === 0 &&
+            dirConflicts.length === 0 &&
+            typeConflicts.length === 0
+              ? "hidden"
+              : ""
+          }`}
+        >
           <div className="conflict-title">Filename conflicts detected</div>
-          <div className="conflict-message">
+          {folderConflicts.map((conflict) => (
+            <div className="conflict-message" key={conflict.relpath}>
+              Folder {conflict.requested_relpath} already exists; these files will go into {conflict.relpath}.
+            </div>
+          ))}
+          {dirConflicts.map((conflict) => (
+            <div className="conflict-message" key={`dir:${conflict.relpath}`}>
+              Folder {conflict.relpath} cannot be created; something else already has that name.
+            </div>
+          ))}
+          <div className={`conflict-message ${typeConflicts.length === 0 ? "hidden" : ""}`}>
+            {typeConflicts.length} {typeConflicts.length === 1 ? "file is" : "files are"} not accepted by this
+            portal and will be rejected.
+          </div>
+          <div className={`conflict-message ${conflictCount === 0 ? "hidden" : ""}`}>
             {conflictCount} {conflictCount === 1 ? "file" : "files"} already exist and will be {conflictVerb}.
           </div>
           <label className="toggle">
@@ -667,7 +898,7 @@ function PortalPage({ portalId }: { portalId: string }) {
               checked={defaultPolicy === "autorename"}
               disabled={!claimed || running || conflictCount === 0}
               onChange={(event) =>
-                setDefaultPolicy(event.target.checked ? "autorename" : "overwrite")
+                setDefaultPolicy(event.target.checked ? "autorename" : fallbackPolicy)
               }
             />
             Auto-rename conflicts instead
@@ -690,16 +921,18 @@ function PortalPage({ portalId }: { portalId: string }) {
                       ? "Starting"
                       : item.status === "uploading"
                         ? "Uploading"
-                        : item.status === "done"
-                          ? "Done"
-                          : item.status === "failed"
-                            ? "Failed"
-                            : item.status;
+                        : item.status === "staged"
+                          ? "Staged"
+                          : item.status === "done"
+                            ? "Done"
+                            : item.status === "failed"
+                              ? "Failed"
+                              : item.status;
                 return (
                   <div key={item.id} className={`queue-row status-${item.status}`}>
                     <div className="queue-main">
                       <div className="queue-name" title={item.relpath}>
-                        {item.relpath}
+                        {item.dir ? `${item.relpath}/` : item.relpath}
                       </div>
                       <div className="queue-progress">
                         <div className="queue-bar" style={{ width: `${progress}%` }} />
@@ -736,6 +969,31 @@ function getPortalRoute(pathname: string): PortalRoute | null {
   };
 }
 
+// waitForClaimApproval polls a claim that needs the operator's approval until
+// it is decided, and returns the final response.
+async function waitForClaimApproval(portalId: string, pending: ClaimPendingResponse): Promise<Response> {
+  for (;;) {
+    await new Promise((resolve) => window.setTimeout(resolve, 2000));
+    const response = await fetch(
+      `/api/portals/${portalId}/claims/${encodeURIComponent(pending.claim_id)}`,
+      { headers: { "X-Claim-Token": pending.claim_token } }
+    );
+    if (response.status !== 202) {
+      return response;
+    }
+  }
+}
+
+function policyFromClaim(policy: ClaimPolicy | undefined): ConflictPolicy {
+  if (!policy) {
+    return "overwrite";
+  }
+  if (policy.default && policy.default in conflictVerbs) {
+    return policy.default;
+  }
+  return policy.autorename ? "autorename" : "overwrite";
+}
+
 function redirectToClaimedPortal(portalId: string) {
   if (!portalId) {
     return;
@@ -812,6 +1070,10 @@ async function readEntryFiles(entry: DropServeFileSystemEntry): Promise<QueueCan
   if (entry.isDirectory) {
     const reader = entry.createReader();
     const entries = await readDirectoryEntries(reader);
+    if (entries.length === 0) {
+      const relpath = stripLeadingSlash(entry.fullPath);
+      return relpath ? [{ file: null, dir: true, relpath }] : [];
+    }
     const files: QueueCandidate[] = [];
     for (const child of entries) {
       const childFiles = await readEntryFiles(child);
@@ -842,6 +1104,10 @@ function readDirectoryEntries(reader: DropServeDirectoryReader): Promise<DropSer
   });
 }
 
+function itemSize(item: QueueItem) {
+  return item.file?.size ?? 0;
+}
+
 function stripLeadingSlash(value: string) {
   return value.replace(/^\/+/, "");
 }
@@ -880,4 +1146,12 @@ async function readError(response: Response) {
   return response.statusText || "request failed";
 }
 
+// waitText turns a Retry-After header in seconds into "a minute",
+// "5 minutes" and so on.
+function waitText(response: Response) {
+  const seconds = Number(response.headers.get("Retry-After"));
+  const minutes = Math.max(1, Math.ceil(seconds / 60) || 1);
+  return minutes === 1 ? "a minute" : `${minutes} minutes`;
+}
+
 export default App;